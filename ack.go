@@ -0,0 +1,79 @@
+package marionette
+
+// ackInterval is the number of stream cells received before a CONN_ACK cell
+// is sent ahead of waiting stream data.
+const ackInterval = 32
+
+// ackState tracks the delivery of stream cells over a reliable connection.
+//
+// Cells are delivered in order over a single connection so the peer
+// acknowledges the number of stream cells it has received with a CONN_ACK
+// cell on stream zero. Sent cells are held until they are acknowledged so that
+// they can be resent on another connection if this connection fails.
+//
+// Unreliable transports use the per-stream selective ACK cells of
+// ReliableLayer instead.
+type ackState struct {
+	inflight []*Cell // sent cells not yet acknowledged, in send order
+	ackedN   int     // number of sent cells acknowledged by the peer
+
+	recvN    int  // number of stream cells received from the peer
+	sentAckN int  // value of recvN in the last CONN_ACK cell sent
+	pending  bool // if true, a CONN_ACK cell needs to be sent
+}
+
+// sent records a stream cell sent to the peer.
+func (a *ackState) sent(cell *Cell) {
+	a.inflight = append(a.inflight, cell)
+}
+
+// ack removes cells from the inflight list once the peer has received n cells.
+func (a *ackState) ack(n int) {
+	if i := n - a.ackedN; i > 0 && i <= len(a.inflight) {
+		for j := 0; j < i; j++ {
+			a.inflight[j] = nil
+		}
+		a.inflight = a.inflight[i:]
+		a.ackedN = n
+	}
+}
+
+// undelivered returns sent cells which have not been acknowledged and
+// stops tracking them.
+func (a *ackState) undelivered() []*Cell {
+	cells := a.inflight
+	a.inflight = nil
+	return cells
+}
+
+// received records a cell received from the peer. Stream cells are counted
+// and session cells are acknowledged so the client knows it was accepted.
+func (a *ackState) received(cell *Cell) {
+	if cell.StreamID != 0 {
+		a.recvN++
+		a.pending = true
+	} else if cell.Type == SESSION {
+		a.pending = true
+	}
+}
+
+// ackDue returns true if enough cells have been received that a CONN_ACK cell
+// should be sent before any more stream data.
+func (a *ackState) ackDue() bool {
+	return a.recvN-a.sentAckN >= ackInterval
+}
+
+// dequeueAck returns a CONN_ACK cell with the number of stream cells received,
+// if an acknowledgement is pending and fits in n bytes.
+func (a *ackState) dequeueAck(n int) *Cell {
+	if !a.pending {
+		return nil
+	} else if n > 0 && n < CellHeaderSize {
+		return nil
+	} else if n > MaxCellLength {
+		n = MaxCellLength
+	}
+
+	a.sentAckN, a.pending = a.recvN, false
+	return NewCell(0, a.recvN, n, CONN_ACK)
+}
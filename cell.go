@@ -15,6 +15,12 @@ const (
 	NORMAL        = 0x1
 	END_OF_STREAM = 0x2
 	NEGOTIATE     = 0x3
+	WINDOW_UPDATE = 0x4
+	ACK           = 0x5
+	SESSION       = 0x6
+	STREAM_OPEN   = 0x7
+	STREAM_REPLY  = 0x8
+	CONN_ACK      = 0x9
 )
 
 // Cell represents a single unit of data sent between the client & server.
@@ -22,7 +28,7 @@ const (
 // This cell is associated with a specific stream and the encoder/decoders
 // handle ordering based on sequence id.
 type Cell struct {
-	Type       int    // Record type (NORMAL, END_OF_STREAM)
+	Type       int    // Record type (NORMAL, END_OF_STREAM, NEGOTIATE, WINDOW_UPDATE, ACK, SESSION, STREAM_OPEN, STREAM_REPLY, CONN_ACK)
 	Payload    []byte // Data
 	Length     int    // Size of marshaled data, if specified.
 	StreamID   int    // Associated stream
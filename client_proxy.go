@@ -1,37 +1,120 @@
 package marionette
 
 import (
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/armon/go-socks5"
 	"go.uber.org/zap"
 )
 
+// Client proxy modes.
+const (
+	// Forwards each connection over a stream to Destination, if set.
+	ClientProxyModeTCP = "tcp"
+
+	// Serves HTTP proxy requests. CONNECT requests are tunneled and other
+	// requests are forwarded to the host of their absolute URI.
+	ClientProxyModeHTTP = "http"
+
+	// Serves SOCKS5 CONNECT requests.
+	ClientProxyModeSOCKS5 = "socks5"
+)
+
+// ErrUnknownProxyMode is returned when opening a client proxy with an unknown mode.
+var ErrUnknownProxyMode = errors.New("marionette: unknown proxy mode")
+
 // ClientProxy represents a proxy between incoming connections and a marionette dialer.
 type ClientProxy struct {
 	ln     net.Listener
 	dialer *Dialer
+	socks5 *socks5.Server
+	conns  connTracker // incoming connections & streams
 	wg     sync.WaitGroup
+
+	// Canceled when connections are forcibly closed.
+	ctx    context.Context
+	cancel func()
+
+	// Determines how incoming connections are handled. In HTTP & SOCKS5
+	// modes each stream is opened to the destination requested by the
+	// client. Defaults to ClientProxyModeTCP.
+	Mode string
+
+	// If set, each stream is opened to this destination on the server.
+	// Either a "host:port" address or the name of a server service.
+	// Only used in TCP mode.
+	Destination string
+
+	// Time allowed on close for open connections to finish before they
+	// are closed. Defaults to DefaultDrainTimeout.
+	DrainTimeout time.Duration
 }
 
 // NewClientProxy returns a new instance of ClientProxy.
 func NewClientProxy(ln net.Listener, dialer *Dialer) *ClientProxy {
-	return &ClientProxy{
+	p := &ClientProxy{
 		ln:     ln,
 		dialer: dialer,
+
+		Mode:         ClientProxyModeTCP,
+		DrainTimeout: DefaultDrainTimeout,
 	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p
 }
 
 func (p *ClientProxy) Open() error {
+	switch p.Mode {
+	case ClientProxyModeTCP, ClientProxyModeHTTP:
+	case ClientProxyModeSOCKS5:
+		// Hostnames are not resolved locally so they are sent to the server.
+		var err error
+		if p.socks5, err = socks5.New(&socks5.Config{
+			Resolver: passthroughResolver{},
+			Dial:     p.dialSOCKS5,
+			Logger:   log.New(ioutil.Discard, "", 0),
+		}); err != nil {
+			return err
+		}
+	default:
+		return ErrUnknownProxyMode
+	}
+
 	p.wg.Add(1)
 	go func() { defer p.wg.Done(); p.run() }()
 
 	return nil
 }
 
+// Close stops accepting connections and waits up to DrainTimeout for open
+// connections to finish. Remaining connections & their streams are then
+// closed. The dialer is not closed.
 func (p *ClientProxy) Close() error {
-	return nil
+	err := p.ln.Close()
+
+	done := make(chan struct{})
+	go func() { p.wg.Wait(); close(done) }()
+
+	timer := time.NewTimer(p.DrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return err
+	case <-timer.C:
+	}
+
+	Logger.Debug("client proxy: drain timeout, closing connections")
+	p.cancel()
+	p.conns.closeAll()
+	<-done
+	return err
 }
 
 func (p *ClientProxy) run() {
@@ -53,18 +136,37 @@ func (p *ClientProxy) run() {
 func (p *ClientProxy) handleConn(incomingConn net.Conn) {
 	defer incomingConn.Close()
 
+	p.conns.add(incomingConn)
+	defer p.conns.remove(incomingConn)
+
 	Logger.Debug("client proxy: connection open")
 	defer Logger.Debug("client proxy: connection closed")
 
+	switch p.Mode {
+	case ClientProxyModeHTTP:
+		p.handleHTTP(incomingConn)
+		return
+	case ClientProxyModeSOCKS5:
+		if err := p.socks5.ServeConn(incomingConn); err != nil {
+			Logger.Debug("client proxy: socks5 error", zap.Error(err))
+		}
+		return
+	}
+
 	// Create a new stream.
-	stream, err := p.dialer.Dial()
+	stream, err := p.openStream(p.ctx, p.Destination)
 	if err != nil {
 		Logger.Debug("client proxy: cannot connect create new stream", zap.Error(err))
 		return
 	}
-	defer stream.Close()
+	defer p.closeStream(stream)
 
-	// Copy between incoming connection and stream until an error occurs.
+	pipe(incomingConn, incomingConn, stream)
+}
+
+// pipe copies between an incoming connection and a stream until an error
+// occurs. Incoming data is read from r, which may buffer incomingConn.
+func pipe(incomingConn net.Conn, r io.Reader, stream net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
@@ -74,8 +176,69 @@ func (p *ClientProxy) handleConn(incomingConn net.Conn) {
 	}()
 	go func() {
 		defer wg.Done()
-		io.Copy(stream, incomingConn)
+		io.Copy(stream, r)
 		stream.Close()
 	}()
 	wg.Wait()
 }
+
+// openStream returns a new stream which is opened to dst, if set. The stream
+// is closed if the proxy is closed before closeStream() is called.
+func (p *ClientProxy) openStream(ctx context.Context, dst string) (net.Conn, error) {
+	var stream net.Conn
+	var err error
+	if dst == "" {
+		stream, err = p.dialer.Dial()
+	} else {
+		stream, err = p.dialer.DialDestination(ctx, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.conns.add(stream)
+	return stream, nil
+}
+
+// closeStream closes a stream returned by openStream().
+func (p *ClientProxy) closeStream(stream net.Conn) error {
+	p.conns.remove(stream)
+	return stream.Close()
+}
+
+// dialSOCKS5 opens a stream to a SOCKS5 request's destination. Opening is
+// canceled when either the request's context is done or the proxy closes.
+func (p *ClientProxy) dialSOCKS5(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	conn, err := p.openStream(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &socks5Conn{Stream: conn.(*Stream), proxy: p}, nil
+}
+
+// socks5Conn wraps a stream with the TCP local address required by the
+// socks5 server's reply.
+type socks5Conn struct {
+	*Stream
+	proxy *ClientProxy
+}
+
+func (c *socks5Conn) LocalAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4zero} }
+
+func (c *socks5Conn) Close() error { return c.proxy.closeStream(c.Stream) }
+
+// passthroughResolver leaves hostnames unresolved so the server resolves them.
+type passthroughResolver struct{}
+
+func (passthroughResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
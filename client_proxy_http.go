@@ -0,0 +1,173 @@
+package marionette
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// errHTTPNotProxyRequest is returned when a request to the HTTP proxy
+	// does not use an absolute URI.
+	errHTTPNotProxyRequest = errors.New("absolute http:// URI required")
+
+	// errHTTPInvalidConnect is returned when a CONNECT request has no port.
+	errHTTPInvalidConnect = errors.New("CONNECT requires host:port")
+)
+
+// hopHeaders are removed from forwarded requests & responses.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// handleHTTP serves HTTP proxy requests from a connection. Consecutive
+// requests to the same host share a stream.
+func (p *ClientProxy) handleHTTP(conn net.Conn) {
+	br := bufio.NewReader(conn)
+
+	var stream net.Conn
+	var streamReader *bufio.Reader
+	var streamDst string
+	defer func() {
+		if stream != nil {
+			p.closeStream(stream)
+		}
+	}()
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		// Tunnel the rest of the connection.
+		if req.Method == http.MethodConnect {
+			if stream != nil {
+				p.closeStream(stream)
+				stream = nil
+			}
+			p.handleHTTPConnect(conn, br, req)
+			return
+		}
+
+		dst, err := httpDestination(req.URL)
+		if err != nil {
+			writeHTTPError(conn, http.StatusBadRequest, err)
+			return
+		}
+
+		// Open a new stream if the destination has changed.
+		if stream == nil || dst != streamDst {
+			if stream != nil {
+				p.closeStream(stream)
+			}
+			if stream, err = p.openStream(p.ctx, dst); err != nil {
+				Logger.Debug("client proxy: cannot open stream", zap.String("destination", dst), zap.Error(err))
+				writeHTTPError(conn, httpErrorStatus(err), err)
+				return
+			}
+			streamReader, streamDst = bufio.NewReader(stream), dst
+		}
+
+		// Forward request in origin form & relay the response.
+		removeHopHeaders(req.Header)
+		if err := req.Write(stream); err != nil {
+			return
+		}
+		resp, err := http.ReadResponse(streamReader, req)
+		if err != nil {
+			writeHTTPError(conn, http.StatusBadGateway, err)
+			return
+		}
+		removeHopHeaders(resp.Header)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || resp.Close || req.Close {
+			return
+		}
+	}
+}
+
+// handleHTTPConnect opens a stream to the CONNECT request's host and copies
+// between it and the connection. Data buffered in br is sent first.
+func (p *ClientProxy) handleHTTPConnect(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, errHTTPInvalidConnect)
+		return
+	}
+
+	stream, err := p.openStream(p.ctx, req.Host)
+	if err != nil {
+		Logger.Debug("client proxy: cannot open stream", zap.String("destination", req.Host), zap.Error(err))
+		writeHTTPError(conn, httpErrorStatus(err), err)
+		return
+	}
+	defer p.closeStream(stream)
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	pipe(conn, br, stream)
+}
+
+// httpDestination returns the "host:port" for an absolute http:// URI.
+func httpDestination(u *url.URL) (string, error) {
+	if !strings.EqualFold(u.Scheme, "http") || u.Host == "" {
+		return "", errHTTPNotProxyRequest
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// httpErrorStatus returns the response status for a stream open error.
+func httpErrorStatus(err error) int {
+	if e, ok := err.(*OpenError); ok {
+		switch e.Code {
+		case OpenErrNotAllowed:
+			return http.StatusForbidden
+		case OpenErrTimeout:
+			return http.StatusGatewayTimeout
+		}
+	}
+	return http.StatusBadGateway
+}
+
+// writeHTTPError writes an error response with the error message as the body.
+func writeHTTPError(w io.Writer, code int, err error) {
+	body := err.Error() + "\n"
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+}
+
+// removeHopHeaders removes hop-by-hop headers, including any listed in the
+// Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,321 @@
+package marionette_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+)
+
+func TestClientProxy_HTTP(t *testing.T) {
+	dialer, closeFn := MustOpenDestinationDialer(t)
+	defer closeFn()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("unexpected proxy header")
+		}
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	echoLn := MustOpenEchoListener(t)
+	defer echoLn.Close()
+
+	proxyAddr := MustOpenClientProxy(t, dialer, marionette.ClientProxyModeHTTP)
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 10 * time.Second}
+
+	t.Run("Forward", func(t *testing.T) {
+		for _, path := range []string{"/foo?bar=baz", "/qux"} {
+			req, _ := http.NewRequest("GET", backend.URL+path, nil)
+			req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			} else if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status: %d", resp.StatusCode)
+			} else if string(body) != "GET "+path {
+				t.Fatalf("unexpected body: %q", body)
+			}
+		}
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		addr := echoLn.Addr().String()
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nfoo", addr, addr)
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+		if err != nil {
+			t.Fatal(err)
+		} else if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status: %d", resp.StatusCode)
+		}
+
+		// Data sent with the request is tunneled.
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "foo" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+	})
+
+	t.Run("ErrForbidden", func(t *testing.T) {
+		resp, err := client.Get("http://127.0.0.2:1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("unexpected status: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("ErrNotProxyRequest", func(t *testing.T) {
+		resp, err := http.Get("http://" + proxyAddr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("unexpected status: %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestClientProxy_SOCKS5(t *testing.T) {
+	dialer, closeFn := MustOpenDestinationDialer(t)
+	defer closeFn()
+
+	echoLn := MustOpenEchoListener(t)
+	defer echoLn.Close()
+	port := echoLn.Addr().(*net.TCPAddr).Port
+
+	proxyAddr := MustOpenClientProxy(t, dialer, marionette.ClientProxyModeSOCKS5)
+
+	t.Run("OK", func(t *testing.T) {
+		// Hostnames are resolved by the server.
+		conn, reply := MustSOCKS5Connect(t, proxyAddr, "localhost", port)
+		defer conn.Close()
+		if reply != 0 {
+			t.Fatalf("unexpected reply: %d", reply)
+		}
+
+		buf := make([]byte, 3)
+		if _, err := conn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "foo" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+	})
+
+	t.Run("ErrDenied", func(t *testing.T) {
+		conn, reply := MustSOCKS5Connect(t, proxyAddr, "127.0.0.2", 1)
+		defer conn.Close()
+		if reply == 0 {
+			t.Fatal("expected failure reply")
+		}
+	})
+}
+
+func TestClientProxy_Close(t *testing.T) {
+	dialer, closeFn := MustOpenDestinationDialer(t)
+	defer closeFn()
+
+	echoLn := MustOpenEchoListener(t)
+	defer echoLn.Close()
+
+	t.Run("OK", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxy := marionette.NewClientProxy(ln, dialer)
+		if err := proxy.Open(); err != nil {
+			t.Fatal(err)
+		} else if err := proxy.Close(); err != nil {
+			t.Fatal(err)
+		} else if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			t.Fatal("expected connection error")
+		}
+	})
+
+	// Ensure connections which do not finish are closed after the timeout.
+	t.Run("DrainTimeout", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxy := marionette.NewClientProxy(ln, dialer)
+		proxy.Destination = echoLn.Addr().String()
+		proxy.DrainTimeout = 100 * time.Millisecond
+		if err := proxy.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		buf := make([]byte, 3)
+		if _, err := conn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := proxy.Close(); err != nil {
+			t.Fatal(err)
+		} else if _, err := conn.Read(buf); err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestClientProxy_Open(t *testing.T) {
+	t.Run("ErrUnknownProxyMode", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		proxy := marionette.NewClientProxy(ln, nil)
+		proxy.Mode = "ftp"
+		if err := proxy.Open(); err != marionette.ErrUnknownProxyMode {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustOpenDestinationDialer returns a dialer connected to a server proxy
+// which allows destinations other than 127.0.0.2.
+func MustOpenDestinationDialer(tb testing.TB) (*marionette.Dialer, func()) {
+	tb.Helper()
+
+	key := fte.NewKey([]byte("secret"))
+
+	serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	if err := ln.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	policy := marionette.NewEgressPolicy()
+	policy.AllowPrivate = true
+	policy.DenyNets = []*net.IPNet{MustParseCIDR(tb, "127.0.0.2/32")}
+
+	proxy := marionette.NewServerProxy(ln)
+	proxy.AllowDestinations = true
+	proxy.Policy = policy
+	if err := proxy.Open(); err != nil {
+		ln.Close()
+		tb.Fatal(err)
+	}
+
+	clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+	if err := dialer.Open(); err != nil {
+		ln.Close()
+		tb.Fatal(err)
+	}
+
+	return dialer, func() {
+		dialer.Close()
+		proxy.Close()
+		ln.Close()
+	}
+}
+
+// MustOpenClientProxy opens a client proxy on a random local port and
+// returns its address.
+func MustOpenClientProxy(tb testing.TB, dialer *marionette.Dialer, mode string) string {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	proxy := marionette.NewClientProxy(ln, dialer)
+	proxy.Mode = mode
+	if err := proxy.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	return ln.Addr().String()
+}
+
+// MustSOCKS5Connect sends a SOCKS5 CONNECT request for a hostname and
+// returns the connection and reply code.
+func MustSOCKS5Connect(tb testing.TB, proxyAddr, host string, port int) (net.Conn, byte) {
+	tb.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Negotiate no authentication.
+	buf := make([]byte, 2)
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		tb.Fatal(err)
+	} else if _, err := io.ReadFull(conn, buf); err != nil {
+		tb.Fatal(err)
+	} else if buf[0] != 5 || buf[1] != 0 {
+		tb.Fatalf("unexpected method reply: %v", buf)
+	}
+
+	// Send request with a domain name address.
+	req := []byte{5, 1, 0, 3, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		tb.Fatal(err)
+	}
+
+	// Read reply with an IPv4 bound address.
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		tb.Fatal(err)
+	} else if reply[0] != 5 || reply[3] != 1 {
+		tb.Fatalf("unexpected reply: %v", reply)
+	}
+	return conn, reply[1]
+}
@@ -0,0 +1,37 @@
+package marionette
+
+import (
+	"context"
+	"time"
+)
+
+// Clock represents an interface to the current time & timers. It allows
+// sleeps & timeouts to be controlled by a fake clock during tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+
+	// Sleep waits for d to elapse. Returns ctx.Err() if ctx is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// DefaultClock is the clock used by FSMs & stream sets. It uses the system time.
+var DefaultClock Clock = wallClock{}
+
+// wallClock implements Clock using the system time.
+type wallClock struct{}
+
+func (wallClock) Now() time.Time                         { return time.Now() }
+func (wallClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (wallClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/redjack/marionette"
 	"github.com/redjack/marionette/fte"
@@ -25,10 +27,16 @@ func (cmd *ClientCommand) Run(args []string) error {
 	// Parse arguments.
 	fs := NewFlagSet("marionette-client", flag.ContinueOnError)
 	var (
-		bind     = fs.String("bind", "127.0.0.1:8079", "Bind address")
+		bind     = fs.String("bind", "127.0.0.1:8079", "Bind address, or blank to disable")
+		httpBind = fs.String("http-bind", "", "Bind address for a local HTTP proxy")
+		socks5   = fs.String("socks5-bind", "", "Bind address for a local SOCKS5 server")
 		serverIP = fs.String("server", "127.0.0.1", "Server IP address")
 		format   = fs.String("format", "", "Format name and version")
 		verbose  = fs.Bool("v", false, "Debug logging enabled")
+		pubKey   = fs.String("server-public-key", "", "Hex-encoded server public key")
+		pool     = fs.Int("pool", 1, "Number of concurrent connections to the server")
+		dst      = fs.String("destination", "", "Destination host:port or service name opened on the server")
+		drain    = fs.Duration("drain-timeout", marionette.DefaultDrainTimeout, "Time allowed for open streams to finish on shutdown")
 	)
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -37,6 +45,8 @@ func (cmd *ClientCommand) Run(args []string) error {
 	// Validate arguments.
 	if *format == "" {
 		return errors.New("format required")
+	} else if *bind == "" && *httpBind == "" && *socks5 == "" {
+		return errors.New("bind address required")
 	}
 
 	// Read MAR file.
@@ -47,11 +57,28 @@ func (cmd *ClientCommand) Run(args []string) error {
 		return err
 	}
 
+	// Derive FTE key from shared secret.
+	key, err := fs.FTEKey()
+	if err != nil {
+		return err
+	} else if key == nil {
+		fmt.Fprintln(os.Stderr, "warning: no -key or -key-file specified, using default FTE key")
+	}
+
+	// Decode pinned server key, if specified.
+	var serverPublicKey []byte
+	if *pubKey != "" {
+		if serverPublicKey, err = hex.DecodeString(*pubKey); err != nil {
+			return fmt.Errorf("invalid server public key: %s", err)
+		}
+	}
+
 	// Parse document.
 	doc, err := mar.Parse(marionette.PartyClient, data)
 	if err != nil {
 		return err
 	}
+	doc.Path = mar.FormatPath(*format)
 
 	// Set logger if debug is on.
 	fte.Verbose = *verbose
@@ -69,28 +96,51 @@ func (cmd *ClientCommand) Run(args []string) error {
 	streamSet.TracePath = fs.TracePath
 
 	// Create dialer to remote server.
-	dialer := marionette.NewDialer(doc, *serverIP, streamSet)
+	dialer := marionette.NewDialer(doc, *serverIP, streamSet, key)
+	dialer.ServerPublicKey = serverPublicKey
+	dialer.PoolSize = *pool
+	dialer.TracePath = fs.TracePath
+	dialer.DrainTimeout = *drain
 	if err := dialer.Open(); err != nil {
 		return err
 	}
 
-	// Start listener.
-	ln, err := net.Listen("tcp", *bind)
-	if err != nil {
-		return err
-	}
-
-	// Start proxy.
-	proxy := marionette.NewClientProxy(ln, dialer)
-	if err := proxy.Open(); err != nil {
-		return err
+	// Start a proxy for each bind address.
+	var proxies []*marionette.ClientProxy
+	for _, cfg := range []struct {
+		bind, mode string
+	}{
+		{*bind, marionette.ClientProxyModeTCP},
+		{*httpBind, marionette.ClientProxyModeHTTP},
+		{*socks5, marionette.ClientProxyModeSOCKS5},
+	} {
+		if cfg.bind == "" {
+			continue
+		}
+
+		ln, err := net.Listen("tcp", cfg.bind)
+		if err != nil {
+			return err
+		}
+
+		proxy := marionette.NewClientProxy(ln, dialer)
+		proxy.Mode = cfg.mode
+		proxy.Destination = *dst
+		proxy.DrainTimeout = *drain
+		if err := proxy.Open(); err != nil {
+			return err
+		}
+		proxies = append(proxies, proxy)
+		if cfg.mode == marionette.ClientProxyModeTCP {
+			fmt.Printf("listening on %s, connected to %s\n", cfg.bind, *serverIP)
+		} else {
+			fmt.Printf("%s proxy listening on %s, connected to %s\n", cfg.mode, cfg.bind, *serverIP)
+		}
 	}
 
-	fmt.Printf("listening on %s, connected to %s\n", *bind, *serverIP)
-
 	// Wait for signal.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 	fmt.Fprintln(os.Stderr, "received interrupt, shutting down...")
 
@@ -99,5 +149,10 @@ func (cmd *ClientCommand) Run(args []string) error {
 		dumpStreams(streamSet.Streams())
 	}
 
-	return nil
+	// Stop accepting connections & wait for them to finish. The dialer then
+	// flushes remaining streams to the server.
+	for _, proxy := range proxies {
+		proxy.Close()
+	}
+	return dialer.Close()
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/redjack/marionette/mar"
+)
+
+type GraphCommand struct{}
+
+func NewGraphCommand() *GraphCommand {
+	return &GraphCommand{}
+}
+
+func (cmd *GraphCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("marionette-graph", flag.ContinueOnError)
+	typ := fs.String("type", "dot", "output type (dot or mermaid)")
+	out := fs.String("o", "", "write output to file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: marionette graph [-type dot|mermaid] [-o FILE] FORMAT|FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() != 1 {
+		return errors.New("format required")
+	}
+	name := fs.Arg(0)
+
+	// Read & parse document.
+	data, err := mar.ReadFormat(name)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("MAR document not found: %s", name)
+	} else if err != nil {
+		return err
+	}
+	doc, err := mar.Parse("", data)
+	if err != nil {
+		return err
+	}
+
+	// Determine writer before creating the output file.
+	var write func(io.Writer, string, *mar.Document) error
+	switch *typ {
+	case "dot":
+		write = mar.WriteDOT
+	case "mermaid":
+		write = mar.WriteMermaid
+	default:
+		return fmt.Errorf("invalid graph type: %s", *typ)
+	}
+
+	// Write to stdout unless an output file is specified.
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return write(w, name, doc)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/redjack/marionette"
+)
+
+type KeygenCommand struct{}
+
+func NewKeygenCommand() *KeygenCommand {
+	return &KeygenCommand{}
+}
+
+func (cmd *KeygenCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("marionette-keygen", flag.ContinueOnError)
+	out := fs.String("o", "", "write private key to file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	privateKey, publicKey, err := marionette.GenerateServerKey()
+	if err != nil {
+		return err
+	}
+
+	// Write private key to file, if specified. Otherwise print to stdout.
+	if *out != "" {
+		if err := ioutil.WriteFile(*out, []byte(hex.EncodeToString(privateKey)+"\n"), 0600); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("private key: %s\n", hex.EncodeToString(privateKey))
+	}
+	fmt.Printf("public key:  %s\n", hex.EncodeToString(publicKey))
+	return nil
+}
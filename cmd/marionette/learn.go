@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/redjack/marionette/learn"
+	"github.com/redjack/marionette/mar"
+)
+
+type LearnCommand struct{}
+
+func NewLearnCommand() *LearnCommand {
+	return &LearnCommand{}
+}
+
+func (cmd *LearnCommand) Run(args []string) error {
+	learner, gen := learn.NewLearner(), learn.NewGenerator()
+
+	fs := flag.NewFlagSet("marionette-learn", flag.ContinueOnError)
+	fs.IntVar(&learner.Port, "port", 0, "server port (defaults to most common)")
+	fs.IntVar(&learner.MaxMessages, "max-messages", learner.MaxMessages, "maximum messages per connection")
+	fs.IntVar(&gen.Buckets, "buckets", gen.Buckets, "buckets per length & gap distribution")
+	fs.IntVar(&gen.MinLength, "min-length", gen.MinLength, "minimum fte.send() message length")
+	fs.StringVar(&gen.ClientRegex, "client-regex", gen.ClientRegex, "client fte.send() regex")
+	fs.StringVar(&gen.ServerRegex, "server-regex", gen.ServerRegex, "server fte.send() regex")
+	fs.StringVar(&gen.ClientGrammar, "client-grammar", "", "client tg.send() grammar")
+	fs.StringVar(&gen.ServerGrammar, "server-grammar", "", "server tg.send() grammar")
+	out := fs.String("o", "", "write output to file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: marionette learn [arguments] FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() != 1 {
+		return errors.New("pcap file required")
+	}
+
+	// Read packets & reconstruct flows.
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	packets, err := learn.ReadPackets(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	var segments []*learn.Segment
+	for _, p := range packets {
+		if seg := learn.DecodeSegment(p); seg != nil {
+			segments = append(segments, seg)
+		}
+	}
+	flows := learn.Reassemble(segments)
+
+	// Build model & generate document.
+	m, err := learner.Learn(flows)
+	if err != nil {
+		return err
+	}
+	data, err := gen.Generate(m)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the generated document is valid before writing.
+	doc, err := mar.Parse("", data)
+	if err != nil {
+		return fmt.Errorf("generated invalid document: %s", err)
+	}
+	for _, err := range mar.Validate(doc) {
+		if !err.Warning {
+			return fmt.Errorf("generated invalid document: %s", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "packets=%d segments=%d flows=%d learned=%d skipped=%d port=%d\n",
+		len(packets), len(segments), len(flows), m.Flows, m.Skipped, m.Port)
+
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*out, data, 0666)
+}
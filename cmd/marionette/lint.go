@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/redjack/marionette/mar"
+)
+
+type LintCommand struct{}
+
+func NewLintCommand() *LintCommand {
+	return &LintCommand{}
+}
+
+func (cmd *LintCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("marionette-lint", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: marionette lint FORMAT|FILE...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 {
+		return errors.New("format required")
+	}
+
+	var n int
+	for _, name := range fs.Args() {
+		data, err := mar.ReadFormat(name)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("MAR document not found: %s", name)
+		} else if err != nil {
+			return err
+		}
+
+		doc, err := mar.Parse("", data)
+		if err != nil {
+			fmt.Printf("%s: %s\n", name, err)
+			n++
+			continue
+		}
+
+		for _, err := range mar.Validate(doc) {
+			fmt.Printf("%s:%s\n", name, err)
+			if !err.Warning {
+				n++
+			}
+		}
+	}
+
+	if n > 0 {
+		return fmt.Errorf("%d problem(s) found", n)
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	_ "expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -12,7 +14,9 @@ import (
 	"text/tabwriter"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
 	"github.com/redjack/marionette/plugins/model"
 )
 
@@ -40,12 +44,26 @@ func run(args []string) error {
 		return NewClientCommand().Run(args[1:])
 	case "formats":
 		return NewFormatsCommand().Run(args[1:])
+	case "graph":
+		return NewGraphCommand().Run(args[1:])
+	case "keygen":
+		return NewKeygenCommand().Run(args[1:])
+	case "learn":
+		return NewLearnCommand().Run(args[1:])
+	case "lint":
+		return NewLintCommand().Run(args[1:])
+	case "precompile":
+		return NewPrecompileCommand().Run(args[1:])
 	case "pt-client":
 		return NewPTClientCommand().Run(args[1:])
 	case "pt-server":
 		return NewPTServerCommand().Run(args[1:])
+	case "selftest":
+		return NewSelftestCommand().Run(args[1:])
 	case "server":
 		return NewServerCommand().Run(args[1:])
+	case "trace":
+		return NewTraceCommand().Run(args[1:])
 	default:
 		return ErrUsage
 	}
@@ -62,11 +80,18 @@ Usage:
 
 The commands are:
 
-	client    runs the client proxy
-	formats   show a list of available formats
-	pt-client runs the client proxy as a PT
-	pt-server runs the server proxy as a PT
-	server    runs the server proxy
+	client     runs the client proxy
+	formats    show a list of available formats
+	graph      renders a format's state machine as DOT or Mermaid
+	keygen     generates a server key pair for negotiation
+	learn      generates a format from a packet capture
+	lint       reports problems in a format
+	precompile compiles a format's DFAs into the DFA cache
+	pt-client  runs the client proxy as a PT
+	pt-server  runs the server proxy as a PT
+	selftest   runs formats end to end in-process
+	server     runs the server proxy
+	trace      replays a recorded connection trace
 `[1:]
 }
 
@@ -74,13 +99,18 @@ type FlagSet struct {
 	*flag.FlagSet
 	Debug     string
 	TracePath string
+	Key       string
+	KeyFile   string
 }
 
 func NewFlagSet(name string, errorHandling flag.ErrorHandling) *FlagSet {
 	fs := &FlagSet{FlagSet: flag.NewFlagSet(name, errorHandling)}
 	fs.Float64Var(&model.SleepFactor, "sleep-factor", model.SleepFactor, "model.sleep() multipler")
 	fs.StringVar(&fs.Debug, "debug", "", "debug http bind address")
-	fs.StringVar(&fs.TracePath, "trace-path", "", "stream trace directory path")
+	fs.StringVar(&fs.TracePath, "trace-path", "", "stream & connection trace directory path")
+	fs.StringVar(&fs.Key, "key", "", "shared secret used to derive FTE keys")
+	fs.StringVar(&fs.KeyFile, "key-file", "", "path to file containing shared secret")
+	fs.StringVar(&fte.DefaultDFACache.Path, "dfa-cache-dir", "", "directory to persist compiled DFAs")
 	return fs
 }
 
@@ -89,15 +119,37 @@ func (fs *FlagSet) Parse(arguments []string) error {
 		return err
 	}
 
-	// Run pprof-server in the background if requested.
+	// Run pprof & metrics server in the background if requested.
 	if fs.Debug != "" {
 		fmt.Fprintf(os.Stderr, "debug http server listening on %s\n", fs.Debug)
+		http.Handle("/metrics", promhttp.Handler())
 		go func() { http.ListenAndServe(fs.Debug, nil) }()
 	}
 
 	return nil
 }
 
+// FTEKey returns FTE key material derived from the -key or -key-file flags.
+// Returns nil if neither flag is specified.
+func (fs *FlagSet) FTEKey() ([]byte, error) {
+	if fs.Key != "" && fs.KeyFile != "" {
+		return nil, errors.New("cannot specify both -key and -key-file")
+	}
+
+	if fs.KeyFile != "" {
+		buf, err := ioutil.ReadFile(fs.KeyFile)
+		if err != nil {
+			return nil, err
+		} else if buf = bytes.TrimSpace(buf); len(buf) == 0 {
+			return nil, fmt.Errorf("key file is empty: %s", fs.KeyFile)
+		}
+		return fte.NewKey(buf), nil
+	} else if fs.Key != "" {
+		return fte.NewKey([]byte(fs.Key)), nil
+	}
+	return nil, nil
+}
+
 // dumpStreams writes out a list of streams ordered by mod time.
 func dumpStreams(streams []*marionette.Stream) {
 	sort.Slice(streams, func(i, j int) bool { return streams[i].ModTime().Before(streams[j].ModTime()) })
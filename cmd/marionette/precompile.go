@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+	"github.com/redjack/marionette/plugins/tg"
+)
+
+type PrecompileCommand struct{}
+
+func NewPrecompileCommand() *PrecompileCommand {
+	return &PrecompileCommand{}
+}
+
+func (cmd *PrecompileCommand) Run(args []string) error {
+	fs := NewFlagSet("marionette-precompile", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: marionette precompile -dfa-cache-dir DIR FORMAT...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Validate arguments.
+	if fte.DefaultDFACache.Path == "" {
+		return errors.New("dfa cache directory required")
+	} else if fs.NArg() == 0 {
+		return errors.New("format required")
+	}
+
+	for _, format := range fs.Args() {
+		data, err := mar.ReadFormat(format)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("MAR document not found: %s", format)
+		} else if err != nil {
+			return err
+		}
+
+		doc, err := mar.Parse("", data)
+		if err != nil {
+			return err
+		}
+
+		for _, dfa := range formatDFAs(doc) {
+			t := time.Now()
+			if err := fte.DefaultDFACache.Precompile(dfa.regex, dfa.n); err != nil {
+				return fmt.Errorf("%s: cannot compile %q: %s", format, dfa.regex, err)
+			}
+			fmt.Printf("%s: compiled %q (n=%d) in %s\n", format, dfa.regex, dfa.n, time.Since(t))
+		}
+	}
+
+	return nil
+}
+
+type dfaParams struct {
+	regex string
+	n     int
+}
+
+// formatDFAs returns the unique set of DFAs used by fte & tg actions in doc.
+// DFAs with lengths chosen at runtime cannot be precompiled.
+func formatDFAs(doc *mar.Document) []dfaParams {
+	var a []dfaParams
+	m := make(map[dfaParams]struct{})
+	add := func(regex string, n int) {
+		if _, ok := m[dfaParams{regex, n}]; !ok {
+			m[dfaParams{regex, n}] = struct{}{}
+			a = append(a, dfaParams{regex, n})
+		}
+	}
+
+	mar.Walk(mar.VisitorFunc(func(node mar.Node) {
+		action, ok := node.(*mar.Action)
+		if !ok {
+			return
+		}
+		args := action.ArgValues()
+
+		switch action.Module {
+		case "fte":
+			if len(args) < 2 {
+				return
+			}
+			regex, ok := args[0].(string)
+			if !ok {
+				return
+			}
+			if n, ok := args[1].(int); ok {
+				add(regex, n)
+			}
+
+		case "tg":
+			if len(args) < 1 {
+				return
+			}
+			name, ok := args[0].(string)
+			if !ok {
+				return
+			}
+			grammar := tg.LookupGrammar(name)
+			if grammar == nil {
+				return
+			}
+			for _, cipher := range grammar.Ciphers {
+				if c, ok := cipher.(interface {
+					Regex() string
+					MsgLen() int
+				}); ok {
+					add(c.Regex(), c.MsgLen())
+				}
+			}
+		}
+	}), doc)
+
+	return a
+}
@@ -59,11 +59,20 @@ func (cmd *PTClientCommand) Run(args []string) error {
 		return err
 	}
 
+	// Derive FTE key from shared secret.
+	key, err := fs.FTEKey()
+	if err != nil {
+		return err
+	} else if key == nil {
+		log.Printf("No -key or -key-file specified, using default FTE key")
+	}
+
 	// Parse document.
 	doc, err := mar.Parse(marionette.PartyClient, data)
 	if err != nil {
 		return err
 	}
+	doc.Path = mar.FormatPath(*format)
 
 	// We always use the production logger when running as a PT.
 	config := zap.NewProductionConfig()
@@ -90,7 +99,7 @@ func (cmd *PTClientCommand) Run(args []string) error {
 		}
 
 		cmd.wg.Add(1)
-		go func() { defer cmd.wg.Done(); cmd.acceptLoop(listener, doc) }()
+		go func() { defer cmd.wg.Done(); cmd.acceptLoop(listener, doc, key) }()
 
 		pt.Cmethod(methodName, listener.Version(), listener.Addr())
 		listeners = append(listeners, listener)
@@ -109,7 +118,7 @@ func (cmd *PTClientCommand) Run(args []string) error {
 	return nil
 }
 
-func (cmd *PTClientCommand) acceptLoop(listener *pt.SocksListener, doc *mar.Document) {
+func (cmd *PTClientCommand) acceptLoop(listener *pt.SocksListener, doc *mar.Document, key []byte) {
 	defer listener.Close()
 
 	for {
@@ -122,11 +131,11 @@ func (cmd *PTClientCommand) acceptLoop(listener *pt.SocksListener, doc *mar.Docu
 		}
 
 		cmd.wg.Add(1)
-		go func() { defer cmd.wg.Done(); cmd.handleConn(connection, doc) }()
+		go func() { defer cmd.wg.Done(); cmd.handleConn(connection, doc, key) }()
 	}
 }
 
-func (cmd *PTClientCommand) handleConn(connection *pt.SocksConn, doc *mar.Document) {
+func (cmd *PTClientCommand) handleConn(connection *pt.SocksConn, doc *mar.Document, key []byte) {
 	host, _, err := net.SplitHostPort(connection.Req.Target)
 	if err != nil {
 		log.Printf("Invalid connection request target: %s", connection.Req.Target)
@@ -142,7 +151,7 @@ func (cmd *PTClientCommand) handleConn(connection *pt.SocksConn, doc *mar.Docume
 	defer streamSet.Close()
 
 	// Create dialer to remote server.
-	dialer := marionette.NewDialer(doc, host, streamSet)
+	dialer := marionette.NewDialer(doc, host, streamSet, key)
 	if err := dialer.Open(); err != nil {
 		log.Printf("Unable to create dialer: %s", err)
 		connection.Reject()
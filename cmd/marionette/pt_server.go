@@ -58,11 +58,20 @@ func (cmd *PTServerCommand) Run(args []string) error {
 		return err
 	}
 
+	// Derive FTE key from shared secret.
+	key, err := fs.FTEKey()
+	if err != nil {
+		return err
+	} else if key == nil {
+		log.Printf("No -key or -key-file specified, using default FTE key")
+	}
+
 	// Parse document.
 	doc, err := mar.Parse(marionette.PartyServer, data)
 	if err != nil {
 		return err
 	}
+	doc.Path = mar.FormatPath(*format)
 
 	// We always use the production logger when running as a PT.
 	config := zap.NewProductionConfig()
@@ -99,7 +108,7 @@ func (cmd *PTServerCommand) Run(args []string) error {
 		}
 
 		// Start the listener.
-		listener, err := marionette.Listen(doc, host)
+		listener, err := marionette.Listen(doc, host, key)
 
 		if err != nil {
 			log.Printf("Unable to create listener: %s", err)
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redjack/marionette/mar"
+	"github.com/redjack/marionette/marionettetest"
+)
+
+type SelftestCommand struct{}
+
+func NewSelftestCommand() *SelftestCommand {
+	return &SelftestCommand{}
+}
+
+func (cmd *SelftestCommand) Run(args []string) error {
+	fs := NewFlagSet("marionette-selftest", flag.ContinueOnError)
+	var (
+		streams = fs.Int("streams", marionettetest.DefaultStreams, "number of streams per format")
+		size    = fs.Int("size", marionettetest.DefaultPayloadSize, "payload bytes per stream")
+		seed    = fs.Int64("seed", 1, "PRNG seed")
+		timeout = fs.Duration("timeout", marionettetest.DefaultTimeout, "time limit per format")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: marionette selftest [arguments] [FORMAT...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := fs.FTEKey()
+	if err != nil {
+		return err
+	}
+
+	// Run all built-in formats if none are specified.
+	formats := fs.Args()
+	if len(formats) == 0 {
+		formats = mar.Formats()
+	}
+
+	var n, skipped int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FORMAT\tSTATUS\tTRANSITIONS\tBYTES\tWIRE\tTHROUGHPUT\t")
+	for _, name := range formats {
+		result, err := cmd.runFormat(name, key, *streams, *size, *seed, *timeout)
+		if err != nil && result != nil && result.PayloadBytes == 0 {
+			// Some formats, such as dns_request, cannot carry stream data.
+			fmt.Fprintf(w, "%s\tskip: no stream data (%s)\t\t\t\t\t\n", name, err)
+			skipped++
+			continue
+		} else if err != nil {
+			fmt.Fprintf(w, "%s\tFAIL: %s\t\t\t\t\t\n", name, err)
+			n++
+			continue
+		}
+		fmt.Fprintf(w, "%s\tok\t%d\t%d\t%d\t%.1f KB/s\t\n",
+			name, result.Transitions, result.PayloadBytes, result.WireBytes, result.Throughput()/1024)
+	}
+	w.Flush()
+
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "%d format(s) skipped, no stream data was delivered\n", skipped)
+	}
+	if n > 0 {
+		return fmt.Errorf("%d format(s) failed", n)
+	}
+	return nil
+}
+
+func (cmd *SelftestCommand) runFormat(name string, key []byte, streams, size int, seed int64, timeout time.Duration) (*marionettetest.Result, error) {
+	data, err := mar.ReadFormat(name)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("MAR document not found: %s", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	h, err := marionettetest.NewHarness(data)
+	if err != nil {
+		return nil, err
+	}
+	h.ClientDoc.Path = mar.FormatPath(name)
+	h.ServerDoc.Path = h.ClientDoc.Path
+	h.Key, h.Seed = key, seed
+	h.Streams, h.PayloadSize = streams, size
+	h.Timeout = timeout
+	return h.Run()
+}
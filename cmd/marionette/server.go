@@ -2,13 +2,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/armon/go-socks5"
 	"github.com/redjack/marionette"
@@ -33,7 +40,22 @@ func (cmd *ServerCommand) Run(args []string) error {
 		proxyAddr = fs.String("proxy", "", "Proxy IP and port")
 		format    = fs.String("format", "", "Format name and version")
 		verbose   = fs.Bool("v", false, "Debug logging enabled")
+		privKey   = fs.String("private-key-file", "", "Path to hex-encoded server private key")
+		allowDsts = fs.Bool("allow-destinations", false, "Allow clients to open streams to any host:port")
+		drain     = fs.Duration("drain-timeout", marionette.DefaultDrainTimeout, "Time allowed for open streams to finish on shutdown")
+
+		allowPrivate = fs.Bool("allow-private", false, "Allow connections to loopback & private addresses")
+		maxConns     = fs.Int("max-conns-per-client", 0, "Maximum concurrent connections per client (0 is unlimited)")
 	)
+	services := make(serviceFlag)
+	fs.Var(services, "service", "Named service clients can open streams to, as NAME=HOST:PORT (repeatable)")
+
+	var allowCIDRs, denyCIDRs, allowHosts, denyHosts, allowPorts listFlag
+	fs.Var(&allowCIDRs, "allow-cidr", "Comma-separated networks connections are allowed to (repeatable)")
+	fs.Var(&denyCIDRs, "deny-cidr", "Comma-separated networks connections are denied to (repeatable)")
+	fs.Var(&allowHosts, "allow-host", "Comma-separated hostnames connections are allowed to, *.DOMAIN matches subdomains (repeatable)")
+	fs.Var(&denyHosts, "deny-host", "Comma-separated hostnames connections are denied to, *.DOMAIN matches subdomains (repeatable)")
+	fs.Var(&allowPorts, "allow-port", "Comma-separated ports connections are allowed to (repeatable)")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -41,10 +63,25 @@ func (cmd *ServerCommand) Run(args []string) error {
 	// Validate arguments.
 	if *format == "" {
 		return errors.New("format required")
-	} else if !*useSocks5 && *proxyAddr == "" {
+	} else if !*useSocks5 && *proxyAddr == "" && len(services) == 0 && !*allowDsts {
 		return errors.New("proxy address required")
 	}
 
+	// Build egress policy.
+	policy := marionette.NewEgressPolicy()
+	policy.AllowHosts, policy.DenyHosts = allowHosts, denyHosts
+	policy.AllowPrivate = *allowPrivate
+	policy.MaxConnsPerClient = *maxConns
+
+	var err error
+	if policy.AllowNets, err = parseCIDRs(allowCIDRs); err != nil {
+		return err
+	} else if policy.DenyNets, err = parseCIDRs(denyCIDRs); err != nil {
+		return err
+	} else if policy.AllowPorts, err = parsePorts(allowPorts); err != nil {
+		return err
+	}
+
 	// Read MAR file.
 	data, err := mar.ReadFormat(*format)
 	if os.IsNotExist(err) {
@@ -53,11 +90,31 @@ func (cmd *ServerCommand) Run(args []string) error {
 		return err
 	}
 
+	// Derive FTE key from shared secret.
+	key, err := fs.FTEKey()
+	if err != nil {
+		return err
+	} else if key == nil {
+		fmt.Fprintln(os.Stderr, "warning: no -key or -key-file specified, using default FTE key")
+	}
+
+	// Read server private key, if specified.
+	var privateKey []byte
+	if *privKey != "" {
+		buf, err := ioutil.ReadFile(*privKey)
+		if err != nil {
+			return err
+		} else if privateKey, err = hex.DecodeString(string(bytes.TrimSpace(buf))); err != nil {
+			return fmt.Errorf("invalid server private key: %s", err)
+		}
+	}
+
 	// Parse document.
 	doc, err := mar.Parse(marionette.PartyServer, data)
 	if err != nil {
 		return err
 	}
+	doc.Path = mar.FormatPath(*format)
 
 	// Set logger if verbose.
 	fte.Verbose = *verbose
@@ -72,23 +129,30 @@ func (cmd *ServerCommand) Run(args []string) error {
 	}
 
 	// Start listener.
-	ln, err := marionette.Listen(doc, *bind)
-	if err != nil {
+	ln := marionette.NewListener(doc, *bind, key)
+	ln.TracePath = fs.TracePath
+	ln.PrivateKey = privateKey
+	ln.DrainTimeout = *drain
+	if err := ln.Open(); err != nil {
 		return err
 	}
-	ln.TracePath = fs.TracePath
 
 	// Start proxy.
 	proxy := marionette.NewServerProxy(ln)
 	if *useSocks5 {
 		if proxy.Socks5Server, err = socks5.New(&socks5.Config{
 			Logger: log.New(&socks5LogWriter{}, "", 0),
+			Rules:  policy,
+			Dial:   proxy.DialContext,
 		}); err != nil {
 			return err
 		}
 	} else {
 		proxy.Addr = *proxyAddr
 	}
+	proxy.Services = services
+	proxy.AllowDestinations = *allowDsts
+	proxy.Policy = policy
 	if err := proxy.Open(); err != nil {
 		return err
 	}
@@ -102,13 +166,89 @@ func (cmd *ServerCommand) Run(args []string) error {
 
 	// Wait for signal.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 	fmt.Fprintln(os.Stderr, "received interrupt, shutting down...")
 
+	// Stop accepting streams, flush them to clients & close connections.
+	return proxy.Close()
+}
+
+// serviceFlag is a repeatable flag of named service addresses.
+type serviceFlag map[string]string
+
+func (f serviceFlag) String() string {
+	a := make([]string, 0, len(f))
+	for name, addr := range f {
+		a = append(a, name+"="+addr)
+	}
+	sort.Strings(a)
+	return strings.Join(a, ",")
+}
+
+func (f serviceFlag) Set(s string) error {
+	name, addr := s, ""
+	if i := strings.Index(s, "="); i != -1 {
+		name, addr = s[:i], s[i+1:]
+	}
+	if name == "" {
+		return errors.New("service name required")
+	} else if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid service address: %q", addr)
+	}
+	f[name] = addr
+	return nil
+}
+
+// listFlag is a repeatable flag of comma-separated values.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *listFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
 	return nil
 }
 
+// parseCIDRs parses a list of networks. Single addresses are also accepted.
+func parseCIDRs(a []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(a))
+	for _, s := range a {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parsePorts parses a list of port numbers.
+func parsePorts(a []string) ([]int, error) {
+	ports := make([]int, 0, len(a))
+	for _, s := range a {
+		port, err := strconv.Atoi(s)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port: %q", s)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
 // socks5LogWriter converts errors to use zap. Also drops some expected errors.
 type socks5LogWriter struct {
 	w io.Writer
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
+	_ "github.com/redjack/marionette/plugins"
+)
+
+type TraceCommand struct{}
+
+func NewTraceCommand() *TraceCommand {
+	return &TraceCommand{}
+}
+
+func (cmd *TraceCommand) Run(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: marionette trace replay [arguments] FILE")
+	}
+
+	switch args[0] {
+	case "replay":
+		return cmd.runReplay(args[1:])
+	default:
+		return fmt.Errorf("unknown trace command: %s", args[0])
+	}
+}
+
+func (cmd *TraceCommand) runReplay(args []string) error {
+	fs := NewFlagSet("marionette-trace-replay", flag.ContinueOnError)
+	var (
+		format  = fs.String("format", "", "Format name and version")
+		output  = fs.String("o", "", "write replayed trace to file")
+		timeout = fs.Duration("timeout", 30*time.Second, "replay timeout")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: marionette trace replay -format FORMAT [arguments] FILE")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *format == "" {
+		return errors.New("format required")
+	} else if fs.NArg() != 1 {
+		return errors.New("trace file required")
+	}
+
+	// Read recorded trace.
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	events, err := marionette.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		return err
+	} else if len(events) == 0 || events[0].Type != marionette.TraceEventOpen {
+		return marionette.ErrInvalidTrace
+	}
+
+	// Parse document for the recorded party.
+	data, err := mar.ReadFormat(*format)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("MAR document not found: %s", *format)
+	} else if err != nil {
+		return err
+	}
+	doc, err := mar.Parse(events[0].Party, data)
+	if err != nil {
+		return err
+	}
+
+	key, err := fs.FTEKey()
+	if err != nil {
+		return err
+	}
+
+	r := marionette.NewReplayer(doc, key, events)
+	if *output != "" {
+		w, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		r.Output = w
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	n, err := r.Replay(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("replayed %d transitions\n", n)
+	return nil
+}
@@ -1,18 +1,27 @@
 package marionette
 
 import (
+	"context"
 	"io"
 	"net"
 	"strings"
 	"sync"
 )
 
+// maxDatagramSize is the largest datagram read from a packet connection.
+const maxDatagramSize = 65535
+
 type BufferedConn struct {
 	net.Conn
 
-	mu  sync.RWMutex
-	buf []byte
-	err error
+	mu   sync.RWMutex
+	buf  []byte
+	err  error
+	msgs []int // message lengths in buf, if in packet mode
+
+	packet bool // if true, message boundaries are preserved
+
+	tracer *Tracer // records reads, writes & peeks, if set
 
 	closing chan struct{}
 	once    sync.Once
@@ -21,19 +30,38 @@ type BufferedConn struct {
 	writeNotify chan struct{} // sent when data has been written to the buffer.
 }
 
+// NewBufferedConn returns a new BufferedConn wrapping conn. Datagram-based
+// connections, such as UDP, are buffered in packet mode.
 func NewBufferedConn(conn net.Conn, bufferSize int) *BufferedConn {
+	return newBufferedConn(conn, bufferSize, nil)
+}
+
+func newBufferedConn(conn net.Conn, bufferSize int, tracer *Tracer) *BufferedConn {
 	c := &BufferedConn{
 		Conn:    conn,
 		buf:     make([]byte, 0, bufferSize*2),
+		packet:  isPacketConn(conn),
+		tracer:  tracer,
 		closing: make(chan struct{}, 0),
 
 		seekNotify:  make(chan struct{}, 1),
 		writeNotify: make(chan struct{}, 1),
 	}
-	go c.monitor()
+	if c.packet {
+		if cap(c.buf) < maxDatagramSize {
+			c.buf = make([]byte, 0, maxDatagramSize)
+		}
+		go c.monitorPackets()
+	} else {
+		go c.monitor()
+	}
 	return c
 }
 
+// PacketMode returns true if the connection preserves message boundaries.
+// In packet mode, Peek(-1) returns a single message at a time.
+func (conn *BufferedConn) PacketMode() bool { return conn.packet }
+
 // Close closes the connection.
 func (conn *BufferedConn) Close() error {
 	conn.once.Do(func() { close(conn.closing) })
@@ -48,6 +76,12 @@ func (conn *BufferedConn) Append(b []byte) {
 	conn.buf = conn.buf[:len(conn.buf)+len(b)]
 }
 
+// Write writes b to the underlying connection.
+func (conn *BufferedConn) Write(b []byte) (int, error) {
+	conn.tracer.writeData(b)
+	return conn.Conn.Write(b)
+}
+
 // Read is unavailable for BufferedConn.
 func (conn *BufferedConn) Read(p []byte) (int, error) {
 	panic("BufferedConn.Read(): unavailable, use Peek/Seek")
@@ -56,12 +90,40 @@ func (conn *BufferedConn) Read(p []byte) (int, error) {
 // Peek returns the first n bytes of the read buffer.
 // If n is -1 then returns any available data after attempting a read.
 func (conn *BufferedConn) Peek(n int, blocking bool) ([]byte, error) {
+	return conn.PeekContext(context.Background(), n, blocking)
+}
+
+// PeekContext returns the first n bytes of the read buffer. A blocking peek
+// returns the buffer & ctx.Err() if ctx is done before enough data is read.
+func (conn *BufferedConn) PeekContext(ctx context.Context, n int, blocking bool) ([]byte, error) {
+	// Advance the trace clock around the peek so replays can deliver reads
+	// at the same point.
+	conn.tracer.tick()
+	buf, err := conn.peek(ctx, n, blocking)
+	conn.tracer.tick()
+
+	if len(buf) > 0 {
+		conn.tracer.peek(len(buf))
+	}
+	return buf, err
+}
+
+func (conn *BufferedConn) peek(ctx context.Context, n int, blocking bool) ([]byte, error) {
 	for {
 		// Read buffer & error from monitor under read lock.
 		conn.mu.RLock()
 		buf, err := conn.buf, conn.err
 		conn.mu.RUnlock()
 
+		// Only return the next message in packet mode.
+		if n == -1 && conn.packet {
+			conn.mu.RLock()
+			if len(conn.msgs) > 0 {
+				buf = buf[:conn.msgs[0]]
+			}
+			conn.mu.RUnlock()
+		}
+
 		// Return any data that exists in the buffer.
 		switch n {
 		case -1:
@@ -86,7 +148,11 @@ func (conn *BufferedConn) Peek(n int, blocking bool) ([]byte, error) {
 		}
 
 		// Wait for a new write or error from the monitor.
-		<-conn.writeNotify
+		select {
+		case <-ctx.Done():
+			return buf, ctx.Err()
+		case <-conn.writeNotify:
+		}
 	}
 }
 
@@ -94,15 +160,26 @@ func (conn *BufferedConn) Peek(n int, blocking bool) ([]byte, error) {
 // This implementation only supports io.SeekCurrent.
 func (conn *BufferedConn) Seek(offset int64, whence int) (int64, error) {
 	assert(whence == io.SeekCurrent)
-	assert(offset <= int64(len(conn.buf)))
 
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
+	// Check the offset under lock as the monitor may be appending.
+	assert(offset <= int64(len(conn.buf)))
+
 	b := conn.buf[offset:]
 	conn.buf = conn.buf[:len(b)]
 	copy(conn.buf, b)
 
+	// Remove messages which have been passed.
+	for offset > 0 && len(conn.msgs) > 0 {
+		if n := int64(conn.msgs[0]); offset >= n {
+			conn.msgs, offset = conn.msgs[1:], offset-n
+		} else {
+			conn.msgs[0], offset = int(n-offset), 0
+		}
+	}
+
 	conn.notifySeek()
 
 	return 0, nil
@@ -141,19 +218,77 @@ func (conn *BufferedConn) monitor() {
 
 		// Append bytes to connection buffer.
 		if n > 0 {
+			conn.tracer.read(buf[:n])
 			conn.Append(buf[:n])
 			conn.notifyWrite()
 		}
 
 		// If an error occurred then save on connection and exit.
 		if err != nil && !isTemporaryError(err) {
+			conn.mu.Lock()
+			conn.err = err
+			conn.mu.Unlock()
+			conn.notifyWrite()
+			return
+		}
+	}
+}
+
+// monitorPackets runs in a separate goroutine and continually reads datagrams
+// to the buffer. Each datagram is appended whole once there is room for it.
+func (conn *BufferedConn) monitorPackets() {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		// Ensure connection is not closed.
+		select {
+		case <-conn.closing:
+			return
+		default:
+		}
+
+		// Read next datagram from connection.
+		n, err := conn.Conn.Read(buf)
+		if n > 0 {
+			conn.tracer.read(buf[:n])
+		}
+
+		// Wait until the message fits on the buffer.
+		for n > 0 && !conn.appendMessage(buf[:n]) {
+			select {
+			case <-conn.closing:
+				return
+			case <-conn.seekNotify:
+			}
+		}
+		if n > 0 {
+			conn.notifyWrite()
+		}
+
+		// If an error occurred then save on connection and exit.
+		if err != nil && !isTemporaryError(err) {
+			conn.mu.Lock()
 			conn.err = err
+			conn.mu.Unlock()
 			conn.notifyWrite()
 			return
 		}
 	}
 }
 
+// appendMessage adds b to the buffer as a single message.
+// Returns false if there is not enough space on the buffer.
+func (conn *BufferedConn) appendMessage(b []byte) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(b) > cap(conn.buf)-len(conn.buf) {
+		return false
+	}
+	conn.buf = append(conn.buf, b...)
+	conn.msgs = append(conn.msgs, len(b))
+	return true
+}
+
 func (conn *BufferedConn) notifySeek() {
 	select {
 	case conn.seekNotify <- struct{}{}:
@@ -188,6 +323,19 @@ func isTemporaryError(err error) bool {
 	return false
 }
 
+// isPacketConn returns true if conn sends & receives datagrams.
+func isPacketConn(conn net.Conn) bool {
+	if _, ok := conn.(net.PacketConn); !ok || conn.LocalAddr() == nil {
+		return false
+	}
+	switch conn.LocalAddr().Network() {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	default:
+		return false
+	}
+}
+
 func isEOFError(err error) bool {
 	return err != nil && strings.Contains(err.Error(), "connection reset by peer")
 }
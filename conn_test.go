@@ -67,3 +67,58 @@ func TestBufferedConn(t *testing.T) {
 		t.Fatalf("incorrect bytes read: got=%d, exp=%d", len(b), len(data))
 	}
 }
+
+func TestBufferedConn_PacketMode(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send two datagrams to the client connection.
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	_, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pc.WriteTo([]byte("foo"), addr); err != nil {
+		t.Fatal(err)
+	} else if _, err := pc.WriteTo([]byte("barbaz"), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	bufConn := marionette.NewBufferedConn(conn, marionette.MaxCellLength)
+	if !bufConn.PacketMode() {
+		t.Fatal("expected packet mode")
+	}
+
+	// Each peek should only return a single datagram.
+	if b, err := bufConn.Peek(-1, true); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "foo" {
+		t.Fatalf("unexpected datagram: %q", b)
+	} else if _, err := bufConn.Seek(int64(len(b)), io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial seeks should leave the remainder of the datagram.
+	if b, err := bufConn.Peek(-1, true); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "barbaz" {
+		t.Fatalf("unexpected datagram: %q", b)
+	} else if _, err := bufConn.Seek(3, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	} else if b, err := bufConn.Peek(-1, true); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "baz" {
+		t.Fatalf("unexpected remainder: %q", b)
+	}
+}
@@ -3,64 +3,209 @@ package marionette
 import (
 	"context"
 	"errors"
+	"math"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
+const (
+	// DefaultMinReconnectDelay is the initial delay before reconnecting.
+	DefaultMinReconnectDelay = 100 * time.Millisecond
+
+	// DefaultMaxReconnectDelay is the upper bound of the reconnect delay.
+	DefaultMaxReconnectDelay = 30 * time.Second
+)
+
 var (
 	// ErrDialerClosed is returned when trying to operate on a closed dialer.
 	ErrDialerClosed = errors.New("marionette: dialer closed")
 )
 
+// ConnState represents the state of a pooled dialer connection.
+type ConnState int
+
+const (
+	ConnStateConnecting   ConnState = iota // dialing the server
+	ConnStateConnected                     // executing the FSM
+	ConnStateEstablished                   // received a reply from the server
+	ConnStateDisconnected                  // waiting to reconnect
+	ConnStateClosed                        // dialer closed
+)
+
+// String returns the string representation of the state.
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateConnecting:
+		return "connecting"
+	case ConnStateConnected:
+		return "connected"
+	case ConnStateEstablished:
+		return "established"
+	case ConnStateDisconnected:
+		return "disconnected"
+	case ConnStateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
 // Dialer represents a client-side dialer that communicates over the marionette protocol.
+//
+// The dialer maintains a pool of connections to the server which share a
+// single stream set. Each connection identifies the dialer's session to the
+// server so that the server also shares streams between them. Failed connections are reconnected with a randomized
+// exponential backoff and any cells which may not have been delivered are
+// resent over another connection.
 type Dialer struct {
 	mu        sync.RWMutex
 	addr      string
 	doc       *mar.Document
-	fsm       FSM
+	fsms      []*fsm
+	states    []ConnState
 	streamSet *StreamSet
+	key       []byte
+	sessionID uint64
+	rand      *rand.Rand // instance id generator, if seeded
+	err       error      // last connection error
+	fatal     error      // error which closed the dialer, if any
+
+	// Closed while at least one connection is established.
+	ready     chan struct{}
+	readyOpen bool
 
 	ctx    context.Context
 	cancel func()
 
-	closed bool
-	wg     sync.WaitGroup
+	closed   bool
+	draining bool
+	wg       sync.WaitGroup
 
 	// Underlying NetDialer used for net connection.
 	Dialer NetDialer
+
+	// Pinned public key of the server. If set, an ephemeral session key is
+	// negotiated with the server before any stream data is sent.
+	ServerPublicKey []byte
+
+	// Number of concurrent connections to the server. Defaults to 1.
+	PoolSize int
+
+	// Bounds of the delay between reconnection attempts. The delay doubles
+	// after each failed attempt and is randomized to avoid reconnecting
+	// all connections at the same time.
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	// Time allowed on close for buffered stream data to be sent to the
+	// server before connections are closed. Defaults to DefaultDrainTimeout.
+	DrainTimeout time.Duration
+
+	// If non-zero, seeds the PRNG used to generate connection instance ids.
+	// Connections execute the same transitions for the same seed.
+	Seed int64
+
+	// Specifies directory for dumping connection traces. Each connection is
+	// traced to a separate JSONL file.
+	TracePath string
+
+	// Clock used by connections for sleeps & timeouts. The stream set's
+	// clock is set separately. Defaults to DefaultClock.
+	Clock Clock
+
+	// Called when a pooled connection changes state. The index identifies
+	// the connection within the pool.
+	OnConnStateChange func(i int, state ConnState)
 }
 
 // NewDialer returns a new instance of Dialer.
-func NewDialer(doc *mar.Document, addr string, streamSet *StreamSet) *Dialer {
-	// Run execution in a separate goroutine.
+// The key is the FTE key material shared with the server. See fte.NewKey().
+func NewDialer(doc *mar.Document, addr string, streamSet *StreamSet, key []byte) *Dialer {
 	d := &Dialer{
 		addr:      addr,
 		doc:       doc,
 		streamSet: streamSet,
+		key:       key,
 		Dialer:    &net.Dialer{},
+		ready:     make(chan struct{}),
+
+		PoolSize:          1,
+		MinReconnectDelay: DefaultMinReconnectDelay,
+		MaxReconnectDelay: DefaultMaxReconnectDelay,
+		DrainTimeout:      DefaultDrainTimeout,
+		Clock:             DefaultClock,
 	}
 	d.ctx, d.cancel = context.WithCancel(context.Background())
 	return d
 }
 
-// Open initializes the underlying connection.
+// Open initializes the underlying connections. Returns an error if any of
+// the initial connections cannot be established.
 func (d *Dialer) Open() error {
-	conn, err := d.Dialer.DialContext(d.ctx, d.doc.Transport, net.JoinHostPort(d.addr, d.doc.Port))
+	if d.ServerPublicKey != nil && len(d.ServerPublicKey) != NegotiateKeySize {
+		return ErrInvalidNegotiateKey
+	}
+
+	sessionID, err := newSessionID()
 	if err != nil {
 		return err
 	}
-	d.fsm = NewFSM(d.doc, d.addr, PartyClient, conn, d.streamSet)
+	d.sessionID = sessionID
+
+	if d.Seed != 0 {
+		d.rand = rand.New(rand.NewSource(d.Seed))
+	}
+
+	n := d.PoolSize
+	if n < 1 {
+		n = 1
+	}
+
+	d.mu.Lock()
+	d.fsms, d.states = make([]*fsm, n), make([]ConnState, n)
+	d.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		fsm, err := d.connect(i)
+		if err != nil {
+			d.close()
+			return err
+		}
+		d.setConn(i, fsm, ConnStateConnected)
+	}
 
-	d.wg.Add(1)
-	go func() { defer d.wg.Done(); d.execute() }()
+	// Run execution in separate goroutines.
+	for i := 0; i < n; i++ {
+		i := i
+		d.wg.Add(1)
+		go func() { defer d.wg.Done(); d.run(i) }()
+	}
 	return nil
 }
 
-// Close stops the dialer and its underlying connections.
+// Close stops the dialer and its underlying connections. New streams are
+// refused while existing streams are ended and given up to DrainTimeout to
+// send their buffered data. If no connection is established then streams
+// drain once one reconnects, within the same timeout.
 func (d *Dialer) Close() error {
+	d.mu.Lock()
+	closed := d.closed
+	d.draining = true
+	d.mu.Unlock()
+
+	if !closed {
+		ctx, cancel := context.WithTimeout(context.Background(), d.DrainTimeout)
+		if err := d.streamSet.Drain(ctx); err != nil {
+			Logger.Debug("dialer drain timeout", zap.Error(err))
+		}
+		cancel()
+	}
+
 	err := d.close()
 	d.wg.Wait()
 	return err
@@ -69,7 +214,13 @@ func (d *Dialer) Close() error {
 func (d *Dialer) close() (err error) {
 	d.mu.Lock()
 	d.closed = true
-	err = d.fsm.Close()
+	for _, fsm := range d.fsms {
+		if fsm == nil {
+			continue
+		} else if e := fsm.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
 	d.mu.Unlock()
 
 	d.cancel()
@@ -84,26 +235,243 @@ func (d *Dialer) Closed() bool {
 	return closed
 }
 
-// Dial returns a new stream from the dialer.
+// Err returns the last error that occurred on a connection.
+func (d *Dialer) Err() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.err
+}
+
+// ConnStates returns the state of each connection in the pool.
+func (d *Dialer) ConnStates() []ConnState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]ConnState(nil), d.states...)
+}
+
+// Dial returns a new stream from the dialer. The stream is returned
+// immediately, even if no connection to the server is established.
 func (d *Dialer) Dial() (net.Conn, error) {
-	if d.Closed() {
+	d.mu.RLock()
+	closed := d.closed || d.draining
+	d.mu.RUnlock()
+
+	if closed {
 		return nil, ErrDialerClosed
 	}
 	return d.streamSet.Create(), nil
 }
 
-func (d *Dialer) execute() {
-	defer d.close()
+// DialContext returns a new stream once a connection has completed a round
+// trip with the server. If the dialer closed itself because of an error then
+// that error is returned. Otherwise ErrDialerClosed is returned once closed.
+func (d *Dialer) DialContext(ctx context.Context) (net.Conn, error) {
+	for {
+		d.mu.RLock()
+		closed, draining, err, ready, readyOpen := d.closed, d.draining, d.fatal, d.ready, d.readyOpen
+		d.mu.RUnlock()
 
+		if draining && !closed {
+			return nil, ErrDialerClosed
+		} else if closed {
+			if err != nil {
+				return nil, err
+			}
+			return nil, ErrDialerClosed
+		} else if readyOpen {
+			return d.streamSet.Create(), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-d.ctx.Done():
+		case <-ready:
+		}
+	}
+}
+
+// DialDestination returns a new stream which the server connects to dst.
+// The destination is a "host:port" address or the name of a service
+// configured on the server. Returns an *OpenError if the server rejects it.
+func (d *Dialer) DialDestination(ctx context.Context, dst string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := conn.(*Stream)
+	if err := stream.Open(dst); err != nil {
+		stream.Close()
+		return nil, err
+	} else if err := stream.WaitReply(ctx); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// connect opens the i-th connection to the server and returns its FSM.
+func (d *Dialer) connect(i int) (*fsm, error) {
+	// UDP transports use a connected socket so each read returns one datagram.
+	conn, err := d.Dialer.DialContext(d.ctx, d.doc.Transport, net.JoinHostPort(d.addr, d.doc.Port))
+	if err != nil {
+		return nil, err
+	}
+	fsm := newFSM(d.doc, d.addr, PartyClient, conn, d.streamSet, d.key, d.nextInstanceID(), createTracer(d.TracePath, PartyClient))
+	fsm.handshake = newHandshake(PartyClient, nil, d.ServerPublicKey)
+	fsm.sessionID, fsm.sessionPending = d.sessionID, true
+	fsm.onEstablished = func() { d.setConn(i, fsm, ConnStateEstablished) }
+	fsm.setClock(d.Clock)
+	return fsm, nil
+}
+
+// nextInstanceID returns the instance id for a new connection.
+// Returns zero to use a random id if the dialer is not seeded.
+func (d *Dialer) nextInstanceID() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rand == nil {
+		return 0
+	}
+	return int(d.rand.Int31n(math.MaxInt32) + 1)
+}
+
+// setConn updates the FSM & state of the i-th connection in the pool.
+// Returns false if the dialer has been closed.
+func (d *Dialer) setConn(i int, fsm *fsm, state ConnState) bool {
+	d.mu.Lock()
+	if d.closed && state != ConnStateClosed {
+		d.mu.Unlock()
+		return false
+	}
+	d.fsms[i], d.states[i] = fsm, state
+	d.updateReady()
+	fn := d.OnConnStateChange
+	d.mu.Unlock()
+
+	if fn != nil {
+		fn(i, state)
+	}
+	return true
+}
+
+// updateReady notifies waiting callers when a connection is established.
+// Must be called under lock.
+func (d *Dialer) updateReady() {
+	var ready bool
+	for _, state := range d.states {
+		if state == ConnStateEstablished {
+			ready = true
+		}
+	}
+
+	if ready && !d.readyOpen {
+		close(d.ready)
+		d.readyOpen = true
+	} else if !ready && d.readyOpen {
+		d.ready = make(chan struct{})
+		d.readyOpen = false
+	}
+}
+
+// setErr records the last connection error.
+func (d *Dialer) setErr(err error) {
+	d.mu.Lock()
+	d.err = err
+	d.mu.Unlock()
+}
+
+// run executes the FSM for the i-th connection in the pool and reconnects
+// whenever the connection fails.
+func (d *Dialer) run(i int) {
+	defer d.setConn(i, nil, ConnStateClosed)
+
+	d.mu.RLock()
+	fsm := d.fsms[i]
+	d.mu.RUnlock()
+
+	for attempt := 0; ; attempt++ {
+		if fsm != nil {
+			err := d.execute(fsm)
+			fsm.requeue()
+			fsm.Close()
+
+			if d.Closed() {
+				return
+			} else if err == ErrNegotiationFailed {
+				// Reconnecting cannot fix a server that cannot be authenticated.
+				Logger.Debug("dialer error", zap.Error(err))
+				d.mu.Lock()
+				d.err, d.fatal = err, err
+				d.mu.Unlock()
+				d.close()
+				return
+			}
+
+			Logger.Debug("dialer connection lost", zap.Int("conn", i), zap.Error(err))
+			d.setErr(err)
+			d.setConn(i, nil, ConnStateDisconnected)
+
+			// Only back off from the minimum delay if the connection worked.
+			if fsm.established {
+				attempt = 0
+			}
+		}
+
+		// Wait before reconnecting.
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.Clock.After(d.reconnectDelay(attempt)):
+		}
+
+		if !d.setConn(i, nil, ConnStateConnecting) {
+			return
+		}
+
+		var err error
+		if fsm, err = d.connect(i); err != nil {
+			Logger.Debug("dialer cannot reconnect", zap.Int("conn", i), zap.Error(err))
+			d.setErr(err)
+			d.setConn(i, nil, ConnStateDisconnected)
+		} else if !d.setConn(i, fsm, ConnStateConnected) {
+			fsm.Close()
+			return
+		}
+	}
+}
+
+// execute runs the FSM until an error occurs or the dialer is closed.
+func (d *Dialer) execute(fsm *fsm) error {
 	for !d.Closed() {
-		if err := d.fsm.Execute(d.ctx); err == ErrStreamClosed {
+		if err := fsm.Execute(d.ctx); err == ErrStreamClosed {
 			continue
 		} else if err != nil {
-			Logger.Debug("dialer error", zap.Error(err))
-			return
+			return err
 		}
-		d.fsm.Reset()
+		fsm.Reset()
+	}
+	return nil
+}
+
+// reconnectDelay returns the randomized delay before a reconnection attempt.
+// The delay is drawn from the seeded PRNG, if set.
+func (d *Dialer) reconnectDelay(attempt int) time.Duration {
+	delay := d.MinReconnectDelay
+	for i := 0; i < attempt && delay < d.MaxReconnectDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxReconnectDelay {
+		delay = d.MaxReconnectDelay
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rand != nil {
+		return delay/2 + time.Duration(d.rand.Int63n(int64(delay/2)+1))
 	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
 }
 
 // NetDialer is an abstract dialer. net.Dialer implements the NetDialer interface.
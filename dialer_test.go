@@ -0,0 +1,804 @@
+package marionette_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+	"github.com/redjack/marionette/marionettetest"
+)
+
+func TestDialer_Reconnect(t *testing.T) {
+	key := fte.NewKey([]byte("secret"))
+
+	serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	if err := ln.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	netDialer := &recordingDialer{}
+	states := make(chan marionette.ConnState, 100)
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+	dialer.Dialer = netDialer
+	dialer.MinReconnectDelay = 10 * time.Millisecond
+	dialer.OnConnStateChange = func(i int, state marionette.ConnState) { states <- state }
+	if err := dialer.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+
+	MustWaitConnStates(t, states, marionette.ConnStateConnected, marionette.ConnStateEstablished)
+
+	// Write from client and read from server.
+	clientConn, err := dialer.DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := clientConn.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(serverConn, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "foo" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	// Sever the underlying connection and wait for the dialer to reconnect.
+	netDialer.Conn(0).Close()
+	MustWaitConnStates(t, states, marionette.ConnStateDisconnected, marionette.ConnStateConnecting, marionette.ConnStateConnected, marionette.ConnStateEstablished)
+	if states := dialer.ConnStates(); len(states) != 1 || states[0] != marionette.ConnStateEstablished {
+		t.Fatalf("unexpected states: %v", states)
+	}
+
+	// The stream should survive on the new connection in both directions.
+	if _, err := clientConn.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(serverConn, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "bar" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	if _, err := serverConn.Write([]byte("baz")); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(clientConn, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "baz" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+}
+
+// Ensure the reconnect delay is measured by the dialer's clock.
+func TestDialer_Reconnect_Clock(t *testing.T) {
+	key := fte.NewKey([]byte("secret"))
+
+	serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	if err := ln.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	clock := marionettetest.NewClock(time.Now())
+	netDialer := &recordingDialer{}
+	states := make(chan marionette.ConnState, 100)
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+	dialer.Dialer = netDialer
+	dialer.Clock = clock
+	dialer.MinReconnectDelay, dialer.MaxReconnectDelay = time.Hour, time.Hour
+	dialer.OnConnStateChange = func(i int, state marionette.ConnState) { states <- state }
+	if err := dialer.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+	MustWaitConnStates(t, states, marionette.ConnStateConnected, marionette.ConnStateEstablished)
+
+	// The dialer waits for the clock before reconnecting.
+	netDialer.Conn(0).Close()
+	MustWaitConnStates(t, states, marionette.ConnStateDisconnected)
+	select {
+	case state := <-states:
+		t.Fatalf("unexpected state: %s", state)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.Add(time.Hour)
+	MustWaitConnStates(t, states, marionette.ConnStateConnecting, marionette.ConnStateConnected, marionette.ConnStateEstablished)
+}
+
+// Ensure the reconnect delay keeps backing off while connections fail before
+// they are established.
+func TestDialer_Reconnect_Backoff(t *testing.T) {
+	serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", fte.NewKey([]byte("other")))
+	if err := ln.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	clock := marionettetest.NewClock(time.Now())
+	states := make(chan marionette.ConnState, 100)
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), fte.NewKey([]byte("secret")))
+	dialer.Clock = clock
+	dialer.MinReconnectDelay, dialer.MaxReconnectDelay = time.Second, time.Hour
+	dialer.OnConnStateChange = func(i int, state marionette.ConnState) { states <- state }
+	if err := dialer.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+	MustWaitConnStates(t, states, marionette.ConnStateConnected, marionette.ConnStateDisconnected)
+
+	// Without backoff, the dialer would reconnect every second.
+	var n int
+	for i := 0; i < 16; i++ {
+		time.Sleep(20 * time.Millisecond)
+		clock.Add(time.Second)
+	LOOP:
+		for {
+			select {
+			case state := <-states:
+				if state == marionette.ConnStateConnecting {
+					n++
+				}
+			case <-time.After(50 * time.Millisecond):
+				break LOOP
+			}
+		}
+	}
+	if n < 2 || n > 5 {
+		t.Fatalf("unexpected reconnects: %d", n)
+	}
+}
+
+func TestDialer_Open(t *testing.T) {
+	t.Run("Pool", func(t *testing.T) {
+		key := fte.NewKey([]byte("secret"))
+
+		serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+		serverDoc.Port = "0"
+		ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+		if err := ln.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+		netDialer := &recordingDialer{}
+		dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+		dialer.Dialer = netDialer
+		dialer.PoolSize = 3
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+
+		if n := netDialer.N(); n != 3 {
+			t.Fatalf("unexpected connection count: %d", n)
+		} else if states := dialer.ConnStates(); len(states) != 3 {
+			t.Fatalf("unexpected states: %v", states)
+		}
+
+		// Cells for a stream are spread across connections in the session.
+		clientConn, err := dialer.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 10000)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		go func() {
+			for i := 0; i < len(data); i += 1000 {
+				if _, err := clientConn.Write(data[i : i+1000]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+
+		serverConn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(serverConn, buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, data) {
+			t.Fatal("data mismatch")
+		}
+	})
+
+	t.Run("ErrConnRefused", func(t *testing.T) {
+		// Reserve a port and close it so nothing is listening.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		doc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		doc.Port = strconv.Itoa(port)
+		dialer := marionette.NewDialer(doc, "127.0.0.1", marionette.NewStreamSet(), nil)
+		if err := dialer.Open(); err == nil {
+			t.Fatal("expected error")
+		} else if !dialer.Closed() {
+			t.Fatal("expected dialer to be closed")
+		}
+	})
+}
+
+func TestDialer_DialContext(t *testing.T) {
+	t.Run("ErrNegotiationFailed", func(t *testing.T) {
+		key := fte.NewKey([]byte("secret"))
+		privateKey, _, err := marionette.GenerateServerKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, otherPublicKey, err := marionette.GenerateServerKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ln, dialer := MustOpenNegotiatingPair(t, "http_simple_blocking", key, privateKey, otherPublicKey)
+		defer ln.Close()
+		defer dialer.Close()
+
+		// The cause should be returned instead of a stream that cannot send data.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := dialer.DialContext(ctx); err != marionette.ErrNegotiationFailed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Connection errors before a normal close should not be returned.
+	t.Run("ErrDialerClosed", func(t *testing.T) {
+		key := fte.NewKey([]byte("secret"))
+		ln := MustOpenListener(t, "http_simple_blocking", key)
+		defer ln.Close()
+
+		doc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		doc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+		netDialer := &recordingDialer{}
+		states := make(chan marionette.ConnState, 100)
+		dialer := marionette.NewDialer(doc, "127.0.0.1", marionette.NewStreamSet(), key)
+		dialer.Dialer = netDialer
+		dialer.MinReconnectDelay = time.Hour
+		dialer.MaxReconnectDelay = time.Hour
+		dialer.OnConnStateChange = func(i int, state marionette.ConnState) { states <- state }
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+
+		MustWaitConnStates(t, states, marionette.ConnStateConnected, marionette.ConnStateEstablished)
+		netDialer.Conn(0).Close()
+		MustWaitConnStates(t, states, marionette.ConnStateDisconnected)
+		if dialer.Err() == nil {
+			t.Fatal("expected connection error")
+		}
+
+		if err := dialer.Close(); err != nil {
+			t.Fatal(err)
+		} else if _, err := dialer.DialContext(context.Background()); err != marionette.ErrDialerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		// Accept TCP connections but never respond.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		doc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		doc.Port = strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		dialer := marionette.NewDialer(doc, "127.0.0.1", marionette.NewStreamSet(), nil)
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, err := dialer.DialContext(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDialer_Close(t *testing.T) {
+	// Ensure buffered stream data is sent to the server before closing.
+	t.Run("Drain", func(t *testing.T) {
+		key := fte.NewKey([]byte("secret"))
+		ln := MustOpenListener(t, "http_simple_blocking", key)
+		defer ln.Close()
+
+		doc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		doc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		dialer := marionette.NewDialer(doc, "127.0.0.1", marionette.NewStreamSet(), key)
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+
+		// Read the stream on the server while the dialer closes.
+		errc := make(chan error, 1)
+		go func() {
+			stream, err := ln.Accept()
+			if err != nil {
+				errc <- err
+				return
+			}
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if buf, err := ioutil.ReadAll(stream); err != nil {
+				errc <- err
+			} else if string(buf) != "foo" {
+				errc <- fmt.Errorf("unexpected data: %q", buf)
+			}
+			close(errc)
+		}()
+
+		conn, err := dialer.DialContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := conn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if err := dialer.Close(); err != nil {
+			t.Fatal(err)
+		} else if _, err := dialer.Dial(); err != marionette.ErrDialerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure streams drain once a lost connection is reestablished.
+	t.Run("Reconnect", func(t *testing.T) {
+		key := fte.NewKey([]byte("secret"))
+		ln := MustOpenListener(t, "http_simple_blocking", key)
+		defer ln.Close()
+
+		doc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		doc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+		clock := marionettetest.NewClock(time.Now())
+		netDialer := &recordingDialer{}
+		states := make(chan marionette.ConnState, 100)
+		dialer := marionette.NewDialer(doc, "127.0.0.1", marionette.NewStreamSet(), key)
+		dialer.Dialer = netDialer
+		dialer.Clock = clock
+		dialer.MinReconnectDelay, dialer.MaxReconnectDelay = time.Hour, time.Hour
+		dialer.OnConnStateChange = func(i int, state marionette.ConnState) { states <- state }
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+		MustWaitConnStates(t, states, marionette.ConnStateConnected, marionette.ConnStateEstablished)
+
+		// Write to a stream while disconnected.
+		netDialer.Conn(0).Close()
+		MustWaitConnStates(t, states, marionette.ConnStateDisconnected)
+		conn, err := dialer.Dial()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := conn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Close should wait for the dialer to reconnect.
+		closec := make(chan error, 1)
+		go func() { closec <- dialer.Close() }()
+		select {
+		case err := <-closec:
+			t.Fatalf("unexpected close: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		clock.Add(time.Hour)
+
+		stream, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 3)
+		stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "foo" {
+			t.Fatalf("unexpected data: %q", buf)
+		} else if err := <-closec; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure close waits no longer than DrainTimeout for a server connection.
+	t.Run("NotConnected", func(t *testing.T) {
+		// Accept TCP connections but never respond.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		doc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		doc.Port = strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		dialer := marionette.NewDialer(doc, "127.0.0.1", marionette.NewStreamSet(), nil)
+		dialer.DrainTimeout = 100 * time.Millisecond
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := dialer.Dial()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := conn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		t0 := time.Now()
+		if err := dialer.Close(); err != nil {
+			t.Fatal(err)
+		} else if elapsed := time.Since(t0); elapsed < dialer.DrainTimeout || elapsed > time.Second {
+			t.Fatalf("close took %s", elapsed)
+		}
+	})
+}
+
+// MustWaitConnStates waits for a sequence of states to be received.
+func MustWaitConnStates(tb testing.TB, ch <-chan marionette.ConnState, states ...marionette.ConnState) {
+	for _, exp := range states {
+		select {
+		case state := <-ch:
+			if state != exp {
+				tb.Fatalf("unexpected state: got=%s, exp=%s", state, exp)
+			}
+		case <-time.After(5 * time.Second):
+			tb.Fatalf("timeout waiting for state: %s", exp)
+		}
+	}
+}
+
+// recordingDialer is a NetDialer which records all connections it opens.
+type recordingDialer struct {
+	net.Dialer
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.conns = append(d.conns, conn)
+	d.mu.Unlock()
+	return conn, nil
+}
+
+// Conn returns the i-th connection opened.
+func (d *recordingDialer) Conn(i int) net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conns[i]
+}
+
+// N returns the number of connections opened.
+func (d *recordingDialer) N() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// Ensure writes larger than the stream buffers are split into cells and
+// delivered in order through a real FSM in both directions.
+func TestDialer_LargeWrite(t *testing.T) {
+	const size = 2 << 20
+	data := []byte(`
+connection(tcp, 8080):
+  start      upstream   NULL       1.0
+  upstream   downstream upstream   1.0
+  downstream upstream   downstream 1.0
+
+action upstream:
+  client fte.send("^\C*$", 1024)
+
+action downstream:
+  server fte.send("^\C*$", 1024)
+`)
+	key := fte.NewKey([]byte("secret"))
+
+	serverDoc := mar.MustParse(marionette.PartyServer, data)
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	ln.ReadBufferSize, ln.WriteBufferSize = 2*marionette.MaxCellLength, 1000
+	if err := ln.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	clientDoc := mar.MustParse(marionette.PartyClient, data)
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	streamSet := marionette.NewStreamSet()
+	streamSet.WriteBufferSize = 4096
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", streamSet, key)
+	if err := dialer.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+
+	upstream, downstream := MustRandomBytes(t, 1, size), MustRandomBytes(t, 2, size)
+
+	clientConn, err := dialer.DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(time.Minute))
+
+	// Write the upstream payload in a single call.
+	errs := make(chan error, 2)
+	go func() {
+		if n, err := clientConn.Write(upstream); err != nil {
+			errs <- err
+		} else if n != len(upstream) {
+			errs <- io.ErrShortWrite
+		} else {
+			errs <- nil
+		}
+	}()
+
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(time.Minute))
+
+	go func() {
+		_, err := serverConn.Write(downstream)
+		errs <- err
+	}()
+
+	// Read both payloads concurrently.
+	var wg sync.WaitGroup
+	var serverBuf []byte
+	var serverErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serverBuf = make([]byte, size)
+		_, serverErr = io.ReadFull(serverConn, serverBuf)
+	}()
+
+	clientBuf := make([]byte, size)
+	if _, err := io.ReadFull(clientConn, clientBuf); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if serverErr != nil {
+		t.Fatal(serverErr)
+	} else if !bytes.Equal(serverBuf, upstream) {
+		t.Fatal("upstream payload mismatch")
+	} else if !bytes.Equal(clientBuf, downstream) {
+		t.Fatal("downstream payload mismatch")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// MustRandomBytes returns n bytes of random data generated from seed.
+func MustRandomBytes(tb testing.TB, seed int64, n int) []byte {
+	tb.Helper()
+	buf := make([]byte, n)
+	if _, err := rand.New(rand.NewSource(seed)).Read(buf); err != nil {
+		tb.Fatal(err)
+	}
+	return buf
+}
+
+func TestDialer_DialDestination(t *testing.T) {
+	key := fte.NewKey([]byte("secret"))
+
+	echoLn := MustOpenEchoListener(t)
+	defer echoLn.Close()
+
+	serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	if err := ln.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	proxy := marionette.NewServerProxy(ln)
+	proxy.Services = map[string]string{"echo": echoLn.Addr().String()}
+	if err := proxy.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+	if err := dialer.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+
+	t.Run("Service", func(t *testing.T) {
+		conn, err := dialer.DialDestination(context.Background(), "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 3)
+		if _, err := conn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "foo" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+	})
+
+	t.Run("ErrUnknownService", func(t *testing.T) {
+		_, err := dialer.DialDestination(context.Background(), "nosuchservice")
+		if e, ok := err.(*marionette.OpenError); !ok || e.Code != marionette.OpenErrUnknownService {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Addresses are rejected unless AllowDestinations is set.
+	t.Run("ErrNotAllowed", func(t *testing.T) {
+		_, err := dialer.DialDestination(context.Background(), echoLn.Addr().String())
+		if e, ok := err.(*marionette.OpenError); !ok || e.Code != marionette.OpenErrNotAllowed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustOpenEchoListener returns a local TCP listener which echoes data back.
+func MustOpenEchoListener(tb testing.TB) net.Listener {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { defer conn.Close(); io.Copy(conn, conn) }()
+		}
+	}()
+	return ln
+}
+
+// Ensure data in flight on a severed connection is resent on the pool's
+// other connections. Asynchronous formats send several cells before any
+// reply so received cells cannot imply that earlier cells were delivered.
+func TestDialer_Migrate(t *testing.T) {
+	for _, format := range []string{"http_simple_blocking", "http_simple_nonblocking"} {
+		t.Run(format, func(t *testing.T) {
+			const size = 32 << 10
+			key := fte.NewKey([]byte("secret"))
+
+			ln := MustOpenListener(t, format, key)
+			defer ln.Close()
+
+			clientDoc := mar.MustParse(marionette.PartyClient, mar.Format(format, ""))
+			clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+			netDialer := &recordingDialer{}
+			dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+			dialer.Dialer = netDialer
+			dialer.PoolSize = 2
+			dialer.MinReconnectDelay = 10 * time.Millisecond
+			if err := dialer.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer dialer.Close()
+
+			clientConn, err := dialer.DialContext(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clientConn.Close()
+			clientConn.SetDeadline(time.Now().Add(30 * time.Second))
+
+			// Echo data back from the server.
+			go func() {
+				serverConn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				io.Copy(serverConn, serverConn)
+			}()
+
+			data := MustRandomBytes(t, 1, size)
+			go func() {
+				if _, err := clientConn.Write(data); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			// Sever a connection once data is flowing in both directions.
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(clientConn, buf[:size/4]); err != nil {
+				t.Fatal(err)
+			}
+			netDialer.Conn(0).Close()
+
+			if _, err := io.ReadFull(clientConn, buf[size/4:]); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(buf, data) {
+				t.Fatal("data mismatch")
+			}
+		})
+	}
+}
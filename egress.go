@@ -0,0 +1,301 @@
+package marionette
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-socks5"
+	"go.uber.org/zap"
+)
+
+// Egress denial reasons.
+const (
+	EgressReasonHost    = "host not allowed"
+	EgressReasonAddr    = "address not allowed"
+	EgressReasonPrivate = "private address not allowed"
+	EgressReasonPort    = "port not allowed"
+	EgressReasonConns   = "too many connections"
+	EgressReasonNoAddr  = "no addresses allowed"
+)
+
+// EgressError is returned when an egress policy denies a destination.
+type EgressError struct {
+	Addr   string
+	Reason string
+}
+
+// Error returns the destination and reason for the denial.
+func (e *EgressError) Error() string {
+	return "marionette: egress denied: " + e.Addr + ": " + e.Reason
+}
+
+// EgressPolicy restricts the destinations a ServerProxy connects to and the
+// number of connections each client can have open.
+//
+// A destination is denied if it matches any deny rule. If allow rules are
+// set then it must also match one of them. Hostnames are resolved before
+// dialing and every resolved address is checked so a hostname cannot be used
+// to reach a denied address.
+type EgressPolicy struct {
+	mu    sync.Mutex
+	conns map[string]int
+
+	// Networks which destination addresses must or must not be in.
+	AllowNets []*net.IPNet
+	DenyNets  []*net.IPNet
+
+	// Hostnames which destinations must or must not match. A leading "*."
+	// matches the domain and any of its subdomains.
+	AllowHosts []string
+	DenyHosts  []string
+
+	// Destination ports which are allowed. All ports are allowed if empty.
+	AllowPorts []int
+
+	// If true, loopback, private, link-local & unspecified addresses are
+	// allowed. Otherwise they are denied unless listed in AllowNets.
+	AllowPrivate bool
+
+	// Maximum number of concurrent connections per client. Unlimited if zero.
+	MaxConnsPerClient int
+
+	// Resolver used to look up hostnames.
+	Resolver *net.Resolver
+}
+
+// NewEgressPolicy returns a new instance of EgressPolicy.
+func NewEgressPolicy() *EgressPolicy {
+	return &EgressPolicy{
+		conns:    make(map[string]int),
+		Resolver: net.DefaultResolver,
+	}
+}
+
+// DialContext connects to addr if the policy allows it. Hostnames are
+// resolved and only allowed addresses are dialed. Returns an *EgressError if
+// the destination is denied.
+func (p *EgressPolicy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	} else if err := p.checkPort(port); err != nil {
+		return nil, p.deny(ctx, addr, err)
+	}
+
+	// Check the host name & resolve it to addresses.
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if err := p.checkHost(host); err != nil {
+		return nil, p.deny(ctx, addr, err)
+	} else if a, err := p.Resolver.LookupIPAddr(ctx, host); err != nil {
+		return nil, err
+	} else {
+		for _, ipAddr := range a {
+			ips = append(ips, ipAddr.IP)
+		}
+	}
+
+	// Dial allowed addresses in order until one connects.
+	var dialer net.Dialer
+	err = &EgressError{Reason: EgressReasonNoAddr}
+	for _, ip := range ips {
+		ipAddr := net.JoinHostPort(ip.String(), port)
+		if e := p.checkIP(ip); e != nil {
+			err = e
+			continue
+		}
+
+		conn, e := dialer.DialContext(ctx, network, ipAddr)
+		if e == nil {
+			return conn, nil
+		}
+		err = e
+	}
+
+	if e, ok := err.(*EgressError); ok {
+		return nil, p.deny(ctx, addr, e)
+	}
+	return nil, err
+}
+
+// Allow implements socks5.RuleSet. It checks the requested host name & port.
+// Addresses are checked when dialing as requests are resolved after rules
+// are evaluated.
+func (p *EgressPolicy) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		return ctx, false
+	}
+
+	if req.RemoteAddr != nil {
+		ctx = withEgressClient(ctx, req.RemoteAddr.IP.String())
+	}
+
+	addr := req.DestAddr.Address()
+	if err := p.checkPort(strconv.Itoa(req.DestAddr.Port)); err != nil {
+		p.deny(ctx, addr, err)
+		return ctx, false
+	} else if req.DestAddr.FQDN != "" {
+		if err := p.checkHost(req.DestAddr.FQDN); err != nil {
+			p.deny(ctx, addr, err)
+			return ctx, false
+		}
+	}
+	return ctx, true
+}
+
+// acquire reserves a connection for a client. Returns an *EgressError if the
+// client has reached its connection limit. Each successful call must be
+// followed by a call to release().
+func (p *EgressPolicy) acquire(ctx context.Context, client string) error {
+	if p.MaxConnsPerClient <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[client] >= p.MaxConnsPerClient {
+		return p.deny(ctx, "", &EgressError{Reason: EgressReasonConns})
+	}
+	p.conns[client]++
+	return nil
+}
+
+// release frees a connection reserved by acquire().
+func (p *EgressPolicy) release(client string) {
+	if p.MaxConnsPerClient <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[client]--; p.conns[client] <= 0 {
+		delete(p.conns, client)
+	}
+}
+
+// ClientConns returns the number of connections open for a client.
+func (p *EgressPolicy) ClientConns(client string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns[client]
+}
+
+func (p *EgressPolicy) checkPort(port string) *EgressError {
+	if len(p.AllowPorts) == 0 {
+		return nil
+	}
+	n, _ := strconv.Atoi(port)
+	for _, allowed := range p.AllowPorts {
+		if n == allowed {
+			return nil
+		}
+	}
+	return &EgressError{Reason: EgressReasonPort}
+}
+
+func (p *EgressPolicy) checkHost(host string) *EgressError {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchHost(p.DenyHosts, host) {
+		return &EgressError{Reason: EgressReasonHost}
+	} else if len(p.AllowHosts) > 0 && !matchHost(p.AllowHosts, host) {
+		return &EgressError{Reason: EgressReasonHost}
+	}
+	return nil
+}
+
+func (p *EgressPolicy) checkIP(ip net.IP) *EgressError {
+	if matchNet(p.DenyNets, ip) {
+		return &EgressError{Reason: EgressReasonAddr}
+	}
+
+	// Listed networks take precedence over the private address check.
+	allowed := matchNet(p.AllowNets, ip)
+	if len(p.AllowNets) > 0 && !allowed {
+		return &EgressError{Reason: EgressReasonAddr}
+	} else if !allowed && !p.AllowPrivate && isPrivateIP(ip) {
+		return &EgressError{Reason: EgressReasonPrivate}
+	}
+	return nil
+}
+
+// deny logs a denied destination and returns err with the address set.
+func (p *EgressPolicy) deny(ctx context.Context, addr string, err *EgressError) *EgressError {
+	client, _ := ctx.Value(egressClientKey{}).(string)
+	err.Addr = addr
+	Logger.Info("egress denied",
+		zap.String("client", client),
+		zap.String("destination", addr),
+		zap.String("reason", err.Reason))
+	return err
+}
+
+// matchHost returns true if host matches any of the patterns.
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if domain := pattern[2:]; host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// matchNet returns true if ip is in any of the networks.
+func matchNet(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateNets are the ranges denied unless private addresses are allowed.
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// isPrivateIP returns true for loopback, private, link-local & unspecified addresses.
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return matchNet(privateNets, ip)
+}
+
+func mustParseCIDRs(a ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(a))
+	for i, s := range a {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// egressClientKey is the context key for the client address in log entries.
+type egressClientKey struct{}
+
+func withEgressClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, egressClientKey{}, client)
+}
@@ -0,0 +1,145 @@
+package marionette_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/armon/go-socks5"
+	"github.com/redjack/marionette"
+)
+
+func TestEgressPolicy_DialContext(t *testing.T) {
+	ln := MustOpenEchoListener(t)
+	defer ln.Close()
+	addr := ln.Addr().String()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	t.Run("AllowPrivate", func(t *testing.T) {
+		policy := marionette.NewEgressPolicy()
+		policy.AllowPrivate = true
+		conn, err := policy.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+
+	t.Run("AllowNets", func(t *testing.T) {
+		policy := marionette.NewEgressPolicy()
+		policy.AllowNets = []*net.IPNet{MustParseCIDR(t, "127.0.0.0/8")}
+		conn, err := policy.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+
+	t.Run("ErrPrivate", func(t *testing.T) {
+		policy := marionette.NewEgressPolicy()
+		MustDenyEgress(t, policy, addr, marionette.EgressReasonPrivate)
+		MustDenyEgress(t, policy, "[::1]:80", marionette.EgressReasonPrivate)
+		MustDenyEgress(t, policy, "192.168.1.1:80", marionette.EgressReasonPrivate)
+	})
+
+	t.Run("ErrDenyNets", func(t *testing.T) {
+		policy := marionette.NewEgressPolicy()
+		policy.AllowPrivate = true
+		policy.DenyNets = []*net.IPNet{MustParseCIDR(t, "127.0.0.1/32")}
+		MustDenyEgress(t, policy, addr, marionette.EgressReasonAddr)
+	})
+
+	t.Run("ErrAllowNets", func(t *testing.T) {
+		policy := marionette.NewEgressPolicy()
+		policy.AllowPrivate = true
+		policy.AllowNets = []*net.IPNet{MustParseCIDR(t, "10.0.0.0/8")}
+		MustDenyEgress(t, policy, addr, marionette.EgressReasonAddr)
+	})
+
+	t.Run("ErrPort", func(t *testing.T) {
+		policy := marionette.NewEgressPolicy()
+		policy.AllowPrivate = true
+		policy.AllowPorts = []int{80, 443}
+		MustDenyEgress(t, policy, addr, marionette.EgressReasonPort)
+
+		policy.AllowPorts = append(policy.AllowPorts, port)
+		conn, err := policy.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+
+	t.Run("ErrHost", func(t *testing.T) {
+		policy := marionette.NewEgressPolicy()
+		policy.AllowPrivate = true
+		policy.DenyHosts = []string{"LOCALHOST"}
+		MustDenyEgress(t, policy, net.JoinHostPort("localhost", strconv.Itoa(port)), marionette.EgressReasonHost)
+
+		policy.DenyHosts = nil
+		policy.AllowHosts = []string{"*.example.com"}
+		MustDenyEgress(t, policy, net.JoinHostPort("localhost", strconv.Itoa(port)), marionette.EgressReasonHost)
+	})
+
+	// Hostnames cannot be used to reach denied addresses.
+	t.Run("ErrResolvedPrivate", func(t *testing.T) {
+		policy := marionette.NewEgressPolicy()
+		policy.AllowHosts = []string{"localhost"}
+		_, err := policy.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		if e, ok := err.(*marionette.EgressError); !ok || e.Reason != marionette.EgressReasonPrivate {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestEgressPolicy_Allow(t *testing.T) {
+	policy := marionette.NewEgressPolicy()
+	policy.AllowHosts = []string{"*.example.com"}
+	policy.AllowPorts = []int{443}
+
+	for _, tt := range []struct {
+		name    string
+		command uint8
+		fqdn    string
+		port    int
+		allow   bool
+	}{
+		{name: "Subdomain", command: socks5.ConnectCommand, fqdn: "www.example.com", port: 443, allow: true},
+		{name: "Domain", command: socks5.ConnectCommand, fqdn: "example.com", port: 443, allow: true},
+		{name: "OtherDomain", command: socks5.ConnectCommand, fqdn: "badexample.com", port: 443},
+		{name: "Port", command: socks5.ConnectCommand, fqdn: "www.example.com", port: 80},
+		{name: "Bind", command: socks5.BindCommand, fqdn: "www.example.com", port: 443},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &socks5.Request{Command: tt.command, DestAddr: &socks5.AddrSpec{FQDN: tt.fqdn, Port: tt.port}}
+			if _, allow := policy.Allow(context.Background(), req); allow != tt.allow {
+				t.Fatalf("unexpected result: %v", allow)
+			}
+		})
+	}
+}
+
+// MustDenyEgress fails unless dialing addr is denied for reason.
+func MustDenyEgress(tb testing.TB, policy *marionette.EgressPolicy, addr, reason string) {
+	tb.Helper()
+
+	conn, err := policy.DialContext(context.Background(), "tcp", addr)
+	if err == nil {
+		conn.Close()
+		tb.Fatalf("expected %s to be denied", addr)
+	} else if e, ok := err.(*marionette.EgressError); !ok || e.Reason != reason || e.Addr != addr {
+		tb.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// MustParseCIDR parses a network.
+func MustParseCIDR(tb testing.TB, s string) *net.IPNet {
+	tb.Helper()
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
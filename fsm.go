@@ -2,6 +2,7 @@ package marionette
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/redjack/marionette/fte"
 	"github.com/redjack/marionette/mar"
@@ -70,6 +72,22 @@ type FSM interface {
 	// Returns the stream set attached to the FSM.
 	StreamSet() *StreamSet
 
+	// Returns the clock used for sleeps & timeouts.
+	Clock() Clock
+
+	// Returns the document being executed.
+	Document() *mar.Document
+
+	// Returns the PRNG used by plugins for random values, such as sleep
+	// durations. It is seeded with the instance id.
+	Rand() *rand.Rand
+
+	// Returns the next cell to send or processes a received cell.
+	// Negotiation cells are handled by the FSM and all other cells are
+	// passed through to the stream set.
+	Dequeue(n int) *Cell
+	Enqueue(cell *Cell) error
+
 	// Sets and retrieves key/values from the FSM.
 	SetVar(key string, value interface{})
 	Var(key string) interface{}
@@ -90,8 +108,34 @@ type fsm struct {
 	party    string
 	fteCache *fte.Cache
 
+	// Session key negotiation. Nil if negotiation is disabled.
+	handshake    *handshake
+	sessionCache *fte.Cache
+
+	// Client session shared by multiple connections. Clients send the
+	// session id before any stream data. Servers join the session's stream
+	// set from the registry when the id is received.
+	sessions       *sessionRegistry
+	sessionID      uint64
+	sessionPending bool // client has not sent the session id yet
+	sessionJoined  bool // server has joined a session
+
+	// Set once the first non-negotiation cell is received from the peer.
+	established   bool
+	onEstablished func()
+
+	// Records connection events, if set. During a replay, cells are
+	// dequeued from the trace instead of the stream set.
+	tracer *Tracer
+	replay *replayDequeuer
+
+	// Used by plugins for sleeps & timeouts.
+	clock Clock
+
 	conn       *BufferedConn
 	streamSet  *StreamSet
+	reliable   *ReliableLayer // nil unless the transport is unreliable
+	acks       ackState       // acknowledgement of stream cells, if reliable is nil
 	listeners  map[int]net.Listener
 	closeFuncs []func() error
 
@@ -99,6 +143,10 @@ type fsm struct {
 	stepN int
 	rand  *rand.Rand
 
+	// PRNG for plugins. It is separate from the transition PRNG so that
+	// actions run by only one party do not change the transitions chosen.
+	pluginRand *rand.Rand
+
 	mu     sync.Mutex
 	closed bool
 	ctx    context.Context
@@ -114,21 +162,37 @@ type fsm struct {
 }
 
 // NewFSM returns a new FSM. If party is the first sender then the instance id is set.
-func NewFSM(doc *mar.Document, host, party string, conn net.Conn, streamSet *StreamSet) FSM {
+// FTE ciphers are created with key. If key is nil then the default FTE key is used.
+func NewFSM(doc *mar.Document, host, party string, conn net.Conn, streamSet *StreamSet, key []byte) FSM {
+	return newFSM(doc, host, party, conn, streamSet, key, 0, nil)
+}
+
+// newFSM returns a new FSM. If party is the first sender then the instance
+// id is set to instanceID, or a random id if zero. Events are recorded to
+// tracer, if set.
+func newFSM(doc *mar.Document, host, party string, conn net.Conn, streamSet *StreamSet, key []byte, instanceID int, tracer *Tracer) *fsm {
 	fsm := &fsm{
 		state:     "start",
 		vars:      make(map[string]interface{}),
 		doc:       doc,
 		host:      host,
 		party:     party,
-		fteCache:  fte.NewCache(),
-		conn:      NewBufferedConn(conn, MaxCellLength),
+		fteCache:  fte.NewCache(key),
+		tracer:    tracer,
+		clock:     DefaultClock,
 		streamSet: streamSet,
 		listeners: make(map[int]net.Listener),
 	}
+	if doc.Transport == "udp" {
+		fsm.reliable = NewReliableLayer(streamSet)
+	}
 	fsm.ctx, fsm.cancel = context.WithCancel(context.TODO())
 	fsm.buildTransitions()
-	fsm.initFirstSender()
+	fsm.initFirstSender(instanceID)
+
+	// Start reading once the trace has been opened.
+	tracer.open(fsm)
+	fsm.conn = newBufferedConn(conn, MaxCellLength, tracer)
 	return fsm
 }
 
@@ -139,12 +203,20 @@ func (fsm *fsm) buildTransitions() {
 	}
 }
 
-func (fsm *fsm) initFirstSender() {
+func (fsm *fsm) initFirstSender(instanceID int) {
 	if fsm.party != fsm.doc.FirstSender() {
 		return
+	} else if instanceID == 0 {
+		instanceID = int(rand.Int31())
 	}
-	fsm.instanceID = int(rand.Int31())
+	fsm.instanceID = instanceID
+	fsm.seed()
+}
+
+// seed initializes the PRNGs from the instance id.
+func (fsm *fsm) seed() {
 	fsm.rand = rand.New(rand.NewSource(int64(fsm.instanceID)))
+	fsm.pluginRand = rand.New(rand.NewSource(int64(fsm.instanceID)))
 }
 
 func (fsm *fsm) Close() error {
@@ -152,6 +224,7 @@ func (fsm *fsm) Close() error {
 	defer fsm.mu.Unlock()
 	fsm.closed = true
 	fsm.cancel()
+	fsm.tracer.Close()
 	return fsm.Conn().Close()
 }
 
@@ -191,6 +264,194 @@ func (fsm *fsm) Conn() *BufferedConn { return fsm.conn }
 // StreamSet returns the stream set the FSM was initialized with.
 func (fsm *fsm) StreamSet() *StreamSet { return fsm.streamSet }
 
+// Clock returns the clock used for sleeps & timeouts.
+func (fsm *fsm) Clock() Clock { return fsm.clock }
+
+// Document returns the document being executed.
+func (fsm *fsm) Document() *mar.Document { return fsm.doc }
+
+// Rand returns the PRNG used by plugins. Returns an unseeded PRNG if the
+// instance id has not been received from the peer yet.
+func (fsm *fsm) Rand() *rand.Rand {
+	if fsm.pluginRand == nil {
+		return Rand()
+	}
+	return fsm.pluginRand
+}
+
+// setClock sets the clock used by plugins & the reliable layer, if any.
+func (fsm *fsm) setClock(clock Clock) {
+	fsm.clock = clock
+	if fsm.reliable != nil {
+		fsm.reliable.Clock = clock
+	}
+}
+
+// Dequeue returns the next cell to send that fits within n bytes. Returns
+// the pending negotiation cell, if any. Stream data is not returned until
+// the session key has been negotiated. Stream cells are passed through the
+// reliability layer for unreliable transports.
+func (fsm *fsm) Dequeue(n int) *Cell {
+	i := fsm.tracer.nextDequeue()
+
+	var cell *Cell
+	if fsm.replay != nil {
+		cell = fsm.replay.dequeue(i)
+	} else {
+		cell = fsm.dequeue(n)
+	}
+
+	if cell != nil {
+		fsm.tracer.dequeue(i, cell)
+	}
+	return cell
+}
+
+func (fsm *fsm) dequeue(n int) *Cell {
+	if fsm.handshake != nil {
+		if cell, ok := fsm.handshake.Dequeue(n); ok {
+			return cell
+		}
+	}
+	if fsm.sessionPending {
+		return fsm.dequeueSession(n)
+	}
+	if fsm.reliable != nil {
+		return fsm.reliable.Dequeue(n)
+	}
+
+	// Acknowledge received cells periodically even if data is waiting.
+	if fsm.acks.ackDue() {
+		if cell := fsm.acks.dequeueAck(n); cell != nil {
+			return cell
+		}
+	}
+
+	// Track stream cells until the peer acknowledges them. Acknowledgements
+	// are sent in place of empty cells when there is no data to send.
+	cell := fsm.streamSet.Dequeue(n)
+	if cell == nil {
+		return fsm.acks.dequeueAck(n)
+	} else if cell.StreamID != 0 {
+		fsm.acks.sent(cell)
+	}
+	return cell
+}
+
+// Enqueue processes a cell received from the remote side.
+func (fsm *fsm) Enqueue(cell *Cell) error {
+	fsm.tracer.enqueue(cell)
+
+	if fsm.party == PartyClient && fsm.reliable != nil {
+		fsm.sessionPending = false
+	}
+
+	if cell.Type == NEGOTIATE {
+		if fsm.handshake == nil {
+			return ErrUnexpectedNegotiateCell
+		}
+		return fsm.handshake.Enqueue(cell)
+	}
+
+	// Reject session & stream data until the session key is in use.
+	if fsm.handshake != nil && (cell.StreamID != 0 || cell.Type == SESSION) {
+		if err := fsm.handshake.AcceptData(); err != nil {
+			return err
+		}
+	}
+
+	// The covert channel is usable once a reply is accepted after negotiation.
+	if !fsm.established && (fsm.handshake == nil || fsm.handshake.AcceptData() == nil) {
+		fsm.established = true
+		if fsm.onEstablished != nil {
+			fsm.onEstablished()
+		}
+	}
+
+	if cell.Type == SESSION {
+		fsm.acks.received(cell)
+		return fsm.joinSession(cell)
+	}
+	if fsm.reliable != nil {
+		return fsm.reliable.Enqueue(cell)
+	} else if cell.Type == CONN_ACK {
+		fsm.acks.ack(cell.SequenceID)
+		return nil
+	}
+	fsm.acks.received(cell)
+	return fsm.streamSet.Enqueue(cell)
+}
+
+// requeue returns stream cells which may not have been delivered to the
+// stream set so that they can be resent on another connection. Cells which
+// the peer has not acknowledged are assumed undelivered.
+func (fsm *fsm) requeue() {
+	var cells []*Cell
+	if fsm.reliable != nil {
+		cells = fsm.reliable.undelivered()
+	} else {
+		cells = fsm.acks.undelivered()
+	}
+	fsm.streamSet.Requeue(cells)
+}
+
+// dequeueSession returns a SESSION cell identifying the client session.
+// Stream data is not sent until the session cell has been sent. Over
+// unreliable transports, the cell is resent until the server replies.
+func (fsm *fsm) dequeueSession(n int) *Cell {
+	if n > MaxCellLength {
+		n = MaxCellLength
+	} else if n > 0 && n < CellHeaderSize+SessionIDSize {
+		return nil
+	}
+
+	cell := NewCell(0, 0, n, SESSION)
+	cell.Payload = make([]byte, SessionIDSize)
+	binary.BigEndian.PutUint64(cell.Payload, fsm.sessionID)
+
+	if fsm.reliable == nil {
+		fsm.sessionPending = false
+	}
+	return cell
+}
+
+// joinSession moves a server connection to the stream set shared by all
+// connections in the client's session. Sessions must be joined before any
+// stream data is received.
+func (fsm *fsm) joinSession(cell *Cell) error {
+	if fsm.sessions == nil || len(cell.Payload) < SessionIDSize {
+		return ErrUnexpectedSessionCell
+	}
+
+	id := binary.BigEndian.Uint64(cell.Payload)
+	if fsm.sessionJoined {
+		if id != fsm.sessionID {
+			return ErrUnexpectedSessionCell
+		}
+		return nil // resent session cell
+	} else if len(fsm.streamSet.Streams()) > 0 {
+		return ErrUnexpectedSessionCell
+	}
+
+	prev := fsm.streamSet
+	fsm.streamSet = fsm.sessions.acquire(id)
+	fsm.streamSet.setAddrs(prev.localAddr, prev.remoteAddr)
+	fsm.sessionID, fsm.sessionJoined = id, true
+	if fsm.reliable != nil {
+		fsm.reliable.setStreamSet(fsm.streamSet)
+	}
+	return prev.Close()
+}
+
+// leaveSession releases the server connection's session, if joined.
+func (fsm *fsm) leaveSession() {
+	if !fsm.sessionJoined {
+		return
+	}
+	fsm.sessions.release(fsm.sessionID)
+	fsm.sessionJoined = false
+}
+
 // Host returns the hostname the FSM was initialized with.
 func (fsm *fsm) Host() string { return fsm.host }
 
@@ -217,6 +478,17 @@ func (fsm *fsm) Dead() bool { return fsm.state == "dead" }
 
 // Execute runs the the FSM to completion.
 func (fsm *fsm) Execute(ctx context.Context) error {
+	// Cancel plugins when either ctx is done or the FSM is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-fsm.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	// If no connection is passed in, create one.
 	// This occurs when an FSM is spawned.
 	if err := fsm.ensureConn(ctx); err != nil {
@@ -224,10 +496,16 @@ func (fsm *fsm) Execute(ctx context.Context) error {
 	}
 
 	for !fsm.Dead() {
+		// Stop between transitions once the caller is shutting down.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		if err := fsm.Next(ctx); err == ErrRetryTransition {
 			fsm.Logger().Debug("retry transition", zap.String("state", fsm.State()))
 			continue
 		} else if err != nil {
+			fsm.tracer.error(err)
 			return err
 		}
 	}
@@ -242,18 +520,20 @@ func (fsm *fsm) Next(ctx context.Context) (err error) {
 
 	// If we have a successful transition, update our state info.
 	// Exit if no transitions were successful.
-	nextState, err := fsm.next(true)
+	nextState, err := fsm.next(ctx, true)
 	if err != nil {
 		return err
 	}
 
+	fsm.tracer.transition(fsm.state, nextState)
 	fsm.stepN += 1
 	fsm.state = nextState
+	fsmTransitions.WithLabelValues(fsm.party, nextState).Inc()
 
 	return nil
 }
 
-func (fsm *fsm) next(eval bool) (nextState string, err error) {
+func (fsm *fsm) next(ctx context.Context, eval bool) (nextState string, err error) {
 	// Find all possible transitions from the current state.
 	transitions := mar.FilterTransitionsBySource(fsm.doc.Transitions, fsm.state)
 	errorTransitions := mar.FilterErrorTransitions(transitions)
@@ -282,7 +562,7 @@ func (fsm *fsm) next(eval bool) (nextState string, err error) {
 
 		// Attempt to execute each action.
 		if eval {
-			if err := fsm.evalActions(actions); err != nil {
+			if err := fsm.evalActions(ctx, actions); err != nil {
 				return "", err
 			}
 		}
@@ -297,13 +577,13 @@ func (fsm *fsm) init() (err error) {
 		return nil
 	}
 
-	// Create new PRNG.
-	fsm.rand = rand.New(rand.NewSource(int64(fsm.instanceID)))
+	// Create new PRNGs.
+	fsm.seed()
 
 	// Restart FSM from the beginning and iterate until the current step.
 	fsm.state = "start"
 	for i := 0; i < fsm.stepN; i++ {
-		fsm.state, err = fsm.next(false)
+		fsm.state, err = fsm.next(context.Background(), false)
 		if err != nil {
 			return err
 		}
@@ -312,7 +592,7 @@ func (fsm *fsm) init() (err error) {
 	return nil
 }
 
-func (fsm *fsm) evalActions(actions []*mar.Action) error {
+func (fsm *fsm) evalActions(ctx context.Context, actions []*mar.Action) error {
 	if len(actions) == 0 {
 		return nil
 	}
@@ -338,10 +618,14 @@ func (fsm *fsm) evalActions(actions []*mar.Action) error {
 		fn := FindPlugin(action.Module, action.Method)
 		if fn == nil {
 			return fmt.Errorf("plugin not found: %s", action.Name())
-		} else if err := fn(fsm.ctx, fsm, action.ArgValues()...); err != nil {
-			return err
 		}
-		return nil
+
+		fsm.tracer.action(fsm.state, action.Name(), action.ArgValues())
+
+		t0 := time.Now()
+		err := fn(ctx, fsm, action.ArgValues()...)
+		actionDuration.WithLabelValues(action.Name()).Observe(time.Since(t0).Seconds())
+		return err
 	}
 
 	return ErrNoTransitions
@@ -366,8 +650,32 @@ func (fsm *fsm) SetVar(key string, value interface{}) {
 
 // Cipher returns a cipher with the given settings.
 // If no cipher exists then a new one is created and returned.
+//
+// If a session key is being negotiated then the returned cipher switches from
+// the static key to the session key as negotiation progresses.
 func (fsm *fsm) Cipher(regex string, n int) (Cipher, error) {
-	return fsm.fteCache.Cipher(regex, n)
+	static, err := fsm.fteCache.Cipher(regex, n)
+	if err != nil || fsm.handshake == nil {
+		return static, err
+	}
+
+	// Use static key until the session key is known.
+	key := fsm.handshake.Key()
+	if key == nil {
+		return &negotiatedCipher{h: fsm.handshake, static: static}, nil
+	}
+
+	// Rekey cache once negotiation produces a session key.
+	if fsm.sessionCache == nil {
+		fsm.sessionCache = fsm.fteCache.WithKey(key)
+	}
+	session, err := fsm.sessionCache.Cipher(regex, n)
+	if err != nil {
+		return nil, err
+	} else if fsm.handshake.Complete() {
+		return session, nil
+	}
+	return &negotiatedCipher{h: fsm.handshake, static: static, session: session}, nil
 }
 
 // DFA returns a DFA with the given settings.
@@ -376,21 +684,22 @@ func (fsm *fsm) DFA(regex string, n int) (DFA, error) {
 	return fsm.fteCache.DFA(regex, n)
 }
 
-func (fsm *fsm) Listen() (port int, err error) {
-	addr := fsm.host
+func (fsm *fsm) Listen() (int, error) {
+	// Bind to a random port unless overridden by the environment.
+	port := "0"
 	if s := os.Getenv("MARIONETTE_CHANNEL_BIND_PORT"); s != "" {
-		addr = net.JoinHostPort(addr, s)
+		port = s
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := net.Listen("tcp", net.JoinHostPort(fsm.host, port))
 	if err != nil {
 		return 0, err
 	}
-	port = ln.Addr().(*net.TCPAddr).Port
-	fsm.listeners[port] = ln
+	n := ln.Addr().(*net.TCPAddr).Port
+	fsm.listeners[n] = ln
 	fsm.closeFuncs = append(fsm.closeFuncs, ln.Close)
 
-	return port, nil
+	return n, nil
 }
 
 func (fsm *fsm) ensureConn(ctx context.Context) error {
@@ -404,12 +713,13 @@ func (fsm *fsm) ensureConn(ctx context.Context) error {
 }
 
 func (fsm *fsm) ensureClientConn(ctx context.Context) error {
-	conn, err := net.Dial(fsm.doc.Transport, net.JoinHostPort(fsm.host, strconv.Itoa(fsm.Port())))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, fsm.doc.Transport, net.JoinHostPort(fsm.host, strconv.Itoa(fsm.Port())))
 	if err != nil {
 		return err
 	}
 
-	fsm.conn = NewBufferedConn(conn, MaxCellLength)
+	fsm.conn = newBufferedConn(conn, MaxCellLength, fsm.tracer)
 	fsm.closeFuncs = append(fsm.closeFuncs, conn.Close)
 
 	return nil
@@ -418,23 +728,43 @@ func (fsm *fsm) ensureClientConn(ctx context.Context) error {
 func (fsm *fsm) ensureServerConn(ctx context.Context) (err error) {
 	ln := fsm.listeners[fsm.Port()]
 	if ln == nil {
-		if ln, err = net.Listen("tcp", net.JoinHostPort(fsm.host, strconv.Itoa(fsm.Port()))); err != nil {
+		if ln, err = listen(fsm.doc.Transport, net.JoinHostPort(fsm.host, strconv.Itoa(fsm.Port()))); err != nil {
 			return err
 		}
 		fsm.listeners[fsm.Port()] = ln
 	}
 
-	conn, err := ln.Accept()
+	conn, err := acceptContext(ctx, ln)
 	if err != nil {
 		return err
 	}
 
-	fsm.conn = NewBufferedConn(conn, MaxCellLength)
+	fsm.conn = newBufferedConn(conn, MaxCellLength, fsm.tracer)
 	fsm.closeFuncs = append(fsm.closeFuncs, conn.Close)
 
 	return nil
 }
 
+// acceptContext accepts a connection from ln. The listener is closed to
+// interrupt the accept if ctx is done first.
+func acceptContext(ctx context.Context, ln net.Listener) (net.Conn, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-done:
+		}
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return conn, err
+}
+
 func (f *fsm) Clone(doc *mar.Document) FSM {
 	other := &fsm{
 		state:     "start",
@@ -443,12 +773,16 @@ func (f *fsm) Clone(doc *mar.Document) FSM {
 		host:      f.host,
 		party:     f.party,
 		fteCache:  f.fteCache,
+		handshake: f.handshake.clone(),
+		clock:     f.clock,
 		streamSet: f.streamSet,
+		reliable:  f.reliable,
 		listeners: f.listeners,
 	}
 
+	other.ctx, other.cancel = context.WithCancel(context.TODO())
 	other.buildTransitions()
-	other.initFirstSender()
+	other.initFirstSender(0)
 
 	other.vars = make(map[string]interface{})
 	for k, v := range f.vars {
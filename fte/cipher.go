@@ -13,17 +13,18 @@ var (
 )
 
 type Cipher struct {
-	dfa *DFA
-	enc *Encrypter
-	dec *Decrypter
+	dfa       *DFA
+	enc       *Encrypter
+	dec       *Decrypter
+	sharedDFA bool // if true, dfa is not closed by the cipher
 }
 
-// NewCipher returns a new instance of Cipher.
-func NewCipher(regex string, n int) (_ *Cipher, err error) {
+// NewCipher returns a new instance of Cipher using key material of KeySize bytes.
+func NewCipher(regex string, n int, key []byte) (_ *Cipher, err error) {
 	var c Cipher
-	if c.enc, err = NewEncrypter(); err != nil {
+	if c.enc, err = NewEncrypter(key); err != nil {
 		return nil, err
-	} else if c.dec, err = NewDecrypter(); err != nil {
+	} else if c.dec, err = NewDecrypter(key); err != nil {
 		return nil, err
 	} else if c.dfa, err = NewDFA(regex, n); err != nil {
 		return nil, err
@@ -31,12 +32,25 @@ func NewCipher(regex string, n int) (_ *Cipher, err error) {
 	return &c, nil
 }
 
+// NewCipherWithDFA returns a new instance of Cipher that encodes using an
+// existing DFA. The DFA is not closed when the cipher is closed.
+func NewCipherWithDFA(dfa *DFA, key []byte) (_ *Cipher, err error) {
+	c := Cipher{dfa: dfa, sharedDFA: true}
+	if c.enc, err = NewEncrypter(key); err != nil {
+		return nil, err
+	} else if c.dec, err = NewDecrypter(key); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 func (c *Cipher) Close() error {
-	if c.dfa != nil {
+	if c.dfa != nil && !c.sharedDFA {
 		err := c.dfa.Close()
 		c.dfa = nil
 		return err
 	}
+	c.dfa = nil
 	return nil
 }
 
@@ -108,6 +122,7 @@ func (c *Cipher) Encrypt(plaintext []byte) (ciphertext []byte, err error) {
 
 // Decrypt decrypts ciphertext into plaintext.
 // Returns ErrShortCiphertext if the ciphertext is too short to be decrypted.
+// Returns ErrHMACVerificationFailed if the ciphertext was encrypted with a different key.
 func (c *Cipher) Decrypt(ciphertext []byte) (plaintext, remainder []byte, err error) {
 	if len(ciphertext) < c.dfa.N() {
 		return nil, nil, ErrShortCiphertext
@@ -128,9 +143,17 @@ func (c *Cipher) Decrypt(ciphertext []byte) (plaintext, remainder []byte, err er
 	c.dec.block.Decrypt(msg_len_header, X[:16])
 	msg_len := binary.BigEndian.Uint64(msg_len_header[8:16])
 
+	// A header decrypted with a different key will have a garbage length.
+	if msg_len > uint64(len(X)-16) {
+		return nil, nil, ErrHMACVerificationFailed
+	}
+
 	retval := X[16 : 16+msg_len]
 	retval = append(retval, ciphertext[c.dfa.N():]...)
-	ctxt_len := c.dec.CiphertextLen(retval)
+	ctxt_len, err := c.dec.CiphertextLen(retval)
+	if err != nil {
+		return nil, nil, err
+	}
 	var remaining_buffer []byte
 	if len(retval) > ctxt_len {
 		remaining_buffer = retval[ctxt_len:]
@@ -24,7 +24,7 @@ func TestCipher_Python(t *testing.T) {
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			// Create Go cipher.
-			cipher, err := fte.NewCipher(tt.regex)
+			cipher, err := fte.NewCipher(tt.regex, 512, fte.DefaultKey)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -80,7 +80,7 @@ func TestCipher_Quick_Python(t *testing.T) {
 				}
 
 				// Create Go cipher.
-				cipher, err := fte.NewCipher(tt.regex)
+				cipher, err := fte.NewCipher(tt.regex, 512, fte.DefaultKey)
 				if err != nil {
 					t.Fatal(err)
 				}
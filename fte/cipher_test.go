@@ -7,7 +7,7 @@ import (
 )
 
 func TestCipher(t *testing.T) {
-	cipher, err := fte.NewCipher(`^(a|b|c)+$`, 512)
+	cipher, err := fte.NewCipher(`^(a|b|c)+$`, 512, fte.DefaultKey)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -39,3 +39,23 @@ func TestCipher(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCipher_KeyMismatch(t *testing.T) {
+	enc, err := fte.NewCipher(`^(a|b|c)+$`, 512, fte.NewKey([]byte("foo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	dec, err := fte.NewCipher(`^(a|b|c)+$`, 512, fte.NewKey([]byte("bar")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+
+	if ciphertext, err := enc.Encrypt([]byte(`test`)); err != nil {
+		t.Fatal(err)
+	} else if _, _, err := dec.Decrypt(ciphertext); err != fte.ErrHMACVerificationFailed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
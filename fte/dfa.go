@@ -1,3 +1,5 @@
+// +build !purego
+
 package fte
 
 // #cgo CXXFLAGS: -std=c++11
@@ -12,7 +14,6 @@ package fte
 import "C"
 
 import (
-	"errors"
 	"fmt"
 	"math/big"
 	"sync"
@@ -21,9 +22,8 @@ import (
 	"github.com/redjack/marionette/regex2dfa"
 )
 
-var (
-	ErrLanguageIsEmptySet = errors.New("fte: language is empty set")
-)
+// dfaImpl identifies the DFA implementation in persisted DFA tables.
+const dfaImpl = "cgo"
 
 type DFA struct {
 	mu       sync.RWMutex
@@ -31,6 +31,7 @@ type DFA struct {
 	capacity int
 
 	regex string
+	tbl   string
 	n     int
 }
 
@@ -39,12 +40,16 @@ func NewDFA(regex string, n int) (*DFA, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewDFAFromTable(regex, tbl, n)
+}
 
+// NewDFAFromTable returns a DFA using a table previously generated for regex.
+func NewDFAFromTable(regex, tbl string, n int) (*DFA, error) {
 	ctbl := C.CString(tbl)
 	defer C.free(unsafe.Pointer(ctbl))
 
 	ptr := C._dfa_new(ctbl, C.uint32_t(n))
-	dfa := &DFA{ptr: ptr, regex: regex, n: n}
+	dfa := &DFA{ptr: ptr, regex: regex, tbl: tbl, n: n}
 
 	// Calculate capacity.
 	if err := dfa.calculateCapacity(); err != nil {
@@ -66,6 +71,9 @@ func (dfa *DFA) Close() error {
 // Regex returns the regex passed into the DFA.
 func (dfa *DFA) Regex() string { return dfa.regex }
 
+// Table returns the DFA table generated from the regex.
+func (dfa *DFA) Table() string { return dfa.tbl }
+
 // N returns the n passed into the DFA.
 func (dfa *DFA) N() int { return dfa.n }
 
@@ -149,16 +157,3 @@ func (dfa *DFA) NumWordsInLanguage(min, max int) (*big.Int, error) {
 	}
 	return &rank, nil
 }
-
-// Log2 returns floor(log2(v)).
-func Log2(v *big.Int) int {
-	for i := 1; ; i++ {
-		var exp big.Int
-		exp.Exp(big.NewInt(2), big.NewInt(int64(i)), nil)
-		if cmp := exp.Cmp(v); cmp == 0 {
-			return i
-		} else if cmp == 1 {
-			return i - 1
-		}
-	}
-}
@@ -0,0 +1,105 @@
+// +build purego
+
+package fte
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/redjack/marionette/regex2dfa"
+)
+
+// DFA ranks & unranks strings of a fixed length in a regular language.
+//
+// This implementation is used when built with the "purego" tag and does not
+// require cgo, GMP, RE2, or OpenFST.
+type DFA struct {
+	mu       sync.RWMutex
+	ranker   *Ranker
+	capacity int
+
+	regex string
+	tbl   string
+	n     int
+}
+
+// dfaImpl identifies the DFA implementation in persisted DFA tables.
+const dfaImpl = "purego"
+
+func NewDFA(regex string, n int) (*DFA, error) {
+	tbl, err := regex2dfa.Regex2DFA(regex)
+	if err != nil {
+		return nil, err
+	}
+	return NewDFAFromTable(regex, tbl, n)
+}
+
+// NewDFAFromTable returns a DFA using a table previously generated for regex.
+func NewDFAFromTable(regex, tbl string, n int) (*DFA, error) {
+	ranker, err := NewRanker(tbl, n)
+	if err != nil {
+		return nil, err
+	}
+	dfa := &DFA{ranker: ranker, regex: regex, tbl: tbl, n: n}
+
+	// Calculate capacity.
+	if err := dfa.calculateCapacity(); err != nil {
+		dfa.Close()
+		return nil, err
+	}
+
+	return dfa, nil
+}
+
+func (dfa *DFA) Close() error {
+	dfa.ranker = nil
+	return nil
+}
+
+// Regex returns the regex passed into the DFA.
+func (dfa *DFA) Regex() string { return dfa.regex }
+
+// Table returns the DFA table generated from the regex.
+func (dfa *DFA) Table() string { return dfa.tbl }
+
+// N returns the n passed into the DFA.
+func (dfa *DFA) N() int { return dfa.n }
+
+// Capacity returns the capacity of the encoder.
+func (dfa *DFA) Capacity() int {
+	return dfa.capacity
+}
+
+func (dfa *DFA) calculateCapacity() error {
+	wordsInSlice, err := dfa.NumWordsInLanguage(dfa.n, dfa.n)
+	if err != nil {
+		return err
+	} else if wordsInSlice.Cmp(big.NewInt(0)) == 0 {
+		return ErrLanguageIsEmptySet
+	}
+
+	dfa.capacity = (Log2(wordsInSlice) - 1) / 8 // div by 8 to convert to bytes
+	return nil
+}
+
+// Rank maps s into an integer ranking.
+func (dfa *DFA) Rank(s string) (*big.Int, error) {
+	dfa.mu.RLock()
+	defer dfa.mu.RUnlock()
+	return dfa.ranker.Rank(s)
+}
+
+// Unrank reverses the map from an integer to a string.
+func (dfa *DFA) Unrank(rank *big.Int) (string, error) {
+	dfa.mu.RLock()
+	defer dfa.mu.RUnlock()
+	return dfa.ranker.Unrank(rank)
+}
+
+func (dfa *DFA) NumWordsInSlice(n int) (*big.Int, error) {
+	return dfa.NumWordsInLanguage(n, n)
+}
+
+func (dfa *DFA) NumWordsInLanguage(min, max int) (*big.Int, error) {
+	return dfa.ranker.NumWordsInLanguage(min, max), nil
+}
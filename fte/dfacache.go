@@ -0,0 +1,246 @@
+package fte
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dfaFileVersion is the version of the on-disk DFA file format.
+const dfaFileVersion = 1
+
+// DefaultDFACache is the process-wide DFA cache shared by all connections.
+var DefaultDFACache = NewDFACache()
+
+// dfaCacheRequests counts DFA lookups by result ("hit" or "miss").
+var dfaCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "marionette_dfa_cache_requests_total",
+	Help: "Number of DFA cache lookups by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(dfaCacheRequests)
+}
+
+// DFACache represents a concurrency-safe cache of DFAs keyed by regex & n.
+//
+// Building a DFA from a regex is expensive so DFAs are shared between all
+// connections. If Path is set then DFA tables are also persisted to disk so
+// they can be reused by later processes.
+type DFACache struct {
+	mu   sync.Mutex
+	dfas map[cacheKey]*dfaCacheEntry
+
+	// Directory to persist DFA tables in. Disabled if blank.
+	// Must be set before the cache is used.
+	Path string
+}
+
+type dfaCacheEntry struct {
+	ready chan struct{}
+	dfa   *DFA
+	err   error
+}
+
+// NewDFACache returns a new instance of DFACache.
+func NewDFACache() *DFACache {
+	return &DFACache{
+		dfas: make(map[cacheKey]*dfaCacheEntry),
+	}
+}
+
+// Close closes and removes all DFAs.
+func (c *DFACache) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.dfas {
+		<-e.ready
+		if e.dfa == nil {
+			continue
+		} else if e2 := e.dfa.Close(); e2 != nil && err == nil {
+			err = e2
+		}
+	}
+	c.dfas = make(map[cacheKey]*dfaCacheEntry)
+
+	return err
+}
+
+// DFA returns a instance of DFA associated with regex & n.
+// Creates a new DFA if one doesn't already exist. Concurrent callers
+// requesting the same DFA wait for a single DFA to be built.
+func (c *DFACache) DFA(regex string, n int) (*DFA, error) {
+	key := cacheKey{regex, n}
+
+	c.mu.Lock()
+	if e := c.dfas[key]; e != nil {
+		c.mu.Unlock()
+		dfaCacheRequests.WithLabelValues("hit").Inc()
+		<-e.ready
+		return e.dfa, e.err
+	}
+	e := &dfaCacheEntry{ready: make(chan struct{})}
+	c.dfas[key] = e
+	c.mu.Unlock()
+	dfaCacheRequests.WithLabelValues("miss").Inc()
+
+	e.dfa, e.err = c.build(regex, n)
+	close(e.ready)
+
+	// Remove failed entries so they can be retried.
+	if e.err != nil {
+		c.mu.Lock()
+		if c.dfas[key] == e {
+			delete(c.dfas, key)
+		}
+		c.mu.Unlock()
+	}
+	return e.dfa, e.err
+}
+
+// Precompile builds the DFA for regex & n and writes it to disk, if Path is set.
+func (c *DFACache) Precompile(regex string, n int) error {
+	dfa, err := c.DFA(regex, n)
+	if err != nil {
+		return err
+	} else if c.Path == "" {
+		return nil
+	}
+
+	// Skip if an up-to-date copy has already been written.
+	if other, err := c.read(regex, n); err == nil && other != nil {
+		other.Close()
+		return nil
+	}
+	return c.write(dfa)
+}
+
+// build reads the DFA from disk, if available, or generates it from regex.
+// Newly generated DFAs are written to disk on a best effort basis.
+func (c *DFACache) build(regex string, n int) (*DFA, error) {
+	if c.Path != "" {
+		if dfa, err := c.read(regex, n); err == nil && dfa != nil {
+			return dfa, nil
+		}
+	}
+
+	dfa, err := NewDFA(regex, n)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Path != "" {
+		if err := c.write(dfa); err != nil {
+			fmt.Fprintf(stderr(), "fte: cannot write dfa cache: %s\n", err)
+		}
+	}
+	return dfa, nil
+}
+
+// read returns the DFA from disk. Returns nil if the file does not exist or
+// it is stale or corrupt.
+func (c *DFACache) read(regex string, n int) (*DFA, error) {
+	buf, err := ioutil.ReadFile(c.path(regex, n))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f dfaFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, nil
+	} else if f.Version != dfaFileVersion || f.Impl != dfaImpl || f.Regex != regex || f.N != n {
+		return nil, nil
+	} else if f.Checksum != f.checksum() {
+		return nil, nil
+	}
+
+	dfa, err := NewDFAFromTable(regex, f.Table, n)
+	if err != nil {
+		return nil, nil
+	}
+
+	// Verify the rebuilt word count table matches the original.
+	if words, err := dfa.NumWordsInSlice(n); err != nil || words.String() != f.Words {
+		dfa.Close()
+		return nil, nil
+	}
+	return dfa, nil
+}
+
+// write atomically writes the DFA table to disk.
+func (c *DFACache) write(dfa *DFA) error {
+	words, err := dfa.NumWordsInSlice(dfa.N())
+	if err != nil {
+		return err
+	}
+
+	f := dfaFile{
+		Version: dfaFileVersion,
+		Impl:    dfaImpl,
+		Regex:   dfa.Regex(),
+		N:       dfa.N(),
+		Table:   dfa.Table(),
+		Words:   words.String(),
+	}
+	f.Checksum = f.checksum()
+
+	buf, err := json.Marshal(f)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(c.Path, 0777); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.Path, ".dfa")
+	if err != nil {
+		return err
+	} else if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	} else if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(dfa.Regex(), dfa.N()))
+}
+
+// path returns the file path for a DFA. The filename is derived from the
+// implementation, regex & n so DFAs are never shared between implementations.
+func (c *DFACache) path(regex string, n int) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", dfaImpl, regex, n)
+	return filepath.Join(c.Path, hex.EncodeToString(h.Sum(nil))+".dfa")
+}
+
+// dfaFile represents the on-disk format of a DFA.
+//
+// Only the DFA table & the number of words in the language are stored. The
+// word count table used for ranking grows with the square of n so it is
+// rebuilt from the DFA table on load and verified against Words.
+type dfaFile struct {
+	Version  int    `json:"version"`
+	Impl     string `json:"impl"`
+	Regex    string `json:"regex"`
+	N        int    `json:"n"`
+	Table    string `json:"table"`
+	Words    string `json:"words"`
+	Checksum string `json:"checksum"`
+}
+
+// checksum returns a hash of the file contents used to detect corruption.
+func (f *dfaFile) checksum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%d\x00%s\x00%s", f.Version, f.Impl, f.Regex, f.N, f.Table, f.Words)
+	return hex.EncodeToString(h.Sum(nil))
+}
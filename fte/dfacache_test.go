@@ -0,0 +1,111 @@
+package fte_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/redjack/marionette/fte"
+)
+
+func TestDFACache_DFA(t *testing.T) {
+	t.Run("Shared", func(t *testing.T) {
+		c := fte.NewDFACache()
+		defer c.Close()
+
+		// Ensure concurrent callers receive the same DFA.
+		var wg sync.WaitGroup
+		dfas := make([]*fte.DFA, 4)
+		for i := range dfas {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				dfa, err := c.DFA(`[a-z]+`, 128)
+				if err != nil {
+					t.Error(err)
+				}
+				dfas[i] = dfa
+			}(i)
+		}
+		wg.Wait()
+
+		for _, dfa := range dfas[1:] {
+			if dfa != dfas[0] {
+				t.Fatal("expected shared dfa")
+			}
+		}
+	})
+
+	t.Run("Persist", func(t *testing.T) {
+		path := MustTempDir()
+		defer os.RemoveAll(path)
+
+		// Build DFA & write to disk.
+		c0 := fte.NewDFACache()
+		c0.Path = path
+		defer c0.Close()
+		dfa0, err := c0.DFA(`[a-z]+`, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filenames, err := filepath.Glob(filepath.Join(path, "*.dfa"))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(filenames) != 1 {
+			t.Fatalf("unexpected file count: %d", len(filenames))
+		}
+
+		// Read DFA from disk in a separate cache.
+		c1 := fte.NewDFACache()
+		c1.Path = path
+		defer c1.Close()
+		if dfa1, err := c1.DFA(`[a-z]+`, 128); err != nil {
+			t.Fatal(err)
+		} else if dfa1.Table() != dfa0.Table() {
+			t.Fatal("table mismatch")
+		} else if dfa1.Capacity() != dfa0.Capacity() {
+			t.Fatalf("capacity mismatch: %d != %d", dfa1.Capacity(), dfa0.Capacity())
+		}
+
+		// Corrupt file and ensure the DFA is rebuilt.
+		if err := ioutil.WriteFile(filenames[0], []byte(`{"version":1}`), 0666); err != nil {
+			t.Fatal(err)
+		}
+		c2 := fte.NewDFACache()
+		c2.Path = path
+		defer c2.Close()
+		if dfa2, err := c2.DFA(`[a-z]+`, 128); err != nil {
+			t.Fatal(err)
+		} else if dfa2.Table() != dfa0.Table() {
+			t.Fatal("table mismatch")
+		}
+	})
+}
+
+func TestDFACache_Precompile(t *testing.T) {
+	path := MustTempDir()
+	defer os.RemoveAll(path)
+
+	c := fte.NewDFACache()
+	c.Path = path
+	defer c.Close()
+	if err := c.Precompile(`[a-z]+`, 128); err != nil {
+		t.Fatal(err)
+	} else if filenames, err := filepath.Glob(filepath.Join(path, "*.dfa")); err != nil {
+		t.Fatal(err)
+	} else if len(filenames) != 1 {
+		t.Fatalf("unexpected file count: %d", len(filenames))
+	}
+}
+
+// MustTempDir returns a new temporary directory. Panic on error.
+func MustTempDir() string {
+	path, err := ioutil.TempDir("", "marionette-fte-")
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
@@ -23,24 +23,46 @@ var (
 	ErrShortCiphertext        = errors.New("fte: short ciphertext")
 	ErrInvalidMessageLength   = errors.New("fte: invalid message length")
 	ErrHMACVerificationFailed = errors.New("fte: hmac verification failed")
+	ErrInvalidKeySize         = errors.New("fte: invalid key size")
 )
 
+// K1 & K2 are the AES and HMAC keys used by the original marionette
+// implementation. They are public and should only be used for compatibility.
 var (
 	K1 = []byte("\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff")
 	K2 = []byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
 )
 
+// KeySize is the size of FTE key material, in bytes. The first half of the
+// key is used for AES encryption and the second half is used for the HMAC.
+const KeySize = 32
+
+// DefaultKey is the key material built from K1 & K2.
+var DefaultKey = append(append([]byte{}, K1...), K2...)
+
+// NewKey derives FTE key material from a shared secret.
+func NewKey(secret []byte) []byte {
+	sum := sha512.Sum512(secret)
+	return sum[:KeySize]
+}
+
 const _IV_LENGTH = 7
 
 type Encrypter struct {
 	block     cipher.Block
 	blockMode cipher.BlockMode
+	macKey    []byte
 
 	IV []byte
 }
 
-func NewEncrypter() (*Encrypter, error) {
-	blk, err := aes.NewCipher(K1)
+// NewEncrypter returns a new instance of Encrypter using key material of KeySize bytes.
+func NewEncrypter(key []byte) (*Encrypter, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKeySize
+	}
+
+	blk, err := aes.NewCipher(key[:KeySize/2])
 	if err != nil {
 		return nil, err
 	}
@@ -48,6 +70,7 @@ func NewEncrypter() (*Encrypter, error) {
 	return &Encrypter{
 		block:     blk,
 		blockMode: ecb.NewEncrypter(blk),
+		macKey:    key[KeySize/2:],
 	}, nil
 }
 
@@ -85,7 +108,7 @@ func (enc *Encrypter) Encrypt(plaintext []byte) ([]byte, error) {
 	ciphertext := append(W1[:len(W1):len(W1)], W2...)
 
 	// Sign the message & limit size to AES block size.
-	mac := hmac.New(sha512.New, K2)
+	mac := hmac.New(sha512.New, enc.macKey)
 	mac.Write(ciphertext)
 	T := mac.Sum(nil)
 	T = T[:aes.BlockSize]
@@ -96,10 +119,16 @@ func (enc *Encrypter) Encrypt(plaintext []byte) ([]byte, error) {
 type Decrypter struct {
 	block     cipher.Block
 	blockMode cipher.BlockMode
+	macKey    []byte
 }
 
-func NewDecrypter() (*Decrypter, error) {
-	blk, err := aes.NewCipher(K1)
+// NewDecrypter returns a new instance of Decrypter using key material of KeySize bytes.
+func NewDecrypter(key []byte) (*Decrypter, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKeySize
+	}
+
+	blk, err := aes.NewCipher(key[:KeySize/2])
 	if err != nil {
 		return nil, err
 	}
@@ -107,6 +136,7 @@ func NewDecrypter() (*Decrypter, error) {
 	return &Decrypter{
 		block:     blk,
 		blockMode: ecb.NewDecrypter(blk),
+		macKey:    key[KeySize/2:],
 	}, nil
 }
 
@@ -116,12 +146,9 @@ func (dec *Decrypter) Decrypt(ciphertext []byte) ([]byte, error) {
 	}
 
 	// Decrypt header.
-	L := make([]byte, 16)
-	dec.block.Decrypt(L, ciphertext[:16])
-
-	plaintext_length := binary.BigEndian.Uint64(L[8:16])
-	if plaintext_length > math.MaxUint32 {
-		return nil, ErrInvalidMessageLength
+	plaintext_length, err := dec.plaintextLen(ciphertext)
+	if err != nil {
+		return nil, err
 	}
 
 	ciphertext_length := plaintext_length + CTXT_EXPANSION
@@ -138,7 +165,7 @@ func (dec *Decrypter) Decrypt(ciphertext []byte) ([]byte, error) {
 	T_expected := ciphertext[T_start:T_end:T_end]
 
 	// Sign the message & limit size to AES block size.
-	mac := hmac.New(sha512.New, K2)
+	mac := hmac.New(sha512.New, dec.macKey)
 	mac.Write(append(W1, W2...))
 	if !hmac.Equal(mac.Sum(nil)[:aes.BlockSize], T_expected) {
 		return nil, ErrHMACVerificationFailed
@@ -158,10 +185,36 @@ func (dec *Decrypter) Decrypt(ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-func (dec *Decrypter) CiphertextLen(ciphertext []byte) int {
+// CiphertextLen returns the total length of the ciphertext encoded in the header.
+func (dec *Decrypter) CiphertextLen(ciphertext []byte) (int, error) {
+	if len(ciphertext) < 16 {
+		return 0, ErrShortCiphertext
+	}
+
+	plaintextN, err := dec.plaintextLen(ciphertext)
+	if err != nil {
+		return 0, err
+	}
+	return int(plaintextN) + CTXT_EXPANSION, nil
+}
+
+// plaintextLen decrypts the header block and returns the plaintext length.
+//
+// A header decrypted with the wrong key will not have the expected marker
+// byte so it is rejected before attempting to read the rest of the message.
+func (dec *Decrypter) plaintextLen(ciphertext []byte) (uint64, error) {
 	L := make([]byte, 16)
 	dec.block.Decrypt(L, ciphertext[:16])
-	return int(binary.BigEndian.Uint32(L[12:16])) + CTXT_EXPANSION
+
+	if L[0] != '\x01' {
+		return 0, ErrHMACVerificationFailed
+	}
+
+	plaintext_length := binary.BigEndian.Uint64(L[8:16])
+	if plaintext_length > math.MaxUint32 {
+		return 0, ErrInvalidMessageLength
+	}
+	return plaintext_length, nil
 }
 
 // u64tob returns the big endian representation of a uint64 value.
@@ -17,7 +17,7 @@ func TestEncrypter_Python(t *testing.T) {
 	}
 
 	// Create Go encrypter.
-	enc, err := fte.NewEncrypter()
+	enc, err := fte.NewEncrypter(fte.DefaultKey)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -44,8 +44,31 @@ func TestEncrypter_Quick(t *testing.T) {
 	}
 }
 
+func TestEncrypter_KeyMismatch(t *testing.T) {
+	enc, err := fte.NewEncrypter(fte.NewKey([]byte("foo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := fte.NewDecrypter(fte.NewKey([]byte("bar")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ciphertext, err := enc.Encrypt([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	} else if _, err := dec.Decrypt(ciphertext); err != fte.ErrHMACVerificationFailed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNewEncrypter_ErrInvalidKeySize(t *testing.T) {
+	if _, err := fte.NewEncrypter([]byte("foo")); err != fte.ErrInvalidKeySize {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 func MustNewEncrypter() *fte.Encrypter {
-	enc, err := fte.NewEncrypter()
+	enc, err := fte.NewEncrypter(fte.DefaultKey)
 	if err != nil {
 		panic(err)
 	}
@@ -53,7 +76,7 @@ func MustNewEncrypter() *fte.Encrypter {
 }
 
 func MustNewDecrypter() *fte.Decrypter {
-	dec, err := fte.NewDecrypter()
+	dec, err := fte.NewDecrypter(fte.DefaultKey)
 	if err != nil {
 		panic(err)
 	}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 )
 
 const (
@@ -19,35 +20,49 @@ const (
 
 var Verbose bool
 
-// Cache represents a cache of Ciphers & DFAs.
+// Cache represents a cache of Ciphers. DFAs are shared with a DFACache.
 type Cache struct {
+	mu      sync.Mutex
+	key     []byte
 	ciphers map[cacheKey]*Cipher
-	dfas    map[cacheKey]*DFA
+	dfas    *DFACache
 }
 
-// NewCache returns a new instance of Cache.
-func NewCache() *Cache {
+// NewCache returns a new instance of Cache. Ciphers are created with key.
+// If key is nil then DefaultKey is used. DFAs are retrieved from DefaultDFACache.
+func NewCache(key []byte) *Cache {
+	return NewCacheWithDFACache(key, DefaultDFACache)
+}
+
+// NewCacheWithDFACache returns a new instance of Cache which retrieves DFAs from dfas.
+func NewCacheWithDFACache(key []byte, dfas *DFACache) *Cache {
+	if key == nil {
+		key = DefaultKey
+	}
 	return &Cache{
+		key:     key,
 		ciphers: make(map[cacheKey]*Cipher),
-		dfas:    make(map[cacheKey]*DFA),
+		dfas:    dfas,
 	}
 }
 
-// Close close and removes all ciphers & dfas.
+// WithKey returns a new cache which creates ciphers with a different key.
+// DFAs are shared with c so they are not rebuilt.
+func (c *Cache) WithKey(key []byte) *Cache {
+	return NewCacheWithDFACache(key, c.dfas)
+}
+
+// Close close and removes all ciphers. DFAs are owned by the DFACache.
 func (c *Cache) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	for _, cipher := range c.ciphers {
 		if e := cipher.Close(); e != nil && err == nil {
 			err = e
 		}
 	}
-	c.ciphers = nil
-
-	for _, dfa := range c.dfas {
-		if e := dfa.Close(); e != nil && err == nil {
-			err = e
-		}
-	}
-	c.dfas = nil
+	c.ciphers = make(map[cacheKey]*Cipher)
 
 	return err
 }
@@ -55,9 +70,15 @@ func (c *Cache) Close() (err error) {
 // Cipher returns a instance of Cipher associated with regex & n.
 // Creates a new cipher if one doesn't already exist.
 func (c *Cache) Cipher(regex string, n int) (_ *Cipher, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	cipher := c.ciphers[cacheKey{regex, n}]
 	if cipher == nil {
-		if cipher, err = NewCipher(regex, n); err != nil {
+		dfa, err := c.dfas.DFA(regex, n)
+		if err != nil {
+			return nil, err
+		} else if cipher, err = NewCipherWithDFA(dfa, c.key); err != nil {
 			return nil, err
 		}
 		c.ciphers[cacheKey{regex, n}] = cipher
@@ -67,15 +88,8 @@ func (c *Cache) Cipher(regex string, n int) (_ *Cipher, err error) {
 
 // DFA returns a instance of DFA associated with regex & n.
 // Creates a new DFA if one doesn't already exist.
-func (c *Cache) DFA(regex string, n int) (_ *DFA, err error) {
-	dfa := c.dfas[cacheKey{regex, n}]
-	if dfa == nil {
-		if dfa, err = NewDFA(regex, n); err != nil {
-			return nil, err
-		}
-		c.dfas[cacheKey{regex, n}] = dfa
-	}
-	return dfa, nil
+func (c *Cache) DFA(regex string, n int) (*DFA, error) {
+	return c.dfas.DFA(regex, n)
 }
 
 type cacheKey struct {
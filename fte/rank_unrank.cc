@@ -1,3 +1,5 @@
+// +build !purego
+
 #include <rank_unrank.h>
 
 #include <iostream>
@@ -0,0 +1,284 @@
+package fte
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrLanguageIsEmptySet = errors.New("fte: language is empty set")
+
+	// ErrInvalidDFATable is returned when a DFA table cannot be parsed.
+	ErrInvalidDFATable = errors.New("fte: invalid dfa table")
+
+	// ErrInvalidRankInput is returned when ranking a string of the wrong length
+	// or one which contains a symbol outside of the DFA's alphabet.
+	ErrInvalidRankInput = errors.New("fte: invalid rank input")
+
+	// ErrInvalidUnrankInput is returned when unranking an integer which is
+	// outside the range of the DFA.
+	ErrInvalidUnrankInput = errors.New("fte: invalid unrank input")
+
+	// ErrNotInFinalState is returned when a string does not end in a final state.
+	ErrNotInFinalState = errors.New("fte: string does not result in an accepting path")
+)
+
+// Ranker maps between fixed-length strings in a regular language and integers.
+// It is a pure Go implementation of the ranking performed by rank_unrank.cc
+// and produces identical results for the same DFA table.
+//
+// See Appendix A of "Protocol Misidentification Made Easy with
+// Format-Transforming Encryption" for details.
+type Ranker struct {
+	n          int
+	startState int
+	final      []bool
+
+	sigma        []byte       // symbol index to byte
+	sigmaReverse map[byte]int // byte to symbol index
+
+	delta      [][]int // transitions by state & symbol index
+	deltaDense []bool  // true if all symbols transition to the same state
+
+	// t[q][i] is the number of strings of length i from state q to a final state.
+	t [][]*big.Int
+}
+
+// NewRanker returns a Ranker for strings of length n using a DFA table in the
+// format returned by regex2dfa.Regex2DFA().
+func NewRanker(tbl string, n int) (*Ranker, error) {
+	type transition struct{ src, dst, sym int }
+
+	r := &Ranker{n: n, sigmaReverse: make(map[byte]int)}
+
+	// Read transitions & final states. Symbols are ordered by first appearance
+	// and the source of the first transition is the start state.
+	var transitions []transition
+	states, finals := make(map[int]struct{}), make(map[int]struct{})
+	for _, line := range strings.Split(tbl, "\n") {
+		if line == "" {
+			break
+		}
+
+		fields := strings.Split(line, "\t")
+		switch len(fields) {
+		case 4:
+			var tr transition
+			var err error
+			if tr.src, err = strconv.Atoi(fields[0]); err != nil {
+				return nil, ErrInvalidDFATable
+			} else if tr.dst, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, ErrInvalidDFATable
+			} else if tr.sym, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, ErrInvalidDFATable
+			} else if tr.src < 0 || tr.dst < 0 || tr.sym < 0 || tr.sym > 255 {
+				return nil, ErrInvalidDFATable
+			}
+
+			if len(transitions) == 0 {
+				r.startState = tr.src
+			}
+			if _, ok := r.sigmaReverse[byte(tr.sym)]; !ok {
+				r.sigmaReverse[byte(tr.sym)] = len(r.sigma)
+				r.sigma = append(r.sigma, byte(tr.sym))
+			}
+			states[tr.src] = struct{}{}
+			transitions = append(transitions, tr)
+
+		case 1:
+			state, err := strconv.Atoi(fields[0])
+			if err != nil || state < 0 {
+				return nil, ErrInvalidDFATable
+			}
+			states[state], finals[state] = struct{}{}, struct{}{}
+
+		default:
+			return nil, ErrInvalidDFATable
+		}
+	}
+
+	if len(states) == 0 || len(r.sigma) == 0 {
+		return nil, ErrInvalidDFATable
+	}
+
+	// Add an extra "dead" state which all missing transitions point to.
+	numStates := len(states) + 1
+	dead := numStates - 1
+	for state := range states {
+		if state >= numStates {
+			return nil, ErrInvalidDFATable
+		}
+	}
+
+	r.final = make([]bool, numStates)
+	for state := range finals {
+		r.final[state] = true
+	}
+
+	r.delta = make([][]int, numStates)
+	for q := range r.delta {
+		r.delta[q] = make([]int, len(r.sigma))
+		for a := range r.delta[q] {
+			r.delta[q][a] = dead
+		}
+	}
+	for _, tr := range transitions {
+		if tr.dst >= numStates {
+			return nil, ErrInvalidDFATable
+		}
+		r.delta[tr.src][r.sigmaReverse[byte(tr.sym)]] = tr.dst
+	}
+
+	r.deltaDense = make([]bool, numStates)
+	for q := range r.delta {
+		r.deltaDense[q] = true
+		for a := 1; a < len(r.sigma); a++ {
+			if r.delta[q][a-1] != r.delta[q][a] {
+				r.deltaDense[q] = false
+				break
+			}
+		}
+	}
+
+	r.buildTable()
+	return r, nil
+}
+
+// buildTable precalculates the number of accepted strings of each length
+// from each state to speed up ranking.
+func (r *Ranker) buildTable() {
+	r.t = make([][]*big.Int, len(r.delta))
+	for q := range r.t {
+		r.t[q] = make([]*big.Int, r.n+1)
+		for i := range r.t[q] {
+			r.t[q][i] = new(big.Int)
+		}
+		if r.final[q] {
+			r.t[q][0].SetInt64(1)
+		}
+	}
+
+	for i := 1; i <= r.n; i++ {
+		for q := range r.delta {
+			for _, state := range r.delta[q] {
+				r.t[q][i].Add(r.t[q][i], r.t[state][i-1])
+			}
+		}
+	}
+}
+
+// N returns the fixed string length of the ranker.
+func (r *Ranker) N() int { return r.n }
+
+// Rank maps s into an integer ranking.
+func (r *Ranker) Rank(s string) (*big.Int, error) {
+	if len(s) != r.n {
+		return nil, ErrInvalidRankInput
+	}
+
+	var tmp big.Int
+	rank, n, q := new(big.Int), len(s), r.startState
+	for i := 1; i <= n; i++ {
+		a, ok := r.sigmaReverse[s[i-1]]
+		if !ok {
+			return nil, ErrInvalidRankInput
+		}
+
+		if r.deltaDense[q] {
+			// All symbols lead to the same state so the rank can be multiplied.
+			state := r.delta[q][0]
+			tmp.Mul(r.t[state][n-i], big.NewInt(int64(a)))
+			rank.Add(rank, &tmp)
+		} else {
+			for j := 1; j <= a; j++ {
+				rank.Add(rank, r.t[r.delta[q][j-1]][n-i])
+			}
+		}
+		q = r.delta[q][a]
+	}
+
+	if !r.final[q] {
+		return nil, ErrNotInFinalState
+	}
+	return rank, nil
+}
+
+// Unrank reverses the map from an integer to a string.
+func (r *Ranker) Unrank(rank *big.Int) (string, error) {
+	if rank.Sign() < 0 || rank.Cmp(r.NumWordsInSlice(r.n)) > 0 {
+		return "", ErrInvalidUnrankInput
+	}
+
+	var charIndex big.Int
+	c := new(big.Int).Set(rank)
+	buf := make([]byte, 0, r.n)
+	q := r.startState
+	for i := 1; i <= r.n; i++ {
+		var cursor, state int
+		if r.deltaDense[q] {
+			// All symbols lead to the same state so the symbol can be divided out.
+			state = r.delta[q][0]
+			if r.t[state][r.n-i].Sign() == 0 {
+				return "", ErrInvalidUnrankInput
+			}
+			charIndex.DivMod(c, r.t[state][r.n-i], c)
+			if !charIndex.IsInt64() || charIndex.Int64() >= int64(len(r.sigma)) {
+				return "", ErrInvalidUnrankInput
+			}
+			cursor = int(charIndex.Int64())
+		} else {
+			state = r.delta[q][cursor]
+			for c.Cmp(r.t[state][r.n-i]) >= 0 {
+				c.Sub(c, r.t[state][r.n-i])
+				if cursor++; cursor >= len(r.sigma) {
+					return "", ErrInvalidUnrankInput
+				}
+				state = r.delta[q][cursor]
+			}
+		}
+		buf = append(buf, r.sigma[cursor])
+		q = state
+	}
+
+	if !r.final[q] {
+		return "", ErrNotInFinalState
+	}
+	return string(buf), nil
+}
+
+// NumWordsInSlice returns the number of accepted strings of length n.
+func (r *Ranker) NumWordsInSlice(n int) *big.Int {
+	return r.NumWordsInLanguage(n, n)
+}
+
+// NumWordsInLanguage returns the number of accepted strings with a length
+// between min and max, inclusive.
+func (r *Ranker) NumWordsInLanguage(min, max int) *big.Int {
+	if min < 0 {
+		min = 0
+	}
+	if max > r.n {
+		max = r.n
+	}
+
+	num := new(big.Int)
+	for i := min; i <= max; i++ {
+		num.Add(num, r.t[r.startState][i])
+	}
+	return num
+}
+
+// Log2 returns floor(log2(v)).
+func Log2(v *big.Int) int {
+	for i := 1; ; i++ {
+		var exp big.Int
+		exp.Exp(big.NewInt(2), big.NewInt(int64(i)), nil)
+		if cmp := exp.Cmp(v); cmp == 0 {
+			return i
+		} else if cmp == 1 {
+			return i - 1
+		}
+	}
+}
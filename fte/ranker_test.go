@@ -0,0 +1,76 @@
+package fte_test
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/regex2dfa"
+)
+
+func TestRanker(t *testing.T) {
+	const regex = `[a-zA-Z0-9\?\-\.\&]+`
+
+	ranker, err := fte.NewRanker(regex2dfa.MustRegex2DFA(regex), 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("NumWordsInSlice", func(t *testing.T) {
+		if n := ranker.NumWordsInSlice(2); n.Int64() != 4356 {
+			t.Fatalf("unexpected num: %s", n.String())
+		} else if n := ranker.NumWordsInSlice(128); n.Cmp(MustParseBigInt("79730364466078295247929974531176772238596904976952276544180970225219793047157262470006331981703289917777986225196953175309100698472000175017293630225745978436511083898450002074128399277315833125284543822420667052424107321762036842496")) != 0 {
+			t.Fatalf("unexpected num: %s", n.String())
+		}
+	})
+
+	// Ensure ranks match those produced by the C++ DFA implementation.
+	t.Run("Rank", func(t *testing.T) {
+		for _, tt := range []struct {
+			s    string
+			rank string
+		}{
+			{s: strings.Repeat("A", 128), rank: "17172693885001478976477225283638074020620871841189721101823593586970416964003102685847517657597631674598335494657805299297344765824738499234494012664006826124787002685820000446735347536652640980830517130982912903599038500071823319922"},
+			{s: strings.Repeat("&z9", 42) + "..", rank: "1193064324364141380394771214918946326615919877600823296728870185251554112902382800208585332563305633928523615161297735822117780152094974705384083887480336003178735918646000483218492056178412543191965451656737368161284577812554244478"},
+			{s: strings.Repeat("-", 128), rank: "1226620991785819926891230377402719572901490845799265792987399541926458354571650191846251261256973691042738249618414664235524626130338464231035286618857630437484785906130000031909667681189474355773608366498779493114217035719415951423"},
+		} {
+			if rank, err := ranker.Rank(tt.s); err != nil {
+				t.Fatal(err)
+			} else if exp := MustParseBigInt(tt.rank); rank.Cmp(exp) != 0 {
+				t.Fatalf("rank mismatch: %s != %s", rank, exp)
+			} else if other, err := ranker.Unrank(rank); err != nil {
+				t.Fatal(err)
+			} else if other != tt.s {
+				t.Fatalf("unexpected unrank: %q", other)
+			}
+		}
+	})
+
+	t.Run("ErrInvalidRankInput", func(t *testing.T) {
+		if _, err := ranker.Rank("foo"); err != fte.ErrInvalidRankInput {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := ranker.Rank(strings.Repeat("#", 128)); err != fte.ErrInvalidRankInput {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrInvalidUnrankInput", func(t *testing.T) {
+		if _, err := ranker.Unrank(big.NewInt(-1)); err != fte.ErrInvalidUnrankInput {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrInvalidDFATable", func(t *testing.T) {
+		if _, err := fte.NewRanker("foo bar", 128); err != fte.ErrInvalidDFATable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func MustParseBigInt(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid integer: " + s)
+	}
+	return n
+}
@@ -0,0 +1,356 @@
+package marionette
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/redjack/marionette/fte"
+	"golang.org/x/crypto/curve25519"
+)
+
+// NegotiateKeySize is the size, in bytes, of X25519 public & private keys.
+const NegotiateKeySize = 32
+
+// negotiateTagSize is the size, in bytes, of the server's key confirmation tag.
+const negotiateTagSize = 32
+
+var (
+	// ErrInvalidNegotiateKey is returned when a negotiation key is not NegotiateKeySize bytes.
+	ErrInvalidNegotiateKey = errors.New("marionette: invalid negotiation key")
+
+	// ErrNegotiationFailed is returned when the server cannot be authenticated.
+	ErrNegotiationFailed = errors.New("marionette: negotiation failed")
+
+	// ErrNegotiationRequired is returned when a data cell is received before
+	// the session key has been negotiated.
+	ErrNegotiationRequired = errors.New("marionette: negotiation required")
+
+	// ErrUnexpectedNegotiateCell is returned when a NEGOTIATE cell is received
+	// when no negotiation is in progress.
+	ErrUnexpectedNegotiateCell = errors.New("marionette: unexpected negotiate cell")
+)
+
+// GenerateServerKey returns a new X25519 key pair used to authenticate a server.
+// The private key is used by the Listener and the public key is pinned by the Dialer.
+func GenerateServerKey() (privateKey, publicKey []byte, err error) {
+	return generateKeyPair()
+}
+
+// ServerPublicKey returns the X25519 public key for a server's private key.
+func ServerPublicKey(privateKey []byte) ([]byte, error) {
+	if len(privateKey) != NegotiateKeySize {
+		return nil, ErrInvalidNegotiateKey
+	}
+	return curve25519.X25519(privateKey, curve25519.Basepoint)
+}
+
+func generateKeyPair() (privateKey, publicKey []byte, err error) {
+	privateKey = make([]byte, NegotiateKeySize)
+	if _, err := io.ReadFull(rand.Reader, privateKey); err != nil {
+		return nil, nil, err
+	}
+	if publicKey, err = ServerPublicKey(privateKey); err != nil {
+		return nil, nil, err
+	}
+	return privateKey, publicKey, nil
+}
+
+// handshake negotiates a per-connection session key using an ephemeral
+// X25519 exchange carried in NEGOTIATE cells.
+//
+// The client sends its ephemeral public key in the first cell it sends. The
+// server replies with its own ephemeral public key and a tag which proves it
+// holds the private key matching the client's pinned public key. Both sides
+// derive the session key from the ephemeral-ephemeral & ephemeral-static
+// shared secrets so compromise of the server's long-term key does not expose
+// previous sessions.
+//
+// Messages are encrypted with the static FTE key until each side knows the
+// other has the session key. No stream data is sent or accepted until then.
+type handshake struct {
+	mu    sync.Mutex
+	party string
+
+	privateKey      []byte // server's long-term private key
+	serverPublicKey []byte // pinned server public key
+
+	ephemeral []byte // local ephemeral private key
+	out       []byte // pending outgoing negotiation payload
+	outSeq    int    // sequence id of next outgoing negotiate cell
+	in        []byte // partial incoming negotiation payload
+	inSeq     int    // expected sequence id of next incoming negotiate cell
+	key       []byte // negotiated session key
+
+	sendSession     bool // if true, encrypt using the session key
+	switchOnEncrypt bool // if true, switch to the session key after the next encryption
+	confirmed       bool // if true, remote side has sent using the session key
+	staticDecrypted bool // if true, the last message was decrypted with the static key
+}
+
+// newHandshake returns a new handshake for party. Returns nil if the party
+// does not have the keys required to negotiate.
+func newHandshake(party string, privateKey, serverPublicKey []byte) *handshake {
+	switch party {
+	case PartyClient:
+		if serverPublicKey == nil {
+			return nil
+		}
+	case PartyServer:
+		if privateKey == nil {
+			return nil
+		}
+	}
+
+	return &handshake{
+		party:           party,
+		privateKey:      privateKey,
+		serverPublicKey: serverPublicKey,
+	}
+}
+
+// clone returns a new handshake with the same long-term keys.
+func (h *handshake) clone() *handshake {
+	if h == nil {
+		return nil
+	}
+	return newHandshake(h.party, h.privateKey, h.serverPublicKey)
+}
+
+// Key returns the negotiated session key. Returns nil if negotiation is incomplete.
+func (h *handshake) Key() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.key
+}
+
+// Complete returns true once both sides are sending with the session key.
+func (h *handshake) Complete() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sendSession && h.confirmed
+}
+
+// Dequeue returns the next NEGOTIATE cell to send. The negotiation payload
+// is split across multiple cells if it does not fit within n bytes.
+// Returns false once negotiation is complete and data cells may be sent.
+func (h *handshake) Dequeue(n int) (*Cell, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Generate the client's ephemeral key on the first send.
+	if h.party == PartyClient && h.ephemeral == nil {
+		privateKey, publicKey, err := generateKeyPair()
+		if err != nil {
+			return nil, true
+		}
+		h.ephemeral, h.out = privateKey, publicKey
+	}
+
+	// Send next fragment of the pending negotiation payload.
+	if len(h.out) > 0 {
+		if n > MaxCellLength {
+			n = MaxCellLength
+		}
+
+		sz := len(h.out)
+		if n > 0 && n-CellHeaderSize < sz {
+			sz = n - CellHeaderSize
+		}
+		if sz <= 0 {
+			return nil, true
+		}
+
+		cell := NewCell(0, h.outSeq, n, NEGOTIATE)
+		cell.Payload, h.out = h.out[:sz], h.out[sz:]
+		h.outSeq++
+
+		// The server's reply is encrypted with the static key since the
+		// client cannot derive the session key until it has received it.
+		if len(h.out) == 0 && h.party == PartyServer {
+			h.switchOnEncrypt = true
+		}
+		return cell, true
+	}
+
+	return nil, h.key == nil
+}
+
+// Enqueue processes a NEGOTIATE cell received from the remote side.
+func (h *handshake) Enqueue(cell *Cell) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.key != nil || (h.party == PartyClient && h.ephemeral == nil) {
+		return ErrUnexpectedNegotiateCell
+	} else if cell.SequenceID != h.inSeq {
+		return ErrNegotiationFailed
+	}
+
+	// Wait until the entire payload has been received.
+	payloadN := NegotiateKeySize
+	if h.party == PartyClient {
+		payloadN += negotiateTagSize
+	}
+	h.in, h.inSeq = append(h.in, cell.Payload...), h.inSeq+1
+	if len(h.in) < payloadN {
+		return nil
+	} else if len(h.in) > payloadN {
+		return ErrNegotiationFailed
+	}
+	payload := h.in
+
+	switch h.party {
+	case PartyServer:
+		remoteEphemeral := payload
+
+		publicKey, err := ServerPublicKey(h.privateKey)
+		if err != nil {
+			return err
+		}
+		ephemeral, ephemeralPublicKey, err := generateKeyPair()
+		if err != nil {
+			return err
+		}
+
+		ee, err := curve25519.X25519(ephemeral, remoteEphemeral)
+		if err != nil {
+			return ErrNegotiationFailed
+		}
+		es, err := curve25519.X25519(h.privateKey, remoteEphemeral)
+		if err != nil {
+			return ErrNegotiationFailed
+		}
+
+		key, tag := negotiateKeys(ee, es, remoteEphemeral, ephemeralPublicKey, publicKey)
+		h.ephemeral, h.key = ephemeral, key
+		h.out = append(ephemeralPublicKey, tag...)
+		return nil
+
+	case PartyClient:
+		remoteEphemeral, remoteTag := payload[:NegotiateKeySize], payload[NegotiateKeySize:]
+
+		publicKey, err := ServerPublicKey(h.ephemeral)
+		if err != nil {
+			return err
+		}
+
+		ee, err := curve25519.X25519(h.ephemeral, remoteEphemeral)
+		if err != nil {
+			return ErrNegotiationFailed
+		}
+		es, err := curve25519.X25519(h.ephemeral, h.serverPublicKey)
+		if err != nil {
+			return ErrNegotiationFailed
+		}
+
+		key, tag := negotiateKeys(ee, es, publicKey, remoteEphemeral, h.serverPublicKey)
+		if !hmac.Equal(tag, remoteTag) {
+			return ErrNegotiationFailed
+		}
+		h.key, h.sendSession = key, true
+		return nil
+
+	default:
+		return ErrUnexpectedNegotiateCell
+	}
+}
+
+// AcceptData returns an error if data cells cannot be accepted yet.
+func (h *handshake) AcceptData() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.key == nil || h.staticDecrypted {
+		return ErrNegotiationRequired
+	}
+	return nil
+}
+
+// useSessionKey returns true if the next message should be encrypted with
+// the session key.
+func (h *handshake) useSessionKey() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := h.sendSession
+	if h.switchOnEncrypt {
+		h.switchOnEncrypt, h.sendSession = false, true
+	}
+	return v
+}
+
+// setDecrypted records which key was used to decrypt the last message.
+func (h *handshake) setDecrypted(session bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if session {
+		h.confirmed = true
+	}
+	h.staticDecrypted = !session
+}
+
+func (h *handshake) isConfirmed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.confirmed
+}
+
+// negotiateKeys derives the session key & server confirmation tag from the
+// shared secrets and the public keys used in the exchange.
+func negotiateKeys(ee, es, clientEphemeral, serverEphemeral, serverPublicKey []byte) (key, tag []byte) {
+	prk := hmac.New(sha512.New, []byte("marionette negotiate"))
+	prk.Write(ee)
+	prk.Write(es)
+
+	expand := func(info byte) []byte {
+		h := hmac.New(sha512.New, prk.Sum(nil))
+		h.Write(clientEphemeral)
+		h.Write(serverEphemeral)
+		h.Write(serverPublicKey)
+		h.Write([]byte{info})
+		return h.Sum(nil)
+	}
+	return expand(0x01)[:fte.KeySize], expand(0x02)[:negotiateTagSize]
+}
+
+// negotiatedCipher encrypts with the static key until the session key is
+// usable and decrypts with either key until the remote side switches.
+type negotiatedCipher struct {
+	h       *handshake
+	static  *fte.Cipher
+	session *fte.Cipher // nil until a session key is negotiated
+}
+
+// Capacity returns the capacity of the underlying DFA.
+func (c *negotiatedCipher) Capacity() int { return c.static.Capacity() }
+
+// Encrypt encrypts plaintext with the session key, if in use.
+func (c *negotiatedCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	if len(plaintext) == 0 {
+		return nil, nil
+	} else if c.h.useSessionKey() && c.session != nil {
+		return c.session.Encrypt(plaintext)
+	}
+	return c.static.Encrypt(plaintext)
+}
+
+// Decrypt decrypts ciphertext with the session key. Falls back to the static
+// key until the remote side has sent a message with the session key.
+func (c *negotiatedCipher) Decrypt(ciphertext []byte) (plaintext, remainder []byte, err error) {
+	if c.session != nil {
+		if plaintext, remainder, err = c.session.Decrypt(ciphertext); err == nil {
+			c.h.setDecrypted(true)
+			return plaintext, remainder, nil
+		} else if err == fte.ErrShortCiphertext || c.h.isConfirmed() {
+			return nil, nil, err
+		}
+	}
+
+	if plaintext, remainder, err = c.static.Decrypt(ciphertext); err != nil {
+		return nil, nil, err
+	}
+	c.h.setDecrypted(false)
+	return plaintext, remainder, nil
+}
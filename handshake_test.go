@@ -0,0 +1,136 @@
+package marionette_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+)
+
+func TestServerPublicKey(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		privateKey, publicKey, err := marionette.GenerateServerKey()
+		if err != nil {
+			t.Fatal(err)
+		} else if other, err := marionette.ServerPublicKey(privateKey); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(publicKey, other) {
+			t.Fatalf("public key mismatch: %x != %x", publicKey, other)
+		}
+	})
+
+	t.Run("ErrInvalidNegotiateKey", func(t *testing.T) {
+		if _, err := marionette.ServerPublicKey([]byte("foo")); err != marionette.ErrInvalidNegotiateKey {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDialer_Negotiate(t *testing.T) {
+	key := fte.NewKey([]byte("secret"))
+
+	t.Run("OK", func(t *testing.T) {
+		privateKey, publicKey, err := marionette.GenerateServerKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ln, dialer := MustOpenNegotiatingPair(t, "http_simple_blocking", key, privateKey, publicKey)
+		defer ln.Close()
+		defer dialer.Close()
+
+		// Write from client and read from server.
+		clientConn, err := dialer.Dial()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := clientConn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		serverConn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(serverConn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "foo" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+
+		// Write back from server to client.
+		if _, err := serverConn.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(clientConn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "bar" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+	})
+
+	t.Run("ErrNegotiationFailed", func(t *testing.T) {
+		privateKey, _, err := marionette.GenerateServerKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, otherPublicKey, err := marionette.GenerateServerKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ln, dialer := MustOpenNegotiatingPair(t, "http_simple_blocking", key, privateKey, otherPublicKey)
+		defer ln.Close()
+		defer dialer.Close()
+
+		if _, err := dialer.Dial(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Dialer should shutdown once it cannot authenticate the server.
+		for i := 0; !dialer.Closed(); i++ {
+			if i > 100 {
+				t.Fatal("expected dialer to close")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+
+	t.Run("ErrInvalidNegotiateKey", func(t *testing.T) {
+		doc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		dialer := marionette.NewDialer(doc, "127.0.0.1", marionette.NewStreamSet(), key)
+		dialer.ServerPublicKey = []byte("foo")
+		if err := dialer.Open(); err != marionette.ErrInvalidNegotiateKey {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustOpenNegotiatingPair returns an open listener & dialer for a format.
+// The listener binds to a random local port.
+func MustOpenNegotiatingPair(tb testing.TB, format string, key, privateKey, publicKey []byte) (*marionette.Listener, *marionette.Dialer) {
+	serverDoc := mar.MustParse(marionette.PartyServer, mar.Format(format, ""))
+	serverDoc.Port = "0"
+
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	ln.PrivateKey = privateKey
+	if err := ln.Open(); err != nil {
+		tb.Fatal(err)
+	}
+
+	clientDoc := mar.MustParse(marionette.PartyClient, mar.Format(format, ""))
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+	dialer.ServerPublicKey = publicKey
+	if err := dialer.Open(); err != nil {
+		ln.Close()
+		tb.Fatal(err)
+	}
+	return ln, dialer
+}
@@ -0,0 +1,162 @@
+package learn
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TCP flags.
+const (
+	TCPFlagFIN = 0x01
+	TCPFlagSYN = 0x02
+	TCPFlagRST = 0x04
+	TCPFlagACK = 0x10
+)
+
+// EtherTypes & IP protocol numbers used while decoding.
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	ipProtoTCP      = 6
+	ipProtoHopByHop = 0
+	ipProtoRouting  = 43
+	ipProtoDestOpts = 60
+)
+
+// Segment represents a decoded TCP segment.
+type Segment struct {
+	Time    time.Time
+	Src     string // source "host:port"
+	Dst     string // destination "host:port"
+	Seq     uint32
+	Flags   uint8
+	Payload []byte
+}
+
+// DecodeSegment decodes the TCP segment within a packet. Returns nil if the
+// packet is not TCP, is fragmented or uses an unsupported link type.
+func DecodeSegment(p *Packet) *Segment {
+	data := p.Data
+
+	// Strip the link layer header.
+	var etherType uint16
+	switch p.LinkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		for (etherType == etherTypeVLAN || etherType == etherTypeQinQ) && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return nil
+		}
+		// Address family is in host byte order.
+		family := binary.LittleEndian.Uint32(data)
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data)
+		}
+		switch family {
+		case 2:
+			etherType = etherTypeIPv4
+		case 24, 28, 30:
+			etherType = etherTypeIPv6
+		}
+		data = data[4:]
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		if len(data) < 1 {
+			return nil
+		}
+		switch data[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	default:
+		return nil
+	}
+
+	// Strip the network layer header.
+	var src, dst net.IP
+	switch etherType {
+	case etherTypeIPv4:
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return nil
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		flagsOffset := binary.BigEndian.Uint16(data[6:])
+		if ihl < 20 || total < ihl || data[9] != ipProtoTCP {
+			return nil
+		} else if flagsOffset&0x3fff != 0 {
+			return nil // fragment
+		}
+		if total < len(data) {
+			data = data[:total] // remove link layer padding
+		}
+		if len(data) < ihl {
+			return nil
+		}
+		src, dst, data = net.IP(data[12:16]), net.IP(data[16:20]), data[ihl:]
+
+	case etherTypeIPv6:
+		if len(data) < 40 || data[0]>>4 != 6 {
+			return nil
+		}
+		if n := 40 + int(binary.BigEndian.Uint16(data[4:])); n < len(data) {
+			data = data[:n]
+		}
+		next := data[6]
+		src, dst, data = net.IP(data[8:24]), net.IP(data[24:40]), data[40:]
+
+		// Skip extension headers.
+		for next == ipProtoHopByHop || next == ipProtoRouting || next == ipProtoDestOpts {
+			if len(data) < 8 {
+				return nil
+			}
+			n := (int(data[1]) + 1) * 8
+			if len(data) < n {
+				return nil
+			}
+			next, data = data[0], data[n:]
+		}
+		if next != ipProtoTCP {
+			return nil
+		}
+
+	default:
+		return nil
+	}
+
+	// Decode the TCP header.
+	if len(data) < 20 {
+		return nil
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || len(data) < offset {
+		return nil
+	}
+	srcPort, dstPort := binary.BigEndian.Uint16(data[0:]), binary.BigEndian.Uint16(data[2:])
+
+	return &Segment{
+		Time:    p.Time,
+		Src:     net.JoinHostPort(src.String(), strconv.Itoa(int(srcPort))),
+		Dst:     net.JoinHostPort(dst.String(), strconv.Itoa(int(dstPort))),
+		Seq:     binary.BigEndian.Uint32(data[4:]),
+		Flags:   data[13],
+		Payload: data[offset:],
+	}
+}
@@ -0,0 +1,223 @@
+package learn
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redjack/marionette"
+)
+
+// Flow represents a reconstructed TCP connection.
+type Flow struct {
+	Client   string // client "host:port"
+	Server   string // server "host:port"
+	Messages []*Message
+}
+
+// ServerPort returns the port of the flow's server.
+func (f *Flow) ServerPort() int {
+	return port(f.Server)
+}
+
+// Message represents the data sent by one party before the other responds.
+type Message struct {
+	Party string    // marionette.PartyClient or marionette.PartyServer
+	Start time.Time // time of the first segment
+	End   time.Time // time of the last segment
+	Len   int
+}
+
+// Reassemble reconstructs TCP flows from segments in capture order.
+// Retransmitted data is ignored & out-of-order segments are delivered once
+// the preceding data arrives. Flows without payload data are not returned.
+//
+// A new flow is started for the same addresses when a new SYN is seen or
+// when data follows a reset or a close by both parties.
+func Reassemble(segments []*Segment) []*Flow {
+	var states []*flowState
+	lookup := make(map[flowKey]*flowState)
+
+	for _, seg := range segments {
+		key := newFlowKey(seg.Src, seg.Dst)
+		state := lookup[key]
+		if state == nil || state.restartedBy(seg) {
+			state = newFlowState(seg)
+			lookup[key] = state
+			states = append(states, state)
+		}
+		state.add(seg)
+	}
+
+	flows := make([]*Flow, 0, len(states))
+	for _, state := range states {
+		state.flush()
+		if len(state.flow.Messages) > 0 {
+			flows = append(flows, state.flow)
+		}
+	}
+	return flows
+}
+
+// flowKey identifies a flow regardless of direction.
+type flowKey struct {
+	a, b string
+}
+
+func newFlowKey(src, dst string) flowKey {
+	if src > dst {
+		src, dst = dst, src
+	}
+	return flowKey{src, dst}
+}
+
+// flowState tracks the reassembly of a single flow.
+type flowState struct {
+	flow  *Flow
+	dirs  map[string]*flowDirection // by sender
+	reset bool                      // true if either party sent a RST
+}
+
+// flowDirection tracks the next expected sequence number from one sender.
+type flowDirection struct {
+	party   string
+	next    uint32
+	init    bool
+	syn     bool       // true if a SYN was sent
+	isn     uint32     // initial sequence number, if syn is set
+	fin     bool       // true if a FIN was sent
+	pending []*Segment // out-of-order segments
+}
+
+// newFlowState returns a flow state for the flow's first segment. The client
+// is the sender of the SYN. If the handshake wasn't captured then the
+// endpoint with the higher, usually ephemeral, port is the client.
+func newFlowState(seg *Segment) *flowState {
+	client, server := seg.Src, seg.Dst
+	if seg.Flags&TCPFlagSYN != 0 {
+		if seg.Flags&TCPFlagACK != 0 {
+			client, server = seg.Dst, seg.Src
+		}
+	} else if port(seg.Src) < port(seg.Dst) {
+		client, server = seg.Dst, seg.Src
+	}
+
+	return &flowState{
+		flow: &Flow{Client: client, Server: server},
+		dirs: map[string]*flowDirection{
+			client: {party: marionette.PartyClient},
+			server: {party: marionette.PartyServer},
+		},
+	}
+}
+
+// restartedBy returns true if seg begins a new connection between the
+// flow's addresses. Retransmitted SYNs continue the existing flow.
+func (s *flowState) restartedBy(seg *Segment) bool {
+	d := s.dirs[seg.Src]
+	if seg.Flags&TCPFlagSYN != 0 {
+		return d.init && !(d.syn && d.isn == seg.Seq)
+	}
+	return s.closed() && len(seg.Payload) > 0
+}
+
+// closed returns true if the flow was reset or both parties sent a FIN.
+func (s *flowState) closed() bool {
+	return s.reset || (s.dirs[s.flow.Client].fin && s.dirs[s.flow.Server].fin)
+}
+
+func (s *flowState) add(seg *Segment) {
+	d := s.dirs[seg.Src]
+	if seg.Flags&TCPFlagRST != 0 {
+		s.reset = true
+	}
+	if seg.Flags&TCPFlagFIN != 0 {
+		d.fin = true
+	}
+
+	// SYN consumes one sequence number before the first data byte.
+	if seg.Flags&TCPFlagSYN != 0 {
+		d.next, d.init = seg.Seq+1, true
+		d.syn, d.isn = true, seg.Seq
+		return
+	} else if len(seg.Payload) == 0 {
+		return
+	} else if !d.init {
+		d.next, d.init = seg.Seq, true
+	}
+
+	// Hold segments which arrive before the data preceding them.
+	if int32(seg.Seq-d.next) > 0 {
+		d.pending = append(d.pending, seg)
+		return
+	}
+	s.deliver(d, seg)
+
+	// Deliver held segments which are now in order.
+	for {
+		i := d.nextPending()
+		if i == -1 {
+			return
+		}
+		seg := d.pending[i]
+		d.pending = append(d.pending[:i], d.pending[i+1:]...)
+		s.deliver(d, seg)
+	}
+}
+
+// deliver appends the new data in seg to the flow's messages.
+func (s *flowState) deliver(d *flowDirection, seg *Segment) {
+	payload := seg.Payload
+	if skip := int32(d.next - seg.Seq); skip > 0 {
+		if int(skip) >= len(payload) {
+			return // retransmission
+		}
+		payload = payload[skip:]
+	}
+	d.next = seg.Seq + uint32(len(seg.Payload))
+
+	// Extend the last message if the same party is still sending.
+	msgs := s.flow.Messages
+	if len(msgs) > 0 && msgs[len(msgs)-1].Party == d.party {
+		msg := msgs[len(msgs)-1]
+		msg.Len += len(payload)
+		if seg.Time.After(msg.End) {
+			msg.End = seg.Time
+		}
+		return
+	}
+	s.flow.Messages = append(msgs, &Message{Party: d.party, Start: seg.Time, End: seg.Time, Len: len(payload)})
+}
+
+// flush delivers any held segments in sequence order, skipping missing data.
+func (s *flowState) flush() {
+	for _, d := range []*flowDirection{s.dirs[s.flow.Client], s.dirs[s.flow.Server]} {
+		sort.Slice(d.pending, func(i, j int) bool { return int32(d.pending[i].Seq-d.pending[j].Seq) < 0 })
+		for _, seg := range d.pending {
+			if int32(seg.Seq-d.next) > 0 {
+				d.next = seg.Seq
+			}
+			s.deliver(d, seg)
+		}
+		d.pending = nil
+	}
+}
+
+// nextPending returns the index of a held segment which starts at or before
+// the next expected sequence number. Returns -1 if none exist.
+func (d *flowDirection) nextPending() int {
+	for i, seg := range d.pending {
+		if int32(seg.Seq-d.next) <= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// port returns the numeric port of a "host:port" address.
+func port(addr string) int {
+	_, s, _ := net.SplitHostPort(addr)
+	n, _ := strconv.Atoi(s)
+	return n
+}
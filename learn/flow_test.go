@@ -0,0 +1,141 @@
+package learn_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/learn"
+)
+
+func TestReassemble(t *testing.T) {
+	t0 := time.Unix(1000, 0).UTC()
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+
+	t.Run("OK", func(t *testing.T) {
+		flows := learn.Reassemble(MustDecodeSegments(t, []*learn.Packet{
+			NewTCPPacket(at(0), "10.0.0.1:5000", "10.0.0.2:80", 100, learn.TCPFlagSYN, nil),
+			NewTCPPacket(at(1), "10.0.0.2:80", "10.0.0.1:5000", 900, learn.TCPFlagSYN|learn.TCPFlagACK, nil),
+			NewTCPPacket(at(2), "10.0.0.1:5000", "10.0.0.2:80", 101, learn.TCPFlagACK, nil),
+
+			// Request split across two segments with a retransmission.
+			NewTCPPacket(at(3), "10.0.0.1:5000", "10.0.0.2:80", 101, learn.TCPFlagACK, []byte("GET / ")),
+			NewTCPPacket(at(4), "10.0.0.1:5000", "10.0.0.2:80", 101, learn.TCPFlagACK, []byte("GET / ")),
+			NewTCPPacket(at(5), "10.0.0.1:5000", "10.0.0.2:80", 107, learn.TCPFlagACK, []byte("HTTP/1.1")),
+
+			// Response arrives out of order.
+			NewTCPPacket(at(50), "10.0.0.2:80", "10.0.0.1:5000", 906, learn.TCPFlagACK, []byte("world")),
+			NewTCPPacket(at(51), "10.0.0.2:80", "10.0.0.1:5000", 901, learn.TCPFlagACK, []byte("hello")),
+
+			// Second request overlaps previously sent data.
+			NewTCPPacket(at(200), "10.0.0.1:5000", "10.0.0.2:80", 111, learn.TCPFlagACK, []byte("1.1\r\n\r\n")),
+			NewTCPPacket(at(201), "10.0.0.1:5000", "10.0.0.2:80", 118, learn.TCPFlagFIN|learn.TCPFlagACK, nil),
+		}))
+
+		if diff := cmp.Diff(flows, []*learn.Flow{{
+			Client: "10.0.0.1:5000",
+			Server: "10.0.0.2:80",
+			Messages: []*learn.Message{
+				{Party: marionette.PartyClient, Start: at(3), End: at(5), Len: 14},
+				{Party: marionette.PartyServer, Start: at(51), End: at(51), Len: 10},
+				{Party: marionette.PartyClient, Start: at(200), End: at(200), Len: 3},
+			},
+		}}); diff != "" {
+			t.Fatal(diff)
+		} else if port := flows[0].ServerPort(); port != 80 {
+			t.Fatalf("unexpected server port: %d", port)
+		}
+	})
+
+	// Without a handshake, the endpoint with the higher port is the client.
+	t.Run("NoHandshake", func(t *testing.T) {
+		flows := learn.Reassemble(MustDecodeSegments(t, []*learn.Packet{
+			NewTCPPacket(at(0), "10.0.0.2:22", "10.0.0.1:40000", 1, learn.TCPFlagACK, []byte("SSH-2.0")),
+			NewTCPPacket(at(1), "10.0.0.1:40000", "10.0.0.2:22", 1, learn.TCPFlagACK, []byte("SSH-2.0-client")),
+		}))
+
+		if diff := cmp.Diff(flows, []*learn.Flow{{
+			Client: "10.0.0.1:40000",
+			Server: "10.0.0.2:22",
+			Messages: []*learn.Message{
+				{Party: marionette.PartyServer, Start: at(0), End: at(0), Len: 7},
+				{Party: marionette.PartyClient, Start: at(1), End: at(1), Len: 14},
+			},
+		}}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	// Connections which reuse the same addresses are separate flows.
+	t.Run("PortReuse", func(t *testing.T) {
+		flows := learn.Reassemble(MustDecodeSegments(t, []*learn.Packet{
+			NewTCPPacket(at(0), "10.0.0.1:5000", "10.0.0.2:80", 100, learn.TCPFlagSYN, nil),
+			NewTCPPacket(at(1), "10.0.0.1:5000", "10.0.0.2:80", 100, learn.TCPFlagSYN, nil), // retransmit
+			NewTCPPacket(at(2), "10.0.0.2:80", "10.0.0.1:5000", 900, learn.TCPFlagSYN|learn.TCPFlagACK, nil),
+			NewTCPPacket(at(3), "10.0.0.1:5000", "10.0.0.2:80", 101, learn.TCPFlagACK, []byte("ping")),
+			NewTCPPacket(at(4), "10.0.0.2:80", "10.0.0.1:5000", 901, learn.TCPFlagACK, []byte("pong")),
+			NewTCPPacket(at(5), "10.0.0.1:5000", "10.0.0.2:80", 105, learn.TCPFlagFIN|learn.TCPFlagACK, nil),
+			NewTCPPacket(at(6), "10.0.0.2:80", "10.0.0.1:5000", 905, learn.TCPFlagFIN|learn.TCPFlagACK, nil),
+
+			// Reopened with new sequence numbers.
+			NewTCPPacket(at(10), "10.0.0.1:5000", "10.0.0.2:80", 5000, learn.TCPFlagSYN, nil),
+			NewTCPPacket(at(11), "10.0.0.2:80", "10.0.0.1:5000", 7000, learn.TCPFlagSYN|learn.TCPFlagACK, nil),
+			NewTCPPacket(at(12), "10.0.0.1:5000", "10.0.0.2:80", 5001, learn.TCPFlagACK, []byte("hello")),
+			NewTCPPacket(at(13), "10.0.0.2:80", "10.0.0.1:5000", 0, learn.TCPFlagRST, nil),
+
+			// Data after a reset without a captured handshake.
+			NewTCPPacket(at(20), "10.0.0.1:5000", "10.0.0.2:80", 9000, learn.TCPFlagACK, []byte("again")),
+		}))
+
+		if diff := cmp.Diff(flows, []*learn.Flow{
+			{
+				Client: "10.0.0.1:5000",
+				Server: "10.0.0.2:80",
+				Messages: []*learn.Message{
+					{Party: marionette.PartyClient, Start: at(3), End: at(3), Len: 4},
+					{Party: marionette.PartyServer, Start: at(4), End: at(4), Len: 4},
+				},
+			},
+			{
+				Client: "10.0.0.1:5000",
+				Server: "10.0.0.2:80",
+				Messages: []*learn.Message{
+					{Party: marionette.PartyClient, Start: at(12), End: at(12), Len: 5},
+				},
+			},
+			{
+				Client: "10.0.0.1:5000",
+				Server: "10.0.0.2:80",
+				Messages: []*learn.Message{
+					{Party: marionette.PartyClient, Start: at(20), End: at(20), Len: 5},
+				},
+			},
+		}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("NoData", func(t *testing.T) {
+		flows := learn.Reassemble(MustDecodeSegments(t, []*learn.Packet{
+			NewTCPPacket(at(0), "10.0.0.1:5000", "10.0.0.2:80", 100, learn.TCPFlagSYN, nil),
+			NewTCPPacket(at(1), "10.0.0.2:80", "10.0.0.1:5000", 0, learn.TCPFlagRST, nil),
+		}))
+		if len(flows) != 0 {
+			t.Fatalf("unexpected flows: %d", len(flows))
+		}
+	})
+}
+
+// MustDecodeSegments decodes the TCP segment from each packet.
+func MustDecodeSegments(tb testing.TB, packets []*learn.Packet) []*learn.Segment {
+	tb.Helper()
+
+	segments := make([]*learn.Segment, len(packets))
+	for i, p := range packets {
+		if segments[i] = learn.DecodeSegment(p); segments[i] == nil {
+			tb.Fatalf("cannot decode packet %d", i)
+		}
+	}
+	return segments
+}
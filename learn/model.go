@@ -0,0 +1,395 @@
+package learn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redjack/marionette"
+)
+
+// DefaultMaxMessages is the default limit of messages learned per flow.
+const DefaultMaxMessages = 32
+
+// Default generator settings.
+const (
+	DefaultBuckets   = 4
+	DefaultMinLength = 128
+	DefaultRegex     = `^\C*$`
+)
+
+var (
+	// ErrNoFlows is returned when no flows with data match the learner.
+	ErrNoFlows = errors.New("learn: no flows with data")
+
+	// ErrInvalidBuckets is returned when generating with less than one bucket.
+	ErrInvalidBuckets = errors.New("learn: invalid bucket count")
+
+	// ErrServerFirstSender is returned when generating a model where the
+	// server sends first. The client must send the first cell so that both
+	// parties can synchronize their transitions.
+	ErrServerFirstSender = errors.New("learn: server first sender not supported")
+)
+
+// Learner builds a traffic model from reconstructed flows.
+type Learner struct {
+	// Server port to learn from. Defaults to the most common server port.
+	Port int
+
+	// Messages after this limit are ignored.
+	MaxMessages int
+}
+
+// NewLearner returns a new instance of Learner.
+func NewLearner() *Learner {
+	return &Learner{
+		MaxMessages: DefaultMaxMessages,
+	}
+}
+
+// Model represents the observed behavior of a protocol.
+type Model struct {
+	Port        int
+	FirstSender string // party which sends the first message
+	Flows       int    // number of flows learned from
+	Skipped     int    // number of flows started by the other party
+
+	Counts  map[int]int          // flows by message count
+	Lengths map[string][]int     // message lengths by party
+	Gaps    map[string][]float64 // seconds before each message by party
+}
+
+// Learn builds a model from flows.
+func (l *Learner) Learn(flows []*Flow) (*Model, error) {
+	m := &Model{
+		Port:    l.Port,
+		Counts:  make(map[int]int),
+		Lengths: make(map[string][]int),
+		Gaps:    make(map[string][]float64),
+	}
+	if m.Port == 0 {
+		m.Port = mostCommonPort(flows)
+	}
+
+	// Filter to flows to the server port.
+	var candidates []*Flow
+	for _, flow := range flows {
+		if flow.ServerPort() == m.Port && len(flow.Messages) > 0 {
+			candidates = append(candidates, flow)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoFlows
+	}
+
+	// The party which starts the majority of flows is the first sender.
+	var clientFirst int
+	for _, flow := range candidates {
+		if flow.Messages[0].Party == marionette.PartyClient {
+			clientFirst++
+		}
+	}
+	m.FirstSender = marionette.PartyClient
+	if clientFirst*2 < len(candidates) {
+		m.FirstSender = marionette.PartyServer
+	}
+
+	for _, flow := range candidates {
+		if flow.Messages[0].Party != m.FirstSender {
+			m.Skipped++
+			continue
+		}
+
+		msgs := flow.Messages
+		if l.MaxMessages > 0 && len(msgs) > l.MaxMessages {
+			msgs = msgs[:l.MaxMessages]
+		}
+
+		m.Flows++
+		m.Counts[len(msgs)]++
+		for i, msg := range msgs {
+			m.Lengths[msg.Party] = append(m.Lengths[msg.Party], msg.Len)
+			if i > 0 {
+				gap := msg.Start.Sub(msgs[i-1].End)
+				if gap < 0 {
+					gap = 0
+				}
+				m.Gaps[msg.Party] = append(m.Gaps[msg.Party], gap.Seconds())
+			}
+		}
+	}
+	return m, nil
+}
+
+// mostCommonPort returns the server port used by the most flows.
+// Ties are broken by the lowest port.
+func mostCommonPort(flows []*Flow) int {
+	counts := make(map[int]int)
+	for _, flow := range flows {
+		counts[flow.ServerPort()]++
+	}
+
+	var port, n int
+	for p, c := range counts {
+		if c > n || (c == n && p < port) {
+			port, n = p, c
+		}
+	}
+	return port
+}
+
+// Generator converts a model into a MAR document.
+type Generator struct {
+	// Number of buckets used for length & gap distributions.
+	Buckets int
+
+	// Minimum message length passed to fte.send().
+	MinLength int
+
+	// Regular expressions used by fte.send() for each party.
+	ClientRegex string
+	ServerRegex string
+
+	// Grammars used by tg.send() for each party. Overrides the regex.
+	ClientGrammar string
+	ServerGrammar string
+}
+
+// NewGenerator returns a new instance of Generator.
+func NewGenerator() *Generator {
+	return &Generator{
+		Buckets:     DefaultBuckets,
+		MinLength:   DefaultMinLength,
+		ClientRegex: DefaultRegex,
+		ServerRegex: DefaultRegex,
+	}
+}
+
+// Generate returns a MAR document for the model. Each observed message count
+// becomes a chain of states which alternate between the parties. Messages
+// after the first are preceded by a model.sleep() of the observed gaps.
+func (g *Generator) Generate(m *Model) ([]byte, error) {
+	if g.Buckets < 1 {
+		return nil, ErrInvalidBuckets
+	} else if m.Flows == 0 {
+		return nil, ErrNoFlows
+	} else if m.FirstSender != marionette.PartyClient {
+		return nil, ErrServerFirstSender
+	}
+	parties := []string{marionette.PartyClient, marionette.PartyServer}
+
+	// Compute message actions for each party.
+	msgs := make(map[string][]*bucketAction)
+	for _, party := range parties {
+		if len(m.Lengths[party]) == 0 {
+			continue
+		}
+		a, err := g.messageActions(party, m.Lengths[party])
+		if err != nil {
+			return nil, err
+		}
+		msgs[party] = a
+	}
+
+	counts := make([]int, 0, len(m.Counts))
+	for n := range m.Counts {
+		counts = append(counts, n)
+	}
+	sort.Ints(counts)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by marionette learn from %d flow(s).\n", m.Flows)
+	fmt.Fprintf(&buf, "connection(tcp, %d):\n", m.Port)
+
+	// Choose the number of messages in the connection.
+	for _, n := range counts {
+		p := strconv.FormatFloat(float64(m.Counts[n])/float64(m.Flows), 'f', 4, 64)
+		if p == "0.0000" {
+			continue
+		}
+		fmt.Fprintf(&buf, "  start conn%d NULL %s\n", n, p)
+	}
+
+	// Generate a chain of message states for each message count.
+	for _, n := range counts {
+		prev := fmt.Sprintf("conn%d", n)
+		for i := 0; i < n; i++ {
+			party := parties[i%2]
+			if i > 0 {
+				gap := fmt.Sprintf("gapx%dx%d", n, i)
+				fmt.Fprintf(&buf, "  %s %s %s_gap 1.0\n", prev, gap, party)
+				prev = gap
+			}
+
+			// The server cannot choose transitions until it receives the
+			// first cell so the first message always uses the largest length.
+			next := fmt.Sprintf("msgx%dx%d", n, i)
+			if i == 0 {
+				a := msgs[party][len(msgs[party])-1]
+				fmt.Fprintf(&buf, "  %s %s %s 1.0\n", prev, next, a.name)
+			} else {
+				for _, a := range msgs[party] {
+					fmt.Fprintf(&buf, "  %s %s %s %s\n", prev, next, a.name, a.prob())
+				}
+			}
+			prev = next
+		}
+		fmt.Fprintf(&buf, "  %s end NULL 1.0\n", prev)
+	}
+
+	// Write action blocks.
+	for _, party := range parties {
+		if gaps := m.Gaps[party]; len(gaps) > 0 {
+			fmt.Fprintf(&buf, "\naction %s_gap:\n", party)
+			fmt.Fprintf(&buf, "  %s model.sleep(%s)\n", party, quote(g.sleepDistribution(gaps)))
+		}
+		for _, a := range msgs[party] {
+			fmt.Fprintf(&buf, "\naction %s:\n", a.name)
+			fmt.Fprintf(&buf, "  %s %s\n", party, a.call)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bucketAction represents a message action & its transition probability.
+type bucketAction struct {
+	name   string
+	call   string
+	weight float64
+}
+
+// prob returns the transition probability formatted for a MAR document.
+func (a *bucketAction) prob() string {
+	return strconv.FormatFloat(a.weight, 'f', 4, 64)
+}
+
+// messageActions returns the send actions for a party. Grammars are sent
+// as-is while regexes are sent with one action per length bucket.
+func (g *Generator) messageActions(party string, lengths []int) ([]*bucketAction, error) {
+	if grammar := g.grammar(party); grammar != "" {
+		return []*bucketAction{{
+			name:   party + "_msg",
+			call:   fmt.Sprintf("tg.send(%s)", quote(grammar)),
+			weight: 1,
+		}}, nil
+	}
+
+	regex := g.regex(party)
+	if regex == "" {
+		return nil, fmt.Errorf("learn: %s regex required", party)
+	}
+
+	values := make([]float64, len(lengths))
+	for i, n := range lengths {
+		values[i] = float64(n)
+	}
+
+	// Use the largest length in each bucket so every message fits.
+	var a []*bucketAction
+	for _, b := range split(values, g.Buckets) {
+		n := int(b[len(b)-1])
+		if n < g.MinLength {
+			n = g.MinLength
+		}
+		weight := float64(len(b)) / float64(len(values))
+
+		name := fmt.Sprintf("%s_msg_%d", party, n)
+		if len(a) > 0 && a[len(a)-1].name == name {
+			a[len(a)-1].weight += weight
+			continue
+		}
+		a = append(a, &bucketAction{
+			name:   name,
+			call:   fmt.Sprintf("fte.send(%s, %d)", quote(regex), n),
+			weight: weight,
+		})
+	}
+	return a, nil
+}
+
+// sleepDistribution returns a discrete model.sleep() distribution using the
+// mean gap of each bucket. Probabilities are written at full precision so
+// they sum to one.
+func (g *Generator) sleepDistribution(gaps []float64) string {
+	var values []string
+	var weights []float64
+	for _, b := range split(gaps, g.Buckets) {
+		var sum float64
+		for _, v := range b {
+			sum += v
+		}
+		value := strconv.FormatFloat(sum/float64(len(b)), 'f', 3, 64)
+		weight := float64(len(b)) / float64(len(gaps))
+
+		if len(values) > 0 && values[len(values)-1] == value {
+			weights[len(weights)-1] += weight
+			continue
+		}
+		values, weights = append(values, value), append(weights, weight)
+	}
+
+	elems := make([]string, len(values))
+	for i := range values {
+		elems[i] = fmt.Sprintf("'%s': %s", values[i], strconv.FormatFloat(weights[i], 'g', -1, 64))
+	}
+	return "{" + strings.Join(elems, ", ") + "}"
+}
+
+// regex returns the fte regex for party.
+func (g *Generator) regex(party string) string {
+	if party == marionette.PartyClient {
+		return g.ClientRegex
+	}
+	return g.ServerRegex
+}
+
+// grammar returns the tg grammar for party.
+func (g *Generator) grammar(party string) string {
+	if party == marionette.PartyClient {
+		return g.ClientGrammar
+	}
+	return g.ServerGrammar
+}
+
+// split sorts values & splits them into at most n groups of similar size.
+func split(values []float64, n int) [][]float64 {
+	values = append([]float64(nil), values...)
+	sort.Float64s(values)
+
+	if n > len(values) {
+		n = len(values)
+	}
+	groups := make([][]float64, 0, n)
+	for i := 0; i < n; i++ {
+		start, end := i*len(values)/n, (i+1)*len(values)/n
+		groups = append(groups, values[start:end])
+	}
+	return groups
+}
+
+// quote returns s as a double-quoted MAR string.
+func quote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, ch := range s {
+		switch ch {
+		case '\\', '"':
+			buf.WriteByte('\\')
+			buf.WriteRune(ch)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			buf.WriteRune(ch)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,197 @@
+package learn_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/learn"
+	"github.com/redjack/marionette/mar"
+)
+
+func TestLearner_Learn(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		m, err := learn.NewLearner().Learn(NewFlows())
+		if err != nil {
+			t.Fatal(err)
+		} else if m.Port != 80 {
+			t.Fatalf("unexpected port: %d", m.Port)
+		} else if m.FirstSender != marionette.PartyClient {
+			t.Fatalf("unexpected first sender: %s", m.FirstSender)
+		} else if m.Flows != 3 || m.Skipped != 1 {
+			t.Fatalf("unexpected flows: learned=%d skipped=%d", m.Flows, m.Skipped)
+		} else if diff := cmp.Diff(m.Counts, map[int]int{2: 2, 4: 1}); diff != "" {
+			t.Fatal(diff)
+		} else if diff := cmp.Diff(m.Lengths, map[string][]int{
+			marionette.PartyClient: {100, 150, 200, 300},
+			marionette.PartyServer: {1000, 2000, 4000, 3000},
+		}); diff != "" {
+			t.Fatal(diff)
+		} else if diff := cmp.Diff(m.Gaps, map[string][]float64{
+			marionette.PartyClient: {1},
+			marionette.PartyServer: {0.1, 0.2, 0.4, 0.3},
+		}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("MaxMessages", func(t *testing.T) {
+		l := learn.NewLearner()
+		l.MaxMessages = 2
+		if m, err := l.Learn(NewFlows()); err != nil {
+			t.Fatal(err)
+		} else if diff := cmp.Diff(m.Counts, map[int]int{2: 3}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("ErrNoFlows", func(t *testing.T) {
+		l := learn.NewLearner()
+		l.Port = 443
+		if _, err := l.Learn(NewFlows()); err != learn.ErrNoFlows {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestGenerator_Generate(t *testing.T) {
+	m, err := learn.NewLearner().Learn(NewFlows())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Regex", func(t *testing.T) {
+		g := learn.NewGenerator()
+		g.Buckets = 2
+		g.MinLength = 160
+		g.ServerRegex = "^HTTP/1\\.1\\ 200 OK\r\n\r\n\\C*$"
+		data, err := g.Generate(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := MustParseValid(t, data)
+
+		if doc.Port != "80" {
+			t.Fatalf("unexpected port: %s", doc.Port)
+		} else if a := doc.ActionBlock("server_msg_2000"); a == nil {
+			t.Fatal("expected server_msg_2000 action block")
+		} else if arg := a.Actions[0].ArgValues()[0].(string); arg != g.ServerRegex {
+			t.Fatalf("unexpected regex: %q", arg)
+		}
+
+		// Client lengths below the minimum are raised.
+		if a := doc.ActionBlock("client_msg_160"); a == nil {
+			t.Fatal("expected client_msg_160 action block")
+		} else if n := a.Actions[0].ArgValues()[1].(int); n != 160 {
+			t.Fatalf("unexpected length: %d", n)
+		}
+		if !strings.Contains(string(data), `server model.sleep("{'0.150': 0.5, '0.350': 0.5}")`) {
+			t.Fatalf("unexpected sleep distribution:\n%s", data)
+		}
+	})
+
+	t.Run("Grammar", func(t *testing.T) {
+		g := learn.NewGenerator()
+		g.ClientGrammar = "http_request_keep_alive"
+		g.ServerGrammar = "http_response_keep_alive"
+		data, err := g.Generate(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := MustParseValid(t, data)
+
+		if a := doc.ActionBlock("client_msg"); a == nil || a.Actions[0].Name() != "tg.send" {
+			t.Fatalf("unexpected client action: %#v", a)
+		}
+	})
+
+	t.Run("ErrServerFirstSender", func(t *testing.T) {
+		other := *m
+		other.FirstSender = marionette.PartyServer
+		if _, err := learn.NewGenerator().Generate(&other); err != learn.ErrServerFirstSender {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrInvalidBuckets", func(t *testing.T) {
+		g := learn.NewGenerator()
+		g.Buckets = 0
+		if _, err := g.Generate(m); err != learn.ErrInvalidBuckets {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// NewFlows returns a set of HTTP-like flows for learning.
+func NewFlows() []*learn.Flow {
+	t0 := time.Unix(1000, 0).UTC()
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	msg := func(party string, start, end, n int) *learn.Message {
+		return &learn.Message{Party: party, Start: at(start), End: at(end), Len: n}
+	}
+
+	return []*learn.Flow{
+		{
+			Client: "10.0.0.1:5000",
+			Server: "10.0.0.2:80",
+			Messages: []*learn.Message{
+				msg(marionette.PartyClient, 0, 0, 100),
+				msg(marionette.PartyServer, 100, 150, 1000),
+			},
+		},
+		{
+			Client: "10.0.0.1:5001",
+			Server: "10.0.0.2:80",
+			Messages: []*learn.Message{
+				msg(marionette.PartyClient, 0, 0, 150),
+				msg(marionette.PartyServer, 200, 300, 2000),
+			},
+		},
+		{
+			Client: "10.0.0.1:5002",
+			Server: "10.0.0.2:80",
+			Messages: []*learn.Message{
+				msg(marionette.PartyClient, 0, 0, 200),
+				msg(marionette.PartyServer, 400, 500, 4000),
+				msg(marionette.PartyClient, 1500, 1500, 300),
+				msg(marionette.PartyServer, 1800, 1900, 3000),
+			},
+		},
+
+		// Started by the server so it is skipped.
+		{
+			Client: "10.0.0.1:5003",
+			Server: "10.0.0.2:80",
+			Messages: []*learn.Message{
+				msg(marionette.PartyServer, 0, 0, 50),
+			},
+		},
+
+		// Different port so it is ignored.
+		{
+			Client: "10.0.0.1:5004",
+			Server: "10.0.0.3:8080",
+			Messages: []*learn.Message{
+				msg(marionette.PartyClient, 0, 0, 50),
+			},
+		},
+	}
+}
+
+// MustParseValid parses a MAR document & fails on any validation errors.
+func MustParseValid(tb testing.TB, data []byte) *mar.Document {
+	tb.Helper()
+
+	doc, err := mar.Parse(marionette.PartyClient, data)
+	if err != nil {
+		tb.Fatalf("cannot parse document: %s\n%s", err, data)
+	}
+	for _, err := range mar.Validate(doc) {
+		if !err.Warning {
+			tb.Fatalf("invalid document: %s\n%s", err, data)
+		}
+	}
+	return doc
+}
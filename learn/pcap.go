@@ -0,0 +1,276 @@
+package learn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Link types supported when decoding packets.
+const (
+	LinkTypeNull     = 0
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101
+	LinkTypeLinuxSLL = 113
+	LinkTypeIPv4     = 228
+	LinkTypeIPv6     = 229
+)
+
+// Magic numbers identifying capture file formats.
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+	pcapngMagic    = 0x0a0d0d0a
+	pcapngBOM      = 0x1a2b3c4d
+)
+
+// pcapng block types.
+const (
+	pcapngBlockInterface      = 0x00000001
+	pcapngBlockSimplePacket   = 0x00000003
+	pcapngBlockEnhancedPacket = 0x00000006
+	pcapngBlockSection        = pcapngMagic
+)
+
+// maxBlockSize is the largest packet record or block read from a file.
+const maxBlockSize = 1 << 24
+
+var (
+	// ErrInvalidPcap is returned when a file is not a pcap or pcapng file.
+	ErrInvalidPcap = errors.New("learn: invalid pcap file")
+
+	// ErrBlockTooLarge is returned when a packet record exceeds maxBlockSize.
+	ErrBlockTooLarge = errors.New("learn: pcap block too large")
+)
+
+// Packet represents a captured packet.
+type Packet struct {
+	Time     time.Time
+	LinkType int
+	Data     []byte
+}
+
+// ReadPackets reads all packets from a pcap or pcapng file.
+func ReadPackets(r io.Reader) ([]*Packet, error) {
+	br := bufio.NewReader(r)
+	buf, err := br.Peek(4)
+	if err == io.EOF {
+		return nil, ErrInvalidPcap
+	} else if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(buf) == pcapngMagic {
+		return readPcapNG(br)
+	}
+	return readPcap(br)
+}
+
+// readPcap reads packets from a libpcap formatted file.
+func readPcap(r io.Reader) ([]*Packet, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, ErrInvalidPcap
+	}
+
+	// Determine byte order & timestamp precision from the magic number.
+	var order binary.ByteOrder
+	var nano bool
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicMicro:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == pcapMagicMicro:
+		order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr) == pcapMagicNano:
+		order, nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr) == pcapMagicNano:
+		order, nano = binary.BigEndian, true
+	default:
+		return nil, ErrInvalidPcap
+	}
+	linkType := int(order.Uint32(hdr[20:]))
+
+	var packets []*Packet
+	rec := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, rec); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("learn: cannot read packet record: %s", err)
+		}
+
+		sec, frac := int64(order.Uint32(rec[0:])), int64(order.Uint32(rec[4:]))
+		if !nano {
+			frac *= 1000
+		}
+
+		n := order.Uint32(rec[8:])
+		if n > maxBlockSize {
+			return nil, ErrBlockTooLarge
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("learn: cannot read packet data: %s", err)
+		}
+
+		packets = append(packets, &Packet{
+			Time:     time.Unix(sec, frac).UTC(),
+			LinkType: linkType,
+			Data:     data,
+		})
+	}
+}
+
+// pcapngInterface represents an interface description block.
+type pcapngInterface struct {
+	linkType int
+	snapLen  uint32
+	tsUnit   float64 // seconds per timestamp unit
+}
+
+// readPcapNG reads packets from a pcapng formatted file. Each section may
+// use a different byte order & interfaces are reset between sections.
+func readPcapNG(r io.Reader) ([]*Packet, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	var ifaces []*pcapngInterface
+	var packets []*Packet
+
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("learn: cannot read block header: %s", err)
+		}
+
+		// Section headers specify the byte order of the following blocks.
+		blockType := order.Uint32(hdr)
+		if binary.LittleEndian.Uint32(hdr) == pcapngBlockSection {
+			bom := make([]byte, 4)
+			if _, err := io.ReadFull(r, bom); err != nil {
+				return nil, ErrInvalidPcap
+			}
+			switch {
+			case binary.LittleEndian.Uint32(bom) == pcapngBOM:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(bom) == pcapngBOM:
+				order = binary.BigEndian
+			default:
+				return nil, ErrInvalidPcap
+			}
+			blockType, ifaces = pcapngBlockSection, nil
+		}
+
+		// Read remaining body & trailing length.
+		n := order.Uint32(hdr[4:])
+		if n > maxBlockSize {
+			return nil, ErrBlockTooLarge
+		} else if n < 12 || n%4 != 0 {
+			return nil, ErrInvalidPcap
+		}
+		headerN := uint32(8)
+		if blockType == pcapngBlockSection {
+			headerN = 12
+		}
+		if n < headerN+4 {
+			return nil, ErrInvalidPcap
+		}
+		body := make([]byte, n-headerN)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("learn: cannot read block: %s", err)
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case pcapngBlockInterface:
+			iface, err := parsePcapNGInterface(body, order)
+			if err != nil {
+				return nil, err
+			}
+			ifaces = append(ifaces, iface)
+
+		case pcapngBlockEnhancedPacket:
+			if len(body) < 20 {
+				return nil, ErrInvalidPcap
+			}
+			id := order.Uint32(body[0:])
+			if int(id) >= len(ifaces) {
+				return nil, fmt.Errorf("learn: unknown interface: %d", id)
+			}
+			iface := ifaces[id]
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			capLen := order.Uint32(body[12:])
+			if int(capLen) > len(body)-20 {
+				return nil, ErrInvalidPcap
+			}
+			packets = append(packets, &Packet{
+				Time:     iface.time(ts),
+				LinkType: iface.linkType,
+				Data:     append([]byte(nil), body[20:20+capLen]...),
+			})
+
+		case pcapngBlockSimplePacket:
+			if len(body) < 4 || len(ifaces) == 0 {
+				return nil, ErrInvalidPcap
+			}
+			iface := ifaces[0]
+			capLen := order.Uint32(body[0:])
+			if iface.snapLen > 0 && capLen > iface.snapLen {
+				capLen = iface.snapLen
+			}
+			if int(capLen) > len(body)-4 {
+				capLen = uint32(len(body) - 4)
+			}
+			packets = append(packets, &Packet{
+				LinkType: iface.linkType,
+				Data:     append([]byte(nil), body[4:4+capLen]...),
+			})
+		}
+	}
+}
+
+// parsePcapNGInterface parses the body of an interface description block.
+func parsePcapNGInterface(body []byte, order binary.ByteOrder) (*pcapngInterface, error) {
+	if len(body) < 8 {
+		return nil, ErrInvalidPcap
+	}
+	iface := &pcapngInterface{
+		linkType: int(order.Uint16(body[0:])),
+		snapLen:  order.Uint32(body[4:]),
+		tsUnit:   1e-6,
+	}
+
+	// Read the timestamp resolution option, if set. Option values are
+	// padded to 32 bits.
+	for opts := body[8:]; len(opts) >= 4; {
+		code, n := order.Uint16(opts[0:]), int(order.Uint16(opts[2:]))
+		if code == 0 {
+			break
+		} else if len(opts) < 4+(n+3)/4*4 {
+			return nil, ErrInvalidPcap
+		}
+		if code == 9 && n >= 1 {
+			if v := opts[4]; v&0x80 == 0 {
+				iface.tsUnit = math.Pow(10, -float64(v))
+			} else {
+				iface.tsUnit = math.Pow(2, -float64(v&0x7f))
+			}
+		}
+		opts = opts[4+(n+3)/4*4:]
+	}
+	return iface, nil
+}
+
+// time converts a timestamp in interface units to a time.
+func (iface *pcapngInterface) time(ts uint64) time.Time {
+	unitsPerSec := uint64(math.Round(1 / iface.tsUnit))
+	if unitsPerSec == 0 {
+		return time.Unix(0, 0).UTC()
+	}
+	sec, frac := ts/unitsPerSec, ts%unitsPerSec
+	return time.Unix(int64(sec), int64(float64(frac)*iface.tsUnit*1e9)).UTC()
+}
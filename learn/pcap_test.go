@@ -0,0 +1,243 @@
+package learn_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redjack/marionette/learn"
+)
+
+func TestReadPackets(t *testing.T) {
+	packets := []*learn.Packet{
+		{Time: time.Unix(100, 250000000).UTC(), LinkType: learn.LinkTypeEthernet, Data: []byte("foo")},
+		{Time: time.Unix(101, 0).UTC(), LinkType: learn.LinkTypeEthernet, Data: []byte("barbaz")},
+	}
+
+	t.Run("Pcap", func(t *testing.T) {
+		other, err := learn.ReadPackets(bytes.NewReader(MustEncodePcap(t, binary.LittleEndian, packets)))
+		if err != nil {
+			t.Fatal(err)
+		} else if diff := cmp.Diff(packets, other); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("PcapBigEndian", func(t *testing.T) {
+		other, err := learn.ReadPackets(bytes.NewReader(MustEncodePcap(t, binary.BigEndian, packets)))
+		if err != nil {
+			t.Fatal(err)
+		} else if diff := cmp.Diff(packets, other); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("PcapNG", func(t *testing.T) {
+		other, err := learn.ReadPackets(bytes.NewReader(MustEncodePcapNG(t, packets)))
+		if err != nil {
+			t.Fatal(err)
+		} else if diff := cmp.Diff(packets, other); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("ErrInvalidPcap", func(t *testing.T) {
+		if _, err := learn.ReadPackets(bytes.NewReader([]byte("not a pcap file at all"))); err != learn.ErrInvalidPcap {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if _, err := learn.ReadPackets(bytes.NewReader(nil)); err != learn.ErrInvalidPcap {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure an interface option longer than its block is rejected.
+	t.Run("ErrTruncatedOption", func(t *testing.T) {
+		data := MustEncodePcapNG(t, packets)
+		binary.LittleEndian.PutUint16(data[46:], 16) // if_tsresol length
+		if _, err := learn.ReadPackets(bytes.NewReader(data)); err != learn.ErrInvalidPcap {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure truncated & corrupted files return an error instead of panicking.
+	t.Run("Corrupt", func(t *testing.T) {
+		for _, data := range [][]byte{
+			MustEncodePcap(t, binary.LittleEndian, packets),
+			MustEncodePcapNG(t, packets),
+		} {
+			for i := range data {
+				learn.ReadPackets(bytes.NewReader(data[:i]))
+			}
+
+			rnd := rand.New(rand.NewSource(0))
+			for i := 0; i < 1000; i++ {
+				other := append([]byte(nil), data...)
+				for j := rnd.Intn(4); j >= 0; j-- {
+					other[rnd.Intn(len(other))] = byte(rnd.Intn(256))
+				}
+				learn.ReadPackets(bytes.NewReader(other))
+			}
+		}
+	})
+}
+
+func TestDecodeSegment(t *testing.T) {
+	t.Run("IPv4", func(t *testing.T) {
+		p := NewTCPPacket(time.Unix(100, 0).UTC(), "10.0.0.1:5000", "10.0.0.2:80", 1234, learn.TCPFlagACK, []byte("hello"))
+		seg := learn.DecodeSegment(p)
+		if diff := cmp.Diff(seg, &learn.Segment{
+			Time:    time.Unix(100, 0).UTC(),
+			Src:     "10.0.0.1:5000",
+			Dst:     "10.0.0.2:80",
+			Seq:     1234,
+			Flags:   learn.TCPFlagACK,
+			Payload: []byte("hello"),
+		}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("Padding", func(t *testing.T) {
+		p := NewTCPPacket(time.Unix(100, 0).UTC(), "10.0.0.1:5000", "10.0.0.2:80", 1, learn.TCPFlagSYN, nil)
+		p.Data = append(p.Data, 0, 0, 0, 0, 0, 0)
+		if seg := learn.DecodeSegment(p); seg == nil {
+			t.Fatal("expected segment")
+		} else if len(seg.Payload) != 0 {
+			t.Fatalf("unexpected payload: %q", seg.Payload)
+		}
+	})
+
+	t.Run("UDP", func(t *testing.T) {
+		p := NewTCPPacket(time.Unix(100, 0).UTC(), "10.0.0.1:5000", "10.0.0.2:80", 1, 0, nil)
+		p.Data[14+9] = 17
+		if seg := learn.DecodeSegment(p); seg != nil {
+			t.Fatalf("unexpected segment: %#v", seg)
+		}
+	})
+
+	t.Run("UnsupportedLinkType", func(t *testing.T) {
+		p := NewTCPPacket(time.Unix(100, 0).UTC(), "10.0.0.1:5000", "10.0.0.2:80", 1, 0, nil)
+		p.LinkType = 9999
+		if seg := learn.DecodeSegment(p); seg != nil {
+			t.Fatalf("unexpected segment: %#v", seg)
+		}
+	})
+}
+
+// NewTCPPacket returns an Ethernet/IPv4/TCP packet.
+func NewTCPPacket(t time.Time, src, dst string, seq uint32, flags uint8, payload []byte) *learn.Packet {
+	srcIP, srcPort := splitAddr(src)
+	dstIP, dstPort := splitAddr(dst)
+
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	tcp = append(tcp, payload...)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(tcp)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], srcIP.To4())
+	copy(ip[16:], dstIP.To4())
+
+	eth := make([]byte, 14)
+	binary.BigEndian.PutUint16(eth[12:], 0x0800)
+
+	data := append(append(eth, ip...), tcp...)
+	return &learn.Packet{Time: t, LinkType: learn.LinkTypeEthernet, Data: data}
+}
+
+func splitAddr(addr string) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		panic(err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		panic(err)
+	}
+	return net.ParseIP(host), uint16(n)
+}
+
+// MustEncodePcap returns packets encoded as a libpcap file with microsecond timestamps.
+func MustEncodePcap(tb testing.TB, order binary.ByteOrder, packets []*learn.Packet) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	hdr := make([]byte, 24)
+	order.PutUint32(hdr[0:], 0xa1b2c3d4)
+	order.PutUint16(hdr[4:], 2)
+	order.PutUint16(hdr[6:], 4)
+	order.PutUint32(hdr[16:], 65535)
+	order.PutUint32(hdr[20:], learn.LinkTypeEthernet)
+	buf.Write(hdr)
+
+	for _, p := range packets {
+		rec := make([]byte, 16)
+		order.PutUint32(rec[0:], uint32(p.Time.Unix()))
+		order.PutUint32(rec[4:], uint32(p.Time.Nanosecond()/1000))
+		order.PutUint32(rec[8:], uint32(len(p.Data)))
+		order.PutUint32(rec[12:], uint32(len(p.Data)))
+		buf.Write(rec)
+		buf.Write(p.Data)
+	}
+	return buf.Bytes()
+}
+
+// MustEncodePcapNG returns packets encoded as a pcapng file with a single
+// interface using nanosecond timestamps.
+func MustEncodePcapNG(tb testing.TB, packets []*learn.Packet) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	writeBlock := func(typ uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		b := make([]byte, 8, 12+len(body))
+		binary.LittleEndian.PutUint32(b[0:], typ)
+		binary.LittleEndian.PutUint32(b[4:], uint32(12+len(body)))
+		b = append(b, body...)
+		b = append(b, b[4:8]...)
+		buf.Write(b)
+	}
+
+	// Section header block.
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], 0x1a2b3c4d)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	writeBlock(0x0a0d0d0a, shb)
+
+	// Interface description block with if_tsresol=9.
+	idb := make([]byte, 8, 20)
+	binary.LittleEndian.PutUint16(idb[0:], learn.LinkTypeEthernet)
+	binary.LittleEndian.PutUint32(idb[4:], 65535)
+	idb = append(idb, 9, 0, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0)
+	writeBlock(1, idb)
+
+	// Enhanced packet blocks.
+	for _, p := range packets {
+		ts := uint64(p.Time.UnixNano())
+		epb := make([]byte, 20)
+		binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+		binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+		binary.LittleEndian.PutUint32(epb[12:], uint32(len(p.Data)))
+		binary.LittleEndian.PutUint32(epb[16:], uint32(len(p.Data)))
+		writeBlock(6, append(epb, p.Data...))
+	}
+	return buf.Bytes()
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
@@ -22,9 +23,11 @@ type Listener struct {
 	mu         sync.RWMutex
 	iface      string
 	ln         net.Listener
-	conns      map[net.Conn]struct{}
+	conns      map[net.Conn]*StreamSet
 	doc        *mar.Document
+	key        []byte
 	newStreams chan *Stream
+	sessions   *sessionRegistry
 	err        error
 
 	ctx    context.Context
@@ -35,40 +38,103 @@ type Listener struct {
 	closing chan struct{}
 	closed  bool
 
-	// Specifies directory for dumping stream traces. Passed to StreamSet.TracePath.
+	// Closed when the listener starts draining its streams.
+	draining  chan struct{}
+	drainOnce sync.Once
+
+	// Specifies directory for dumping stream & connection traces. Passed to
+	// StreamSet.TracePath. Each connection is traced to a separate JSONL file.
 	TracePath string
-}
 
-// Listen returns a new instance of Listener.
-func Listen(doc *mar.Document, iface string) (*Listener, error) {
-	// Parse port from MAR specification.
-	port, err := strconv.Atoi(doc.Port)
-	if err != nil {
-		return nil, errors.New("invalid connection port")
-	}
-	addr := net.JoinHostPort(iface, strconv.Itoa(port))
+	// Long-term private key of the server. If set, clients must negotiate an
+	// ephemeral session key before sending stream data. See GenerateServerKey().
+	PrivateKey []byte
 
-	Logger.Debug("listen", zap.String("transport", doc.Transport), zap.String("bind", addr))
+	// Opens the underlying network listener. Defaults to listening on the
+	// document's transport. Packet-based transports are demultiplexed by
+	// remote address.
+	Listen func(network, address string) (net.Listener, error)
 
-	ln, err := net.Listen(doc.Transport, addr)
-	if err != nil {
-		return nil, err
-	}
+	// Time to keep a client session's streams after its last connection
+	// closes. Connections from the same session share streams so streams
+	// can outlive the connection they were created on.
+	SessionTimeout time.Duration
+
+	// Clock used by connections & stream sets for sleeps & timeouts.
+	// Defaults to DefaultClock.
+	Clock Clock
+
+	// Buffer sizes for accepted streams. Passed to StreamSet.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Time allowed on close for buffered stream data to be sent to clients
+	// before connections are closed. Defaults to DefaultDrainTimeout.
+	DrainTimeout time.Duration
+}
+
+// NewListener returns a new instance of Listener.
+// The key is the FTE key material shared with clients. See fte.NewKey().
+func NewListener(doc *mar.Document, iface string, key []byte) *Listener {
 	l := &Listener{
-		ln:         ln,
 		iface:      iface,
 		doc:        doc,
-		conns:      make(map[net.Conn]struct{}),
+		key:        key,
+		conns:      make(map[net.Conn]*StreamSet),
 		newStreams: make(chan *Stream),
 		closing:    make(chan struct{}),
+		draining:   make(chan struct{}),
+
+		SessionTimeout:  DefaultSessionTimeout,
+		Clock:           DefaultClock,
+		ReadBufferSize:  DefaultStreamBufferSize,
+		WriteBufferSize: DefaultStreamBufferSize,
+		DrainTimeout:    DefaultDrainTimeout,
 	}
 	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l
+}
+
+// Listen returns a new, opened instance of Listener.
+func Listen(doc *mar.Document, iface string, key []byte) (*Listener, error) {
+	l := NewListener(doc, iface, key)
+	if err := l.Open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Open starts listening on the port specified by the document.
+func (l *Listener) Open() error {
+	if l.PrivateKey != nil && len(l.PrivateKey) != NegotiateKeySize {
+		return ErrInvalidNegotiateKey
+	}
+
+	// Parse port from MAR specification.
+	port, err := strconv.Atoi(l.doc.Port)
+	if err != nil {
+		return errors.New("invalid connection port")
+	}
+	addr := net.JoinHostPort(l.iface, strconv.Itoa(port))
+
+	Logger.Debug("listen", zap.String("transport", l.doc.Transport), zap.String("bind", addr))
+
+	listenFn := l.Listen
+	if listenFn == nil {
+		listenFn = listen
+	}
+	ln, err := listenFn(l.doc.Transport, addr)
+	if err != nil {
+		return err
+	}
+	l.ln = ln
+	l.sessions = newSessionRegistry(l.newStreamSet, l.SessionTimeout, l.Clock)
 
 	// Hand off connection handling to separate goroutine.
 	l.wg.Add(1)
 	go func() { defer l.wg.Done(); l.accept() }()
 
-	return l, nil
+	return nil
 }
 
 // Err returns the last error that occurred on the listener.
@@ -81,9 +147,15 @@ func (l *Listener) Err() error {
 // Addr returns the underlying network address.
 func (l *Listener) Addr() net.Addr { return l.ln.Addr() }
 
-// Close stops the listener and waits for the connections to finish.
-func (l *Listener) Close() error {
-	err := l.ln.Close()
+// Close stops the listener and waits for the connections to finish. New
+// connections & streams are refused while existing streams are ended and
+// given up to DrainTimeout to send their buffered data.
+func (l *Listener) Close() (err error) {
+	l.drain()
+
+	if l.ln != nil {
+		err = l.ln.Close()
+	}
 
 	l.mu.Lock()
 	l.closed = true
@@ -101,9 +173,57 @@ func (l *Listener) Close() error {
 	})
 	l.wg.Wait()
 
+	if l.sessions != nil {
+		if e := l.sessions.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
 	return err
 }
 
+// drain stops accepting streams and waits for existing streams to flush.
+// Only the first call drains. The network listener is left open so that
+// packet-based connections can continue to send.
+func (l *Listener) drain() {
+	var draining bool
+	l.drainOnce.Do(func() {
+		close(l.draining)
+		draining = true
+	})
+	if !draining || l.ln == nil {
+		return
+	}
+
+	// Drain connections which have not joined a session & active sessions.
+	l.mu.RLock()
+	streamSets := make([]*StreamSet, 0, len(l.conns))
+	for _, streamSet := range l.conns {
+		streamSets = append(streamSets, streamSet)
+	}
+	l.mu.RUnlock()
+	streamSets = append(streamSets, l.sessions.activeStreamSets()...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.DrainTimeout)
+	defer cancel()
+	for _, streamSet := range streamSets {
+		if err := streamSet.Drain(ctx); err != nil {
+			Logger.Debug("listener drain timeout", zap.Error(err))
+			return
+		}
+	}
+}
+
+// isDraining returns true if the listener has started closing.
+func (l *Listener) isDraining() bool {
+	select {
+	case <-l.draining:
+		return true
+	default:
+		return false
+	}
+}
+
 // Closed returns true if the listener has been closed.
 func (l *Listener) Closed() bool {
 	l.mu.RLock()
@@ -114,9 +234,18 @@ func (l *Listener) Closed() bool {
 
 // Accept waits for a new connection.
 func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for a new connection or until ctx is done.
+func (l *Listener) AcceptContext(ctx context.Context) (net.Conn, error) {
 	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case <-l.closing:
 		return nil, ErrListenerClosed
+	case <-l.draining:
+		return nil, ErrListenerClosed
 	case stream := <-l.newStreams:
 		return stream, l.Err()
 	}
@@ -131,7 +260,7 @@ func (l *Listener) accept() {
 		conn, err := l.ln.Accept()
 		if err != nil {
 			l.mu.Lock()
-			if l.closed {
+			if l.closed || l.isDraining() {
 				l.err = ErrListenerClosed
 			} else {
 				l.err = err
@@ -140,22 +269,37 @@ func (l *Listener) accept() {
 			return
 		}
 
-		streamSet := NewStreamSet()
-		streamSet.OnNewStream = l.onNewStream
-		streamSet.TracePath = l.TracePath
+		// Refuse new connections while draining.
+		if l.isDraining() {
+			conn.Close()
+			continue
+		}
 
-		fsm := NewFSM(l.doc, l.iface, PartyServer, conn, streamSet)
+		// Connections use their own stream set until the client identifies
+		// its session.
+		streamSet := l.newStreamSet()
+		streamSet.setAddrs(conn.LocalAddr(), conn.RemoteAddr())
+		fsm := newFSM(l.doc, l.iface, PartyServer, conn, streamSet, l.key, 0, createTracer(l.TracePath, PartyServer))
+		fsm.handshake = newHandshake(PartyServer, l.PrivateKey, nil)
+		fsm.sessions = l.sessions
+		fsm.setClock(l.Clock)
 
 		// Run execution in a separate goroutine.
 		l.wg.Add(1)
+		l.addConn(conn, streamSet)
 		go func() { defer l.wg.Done(); l.execute(fsm, conn) }()
 	}
 }
 
-func (l *Listener) execute(fsm FSM, conn net.Conn) {
-	l.addConn(conn)
+func (l *Listener) execute(fsm *fsm, conn net.Conn) {
+	defer conn.Close()
+	defer fsm.Close()
 	defer l.removeConn(conn)
 
+	// Resend undelivered cells over the session's other connections.
+	defer fsm.leaveSession()
+	defer fsm.requeue()
+
 	for !l.Closed() {
 		if err := fsm.Execute(l.ctx); err == ErrStreamClosed {
 			return
@@ -170,14 +314,31 @@ func (l *Listener) execute(fsm FSM, conn net.Conn) {
 	}
 }
 
+// newStreamSet returns a new stream set for a connection or session.
+func (l *Listener) newStreamSet() *StreamSet {
+	ss := NewStreamSet()
+	ss.OnNewStream = l.onNewStream
+	ss.TracePath = l.TracePath
+	ss.Clock = l.Clock
+	ss.ReadBufferSize = l.ReadBufferSize
+	ss.WriteBufferSize = l.WriteBufferSize
+	ss.gauge = activeStreams.WithLabelValues(l.ln.Addr().String())
+	return ss
+}
+
 // onNewStream is called everytime the FSM's stream set creates a new stream.
+// Streams are closed instead if the listener is draining.
 func (l *Listener) onNewStream(stream *Stream) {
-	l.newStreams <- stream
+	select {
+	case l.newStreams <- stream:
+	case <-l.draining:
+		stream.CloseWrite()
+	}
 }
 
-func (l *Listener) addConn(conn net.Conn) {
+func (l *Listener) addConn(conn net.Conn, streamSet *StreamSet) {
 	l.mu.Lock()
-	l.conns[conn] = struct{}{}
+	l.conns[conn] = streamSet
 	l.mu.Unlock()
 }
 
@@ -0,0 +1,165 @@
+package marionette_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+)
+
+func TestListener_AcceptContext(t *testing.T) {
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		ln := MustOpenListener(t, "http_simple_blocking", fte.NewKey([]byte("secret")))
+		defer ln.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := ln.AcceptContext(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrListenerClosed", func(t *testing.T) {
+		ln := MustOpenListener(t, "http_simple_blocking", fte.NewKey([]byte("secret")))
+		if err := ln.Close(); err != nil {
+			t.Fatal(err)
+		} else if _, err := ln.AcceptContext(context.Background()); err != marionette.ErrListenerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestListener_Close(t *testing.T) {
+	// Ensure shutdown does not wait for sleeps to complete.
+	t.Run("Sleep", func(t *testing.T) {
+		MustCloseWithin(t, []byte(`
+connection(tcp, 8080):
+  start      upstream   NULL     1.0
+  upstream   downstream http_get 1.0
+  downstream sleep      http_ok  1.0
+  sleep      end        pause    1.0
+
+action http_get:
+  client fte.send("^GET\ \/([a-zA-Z0-9\.\/]*) HTTP/1\.1\r\n\r\n$", 128)
+
+action http_ok:
+  server fte.send("^HTTP/1\.1\ 200 OK\r\nContent-Type:\ ([a-zA-Z0-9]+)\r\n\r\n\C*$", 128)
+
+action pause:
+  client model.sleep("{'60.0' : 1.0}")
+  server model.sleep("{'60.0' : 1.0}")
+`), time.Second)
+	})
+
+	// Ensure shutdown interrupts child FSMs started by model.spawn.
+	t.Run("Spawn", func(t *testing.T) {
+		MustCloseWithin(t, mar.Format("ftp_simple_blocking", ""), time.Second)
+	})
+
+	// Ensure buffered stream data is sent to the client before closing.
+	t.Run("Drain", func(t *testing.T) {
+		key := fte.NewKey([]byte("secret"))
+		ln := MustOpenListener(t, "http_simple_blocking", key)
+		defer ln.Close()
+
+		clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+		dialer.DrainTimeout = 100 * time.Millisecond // server closes first
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+
+		conn, err := dialer.DialContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		stream, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(stream, make([]byte, 3)); err != nil {
+			t.Fatal(err)
+		} else if _, err := stream.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+
+		errc := make(chan error, 1)
+		go func() { errc <- ln.Close() }()
+
+		// The client receives the data & end of stream.
+		if buf, err := ioutil.ReadAll(conn); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "bar" {
+			t.Fatalf("unexpected data: %q", buf)
+		} else if err := <-errc; err != nil {
+			t.Fatal(err)
+		} else if _, err := ln.Accept(); err != marionette.ErrListenerClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustCloseWithin connects a dialer & listener using the MAR document in data
+// and verifies that both close within d while the connection is executing.
+func MustCloseWithin(tb testing.TB, data []byte, d time.Duration) {
+	tb.Helper()
+	key := fte.NewKey([]byte("secret"))
+
+	serverDoc := mar.MustParse(marionette.PartyServer, data)
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	if err := ln.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	clientDoc := mar.MustParse(marionette.PartyClient, data)
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	states := make(chan marionette.ConnState, 100)
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+	dialer.OnConnStateChange = func(i int, state marionette.ConnState) { states <- state }
+	if err := dialer.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	defer dialer.Close()
+
+	// Allow the FSMs to move past the first exchange.
+	MustWaitConnStates(tb, states, marionette.ConnStateConnected)
+	time.Sleep(100 * time.Millisecond)
+
+	t0 := time.Now()
+	if err := dialer.Close(); err != nil {
+		tb.Fatal(err)
+	} else if err := ln.Close(); err != nil {
+		tb.Fatal(err)
+	} else if elapsed := time.Since(t0); elapsed > d {
+		tb.Fatalf("close took %s", elapsed)
+	}
+}
+
+// MustOpenListener returns an open listener for a format on a random local port.
+func MustOpenListener(tb testing.TB, format string, key []byte) *marionette.Listener {
+	doc := mar.MustParse(marionette.PartyServer, mar.Format(format, ""))
+	doc.Port = "0"
+
+	ln := marionette.NewListener(doc, "127.0.0.1", key)
+	if err := ln.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	return ln
+}
@@ -20,6 +20,9 @@ type Document struct {
 	UUID   int
 	Format string
 
+	// File the document was read from. Blank for built-in formats.
+	Path string
+
 	Connection   Pos
 	Lparen       Pos
 	Transport    string
@@ -0,0 +1,275 @@
+package mar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxGraphArgLen is the maximum length of an action argument in graph labels.
+// Longer arguments, such as regular expressions, are truncated.
+var MaxGraphArgLen = 40
+
+// WriteDOT writes doc to w as a Graphviz DOT digraph. Transitions are labeled
+// with their action block, probability, and per-party actions. Error
+// transitions are dashed. Formats spawned by model.spawn are drawn as clusters.
+// Spawned formats are read from the same version as name, if one is specified.
+func WriteDOT(w io.Writer, name string, doc *Document) error {
+	_, version := SplitFormat(name)
+	g := newGraph(name, version, doc, make(map[string]bool))
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %s {\n", strconv.Quote(name))
+	fmt.Fprintln(bw, "\trankdir=LR;")
+	fmt.Fprintln(bw, "\tnode [shape=ellipse];")
+	g.writeDOT(bw, "\t")
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// WriteMermaid writes doc to w as a Mermaid flowchart. The layout matches
+// WriteDOT() with spawned formats drawn as subgraphs.
+func WriteMermaid(w io.Writer, name string, doc *Document) error {
+	_, version := SplitFormat(name)
+	g := newGraph(name, version, doc, make(map[string]bool))
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "flowchart LR")
+	g.writeMermaid(bw, "    ", make(map[string]string))
+	return bw.Flush()
+}
+
+// graph represents a document and the formats it spawns.
+type graph struct {
+	name     string
+	doc      *Document
+	children []*graph
+	spawns   map[string][]string // spawned format names by action block
+	missing  map[string]bool     // spawned formats which could not be found
+}
+
+func newGraph(name, version string, doc *Document, seen map[string]bool) *graph {
+	g := &graph{
+		name:    name,
+		doc:     doc,
+		spawns:  make(map[string][]string),
+		missing: make(map[string]bool),
+	}
+	seen[name] = true
+
+	for _, blk := range doc.ActionBlocks {
+		for _, action := range blk.Actions {
+			if action.Name() != "model.spawn" || len(action.Args) == 0 {
+				continue
+			}
+			child, ok := action.Args[0].Value.(string)
+			if !ok {
+				continue
+			}
+			if !containsString(g.spawns[blk.Name], child) {
+				g.spawns[blk.Name] = append(g.spawns[blk.Name], child)
+			}
+
+			// Only render each spawned format once.
+			if seen[child] {
+				continue
+			}
+			childDoc, err := Parse("", Format(child, version))
+			if err != nil || len(childDoc.Transitions) == 0 {
+				g.missing[child] = true
+				continue
+			}
+			g.children = append(g.children, newGraph(child, version, childDoc, seen))
+		}
+	}
+	return g
+}
+
+// transitions returns the document transitions excluding the implicit
+// transitions out of the "end" & "dead" states added by Normalize().
+func (g *graph) transitions() []*Transition {
+	var a []*Transition
+	for _, t := range g.doc.Transitions {
+		if t.Source != "end" && t.Source != "dead" {
+			a = append(a, t)
+		}
+	}
+	return a
+}
+
+// states returns the unique state names in transition order.
+func (g *graph) states() []string {
+	var a []string
+	m := make(map[string]bool)
+	for _, t := range g.transitions() {
+		for _, state := range []string{t.Source, t.Destination} {
+			if !m[state] {
+				m[state] = true
+				a = append(a, state)
+			}
+		}
+	}
+	return a
+}
+
+// label returns the multi-line label for a transition.
+func (g *graph) label(t *Transition) []string {
+	var lines []string
+	if t.IsErrorTransition {
+		lines = append(lines, t.ActionBlock+" (error)")
+	} else {
+		lines = append(lines, fmt.Sprintf("%s p=%s", t.ActionBlock, strconv.FormatFloat(t.Probability, 'f', -1, 64)))
+	}
+
+	if blk := g.doc.ActionBlock(t.ActionBlock); blk != nil {
+		for _, action := range blk.Actions {
+			args := make([]string, len(action.Args))
+			for i, arg := range action.Args {
+				args[i] = formatGraphArg(arg.Value)
+			}
+
+			line := fmt.Sprintf("%s(%s)", action.Name(), strings.Join(args, ", "))
+			if action.Party != "" {
+				line = action.Party + ": " + line
+			}
+			if action.Regex != "" {
+				line += " if " + formatGraphArg(action.Regex)
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (g *graph) writeDOT(w io.Writer, indent string) {
+	id := func(state string) string { return strconv.Quote(g.name + "/" + state) }
+
+	for _, state := range g.states() {
+		attrs := fmt.Sprintf("label=%s", strconv.Quote(state))
+		switch state {
+		case "start":
+			attrs += ", shape=box"
+		case "end":
+			attrs += ", shape=doublecircle"
+		case "dead":
+			attrs += ", style=dotted"
+		}
+		fmt.Fprintf(w, "%s%s [%s];\n", indent, id(state), attrs)
+	}
+
+	for _, t := range g.transitions() {
+		attrs := fmt.Sprintf("label=%s", dotLabel(g.label(t)))
+		if t.IsErrorTransition {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(w, "%s%s -> %s [%s];\n", indent, id(t.Source), id(t.Destination), attrs)
+
+		for _, child := range g.spawns[t.ActionBlock] {
+			if g.missing[child] {
+				fmt.Fprintf(w, "%s%s [label=%s, shape=box, style=dashed];\n", indent, strconv.Quote(child+"/start"), strconv.Quote(child+" (not found)"))
+			}
+			fmt.Fprintf(w, "%s%s -> %s [label=\"spawn\", style=dotted];\n", indent, id(t.Source), strconv.Quote(child+"/start"))
+		}
+	}
+
+	for _, child := range g.children {
+		fmt.Fprintf(w, "%ssubgraph %s {\n", indent, strconv.Quote("cluster_"+child.name))
+		fmt.Fprintf(w, "%s\tlabel=%s;\n", indent, strconv.Quote(child.name))
+		child.writeDOT(w, indent+"\t")
+		fmt.Fprintf(w, "%s}\n", indent)
+	}
+}
+
+func (g *graph) writeMermaid(w io.Writer, indent string, ids map[string]string) {
+	// Mermaid requires simple identifiers so assign one to each node.
+	id := func(name string) string {
+		if s, ok := ids[name]; ok {
+			return s
+		}
+		ids[name] = "n" + strconv.Itoa(len(ids))
+		return ids[name]
+	}
+
+	for _, state := range g.states() {
+		switch state {
+		case "start":
+			fmt.Fprintf(w, "%s%s[%s]\n", indent, id(g.name+"/"+state), mermaidLabel([]string{state}))
+		case "end":
+			fmt.Fprintf(w, "%s%s(((%s)))\n", indent, id(g.name+"/"+state), mermaidLabel([]string{state}))
+		default:
+			fmt.Fprintf(w, "%s%s(%s)\n", indent, id(g.name+"/"+state), mermaidLabel([]string{state}))
+		}
+	}
+
+	for _, t := range g.transitions() {
+		arrow := "-->"
+		if t.IsErrorTransition {
+			arrow = "-.->"
+		}
+		fmt.Fprintf(w, "%s%s %s|%s| %s\n", indent, id(g.name+"/"+t.Source), arrow, mermaidLabel(g.label(t)), id(g.name+"/"+t.Destination))
+
+		for _, child := range g.spawns[t.ActionBlock] {
+			if g.missing[child] {
+				fmt.Fprintf(w, "%s%s[%s]\n", indent, id(child+"/start"), mermaidLabel([]string{child + " (not found)"}))
+			}
+			fmt.Fprintf(w, "%s%s -.->|spawn| %s\n", indent, id(g.name+"/"+t.Source), id(child+"/start"))
+		}
+	}
+
+	for _, child := range g.children {
+		fmt.Fprintf(w, "%ssubgraph %s[%s]\n", indent, id("cluster/"+child.name), mermaidLabel([]string{child.name}))
+		child.writeMermaid(w, indent+"    ", ids)
+		fmt.Fprintf(w, "%send\n", indent)
+	}
+}
+
+// formatGraphArg returns a short representation of an action argument.
+func formatGraphArg(v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+
+	if MaxGraphArgLen > 0 && len(s) > MaxGraphArgLen {
+		s = s[:MaxGraphArgLen] + "..."
+	}
+	return strconv.Quote(s)
+}
+
+// dotLabel returns a quoted DOT label with left-justified lines.
+func dotLabel(lines []string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for _, line := range lines {
+		line = strings.Replace(line, `\`, `\\`, -1)
+		line = strings.Replace(line, `"`, `\"`, -1)
+		buf.WriteString(line)
+		buf.WriteString(`\l`)
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// mermaidLabel returns a quoted Mermaid label. Quotes are escaped as entity
+// codes since Mermaid does not support backslash escapes.
+func mermaidLabel(lines []string) string {
+	for i, line := range lines {
+		line = strings.Replace(line, "#", "#35;", -1)
+		line = strings.Replace(line, `"`, "#quot;", -1)
+		line = strings.Replace(line, "<", "#lt;", -1)
+		line = strings.Replace(line, ">", "#gt;", -1)
+		lines[i] = line
+	}
+	return `"` + strings.Join(lines, "<br/>") + `"`
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package mar_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/redjack/marionette/mar"
+)
+
+func TestWriteDOT(t *testing.T) {
+	doc := MustParse(`connection(tcp, 80):
+  start upstream NULL 1.0
+  upstream end transfer 1.0
+  upstream end NULL error
+
+action transfer:
+  client model.spawn("ftp_pasv_transfer", 1)
+  server model.spawn("ftp_pasv_transfer", 1)
+`)
+
+	var buf bytes.Buffer
+	if err := mar.WriteDOT(&buf, "test", doc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		`digraph "test" {`,
+		`"test/start" [label="start", shape=box];`,
+		`"test/upstream" -> "test/end" [label="transfer p=1\lclient: model.spawn(\"ftp_pasv_transfer\", 1)\lserver: model.spawn(\"ftp_pasv_transfer\", 1)\l"];`,
+		`"test/upstream" -> "test/end" [label="NULL (error)\l", style=dashed];`,
+		`"test/upstream" -> "ftp_pasv_transfer/start" [label="spawn", style=dotted];`,
+		`subgraph "cluster_ftp_pasv_transfer" {`,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("expected output to contain %s:\n%s", s, buf.String())
+		}
+	}
+	if strings.Count(buf.String(), `-> "ftp_pasv_transfer/start"`) != 1 {
+		t.Fatalf("expected one spawn edge:\n%s", buf.String())
+	}
+
+	// Ensure spawned formats are read from the parent's version.
+	t.Run("Version", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := mar.WriteDOT(&buf, "test:20150701", doc); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(buf.String(), `subgraph "cluster_ftp_pasv_transfer" {`) {
+			t.Fatalf("expected spawned format:\n%s", buf.String())
+		}
+
+		buf.Reset()
+		if err := mar.WriteDOT(&buf, "test:20150702", doc); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(buf.String(), `"ftp_pasv_transfer/start" [label="ftp_pasv_transfer (not found)", shape=box, style=dashed];`) {
+			t.Fatalf("expected missing spawned format:\n%s", buf.String())
+		}
+	})
+}
+
+func TestWriteMermaid(t *testing.T) {
+	doc := MustParse(`connection(tcp, 80):
+  start upstream NULL 1.0
+  upstream end http_get 1.0
+
+action http_get:
+  client fte.send("^GET\ /\r\n$", 128)
+`)
+
+	var buf bytes.Buffer
+	if err := mar.WriteMermaid(&buf, "test", doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := `flowchart LR
+    n0["start"]
+    n1("upstream")
+    n2((("end")))
+    n0 -->|"NULL p=1"| n1
+    n1 -->|"http_get p=1<br/>client: fte.send(#quot;^GET\\ /\r\n$#quot;, 128)"| n2
+`; buf.String() != exp {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
@@ -42,6 +42,15 @@ func ReadFormat(name string) ([]byte, error) {
 	return ioutil.ReadFile(name)
 }
 
+// FormatPath returns the file path of a format read by ReadFormat().
+// Returns blank for built-in formats.
+func FormatPath(name string) string {
+	if data := Format(SplitFormat(name)); data != nil {
+		return ""
+	}
+	return name
+}
+
 // Formats returns a list of available built-in formats.
 // Excludes formats that are only to be spawned by other formats.
 func Formats() []string {
@@ -20,3 +20,11 @@ func TestFormat(t *testing.T) {
 		}
 	})
 }
+
+func TestFormatPath(t *testing.T) {
+	if path := mar.FormatPath("http_simple_blocking:20150701"); path != "" {
+		t.Fatalf("unexpected path: %q", path)
+	} else if path := mar.FormatPath("formats/custom.mar"); path != "formats/custom.mar" {
+		t.Fatalf("unexpected path: %q", path)
+	}
+}
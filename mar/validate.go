@@ -0,0 +1,283 @@
+package mar
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+)
+
+// Argument types used by ExpectArgs().
+const (
+	ArgString = "string"
+	ArgInt    = "int"
+	ArgFloat  = "float"
+)
+
+// ArgsValidator validates the arguments passed to an action.
+type ArgsValidator func(args []*Arg) error
+
+var actions = make(map[string]ArgsValidator)
+
+// RegisterAction marks module.method as a known action for Validate().
+// If no actions are registered then action names are not validated.
+func RegisterAction(module, method string) {
+	if _, ok := actions[module+"."+method]; !ok {
+		actions[module+"."+method] = nil
+	}
+}
+
+// RegisterArgsValidator sets the validator used to check the arguments of
+// module.method. The action is also registered if it is not already.
+func RegisterArgsValidator(module, method string, fn ArgsValidator) {
+	actions[module+"."+method] = fn
+}
+
+// ExpectArgs returns an ArgsValidator which checks the number & type of arguments.
+// ArgFloat arguments also accept integers.
+func ExpectArgs(types ...string) ArgsValidator {
+	return func(args []*Arg) error {
+		if len(args) != len(types) {
+			return fmt.Errorf("expected %d argument(s), found %d", len(types), len(args))
+		}
+
+		for i, arg := range args {
+			var ok bool
+			switch types[i] {
+			case ArgString:
+				_, ok = arg.Value.(string)
+			case ArgInt:
+				_, ok = arg.Value.(int)
+			case ArgFloat:
+				switch arg.Value.(type) {
+				case int, float64:
+					ok = true
+				}
+			}
+			if !ok {
+				return &ValidationError{
+					Message: fmt.Sprintf("argument %d: expected %s, found %s", i+1, types[i], argType(arg.Value)),
+					Pos:     arg.Pos,
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func argType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return ArgString
+	case int:
+		return ArgInt
+	case float64:
+		return ArgFloat
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// ValidationError represents a problem found in a document by Validate().
+type ValidationError struct {
+	Message string
+	Pos     Pos
+
+	// If true, the document can run but may not behave as intended.
+	Warning bool
+}
+
+// Error returns the message prefixed with the one-based line & char position.
+func (e *ValidationError) Error() string {
+	if e.Warning {
+		return fmt.Sprintf("%d:%d: warning: %s", e.Pos.Line+1, e.Pos.Char+1, e.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Pos.Line+1, e.Pos.Char+1, e.Message)
+}
+
+// Validate checks doc for problems which would cause it to fail at runtime.
+// All problems are returned in document order.
+func Validate(doc *Document) []*ValidationError {
+	v := &validator{doc: doc, blocks: make(map[string]bool)}
+	Walk(v, doc)
+	v.validateProbabilities()
+	v.validateReachability()
+
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		if a, b := v.errs[i].Pos, v.errs[j].Pos; a.Line != b.Line {
+			return a.Line < b.Line
+		} else {
+			return a.Char < b.Char
+		}
+	})
+	return v.errs
+}
+
+type validator struct {
+	doc    *Document
+	blocks map[string]bool // action block names already visited
+	errs   []*ValidationError
+}
+
+// Visit checks each transition, action block & action in the document.
+func (v *validator) Visit(node Node) Visitor {
+	switch node := node.(type) {
+	case *Transition:
+		v.validateTransition(node)
+	case *ActionBlock:
+		v.validateActionBlock(node)
+	case *Action:
+		v.validateAction(node)
+	}
+	return v
+}
+
+func (v *validator) errorf(pos Pos, format string, a ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{Message: fmt.Sprintf(format, a...), Pos: pos})
+}
+
+func (v *validator) warnf(pos Pos, format string, a ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{Message: fmt.Sprintf(format, a...), Pos: pos, Warning: true})
+}
+
+// validateTransition ensures a transition only references a defined action block.
+func (v *validator) validateTransition(t *Transition) {
+	if t.ActionBlock != "NULL" && v.doc.ActionBlock(t.ActionBlock) == nil {
+		v.errorf(t.ActionBlockPos, "action block not found: %s", t.ActionBlock)
+	}
+}
+
+// validateActionBlock ensures an action block is only defined once.
+func (v *validator) validateActionBlock(blk *ActionBlock) {
+	if v.blocks[blk.Name] {
+		v.errorf(blk.NamePos, "action block redefined: %s", blk.Name)
+	}
+	v.blocks[blk.Name] = true
+}
+
+// validateProbabilities ensures the probabilities of non-error transitions out
+// of each state sum to one. Sums within 0.01 are allowed so that rounded
+// fractions, such as three transitions of 0.33, are accepted.
+func (v *validator) validateProbabilities() {
+	for _, state := range v.sources() {
+		transitions := FilterNonErrorTransitions(FilterTransitionsBySource(v.doc.Transitions, state))
+		if len(transitions) == 0 {
+			continue
+		}
+
+		var sum float64
+		for _, t := range transitions {
+			if t.Probability < 0 || t.Probability > 1 {
+				v.errorf(t.ProbabilityPos, "probability out of range: %g", t.Probability)
+			}
+			sum += t.Probability
+		}
+		if math.Abs(sum-1) > 0.01+1e-9 {
+			v.errorf(transitions[0].SourcePos, "probabilities from state %q sum to %g, expected 1", state, sum)
+		}
+	}
+}
+
+// validateReachability ensures every state is reachable from "start" and has
+// at least one transition. States which loop without reaching "end" are
+// reported as warnings since some formats intentionally run until closed.
+func (v *validator) validateReachability() {
+	forward := make(map[string][]string)
+	reverse := make(map[string][]string)
+	for _, t := range v.doc.Transitions {
+		if !t.IsErrorTransition && t.Probability <= 0 {
+			continue
+		}
+		forward[t.Source] = append(forward[t.Source], t.Destination)
+		reverse[t.Destination] = append(reverse[t.Destination], t.Source)
+	}
+
+	reachable := visitStates("start", forward)
+	terminal := visitStates("end", reverse)
+
+	// Report destination states which cannot transition anywhere.
+	seen := make(map[string]bool)
+	for _, t := range v.doc.Transitions {
+		if seen[t.Destination] || t.Destination == "end" || t.Destination == "dead" {
+			continue
+		}
+		seen[t.Destination] = true
+
+		if len(FilterTransitionsBySource(v.doc.Transitions, t.Destination)) == 0 {
+			v.errorf(t.DestinationPos, "state %q has no transitions", t.Destination)
+		}
+	}
+
+	for _, state := range v.sources() {
+		if state == "end" || state == "dead" {
+			continue
+		}
+
+		pos := FilterTransitionsBySource(v.doc.Transitions, state)[0].SourcePos
+		if !reachable[state] {
+			v.errorf(pos, "state %q is unreachable from start", state)
+		} else if !terminal[state] {
+			v.warnf(pos, "state %q has no path to end", state)
+		}
+	}
+}
+
+// visitStates returns the set of states reachable from name using edges.
+func visitStates(name string, edges map[string][]string) map[string]bool {
+	m := map[string]bool{name: true}
+	for queue := []string{name}; len(queue) > 0; queue = queue[1:] {
+		for _, other := range edges[queue[0]] {
+			if !m[other] {
+				m[other] = true
+				queue = append(queue, other)
+			}
+		}
+	}
+	return m
+}
+
+// validateAction ensures an action references a registered plugin and passes
+// valid arguments.
+func (v *validator) validateAction(action *Action) {
+	if action.Party != "" && action.Party != "client" && action.Party != "server" {
+		v.errorf(action.PartyPos, "invalid party: %s", action.Party)
+	}
+	if action.Regex != "" {
+		if _, err := regexp.Compile(action.Regex); err != nil {
+			v.errorf(action.RegexPos, "invalid regex_match_incoming: %s", err)
+		}
+	}
+
+	if len(actions) == 0 {
+		return
+	}
+
+	fn, ok := actions[action.Name()]
+	if !ok {
+		v.errorf(action.ModulePos, "unknown action: %s", action.Name())
+		return
+	} else if fn == nil {
+		return
+	}
+
+	if err := fn(action.Args); err != nil {
+		if e, ok := err.(*ValidationError); ok {
+			v.errorf(e.Pos, "%s: %s", action.Name(), e.Message)
+		} else {
+			v.errorf(action.ModulePos, "%s: %s", action.Name(), err)
+		}
+	}
+}
+
+// sources returns the unique source state names in document order.
+func (v *validator) sources() []string {
+	var a []string
+	m := make(map[string]bool)
+	for _, t := range v.doc.Transitions {
+		if !m[t.Source] {
+			m[t.Source] = true
+			a = append(a, t.Source)
+		}
+	}
+	return a
+}
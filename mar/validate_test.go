@@ -0,0 +1,86 @@
+package mar_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/redjack/marionette/mar"
+)
+
+func TestValidate(t *testing.T) {
+	mar.RegisterArgsValidator("test", "send", mar.ExpectArgs(mar.ArgString, mar.ArgInt))
+	mar.RegisterAction("test", "recv")
+
+	t.Run("OK", func(t *testing.T) {
+		doc := MustParse(`connection(tcp, 80):
+  start upstream NULL 1.0
+  upstream end http_get 1.0
+
+action http_get:
+  client test.send("foo", 128)
+  server test.recv()
+`)
+		if errs := mar.Validate(doc); len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		doc := MustParse(`connection(tcp, 80):
+  start upstream NULL 0.5
+  upstream end http_get 1.0
+  upstream missing http_post 0.0
+  orphan end NULL 1.0
+
+action http_get:
+  client test.send(128, 128)
+  server test.unknown()
+`)
+		exp := []string{
+			`2:3: probabilities from state "start" sum to 0.5, expected 1`,
+			`4:12: state "missing" has no transitions`,
+			`4:20: action block not found: http_post`,
+			`5:3: state "orphan" is unreachable from start`,
+			`8:20: test.send: argument 1: expected string, found int`,
+			`9:10: unknown action: test.unknown`,
+		}
+		if errs := ErrorStrings(mar.Validate(doc)); !reflect.DeepEqual(errs, exp) {
+			t.Fatalf("unexpected errors: %#v", errs)
+		}
+	})
+
+	t.Run("Warning", func(t *testing.T) {
+		doc := MustParse(`connection(tcp, 80):
+  start upstream NULL 1.0
+  upstream downstream NULL 1.0
+  downstream upstream NULL 1.0
+`)
+		errs := mar.Validate(doc)
+		if len(errs) != 3 {
+			t.Fatalf("unexpected error count: %d", len(errs))
+		}
+		for _, err := range errs {
+			if !err.Warning {
+				t.Fatalf("expected warning: %s", err)
+			}
+		}
+	})
+}
+
+// MustParse parses data into a document. Panic on error.
+func MustParse(data string) *mar.Document {
+	doc, err := Parse("", data)
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// ErrorStrings converts a list of validation errors to strings.
+func ErrorStrings(errs []*mar.ValidationError) []string {
+	a := make([]string, len(errs))
+	for i := range errs {
+		a[i] = errs[i].Error()
+	}
+	return a
+}
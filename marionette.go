@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
@@ -43,6 +44,7 @@ func RegisterPlugin(module, method string, fn PluginFunc) {
 		panic("plugin already registered")
 	}
 	plugins[pluginKey{module, method}] = fn
+	mar.RegisterAction(module, method)
 }
 
 type pluginKey struct {
@@ -1,10 +1,14 @@
 package marionette_test
 
 import (
+	"flag"
 	"math/rand"
+	"os"
+	"testing"
 
 	"github.com/redjack/marionette"
 	_ "github.com/redjack/marionette/plugins"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -12,6 +16,14 @@ func init() {
 	marionette.Rand = NewRand
 }
 
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		marionette.Logger = zap.NewNop()
+	}
+	os.Exit(m.Run())
+}
+
 // NewRand returns a PRNG with a zero source.
 func NewRand() *rand.Rand {
 	return rand.New(rand.NewSource(0))
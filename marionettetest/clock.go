@@ -0,0 +1,97 @@
+package marionettetest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redjack/marionette"
+)
+
+// Ensure type implements interface.
+var _ marionette.Clock = (*Clock)(nil)
+
+// Clock represents a fake clock. Sleeping advances the clock immediately
+// instead of blocking. Timers fire once the clock is advanced past them.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	slept  time.Duration
+	timers []*clockTimer
+}
+
+// NewClock returns a new Clock set to t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the current virtual time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the virtual time once the clock
+// has been advanced by d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, &clockTimer{when: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Sleep advances the clock by d and returns immediately.
+// Returns ctx.Err() without advancing if ctx is already done.
+func (c *Clock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	} else if d <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slept += d
+	c.advance(d)
+	return nil
+}
+
+// Add advances the clock by d without counting it as a sleep.
+func (c *Clock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(d)
+}
+
+// advance moves the clock forward and fires all timers that are due.
+func (c *Clock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = timers
+}
+
+// Slept returns the total duration of all sleeps.
+func (c *Clock) Slept() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.slept
+}
+
+type clockTimer struct {
+	when time.Time
+	ch   chan time.Time
+}
@@ -0,0 +1,70 @@
+package marionettetest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette/marionettetest"
+)
+
+func TestClock_After(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		c := marionettetest.NewClock(time.Unix(0, 0))
+		ch := c.After(5 * time.Second)
+
+		c.Add(4 * time.Second)
+		select {
+		case <-ch:
+			t.Fatal("timer fired early")
+		default:
+		}
+
+		if err := c.Sleep(context.Background(), 1*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case now := <-ch:
+			if !now.Equal(time.Unix(5, 0)) {
+				t.Fatalf("unexpected time: %s", now)
+			}
+		default:
+			t.Fatal("expected timer to fire")
+		}
+	})
+
+	t.Run("Zero", func(t *testing.T) {
+		c := marionettetest.NewClock(time.Unix(0, 0))
+		select {
+		case <-c.After(0):
+		default:
+			t.Fatal("expected timer to fire")
+		}
+	})
+}
+
+func TestClock_Sleep(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		c := marionettetest.NewClock(time.Unix(0, 0))
+		if err := c.Sleep(context.Background(), 2*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		c.Add(3 * time.Second)
+		if now := c.Now(); !now.Equal(time.Unix(5, 0)) {
+			t.Fatalf("unexpected time: %s", now)
+		} else if slept := c.Slept(); slept != 2*time.Second {
+			t.Fatalf("unexpected slept: %s", slept)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		c := marionettetest.NewClock(time.Unix(0, 0))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := c.Sleep(ctx, time.Second); err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		} else if slept := c.Slept(); slept != 0 {
+			t.Fatalf("unexpected slept: %s", slept)
+		}
+	})
+}
@@ -0,0 +1,304 @@
+// Package marionettetest provides an in-process client/server harness for
+// testing formats end to end.
+package marionettetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
+	_ "github.com/redjack/marionette/plugins"
+)
+
+const (
+	// DefaultStreams is the default number of streams opened by a harness.
+	DefaultStreams = 1
+
+	// DefaultPayloadSize is the default number of bytes sent over each stream.
+	DefaultPayloadSize = 4096
+
+	// DefaultTimeout is the default time limit of a harness run.
+	DefaultTimeout = 30 * time.Second
+
+	// ChunkSize is the size of each write to a stream.
+	ChunkSize = 1024
+)
+
+// Host is the address the harness listener binds to & the dialer connects to.
+const Host = "127.0.0.1"
+
+// Harness runs a format between an in-process client & server connected
+// over a PipeNetwork. Payloads are written from the client over each stream,
+// echoed by the server and verified by the client.
+type Harness struct {
+	ClientDoc *mar.Document
+	ServerDoc *mar.Document
+
+	// FTE key shared by the client & server. Uses the default key if nil.
+	Key []byte
+
+	// Seeds the client's instance ids & the payload data.
+	Seed int64
+
+	// Number of streams and the bytes sent in each direction per stream.
+	Streams     int
+	PayloadSize int
+
+	// Time limit of the run.
+	Timeout time.Duration
+
+	// Fake clock shared by the client & server. Sleeps advance the clock
+	// instead of blocking.
+	Clock *Clock
+
+	// Directory for connection traces. If blank, traces are written to a
+	// temporary directory which is removed after the run.
+	TracePath string
+}
+
+// NewHarness returns a new Harness for the MAR document in data.
+func NewHarness(data []byte) (*Harness, error) {
+	clientDoc, err := mar.Parse(marionette.PartyClient, data)
+	if err != nil {
+		return nil, err
+	}
+	serverDoc, err := mar.Parse(marionette.PartyServer, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Harness{
+		ClientDoc:   clientDoc,
+		ServerDoc:   serverDoc,
+		Seed:        1,
+		Streams:     DefaultStreams,
+		PayloadSize: DefaultPayloadSize,
+		Timeout:     DefaultTimeout,
+		Clock:       NewClock(time.Unix(0, 0).UTC()),
+	}, nil
+}
+
+// Run executes the format until all payloads have been echoed back to the
+// client or the timeout elapses. On timeout, the partial result is returned
+// with the error so callers can tell if any stream data was delivered.
+func (h *Harness) Run() (_ *Result, err error) {
+	tracePath := h.TracePath
+	if tracePath == "" {
+		if tracePath, err = ioutil.TempDir("", "marionettetest-"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tracePath)
+	}
+
+	network := NewPipeNetwork()
+
+	ln := marionette.NewListener(h.ServerDoc, Host, h.Key)
+	ln.Listen = network.Listen
+	ln.Clock = h.Clock
+	ln.TracePath = filepath.Join(tracePath, marionette.PartyServer)
+	if err := ln.Open(); err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	streamSet := marionette.NewStreamSet()
+	streamSet.Clock = h.Clock
+	defer streamSet.Close()
+
+	dialer := marionette.NewDialer(h.ClientDoc, Host, streamSet, h.Key)
+	dialer.Dialer = network
+	dialer.Seed = h.Seed
+	dialer.Clock = h.Clock
+	// The virtual clock only advances on sleeps so reconnect immediately.
+	dialer.MinReconnectDelay, dialer.MaxReconnectDelay = 0, 0
+	dialer.TracePath = filepath.Join(tracePath, marionette.PartyClient)
+	if err := dialer.Open(); err != nil {
+		return nil, err
+	}
+	defer dialer.Close()
+
+	t0, slept := time.Now(), h.Clock.Slept()
+	result := &Result{Streams: h.Streams}
+
+	// Stream bytes read by the client & server, updated atomically.
+	var delivered int64
+
+	// Echo all streams from the server & verify payloads on the client.
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*h.Streams)
+	rnd := rand.New(rand.NewSource(h.Seed))
+	for i := 0; i < h.Streams; i++ {
+		payload := make([]byte, h.PayloadSize)
+		rnd.Read(payload)
+
+		conn, err := dialer.Dial()
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		wg.Add(2)
+		go func() { defer wg.Done(); errs <- h.echo(ln, &delivered) }()
+		go func() { defer wg.Done(); errs <- h.verify(conn, payload, &delivered) }()
+	}
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+
+	select {
+	case <-done:
+	case <-time.After(h.Timeout):
+		dialer.Close()
+		ln.Close()
+		streamSet.Close()
+		<-done
+		result.Duration = time.Since(t0)
+		result.Slept = h.Clock.Slept() - slept
+		result.PayloadBytes = atomic.LoadInt64(&delivered)
+		return result, fmt.Errorf("marionettetest: timeout after %s", h.Timeout)
+	}
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Duration = time.Since(t0)
+	result.Slept = h.Clock.Slept() - slept
+	result.PayloadBytes = int64(2 * h.Streams * h.PayloadSize)
+
+	// Close connections so that traces are complete.
+	if err := dialer.Close(); err != nil {
+		return nil, err
+	} else if err := ln.Close(); err != nil {
+		return nil, err
+	}
+	if err := result.readTraces(tracePath); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// echo accepts a stream on the server and writes back the data it reads.
+// Bytes read are added to delivered.
+func (h *Harness) echo(ln *marionette.Listener, delivered *int64) error {
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, h.PayloadSize)
+	if _, err := io.ReadFull(&countingReader{r: conn, n: delivered}, buf); err != nil {
+		return fmt.Errorf("marionettetest: server read: %s", err)
+	}
+	return writeChunks(conn, buf)
+}
+
+// verify writes payload to the stream and verifies the echoed data.
+// Bytes read are added to delivered.
+func (h *Harness) verify(conn net.Conn, payload []byte, delivered *int64) error {
+	if err := writeChunks(conn, payload); err != nil {
+		return err
+	}
+
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(&countingReader{r: conn, n: delivered}, buf); err != nil {
+		return fmt.Errorf("marionettetest: client read: %s", err)
+	} else if !bytes.Equal(buf, payload) {
+		return fmt.Errorf("marionettetest: payload mismatch")
+	}
+	return nil
+}
+
+// writeChunks writes b to w in ChunkSize writes.
+func writeChunks(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n := ChunkSize
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := w.Write(b[:n]); err != nil {
+			return fmt.Errorf("marionettetest: write: %s", err)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// countingReader atomically adds the number of bytes read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// Result represents the statistics of a harness run.
+type Result struct {
+	Streams      int
+	Connections  int           // connections opened by the client
+	Transitions  int           // transitions taken by the client & server
+	PayloadBytes int64         // stream bytes delivered in both directions
+	WireBytes    int64         // bytes written to the network by both parties
+	Duration     time.Duration // wall time until all payloads were echoed
+	Slept        time.Duration // virtual time skipped by model.sleep
+}
+
+// Throughput returns the payload bytes delivered per second of wall time.
+func (r *Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.PayloadBytes) / r.Duration.Seconds()
+}
+
+// readTraces computes transition & wire statistics from connection traces.
+func (r *Result) readTraces(path string) error {
+	paths, err := filepath.Glob(filepath.Join(path, "*", "*.jsonl"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		events, err := marionette.ReadTrace(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			switch e.Type {
+			case marionette.TraceEventOpen:
+				if e.Party == marionette.PartyClient {
+					r.Connections++
+				}
+			case marionette.TraceEventTransition:
+				r.Transitions++
+			case marionette.TraceEventWrite:
+				r.WireBytes += int64(len(e.Data))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package marionettetest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette/mar"
+	"github.com/redjack/marionette/marionettetest"
+)
+
+func TestHarness_Run(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		h := MustNewHarness(t, "http_simple_blocking")
+		h.Streams, h.PayloadSize = 3, 5000
+
+		result, err := h.Run()
+		if err != nil {
+			t.Fatal(err)
+		} else if result.PayloadBytes != 30000 {
+			t.Fatalf("unexpected payload bytes: %d", result.PayloadBytes)
+		} else if result.Connections != 1 {
+			t.Fatalf("unexpected connections: %d", result.Connections)
+		} else if result.Transitions == 0 {
+			t.Fatal("expected transitions")
+		} else if result.WireBytes <= result.PayloadBytes {
+			t.Fatalf("unexpected wire bytes: %d", result.WireBytes)
+		} else if result.Throughput() <= 0 {
+			t.Fatalf("unexpected throughput: %f", result.Throughput())
+		}
+	})
+
+	// Ensure sleeps advance the virtual clock instead of blocking.
+	t.Run("Sleep", func(t *testing.T) {
+		h, err := marionettetest.NewHarness([]byte(`
+connection(tcp, 8081):
+  start      upstream   NULL     1.0
+  upstream   downstream http_get 1.0
+  downstream sleep      http_ok  1.0
+  sleep      end        pause    1.0
+
+action http_get:
+  client fte.send("^GET\ \/([a-zA-Z0-9\.\/]*) HTTP/1\.1\r\n\r\n$", 128)
+
+action http_ok:
+  server fte.send("^HTTP/1\.1\ 200 OK\r\nContent-Type:\ ([a-zA-Z0-9]+)\r\n\r\n\C*$", 128)
+
+action pause:
+  client model.sleep("{'5.0' : 1.0}")
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := h.Run()
+		if err != nil {
+			t.Fatal(err)
+		} else if result.Slept == 0 || result.Slept%(5*time.Second) != 0 {
+			t.Fatalf("unexpected virtual sleep: %s", result.Slept)
+		}
+	})
+
+	// Ensure formats which bind a data channel can run in-process.
+	t.Run("Channel", func(t *testing.T) {
+		h := MustNewHarness(t, "ftp_simple_blocking")
+		h.Timeout = 10 * time.Second
+
+		if result, err := h.Run(); err != nil {
+			t.Fatal(err)
+		} else if result.PayloadBytes != 2*marionettetest.DefaultPayloadSize {
+			t.Fatalf("unexpected payload bytes: %d", result.PayloadBytes)
+		}
+	})
+
+	// Ensure connections closed by the format are reopened without waiting
+	// on the virtual clock.
+	t.Run("Reconnect", func(t *testing.T) {
+		h := MustNewHarness(t, "http_probabilistic_blocking")
+		h.Timeout = 10 * time.Second
+
+		result, err := h.Run()
+		if err != nil {
+			t.Fatal(err)
+		} else if result.Connections < 2 {
+			t.Fatalf("unexpected connections: %d", result.Connections)
+		}
+	})
+
+	t.Run("ErrTimeout", func(t *testing.T) {
+		h := MustNewHarness(t, "dummy")
+		h.Timeout = 100 * time.Millisecond
+		if result, err := h.Run(); err == nil || err.Error() != "marionettetest: timeout after 100ms" {
+			t.Fatalf("unexpected error: %v", err)
+		} else if result == nil {
+			t.Fatal("expected partial result")
+		}
+	})
+
+	// Ensure formats which cannot carry stream data report no payload bytes.
+	t.Run("NoData", func(t *testing.T) {
+		h := MustNewHarness(t, "dns_request")
+		h.Timeout = 500 * time.Millisecond
+		if result, err := h.Run(); err == nil {
+			t.Fatal("expected error")
+		} else if result == nil || result.PayloadBytes != 0 {
+			t.Fatalf("unexpected result: %#v", result)
+		}
+	})
+}
+
+// MustNewHarness returns a harness for a built-in format.
+func MustNewHarness(tb testing.TB, format string) *marionettetest.Harness {
+	tb.Helper()
+	h, err := marionettetest.NewHarness(mar.Format(format, ""))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return h
+}
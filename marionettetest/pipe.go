@@ -0,0 +1,117 @@
+package marionettetest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrConnRefused is returned when dialing an address without a listener.
+	ErrConnRefused = errors.New("marionettetest: connection refused")
+
+	// ErrListenerClosed is returned when accepting from a closed listener.
+	ErrListenerClosed = errors.New("marionettetest: listener closed")
+
+	// ErrAddrInUse is returned when listening on an address twice.
+	ErrAddrInUse = errors.New("marionettetest: address in use")
+)
+
+// PipeNetwork connects dialers to listeners in memory using net.Pipe().
+// It implements marionette.NetDialer and its Listen method can be used as
+// marionette.Listener.Listen.
+type PipeNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+// NewPipeNetwork returns a new instance of PipeNetwork.
+func NewPipeNetwork() *PipeNetwork {
+	return &PipeNetwork{listeners: make(map[string]*pipeListener)}
+}
+
+// Listen returns a listener for address. The network is ignored.
+func (n *PipeNetwork) Listen(network, address string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[address]; ok {
+		return nil, ErrAddrInUse
+	}
+	ln := &pipeListener{
+		network: n,
+		addr:    pipeAddr(address),
+		conns:   make(chan net.Conn),
+		closing: make(chan struct{}),
+	}
+	n.listeners[address] = ln
+	return ln, nil
+}
+
+// Dial connects to the listener on address.
+func (n *PipeNetwork) Dial(network, address string) (net.Conn, error) {
+	return n.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the listener on address. The network is ignored.
+func (n *PipeNetwork) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n.mu.Lock()
+	ln := n.listeners[address]
+	n.mu.Unlock()
+	if ln == nil {
+		return nil, ErrConnRefused
+	}
+
+	client, server := net.Pipe()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-ln.closing:
+		return nil, ErrConnRefused
+	case ln.conns <- server:
+		return client, nil
+	}
+}
+
+func (n *PipeNetwork) remove(ln *pipeListener) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listeners[string(ln.addr)] == ln {
+		delete(n.listeners, string(ln.addr))
+	}
+}
+
+// pipeListener accepts connections dialed through a PipeNetwork.
+type pipeListener struct {
+	network *PipeNetwork
+	addr    pipeAddr
+	conns   chan net.Conn
+	closing chan struct{}
+	once    sync.Once
+}
+
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case <-ln.closing:
+		return nil, ErrListenerClosed
+	case conn := <-ln.conns:
+		return conn, nil
+	}
+}
+
+func (ln *pipeListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.closing)
+		ln.network.remove(ln)
+	})
+	return nil
+}
+
+func (ln *pipeListener) Addr() net.Addr { return ln.addr }
+
+// pipeAddr is the address of a pipe listener.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
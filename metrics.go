@@ -0,0 +1,98 @@
+package marionette
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics recorded by the FSM, stream sets & plugins. They are registered
+// with the default Prometheus registry.
+var (
+	fsmTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "marionette_fsm_transitions_total",
+		Help: "Number of FSM transitions into each state.",
+	}, []string{"party", "state"})
+
+	actionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "marionette_action_duration_seconds",
+		Help:    "Latency of plugin actions.",
+		Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+	}, []string{"plugin"})
+
+	activeStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "marionette_listener_active_streams",
+		Help: "Number of open streams on each listener.",
+	}, []string{"listener"})
+
+	plaintextBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "marionette_plaintext_bytes_total",
+		Help: "Cell payload bytes sent & received by plugins.",
+	}, []string{"plugin"})
+
+	ciphertextBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "marionette_ciphertext_bytes_total",
+		Help: "Encoded bytes sent & received by plugins.",
+	}, []string{"plugin"})
+
+	emptyCells = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "marionette_empty_cells_total",
+		Help: "Cells sent by plugins without stream data.",
+	}, []string{"plugin"})
+
+	uuidMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "marionette_uuid_mismatches_total",
+		Help: "Cells received with a different document UUID.",
+	}, []string{"plugin"})
+
+	instanceMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "marionette_instance_mismatches_total",
+		Help: "Cells received with a different instance id.",
+	}, []string{"plugin"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		fsmTransitions,
+		actionDuration,
+		activeStreams,
+		plaintextBytes,
+		ciphertextBytes,
+		emptyCells,
+		uuidMismatches,
+		instanceMismatches,
+	)
+}
+
+// PluginMetrics records the messages sent & received by a plugin.
+type PluginMetrics struct {
+	plaintextBytes     prometheus.Counter
+	ciphertextBytes    prometheus.Counter
+	emptyCells         prometheus.Counter
+	uuidMismatches     prometheus.Counter
+	instanceMismatches prometheus.Counter
+}
+
+// NewPluginMetrics returns the metrics for the named plugin, e.g. "fte.send".
+func NewPluginMetrics(plugin string) *PluginMetrics {
+	return &PluginMetrics{
+		plaintextBytes:     plaintextBytes.WithLabelValues(plugin),
+		ciphertextBytes:    ciphertextBytes.WithLabelValues(plugin),
+		emptyCells:         emptyCells.WithLabelValues(plugin),
+		uuidMismatches:     uuidMismatches.WithLabelValues(plugin),
+		instanceMismatches: instanceMismatches.WithLabelValues(plugin),
+	}
+}
+
+// AddPlaintext records n bytes of cell payload.
+func (m *PluginMetrics) AddPlaintext(n int) { m.plaintextBytes.Add(float64(n)) }
+
+// AddCiphertext records n encoded bytes.
+func (m *PluginMetrics) AddCiphertext(n int) { m.ciphertextBytes.Add(float64(n)) }
+
+// EmptyCell records a cell sent without stream data.
+func (m *PluginMetrics) EmptyCell() { m.emptyCells.Inc() }
+
+// UUIDMismatch records a cell received for a different document.
+func (m *PluginMetrics) UUIDMismatch() { m.uuidMismatches.Inc() }
+
+// InstanceMismatch records a cell received for a different FSM instance.
+func (m *PluginMetrics) InstanceMismatch() { m.instanceMismatches.Inc() }
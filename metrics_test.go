@@ -0,0 +1,34 @@
+package marionette_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redjack/marionette"
+)
+
+func TestPluginMetrics(t *testing.T) {
+	m := marionette.NewPluginMetrics("test.plugin")
+	m.AddPlaintext(10)
+	m.AddCiphertext(20)
+	m.EmptyCell()
+	m.UUIDMismatch()
+	m.InstanceMismatch()
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		`marionette_plaintext_bytes_total{plugin="test.plugin"} 10`,
+		`marionette_ciphertext_bytes_total{plugin="test.plugin"} 20`,
+		`marionette_empty_cells_total{plugin="test.plugin"} 1`,
+		`marionette_uuid_mismatches_total{plugin="test.plugin"} 1`,
+		`marionette_instance_mismatches_total{plugin="test.plugin"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expected %q in output:\n%s", line, body)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package mock
 
 import (
 	"context"
+	"math/rand"
 	"net"
 
 	"github.com/redjack/marionette"
@@ -27,6 +28,11 @@ type FSM struct {
 	ListenFn        func() (int, error)
 	ConnFn          func() *marionette.BufferedConn
 	StreamSetFn     func() *marionette.StreamSet
+	ClockFn         func() marionette.Clock
+	DocumentFn      func() *mar.Document
+	RandFn          func() *rand.Rand
+	DequeueFn       func(n int) *marionette.Cell
+	EnqueueFn       func(cell *marionette.Cell) error
 	CipherFn        func(regex string, n int) (marionette.Cipher, error)
 	DFAFn           func(regex string, n int) (marionette.DFA, error)
 	SetVarFn        func(key string, value interface{})
@@ -45,6 +51,11 @@ func NewFSM(conn net.Conn, streamSet *marionette.StreamSet) FSM {
 	fsm.StateFn = func() string { return "default" }
 	fsm.ConnFn = func() *marionette.BufferedConn { return fsm.BufferedConn }
 	fsm.StreamSetFn = func() *marionette.StreamSet { return streamSet }
+	fsm.ClockFn = func() marionette.Clock { return marionette.DefaultClock }
+	fsm.DocumentFn = func() *mar.Document { return &mar.Document{} }
+	fsm.RandFn = func() *rand.Rand { return marionette.Rand() }
+	fsm.DequeueFn = func(n int) *marionette.Cell { return streamSet.Dequeue(n) }
+	fsm.EnqueueFn = func(cell *marionette.Cell) error { return streamSet.Enqueue(cell) }
 	fsm.LoggerFn = func() *zap.Logger { return marionette.Logger }
 	return fsm
 }
@@ -67,6 +78,12 @@ func (m *FSM) Reset()                            { m.ResetFn() }
 func (m *FSM) Listen() (int, error)             { return m.ListenFn() }
 func (m *FSM) Conn() *marionette.BufferedConn   { return m.ConnFn() }
 func (m *FSM) StreamSet() *marionette.StreamSet { return m.StreamSetFn() }
+func (m *FSM) Clock() marionette.Clock          { return m.ClockFn() }
+func (m *FSM) Document() *mar.Document          { return m.DocumentFn() }
+func (m *FSM) Rand() *rand.Rand                 { return m.RandFn() }
+
+func (m *FSM) Dequeue(n int) *marionette.Cell      { return m.DequeueFn(n) }
+func (m *FSM) Enqueue(cell *marionette.Cell) error { return m.EnqueueFn(cell) }
 
 func (m *FSM) SetVar(key string, value interface{}) { m.SetVarFn(key, value) }
 func (m *FSM) Var(key string) interface{}           { return m.VarFn(key) }
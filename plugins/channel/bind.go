@@ -6,11 +6,13 @@ import (
 	"time"
 
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
 func init() {
 	marionette.RegisterPlugin("channel", "bind", Bind)
+	mar.RegisterArgsValidator("channel", "bind", mar.ExpectArgs(mar.ArgString))
 }
 
 // Bind binds the variable specified in the first argument to a port.
@@ -9,12 +9,17 @@ import (
 
 	"github.com/redjack/marionette"
 	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
+var recvMetrics = marionette.NewPluginMetrics("fte.recv")
+
 func init() {
 	marionette.RegisterPlugin("fte", "recv", Recv)
+	mar.RegisterArgsValidator("fte", "recv", mar.ExpectArgs(mar.ArgString, mar.ArgInt))
 	marionette.RegisterPlugin("fte", "recv_async", RecvAsync)
+	mar.RegisterArgsValidator("fte", "recv_async", mar.ExpectArgs(mar.ArgString, mar.ArgInt))
 }
 
 // Recv receives data from a connection.
@@ -52,7 +57,7 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 
 	// Retrieve data from the connection.
 	conn := fsm.Conn()
-	ciphertext, err := conn.Peek(-1, blocking)
+	ciphertext, err := conn.PeekContext(ctx, -1, blocking)
 	if err != nil && err != io.EOF {
 		logger().Error("cannot read from connection", zap.Error(err))
 		return err
@@ -72,7 +77,12 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 		zap.Int("ciphertext", len(ciphertext)),
 		zap.Error(err),
 	)
-	if err == fte.ErrShortCiphertext {
+	if err != nil && conn.PacketMode() {
+		// Datagrams are never extended so discard any that cannot be decoded.
+		logger().Debug("discarding datagram", zap.Error(err))
+		_, err = conn.Seek(int64(len(ciphertext)), io.SeekCurrent)
+		return err
+	} else if err == fte.ErrShortCiphertext {
 		return nil
 	} else if err != nil {
 		logger().Error("cannot decrypt ciphertext", zap.Error(err))
@@ -89,6 +99,7 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 	// Validate that the FSM & cell document UUIDs match.
 	if fsm.UUID() != cell.UUID {
 		logger().Error("uuid mismatch", zap.Int("local", fsm.UUID()), zap.Int("remote", cell.UUID))
+		recvMetrics.UUIDMismatch()
 		return marionette.ErrUUIDMismatch
 	}
 
@@ -99,21 +110,30 @@ func recv(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 		return marionette.ErrRetryTransition
 	} else if cell.InstanceID != 0 && fsm.InstanceID() != cell.InstanceID {
 		logger().Error("instance id mismatch", zap.Int("local", fsm.InstanceID()), zap.Int("remote", cell.InstanceID))
+		recvMetrics.InstanceMismatch()
 		return fmt.Errorf("instance id mismatch: fsm=%d, cell=%d", fsm.InstanceID(), cell.InstanceID)
 	}
 
 	// Write plaintext to a cell decoder pipe.
-	if err := fsm.StreamSet().Enqueue(&cell); err != nil {
+	if err := fsm.Enqueue(&cell); err != nil {
 		logger().Error("cannot enqueue cell", zap.Error(err))
 		return err
 	}
 
 	// Move buffer forward by bytes consumed by the cipher.
-	if _, err := conn.Seek(int64(len(ciphertext)-len(remainder)), io.SeekCurrent); err != nil {
+	// In packet mode, the remainder of the datagram is discarded.
+	n := len(ciphertext) - len(remainder)
+	if conn.PacketMode() {
+		n = len(ciphertext)
+	}
+	if _, err := conn.Seek(int64(n), io.SeekCurrent); err != nil {
 		logger().Error("cannot move buffer forward", zap.Error(err))
 		return err
 	}
 
+	recvMetrics.AddPlaintext(len(cell.Payload))
+	recvMetrics.AddCiphertext(n)
+
 	logger().Debug("msg received",
 		zap.Int("plaintext", len(cell.Payload)),
 		zap.Int("ciphertext", len(ciphertext)),
@@ -7,12 +7,17 @@ import (
 
 	"github.com/redjack/marionette"
 	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
+var sendMetrics = marionette.NewPluginMetrics("fte.send")
+
 func init() {
 	marionette.RegisterPlugin("fte", "send", Send)
+	mar.RegisterArgsValidator("fte", "send", mar.ExpectArgs(mar.ArgString, mar.ArgInt))
 	marionette.RegisterPlugin("fte", "send_async", SendAsync)
+	mar.RegisterArgsValidator("fte", "send_async", mar.ExpectArgs(mar.ArgString, mar.ArgInt))
 }
 
 // Send sends data to a connection.
@@ -58,12 +63,13 @@ func send(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 	// blocking then send an empty cell. If no cell exists and we are not
 	// blocking then return. The FSM will move on to the next step. This
 	// allows non-blocking send/recv to continually check both sides of a conn.
-	cell := fsm.StreamSet().Dequeue(capacity)
+	cell := fsm.Dequeue(capacity)
 	if cell != nil {
 		// nop
 	} else if cell == nil && blocking {
 		logger.Debug("no cell, sending empty cell")
 		cell = marionette.NewCell(0, 0, 0, marionette.NORMAL)
+		sendMetrics.EmptyCell()
 	} else {
 		return nil
 	}
@@ -88,6 +94,9 @@ func send(ctx context.Context, fsm marionette.FSM, args []interface{}, blocking
 		return err
 	}
 
+	sendMetrics.AddPlaintext(len(cell.Payload))
+	sendMetrics.AddCiphertext(len(ciphertext))
+
 	logger.Debug("msg sent",
 		zap.Int("plaintext", len(cell.Payload)),
 		zap.Int("ciphertext", len(ciphertext)),
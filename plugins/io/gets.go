@@ -9,11 +9,13 @@ import (
 	"time"
 
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
 func init() {
 	marionette.RegisterPlugin("io", "gets", Gets)
+	mar.RegisterArgsValidator("io", "gets", mar.ExpectArgs(mar.ArgString))
 }
 
 func Gets(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
@@ -34,7 +36,7 @@ func Gets(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	}
 
 	// Read buffer to see if our expected data comes through.
-	buf, err := fsm.Conn().Peek(len(exp), true)
+	buf, err := fsm.Conn().PeekContext(ctx, len(exp), true)
 	if err == io.EOF {
 		return err
 	} else if err != nil {
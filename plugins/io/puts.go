@@ -6,11 +6,13 @@ import (
 	"time"
 
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
 func init() {
 	marionette.RegisterPlugin("io", "puts", Puts)
+	mar.RegisterArgsValidator("io", "puts", mar.ExpectArgs(mar.ArgString))
 }
 
 func Puts(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
@@ -0,0 +1,579 @@
+package model
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// probabilityTolerance is the allowed error when summing probabilities.
+const probabilityTolerance = 1e-6
+
+var (
+	errEmptyDistribution = errors.New("empty distribution")
+	errProbabilitySum    = errors.New("probabilities must sum to 1")
+	errNegativeValue     = errors.New("negative value")
+)
+
+// Distribution represents a distribution of sleep durations, in seconds.
+type Distribution interface {
+	// Returns a random value from the distribution using rng. Never negative.
+	Sample(rng *rand.Rand) float64
+}
+
+// ParseDistribution parses a distribution expression. The following are supported:
+//
+//	{'0.1' : 0.5, '0.2' : 0.5}  discrete values & their probabilities
+//	uniform(min, max)           uniform between min & max
+//	exponential(mean)           exponential with the given mean
+//	normal(mean, stddev)        normal, truncated at zero
+//	lognormal(mu, sigma)        log-normal with the underlying normal's parameters
+//	pareto(scale, shape)        Pareto with minimum value scale
+//	empirical('path')           empirical CDF read from a file. See ReadEmpiricalDistribution().
+//
+// Relative empirical paths are resolved against the working directory.
+func ParseDistribution(s string) (Distribution, error) {
+	return parseDistribution(s, "", true)
+}
+
+// parseDistribution parses a distribution expression. Relative empirical
+// paths are resolved against dir. If read is false then empirical files are
+// not read and an empty distribution is returned in their place.
+func parseDistribution(s, dir string, read bool) (Distribution, error) {
+	p := &distParser{s: s, dir: dir, read: read}
+	dist, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid distribution %q: %s", s, err)
+	}
+	return dist, nil
+}
+
+// ParseSleepDistribution parses a discrete distribution into a lookup of
+// values to their probabilities.
+func ParseSleepDistribution(s string) (map[float64]float64, error) {
+	p := &distParser{s: s}
+	dist, err := p.parseDiscrete()
+	if err != nil {
+		return nil, fmt.Errorf("invalid distribution %q: %s", s, err)
+	}
+
+	m := make(map[float64]float64, len(dist.Values))
+	for i, v := range dist.Values {
+		m[v] = dist.Probs[i]
+	}
+	return m, nil
+}
+
+// distributions caches parsed distributions by directory & expression.
+var distributions = struct {
+	mu sync.Mutex
+	m  map[distributionKey]Distribution
+}{m: make(map[distributionKey]Distribution)}
+
+type distributionKey struct {
+	dir, s string
+}
+
+// lookupDistribution returns a parsed distribution from the cache. The
+// expression is parsed & added to the cache if it doesn't exist. Relative
+// empirical paths are resolved against dir.
+//
+// Distributions are cached for the life of the process so empirical files
+// are only read once. Changes to a file are not seen until restart.
+func lookupDistribution(s, dir string) (Distribution, error) {
+	distributions.mu.Lock()
+	defer distributions.mu.Unlock()
+
+	key := distributionKey{dir: dir, s: s}
+	if dist := distributions.m[key]; dist != nil {
+		return dist, nil
+	}
+
+	dist, err := parseDistribution(s, dir, true)
+	if err != nil {
+		return nil, err
+	}
+	distributions.m[key] = dist
+	return dist, nil
+}
+
+// DiscreteDistribution chooses from a fixed set of values.
+type DiscreteDistribution struct {
+	Values []float64 // sorted ascending
+	Probs  []float64 // probability of each value
+}
+
+// NewDiscreteDistribution returns a discrete distribution from a lookup of
+// values to probabilities. Returns an error if a value is negative or if the
+// probabilities do not sum to 1.
+func NewDiscreteDistribution(m map[float64]float64) (*DiscreteDistribution, error) {
+	if len(m) == 0 {
+		return nil, errEmptyDistribution
+	}
+
+	d := &DiscreteDistribution{}
+	for v := range m {
+		d.Values = append(d.Values, v)
+	}
+	sort.Float64s(d.Values)
+
+	var sum float64
+	for _, v := range d.Values {
+		p := m[v]
+		if v < 0 {
+			return nil, errNegativeValue
+		} else if p < 0 || p > 1 {
+			return nil, fmt.Errorf("probability out of range: %g", p)
+		}
+		d.Probs = append(d.Probs, p)
+		sum += p
+	}
+	if math.Abs(sum-1) > probabilityTolerance {
+		return nil, errProbabilitySum
+	}
+	return d, nil
+}
+
+func (d *DiscreteDistribution) Sample(rng *rand.Rand) float64 {
+	var sum float64
+	coin := rng.Float64()
+	for i, v := range d.Values {
+		if sum += d.Probs[i]; sum >= coin {
+			return v
+		}
+	}
+	return d.Values[len(d.Values)-1]
+}
+
+// UniformDistribution is a continuous uniform distribution between Min & Max.
+type UniformDistribution struct {
+	Min, Max float64
+}
+
+func (d *UniformDistribution) Sample(rng *rand.Rand) float64 {
+	return d.Min + rng.Float64()*(d.Max-d.Min)
+}
+
+// ExponentialDistribution is an exponential distribution with the given mean.
+type ExponentialDistribution struct {
+	Mean float64
+}
+
+func (d *ExponentialDistribution) Sample(rng *rand.Rand) float64 {
+	return rng.ExpFloat64() * d.Mean
+}
+
+// NormalDistribution is a normal distribution. Negative samples are returned as zero.
+type NormalDistribution struct {
+	Mean, StdDev float64
+}
+
+func (d *NormalDistribution) Sample(rng *rand.Rand) float64 {
+	return math.Max(0, d.Mean+rng.NormFloat64()*d.StdDev)
+}
+
+// LogNormalDistribution is a log-normal distribution. Mu & Sigma are the mean
+// & standard deviation of the value's natural logarithm.
+type LogNormalDistribution struct {
+	Mu, Sigma float64
+}
+
+func (d *LogNormalDistribution) Sample(rng *rand.Rand) float64 {
+	return math.Exp(d.Mu + rng.NormFloat64()*d.Sigma)
+}
+
+// ParetoDistribution is a Pareto (type I) distribution with minimum value
+// Scale & tail index Shape.
+type ParetoDistribution struct {
+	Scale, Shape float64
+}
+
+func (d *ParetoDistribution) Sample(rng *rand.Rand) float64 {
+	// Invert the CDF using a uniform value in (0,1].
+	return d.Scale / math.Pow(1-rng.Float64(), 1/d.Shape)
+}
+
+// EmpiricalDistribution samples from an empirical cumulative distribution
+// function by linearly interpolating between its points.
+type EmpiricalDistribution struct {
+	Values []float64 // non-decreasing
+	Probs  []float64 // cumulative probability of each value, ending at 1
+}
+
+// NewEmpiricalDistribution returns an empirical distribution from the points
+// of a CDF. Returns an error if values are negative or if either values or
+// probabilities decrease.
+func NewEmpiricalDistribution(values, probs []float64) (*EmpiricalDistribution, error) {
+	if len(values) == 0 {
+		return nil, errEmptyDistribution
+	} else if len(values) != len(probs) {
+		return nil, errors.New("value & probability count mismatch")
+	}
+
+	for i := range values {
+		if values[i] < 0 {
+			return nil, errNegativeValue
+		} else if probs[i] < 0 || probs[i] > 1 {
+			return nil, fmt.Errorf("probability out of range: %g", probs[i])
+		} else if i > 0 && values[i] < values[i-1] {
+			return nil, fmt.Errorf("values must not decrease: %g", values[i])
+		} else if i > 0 && probs[i] < probs[i-1] {
+			return nil, fmt.Errorf("cumulative probabilities must not decrease: %g", probs[i])
+		}
+	}
+	if math.Abs(probs[len(probs)-1]-1) > probabilityTolerance {
+		return nil, errProbabilitySum
+	}
+	return &EmpiricalDistribution{Values: values, Probs: probs}, nil
+}
+
+// ReadEmpiricalDistribution reads a CDF from a file. Each line contains a
+// value in seconds & its cumulative probability separated by whitespace or
+// a comma. Blank lines & lines starting with '#' are ignored.
+func ReadEmpiricalDistribution(path string) (*EmpiricalDistribution, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values, probs []float64
+	scanner := bufio.NewScanner(f)
+	for lineN := 1; scanner.Scan(); lineN++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected value & probability", path, lineN)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid value: %q", path, lineN, fields[0])
+		}
+		prob, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid probability: %q", path, lineN, fields[1])
+		}
+		values, probs = append(values, value), append(probs, prob)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	d, err := NewEmpiricalDistribution(values, probs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return d, nil
+}
+
+func (d *EmpiricalDistribution) Sample(rng *rand.Rand) float64 {
+	u := rng.Float64()
+	i := sort.SearchFloat64s(d.Probs, u)
+	if i == 0 {
+		return d.Values[0]
+	} else if i >= len(d.Probs) {
+		return d.Values[len(d.Values)-1]
+	}
+
+	// Interpolate between the surrounding points.
+	p0, p1 := d.Probs[i-1], d.Probs[i]
+	v0, v1 := d.Values[i-1], d.Values[i]
+	if p1 == p0 {
+		return v1
+	}
+	return v0 + (v1-v0)*(u-p0)/(p1-p0)
+}
+
+// distParser parses distribution expressions.
+type distParser struct {
+	s    string
+	pos  int
+	dir  string // directory for relative empirical paths
+	read bool   // if false, empirical files are not read
+}
+
+func (p *distParser) parse() (Distribution, error) {
+	p.skipSpace()
+	if p.peek() == '{' {
+		return p.parseDiscrete()
+	}
+
+	// Read function name & arguments.
+	name := p.readIdent()
+	if name == "" {
+		return nil, p.errorf("expected '{' or distribution name")
+	}
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	} else if err := p.expectEOF(); err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "uniform":
+		v, err := floatArgs(name, args, 2)
+		if err != nil {
+			return nil, err
+		} else if v[0] < 0 || v[1] < 0 {
+			return nil, errNegativeValue
+		} else if v[0] > v[1] {
+			return nil, errors.New("uniform: min greater than max")
+		}
+		return &UniformDistribution{Min: v[0], Max: v[1]}, nil
+
+	case "exponential":
+		v, err := floatArgs(name, args, 1)
+		if err != nil {
+			return nil, err
+		} else if v[0] <= 0 {
+			return nil, errors.New("exponential: mean must be positive")
+		}
+		return &ExponentialDistribution{Mean: v[0]}, nil
+
+	case "normal":
+		v, err := floatArgs(name, args, 2)
+		if err != nil {
+			return nil, err
+		} else if v[0] < 0 {
+			return nil, errNegativeValue
+		} else if v[1] < 0 {
+			return nil, errors.New("normal: stddev must not be negative")
+		}
+		return &NormalDistribution{Mean: v[0], StdDev: v[1]}, nil
+
+	case "lognormal":
+		v, err := floatArgs(name, args, 2)
+		if err != nil {
+			return nil, err
+		} else if v[1] < 0 {
+			return nil, errors.New("lognormal: sigma must not be negative")
+		}
+		return &LogNormalDistribution{Mu: v[0], Sigma: v[1]}, nil
+
+	case "pareto":
+		v, err := floatArgs(name, args, 2)
+		if err != nil {
+			return nil, err
+		} else if v[0] <= 0 || v[1] <= 0 {
+			return nil, errors.New("pareto: scale & shape must be positive")
+		}
+		return &ParetoDistribution{Scale: v[0], Shape: v[1]}, nil
+
+	case "empirical":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("empirical: expected 1 argument, found %d", len(args))
+		} else if !p.read {
+			return &EmpiricalDistribution{}, nil
+		}
+
+		path := args[0]
+		if p.dir != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(p.dir, path)
+		}
+		return ReadEmpiricalDistribution(path)
+
+	default:
+		return nil, fmt.Errorf("unknown distribution: %s", name)
+	}
+}
+
+// parseDiscrete parses a dictionary of quoted or unquoted values to probabilities.
+func (p *distParser) parseDiscrete() (*DiscreteDistribution, error) {
+	p.skipSpace()
+	if !p.consume('{') {
+		return nil, p.errorf("expected '{'")
+	}
+
+	m := make(map[float64]float64)
+	for {
+		p.skipSpace()
+		if p.consume('}') {
+			break
+		}
+
+		key, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume(':') {
+			return nil, p.errorf("expected ':'")
+		}
+		prob, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("duplicate value: %g", key)
+		}
+		m[key] = prob
+
+		p.skipSpace()
+		if p.consume(',') {
+			continue
+		} else if p.consume('}') {
+			break
+		}
+		return nil, p.errorf("expected ',' or '}'")
+	}
+
+	if err := p.expectEOF(); err != nil {
+		return nil, err
+	}
+	return NewDiscreteDistribution(m)
+}
+
+// parseArgs parses a parenthesized, comma-separated list of arguments.
+// Quotes are removed from quoted arguments.
+func (p *distParser) parseArgs() ([]string, error) {
+	p.skipSpace()
+	if !p.consume('(') {
+		return nil, p.errorf("expected '('")
+	}
+
+	var args []string
+	for {
+		p.skipSpace()
+		if len(args) == 0 && p.consume(')') {
+			return args, nil
+		}
+
+		var arg string
+		if c := p.peek(); c == '\'' || c == '"' {
+			s, err := p.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			arg = s
+		} else {
+			start := p.pos
+			for p.pos < len(p.s) && !strings.ContainsRune(",) \t\r\n", rune(p.s[p.pos])) {
+				p.pos++
+			}
+			if arg = p.s[start:p.pos]; arg == "" {
+				return nil, p.errorf("expected argument")
+			}
+		}
+		args = append(args, arg)
+
+		p.skipSpace()
+		if p.consume(',') {
+			continue
+		} else if p.consume(')') {
+			return args, nil
+		}
+		return nil, p.errorf("expected ',' or ')'")
+	}
+}
+
+// parseNumber parses a float that may optionally be quoted.
+func (p *distParser) parseNumber() (float64, error) {
+	p.skipSpace()
+
+	var s string
+	if c := p.peek(); c == '\'' || c == '"' {
+		v, err := p.readQuoted()
+		if err != nil {
+			return 0, err
+		}
+		s = strings.TrimSpace(v)
+	} else {
+		start := p.pos
+		for p.pos < len(p.s) && strings.ContainsRune("0123456789.+-eE", rune(p.s[p.pos])) {
+			p.pos++
+		}
+		s = p.s[start:p.pos]
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid number: %q", s)
+	}
+	return v, nil
+}
+
+// readQuoted reads a single or double quoted string.
+func (p *distParser) readQuoted() (string, error) {
+	quote := p.s[p.pos]
+	end := strings.IndexByte(p.s[p.pos+1:], quote)
+	if end == -1 {
+		return "", p.errorf("unterminated string")
+	}
+	s := p.s[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+	return s, nil
+}
+
+func (p *distParser) readIdent() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' {
+			break
+		}
+		p.pos++
+	}
+	return strings.ToLower(p.s[start:p.pos])
+}
+
+func (p *distParser) expectEOF() error {
+	if p.skipSpace(); p.pos < len(p.s) {
+		return p.errorf("unexpected trailing characters")
+	}
+	return nil
+}
+
+func (p *distParser) skipSpace() {
+	for p.pos < len(p.s) && strings.ContainsRune(" \t\r\n", rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *distParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *distParser) consume(c byte) bool {
+	if p.peek() != c || c == 0 {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *distParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("char %d: %s", p.pos+1, fmt.Sprintf(format, a...))
+}
+
+// floatArgs parses exactly n arguments as floats.
+func floatArgs(name string, args []string, n int) ([]float64, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("%s: expected %d argument(s), found %d", name, n, len(args))
+	}
+
+	values := make([]float64, n)
+	for i, arg := range args {
+		v, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%s: invalid number: %q", name, arg)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
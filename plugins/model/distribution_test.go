@@ -0,0 +1,167 @@
+package model_test
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redjack/marionette/plugins/model"
+)
+
+func TestParseDistribution(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	t.Run("Discrete", func(t *testing.T) {
+		dist := MustParseDistribution(t, `{'0.1' : 0.25, "0.2": 0.75}`)
+		for i := 0; i < 100; i++ {
+			if v := dist.Sample(rng); v != 0.1 && v != 0.2 {
+				t.Fatalf("unexpected sample: %f", v)
+			}
+		}
+	})
+
+	t.Run("Uniform", func(t *testing.T) {
+		dist := MustParseDistribution(t, `uniform(1, 2.5)`)
+		for i := 0; i < 100; i++ {
+			if v := dist.Sample(rng); v < 1 || v > 2.5 {
+				t.Fatalf("unexpected sample: %f", v)
+			}
+		}
+	})
+
+	t.Run("Exponential", func(t *testing.T) {
+		MustSampleMean(t, MustParseDistribution(t, `exponential(2)`), 2, 0.1)
+	})
+
+	t.Run("Normal", func(t *testing.T) {
+		dist := MustParseDistribution(t, `normal(5, 1)`)
+		MustSampleMean(t, dist, 5, 0.1)
+	})
+
+	t.Run("LogNormal", func(t *testing.T) {
+		// Mean is exp(mu + sigma^2 / 2).
+		MustSampleMean(t, MustParseDistribution(t, `lognormal(0, 0.5)`), math.Exp(0.125), 0.1)
+	})
+
+	t.Run("Pareto", func(t *testing.T) {
+		// Mean is shape * scale / (shape - 1) for shape > 1.
+		dist := MustParseDistribution(t, `pareto(1, 3)`)
+		for i := 0; i < 100; i++ {
+			if v := dist.Sample(rng); v < 1 {
+				t.Fatalf("unexpected sample: %f", v)
+			}
+		}
+		MustSampleMean(t, dist, 1.5, 0.1)
+	})
+
+	t.Run("Empirical", func(t *testing.T) {
+		path := MustWriteTempFile(t, "# seconds cdf\n0 0\n1 0.5\n\n3,1.0\n")
+		defer os.RemoveAll(filepath.Dir(path))
+
+		dist := MustParseDistribution(t, `empirical('`+path+`')`)
+		for i := 0; i < 100; i++ {
+			if v := dist.Sample(rng); v < 0 || v > 3 {
+				t.Fatalf("unexpected sample: %f", v)
+			}
+		}
+		MustSampleMean(t, dist, 1.25, 0.1)
+	})
+
+	// Ensure samples are reproducible from the same seed.
+	t.Run("Seeded", func(t *testing.T) {
+		dist := MustParseDistribution(t, `lognormal(0, 1)`)
+		rng0, rng1 := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			if v0, v1 := dist.Sample(rng0), dist.Sample(rng1); v0 != v1 {
+				t.Fatalf("samples differ: %f != %f", v0, v1)
+			}
+		}
+	})
+
+	t.Run("ErrInvalid", func(t *testing.T) {
+		for _, tt := range []struct {
+			s   string
+			err string
+		}{
+			{`{'1.0' : 0.5}`, `invalid distribution "{'1.0' : 0.5}": probabilities must sum to 1`},
+			{`{'-1.0' : 1.0}`, `invalid distribution "{'-1.0' : 1.0}": negative value`},
+			{`{'1.0' : 0.5, '1.0' : 0.5}`, `invalid distribution "{'1.0' : 0.5, '1.0' : 0.5}": duplicate value: 1`},
+			{`{}`, `invalid distribution "{}": empty distribution`},
+			{`{'1.0' 1.0}`, `invalid distribution "{'1.0' 1.0}": char 8: expected ':'`},
+			{`{'x' : 1.0}`, `invalid distribution "{'x' : 1.0}": invalid number: "x"`},
+			{`{'1.0' : 1.0} x`, `invalid distribution "{'1.0' : 1.0} x": char 15: unexpected trailing characters`},
+			{`uniform(2, 1)`, `invalid distribution "uniform(2, 1)": uniform: min greater than max`},
+			{`uniform(1)`, `invalid distribution "uniform(1)": uniform: expected 2 argument(s), found 1`},
+			{`exponential(0)`, `invalid distribution "exponential(0)": exponential: mean must be positive`},
+			{`normal(1, -1)`, `invalid distribution "normal(1, -1)": normal: stddev must not be negative`},
+			{`pareto(0, 1)`, `invalid distribution "pareto(0, 1)": pareto: scale & shape must be positive`},
+			{`gamma(1, 2)`, `invalid distribution "gamma(1, 2)": unknown distribution: gamma`},
+			{`normal(1, x)`, `invalid distribution "normal(1, x)": normal: invalid number: "x"`},
+			{`normal(1, 2`, `invalid distribution "normal(1, 2": char 12: expected ',' or ')'`},
+		} {
+			if _, err := model.ParseDistribution(tt.s); err == nil || err.Error() != tt.err {
+				t.Errorf("%s: unexpected error: %v", tt.s, err)
+			}
+		}
+	})
+
+	t.Run("ErrEmpirical", func(t *testing.T) {
+		path := MustWriteTempFile(t, "0 0.5\n1 0.25\n")
+		defer os.RemoveAll(filepath.Dir(path))
+		if _, err := model.ReadEmpiricalDistribution(path); err == nil || err.Error() != path+": cumulative probabilities must not decrease: 0.25" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		path = MustWriteTempFile(t, "0 0.5\n1 0.75\n")
+		defer os.RemoveAll(filepath.Dir(path))
+		if _, err := model.ReadEmpiricalDistribution(path); err == nil || err.Error() != path+": probabilities must sum to 1" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustParseDistribution parses s or fails.
+func MustParseDistribution(tb testing.TB, s string) model.Distribution {
+	tb.Helper()
+	dist, err := model.ParseDistribution(s)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dist
+}
+
+// MustSampleMean verifies the mean of many samples is within tol of mean.
+func MustSampleMean(tb testing.TB, dist model.Distribution, mean, tol float64) {
+	tb.Helper()
+	rng := rand.New(rand.NewSource(0))
+	const n = 100000
+	var sum float64
+	for i := 0; i < n; i++ {
+		v := dist.Sample(rng)
+		if v < 0 {
+			tb.Fatalf("negative sample: %f", v)
+		}
+		sum += v
+	}
+	if avg := sum / n; math.Abs(avg-mean) > tol {
+		tb.Fatalf("unexpected mean: %f, expected %f", avg, mean)
+	}
+}
+
+// MustWriteTempFile writes data to a file in a new temporary directory and
+// returns its path.
+func MustWriteTempFile(tb testing.TB, data string) string {
+	tb.Helper()
+	dir, err := ioutil.TempDir("", "marionette-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	path := filepath.Join(dir, "cdf")
+	if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
@@ -3,26 +3,40 @@ package model
 import (
 	"context"
 	"errors"
-	"math/rand"
-	"sort"
-	"strconv"
-	"strings"
+	"path/filepath"
 	"time"
 
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
 func init() {
 	marionette.RegisterPlugin("model", "sleep", Sleep)
+	mar.RegisterArgsValidator("model", "sleep", ValidateSleepArgs)
+}
+
+// ValidateSleepArgs validates the distribution passed to model.sleep.
+// Empirical files are not read as their paths are relative to the document.
+func ValidateSleepArgs(args []*mar.Arg) error {
+	if err := mar.ExpectArgs(mar.ArgString)(args); err != nil {
+		return err
+	} else if _, err := parseDistribution(args[0].Value.(string), "", false); err != nil {
+		return &mar.ValidationError{Message: err.Error(), Pos: args[0].Pos}
+	}
+	return nil
 }
 
 // SleepFactor is the multiplier the sleep value is multipled by.
 // By default the sleep is not adjusted.
 var SleepFactor = 1.0
 
+// MaxSleep is the longest duration of a single sleep. Larger samples, such as
+// from the tail of a lognormal or Pareto distribution, are clamped to it.
+var MaxSleep = 1 * time.Hour
+
 func Sleep(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
-	t0 := time.Now()
+	t0 := fsm.Clock().Now()
 
 	logger := marionette.Logger.With(
 		zap.String("plugin", "model.sleep"),
@@ -38,62 +52,27 @@ func Sleep(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 		return errors.New("invalid argument type")
 	}
 
-	dist, err := ParseSleepDistribution(distStr)
+	// Empirical files are relative to the document, if read from a file.
+	var dir string
+	if path := fsm.Document().Path; path != "" {
+		dir = filepath.Dir(path)
+	}
+	dist, err := lookupDistribution(distStr, dir)
 	if err != nil {
 		return err
 	}
 
-	keys := make([]float64, 0, len(dist))
-	for k := range dist {
-		keys = append(keys, k)
+	// Wait for the duration or until the FSM is shutting down.
+	duration := MaxSleep
+	if seconds := dist.Sample(fsm.Rand()) * SleepFactor; seconds < MaxSleep.Seconds() {
+		duration = time.Duration(seconds * float64(time.Second))
 	}
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-
-	sum, coin := float64(0), rand.Float64()
-	var k float64
-	for _, k = range keys {
-		sum += dist[k]
-		if sum >= coin {
-			break
-		}
+	if err := fsm.Clock().Sleep(ctx, duration); err != nil {
+		logger.Debug("sleep canceled", zap.Duration("duration", duration))
+		return err
 	}
 
-	duration := time.Duration(k * float64(time.Second) * SleepFactor)
-	time.Sleep(duration)
-
-	logger.Debug("sleep complete", zap.Duration("duration", duration), zap.Duration("t", time.Since(t0)))
+	logger.Debug("sleep complete", zap.Duration("duration", duration), zap.Duration("t", fsm.Clock().Now().Sub(t0)))
 
 	return nil
 }
-
-func ParseSleepDistribution(s string) (map[float64]float64, error) {
-	s = strings.TrimSpace(s)
-	s = strings.TrimLeft(s, "{")
-	s = strings.TrimRight(s, "}")
-	s = strings.Replace(s, " ", "", -1)
-	s = strings.Replace(s, "\n", "", -1)
-	s = strings.Replace(s, "\t", "", -1)
-	s = strings.Replace(s, "\r", "", -1)
-
-	dist := make(map[float64]float64)
-	for _, item := range strings.Split(s, ",") {
-		a := strings.Split(item, ":")
-		a[0] = strings.Trim(a[0], "'")
-
-		val, err := strconv.ParseFloat(a[0], 64)
-		if err != nil {
-			return nil, err
-		}
-
-		prob, err := strconv.ParseFloat(a[1], 64)
-		if err != nil {
-			return nil, err
-		}
-
-		if val > 0 {
-			dist[val] = prob
-		}
-	}
-
-	return dist, nil
-}
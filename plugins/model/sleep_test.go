@@ -1,12 +1,117 @@
 package model_test
 
 import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
+	"github.com/redjack/marionette/marionettetest"
+	"github.com/redjack/marionette/mock"
 	"github.com/redjack/marionette/plugins/model"
 )
 
+func TestSleep(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		clock := marionettetest.NewClock(time.Unix(0, 0))
+		conn := mock.DefaultConn()
+		fsm := mock.NewFSM(&conn, marionette.NewStreamSet())
+		fsm.PartyFn = func() string { return marionette.PartyClient }
+		fsm.ClockFn = func() marionette.Clock { return clock }
+
+		// Sleeps use the FSM's clock so the fake clock returns immediately.
+		if err := model.Sleep(context.Background(), &fsm, "{'5.0' : 1.0}"); err != nil {
+			t.Fatal(err)
+		} else if slept := clock.Slept(); slept != 5*time.Second {
+			t.Fatalf("unexpected sleep: %s", slept)
+		}
+	})
+
+	// Ensure samples too large for a time.Duration are clamped.
+	t.Run("MaxSleep", func(t *testing.T) {
+		for _, s := range []string{"{'1e300' : 1.0}", "lognormal(1000, 0)"} {
+			clock := marionettetest.NewClock(time.Unix(0, 0))
+			conn := mock.DefaultConn()
+			fsm := mock.NewFSM(&conn, marionette.NewStreamSet())
+			fsm.PartyFn = func() string { return marionette.PartyClient }
+			fsm.ClockFn = func() marionette.Clock { return clock }
+
+			if err := model.Sleep(context.Background(), &fsm, s); err != nil {
+				t.Fatal(err)
+			} else if slept := clock.Slept(); slept != model.MaxSleep {
+				t.Fatalf("%s: unexpected sleep: %s", s, slept)
+			}
+		}
+	})
+
+	// Ensure sleep durations are drawn from the FSM's PRNG.
+	t.Run("Seeded", func(t *testing.T) {
+		var slept [2]time.Duration
+		for i := range slept {
+			clock := marionettetest.NewClock(time.Unix(0, 0))
+			conn := mock.DefaultConn()
+			fsm := mock.NewFSM(&conn, marionette.NewStreamSet())
+			fsm.PartyFn = func() string { return marionette.PartyClient }
+			fsm.ClockFn = func() marionette.Clock { return clock }
+			rng := rand.New(rand.NewSource(1))
+			fsm.RandFn = func() *rand.Rand { return rng }
+
+			for j := 0; j < 10; j++ {
+				if err := model.Sleep(context.Background(), &fsm, "exponential(1)"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			slept[i] = clock.Slept()
+		}
+		if slept[0] != slept[1] {
+			t.Fatalf("sleeps differ: %s != %s", slept[0], slept[1])
+		}
+	})
+
+	// Ensure empirical paths are relative to the document.
+	t.Run("EmpiricalRelative", func(t *testing.T) {
+		path := MustWriteTempFile(t, "2 0\n2 1\n")
+		defer os.RemoveAll(filepath.Dir(path))
+
+		clock := marionettetest.NewClock(time.Unix(0, 0))
+		conn := mock.DefaultConn()
+		fsm := mock.NewFSM(&conn, marionette.NewStreamSet())
+		fsm.PartyFn = func() string { return marionette.PartyClient }
+		fsm.ClockFn = func() marionette.Clock { return clock }
+		fsm.DocumentFn = func() *mar.Document {
+			return &mar.Document{Path: filepath.Join(filepath.Dir(path), "format.mar")}
+		}
+
+		if err := model.Sleep(context.Background(), &fsm, "empirical('"+filepath.Base(path)+"')"); err != nil {
+			t.Fatal(err)
+		} else if slept := clock.Slept(); slept != 2*time.Second {
+			t.Fatalf("unexpected sleep: %s", slept)
+		}
+	})
+
+	// Ensure sleeps on the system clock return once the context is canceled.
+	t.Run("Canceled", func(t *testing.T) {
+		conn := mock.DefaultConn()
+		fsm := mock.NewFSM(&conn, marionette.NewStreamSet())
+		fsm.PartyFn = func() string { return marionette.PartyClient }
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		t0 := time.Now()
+		if err := model.Sleep(ctx, &fsm, "{'60.0' : 1.0}"); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		} else if elapsed := time.Since(t0); elapsed > time.Second {
+			t.Fatalf("sleep took %s", elapsed)
+		}
+	})
+}
+
 func TestParseSleepDistribution(t *testing.T) {
 	t.Run("http_timings", func(t *testing.T) {
 		if dist, err := model.ParseSleepDistribution(
@@ -12,6 +12,7 @@ import (
 
 func init() {
 	marionette.RegisterPlugin("model", "spawn", Spawn)
+	mar.RegisterArgsValidator("model", "spawn", mar.ExpectArgs(mar.ArgString, mar.ArgInt))
 }
 
 func Spawn(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
@@ -48,11 +49,11 @@ func Spawn(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	}
 	doc.Format = formatName
 
-	// Execute a sub-FSM multiple times.
+	// Execute a sub-FSM multiple times. Children are canceled with the parent.
 	for i := 0; i < n; i++ {
 		logger.Debug("spawn begin", zap.Int("i", i))
 		child := fsm.Clone(doc)
-		if err := child.Execute(context.TODO()); err != nil {
+		if err := child.Execute(ctx); err != nil {
 			logger.Error("child execution failed", zap.Error(err))
 			child.Reset()
 			return err
@@ -24,6 +24,9 @@ func TestSpawn(t *testing.T) {
 		fsm.PartyFn = func() string { return marionette.PartyClient }
 		fsm.ResetFn = func() {}
 
+		parent, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
 		var executeN int
 		fsm.CloneFn = func(doc *mar.Document) marionette.FSM {
 			if doc.Format != `ftp_pasv_transfer` {
@@ -31,6 +34,9 @@ func TestSpawn(t *testing.T) {
 			}
 			other := mock.FSM{
 				ExecuteFn: func(ctx context.Context) error {
+					if ctx != parent {
+						t.Fatal("expected child to inherit parent context")
+					}
 					executeN++
 					return nil
 				},
@@ -39,7 +45,7 @@ func TestSpawn(t *testing.T) {
 			return &other
 		}
 
-		if err := model.Spawn(context.Background(), &fsm, "ftp_pasv_transfer", 5); err != nil {
+		if err := model.Spawn(parent, &fsm, "ftp_pasv_transfer", 5); err != nil {
 			t.Fatal(err)
 		} else if executeN != 5 {
 			t.Fatalf("unexpected execution count: %d", executeN)
@@ -27,7 +27,7 @@ func (c *SetDNSTransactionIDCipher) Encrypt(fsm marionette.FSM, template string,
 	if v := fsm.Var("dns_transaction_id"); v != nil {
 		id = v.(string)
 	} else {
-		id = string([]rune{rune(rand.Intn(253) + 1), rune(rand.Intn(253) + 1)})
+		id = string([]byte{byte(rand.Intn(253) + 1), byte(rand.Intn(253) + 1)})
 		fsm.SetVar("dns_transaction_id", id)
 	}
 	return []byte(id), nil
@@ -98,7 +98,7 @@ func (c *SetDNSIPCipher) Encrypt(fsm marionette.FSM, template string, plaintext
 	if v := fsm.Var("dns_ip"); v != nil {
 		ip = v.(string)
 	} else {
-		ip = string([]rune{rune(rand.Intn(253) + 1), rune(rand.Intn(253) + 1), rune(rand.Intn(253) + 1), rune(rand.Intn(253) + 1)})
+		ip = string([]byte{byte(rand.Intn(253) + 1), byte(rand.Intn(253) + 1), byte(rand.Intn(253) + 1), byte(rand.Intn(253) + 1)})
 		fsm.SetVar("dns_ip", ip)
 	}
 	return []byte(ip), nil
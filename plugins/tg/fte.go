@@ -27,6 +27,12 @@ func (c *FTECipher) Key() string {
 	return c.key
 }
 
+// Regex returns the regex used to generate the DFA.
+func (c *FTECipher) Regex() string { return c.regex }
+
+// MsgLen returns the fixed length of the DFA.
+func (c *FTECipher) MsgLen() int { return c.msgLen }
+
 func (c *FTECipher) Capacity(fsm marionette.FSM) (int, error) {
 	if !c.useCapacity && strings.HasSuffix(c.regex, ".+") {
 		return marionette.MaxCellLength, nil
@@ -24,6 +24,12 @@ func (c *RankerCipher) Key() string {
 	return c.key
 }
 
+// Regex returns the regex used to generate the DFA.
+func (c *RankerCipher) Regex() string { return c.regex }
+
+// MsgLen returns the fixed length of the DFA.
+func (c *RankerCipher) MsgLen() int { return c.msgLen }
+
 func (c *RankerCipher) Capacity(fsm marionette.FSM) (int, error) {
 	dfa, err := fsm.DFA(c.regex, c.msgLen)
 	if err != nil {
@@ -7,11 +7,15 @@ import (
 	"time"
 
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
+var recvMetrics = marionette.NewPluginMetrics("tg.recv")
+
 func init() {
 	marionette.RegisterPlugin("tg", "recv", Recv)
+	mar.RegisterArgsValidator("tg", "recv", ValidateArgs)
 }
 
 func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
@@ -39,7 +43,7 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 	}
 
 	// Retrieve data from the connection.
-	ciphertext, err := fsm.Conn().Peek(-1, true)
+	ciphertext, err := fsm.Conn().PeekContext(ctx, -1, true)
 	if err == io.EOF {
 		return err
 	} else if err != nil {
@@ -75,6 +79,7 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 			return err
 		} else if cell.UUID != fsm.UUID() {
 			logger.Error("uuid mismatch", zap.Int("local", fsm.UUID()), zap.Int("remote", cell.UUID))
+			recvMetrics.UUIDMismatch()
 			return marionette.ErrUUIDMismatch
 		}
 		plaintextN = len(cell.Payload)
@@ -87,7 +92,7 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 			fsm.SetInstanceID(cell.InstanceID)
 		}
 
-		if err := fsm.StreamSet().Enqueue(&cell); err != nil {
+		if err := fsm.Enqueue(&cell); err != nil {
 			logger.Error("cannot enqueue cell", zap.Error(err))
 			return err
 		}
@@ -99,6 +104,9 @@ func Recv(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 		return err
 	}
 
+	recvMetrics.AddPlaintext(plaintextN)
+	recvMetrics.AddCiphertext(ciphertextN)
+
 	logger.Debug("msg received",
 		zap.String("grammar", name),
 		zap.Int("ciphertext", ciphertextN),
@@ -9,11 +9,15 @@ import (
 	"time"
 
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
 	"go.uber.org/zap"
 )
 
+var sendMetrics = marionette.NewPluginMetrics("tg.send")
+
 func init() {
 	marionette.RegisterPlugin("tg", "send", Send)
+	mar.RegisterArgsValidator("tg", "send", ValidateArgs)
 }
 
 func Send(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
@@ -58,6 +62,8 @@ func Send(ctx context.Context, fsm marionette.FSM, args ...interface{}) error {
 		return err
 	}
 
+	sendMetrics.AddCiphertext(len(ciphertext))
+
 	logger.Debug("msg sent", zap.String("grammar", name), zap.Int("ciphertext", len(ciphertext)), zap.Duration("t", time.Since(t0)))
 	return nil
 }
@@ -68,10 +74,12 @@ func encryptTo(fsm marionette.FSM, cipher TemplateCipher, template string, logge
 	if capacity, err := cipher.Capacity(fsm); err != nil {
 		return "", err
 	} else if capacity > 0 {
-		cell := fsm.StreamSet().Dequeue(capacity)
+		cell := fsm.Dequeue(capacity)
 		if cell == nil {
 			cell = marionette.NewCell(0, 0, capacity, marionette.NORMAL)
+			sendMetrics.EmptyCell()
 		}
+		sendMetrics.AddPlaintext(len(cell.Payload))
 
 		// Assign ids and marshal to bytes.
 		cell.UUID, cell.InstanceID = fsm.UUID(), fsm.InstanceID()
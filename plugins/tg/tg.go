@@ -1,9 +1,11 @@
 package tg
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/mar"
 )
 
 type Grammar struct {
@@ -26,6 +28,22 @@ func RegisterGrammar(grammar *Grammar) {
 	grammars[grammar.Name] = grammar
 }
 
+// ValidateArgs validates the arguments to tg.send & tg.recv.
+func ValidateArgs(args []*mar.Arg) error {
+	if err := mar.ExpectArgs(mar.ArgString)(args); err != nil {
+		return err
+	} else if name := args[0].Value.(string); grammars[name] == nil {
+		return &mar.ValidationError{Message: fmt.Sprintf("unknown grammar: %s", name), Pos: args[0].Pos}
+	}
+	return nil
+}
+
+// LookupGrammar returns a registered grammar by name.
+// Returns nil if the grammar does not exist.
+func LookupGrammar(name string) *Grammar {
+	return grammars[name]
+}
+
 func init() {
 	RegisterGrammar(&Grammar{
 		Name: "http_request_keep_alive",
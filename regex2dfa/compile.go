@@ -0,0 +1,382 @@
+package regex2dfa
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupported is returned when a regex uses a feature that cannot be
+// represented as a byte-oriented DFA, such as word boundaries.
+var ErrUnsupported = errors.New("regex2dfa: unsupported regex")
+
+// Compile converts regex into a minimized DFA table using a pure Go
+// implementation. States are numbered in breadth-first order which matches
+// Regex2DFA() for the regexes used by the built-in formats. Some cyclic
+// regexes may be numbered differently by OpenFST, which changes the symbol
+// order used for ranking, so both peers must use the same implementation
+// when using custom formats.
+//
+// The regex is parsed using RE2 syntax in Latin-1 mode with "." matching
+// newlines. The \C escape matches any single byte.
+func Compile(regex string) (string, error) {
+	re, err := syntax.Parse(latin1("^"+regex+"$"), syntax.ClassNL|syntax.DotNL|syntax.OneLine|syntax.PerlX)
+	if err != nil {
+		return "", err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return "", err
+	}
+
+	d, err := newDFA(prog)
+	if err != nil {
+		return "", err
+	}
+	return d.minimize().String(), nil
+}
+
+// latin1 converts each byte of s to a rune so that the parser treats the
+// regex as Latin-1. Also rewrites \C to match any byte.
+func latin1(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			if s[i+1] == 'C' {
+				buf.WriteString(`(?s:.)`)
+			} else {
+				buf.WriteRune(rune(s[i]))
+				buf.WriteRune(rune(s[i+1]))
+			}
+			i++
+			continue
+		}
+		buf.WriteRune(rune(s[i]))
+	}
+	return buf.String()
+}
+
+// dfa represents a byte-oriented DFA. State 0 is the start state.
+type dfa struct {
+	delta [][256]int // transitions, -1 if none
+	final []bool
+}
+
+// newDFA builds a DFA from prog using subset construction.
+func newDFA(prog *syntax.Prog) (*dfa, error) {
+	d := &dfa{}
+	index := make(map[string]int)
+	var queue [][]uint32
+
+	add := func(pcs []uint32) int {
+		key := fmt.Sprint(pcs)
+		if i, ok := index[key]; ok {
+			return i
+		}
+		i := len(d.delta)
+		index[key] = i
+		d.delta = append(d.delta, emptyTransitions())
+		d.final = append(d.final, false)
+		queue = append(queue, pcs)
+		return i
+	}
+
+	start, err := closure(prog, []uint32{uint32(prog.Start)}, true)
+	if err != nil {
+		return nil, err
+	}
+	add(start)
+
+	for i := 0; i < len(queue); i++ {
+		pcs := queue[i]
+
+		// Determine if the state accepts at the end of the text.
+		if final, err := isFinal(prog, pcs); err != nil {
+			return nil, err
+		} else if final {
+			d.final[i] = true
+		}
+
+		// Compute transitions for every byte.
+		for b := 0; b < 256; b++ {
+			var next []uint32
+			for _, pc := range pcs {
+				inst := &prog.Inst[pc]
+				switch inst.Op {
+				case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+					if inst.MatchRune(rune(b)) {
+						next = append(next, inst.Out)
+					}
+				}
+			}
+			if len(next) == 0 {
+				continue
+			}
+
+			next, err := closure(prog, next, false)
+			if err != nil {
+				return nil, err
+			} else if len(next) == 0 {
+				continue
+			}
+			d.delta[i][b] = add(next)
+		}
+	}
+
+	return d, nil
+}
+
+// closure returns the sorted set of consuming & match instructions reachable
+// from pcs without consuming input. Beginning of text assertions only pass if
+// begin is true. End of text assertions are evaluated by isFinal().
+func closure(prog *syntax.Prog, pcs []uint32, begin bool) ([]uint32, error) {
+	seen := make(map[uint32]bool)
+	var out []uint32
+
+	var visit func(pc uint32) error
+	visit = func(pc uint32) error {
+		if seen[pc] {
+			return nil
+		}
+		seen[pc] = true
+
+		inst := &prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			if err := visit(inst.Out); err != nil {
+				return err
+			}
+			return visit(inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			return visit(inst.Out)
+		case syntax.InstEmptyWidth:
+			switch syntax.EmptyOp(inst.Arg) &^ (syntax.EmptyBeginText | syntax.EmptyBeginLine | syntax.EmptyEndText | syntax.EmptyEndLine) {
+			case 0:
+			default:
+				return ErrUnsupported
+			}
+			if syntax.EmptyOp(inst.Arg)&(syntax.EmptyBeginText|syntax.EmptyBeginLine) != 0 && !begin {
+				return nil
+			}
+			// End of text assertions are kept so they can be resolved at the end.
+			if syntax.EmptyOp(inst.Arg)&(syntax.EmptyEndText|syntax.EmptyEndLine) != 0 {
+				out = append(out, pc)
+				return nil
+			}
+			return visit(inst.Out)
+		case syntax.InstFail:
+			return nil
+		default:
+			out = append(out, pc)
+			return nil
+		}
+	}
+
+	for _, pc := range pcs {
+		if err := visit(pc); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+// isFinal returns true if a match instruction can be reached from pcs at the
+// end of the text.
+func isFinal(prog *syntax.Prog, pcs []uint32) (bool, error) {
+	seen := make(map[uint32]bool)
+
+	var visit func(pc uint32) bool
+	visit = func(pc uint32) bool {
+		if seen[pc] {
+			return false
+		}
+		seen[pc] = true
+
+		inst := &prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstMatch:
+			return true
+		case syntax.InstAlt, syntax.InstAltMatch:
+			return visit(inst.Out) || visit(inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			return visit(inst.Out)
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(inst.Arg)&(syntax.EmptyBeginText|syntax.EmptyBeginLine) != 0 {
+				return false
+			}
+			return visit(inst.Out)
+		default:
+			return false
+		}
+	}
+
+	for _, pc := range pcs {
+		if visit(pc) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// minimize returns an equivalent DFA with the minimum number of states.
+// States that cannot reach a final state are removed and the remaining
+// states are numbered in breadth-first order from the start state.
+func (d *dfa) minimize() *dfa {
+	live := d.live()
+
+	// Partition live states by finality and then refine until stable.
+	class := make([]int, len(d.delta))
+	for i := range class {
+		switch {
+		case !live[i]:
+			class[i] = -1
+		case d.final[i]:
+			class[i] = 1
+		default:
+			class[i] = 0
+		}
+	}
+
+	for {
+		index := make(map[string]int)
+		next := make([]int, len(d.delta))
+		for i := range d.delta {
+			if !live[i] {
+				next[i] = -1
+				continue
+			}
+
+			var key strings.Builder
+			key.WriteString(strconv.Itoa(class[i]))
+			for b := 0; b < 256; b++ {
+				key.WriteByte(',')
+				if j := d.delta[i][b]; j >= 0 && live[j] {
+					key.WriteString(strconv.Itoa(class[j]))
+				} else {
+					key.WriteString("-1")
+				}
+			}
+
+			c, ok := index[key.String()]
+			if !ok {
+				c = len(index)
+				index[key.String()] = c
+			}
+			next[i] = c
+		}
+
+		// Stop once refinement no longer splits any class.
+		if len(index) == countClasses(class) {
+			break
+		}
+		class = next
+	}
+
+	// Renumber classes in breadth-first order from the start state.
+	other := &dfa{}
+	ids := make(map[int]int)
+	var queue []int
+	visit := func(i int) int {
+		if id, ok := ids[class[i]]; ok {
+			return id
+		}
+		id := len(other.delta)
+		ids[class[i]] = id
+		other.delta = append(other.delta, emptyTransitions())
+		other.final = append(other.final, d.final[i])
+		queue = append(queue, i)
+		return id
+	}
+
+	if !live[0] {
+		return other
+	}
+	visit(0)
+	for n := 0; n < len(queue); n++ {
+		i := queue[n]
+		for b := 0; b < 256; b++ {
+			if j := d.delta[i][b]; j >= 0 && live[j] {
+				other.delta[n][b] = visit(j)
+			}
+		}
+	}
+	return other
+}
+
+// live returns a flag for each state that is reachable from the start state
+// and can reach a final state.
+func (d *dfa) live() []bool {
+	reachable := make([]bool, len(d.delta))
+	stack := []int{0}
+	reachable[0] = true
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, j := range d.delta[i] {
+			if j >= 0 && !reachable[j] {
+				reachable[j] = true
+				stack = append(stack, j)
+			}
+		}
+	}
+
+	// Iteratively mark states which transition into a live state.
+	live := make([]bool, len(d.delta))
+	for i := range live {
+		live[i] = reachable[i] && d.final[i]
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := range d.delta {
+			if live[i] || !reachable[i] {
+				continue
+			}
+			for _, j := range d.delta[i] {
+				if j >= 0 && live[j] {
+					live[i], changed = true, true
+					break
+				}
+			}
+		}
+	}
+	return live
+}
+
+// String returns the DFA in the AT&T FSM text format used by Regex2DFA().
+func (d *dfa) String() string {
+	var buf bytes.Buffer
+	for i := range d.delta {
+		for b, j := range d.delta[i] {
+			if j >= 0 {
+				fmt.Fprintf(&buf, "%d\t%d\t%d\t%d\n", i, j, b, b)
+			}
+		}
+		if d.final[i] {
+			fmt.Fprintf(&buf, "%d\n", i)
+		}
+	}
+	return buf.String()
+}
+
+func emptyTransitions() (a [256]int) {
+	for i := range a {
+		a[i] = -1
+	}
+	return a
+}
+
+func countClasses(class []int) int {
+	m := make(map[int]struct{})
+	for _, c := range class {
+		if c >= 0 {
+			m[c] = struct{}{}
+		}
+	}
+	return len(m)
+}
@@ -0,0 +1,43 @@
+// +build !purego
+
+package regex2dfa_test
+
+import (
+	"testing"
+
+	"github.com/redjack/marionette/mar"
+	"github.com/redjack/marionette/regex2dfa"
+)
+
+// Ensure the pure Go compiler produces identical tables to the C++ library
+// for every regex used by the built-in formats. The purego build has no C++
+// library to compare against.
+func TestCompile_Formats(t *testing.T) {
+	for _, format := range mar.Formats() {
+		name, version := mar.SplitFormat(format)
+		doc, err := mar.Parse("", mar.Format(name, version))
+		if err != nil {
+			t.Fatal(format, err)
+		}
+
+		mar.Walk(mar.VisitorFunc(func(node mar.Node) {
+			action, ok := node.(*mar.Action)
+			if !ok || action.Module != "fte" || len(action.Args) == 0 {
+				return
+			}
+
+			regex, ok := action.Args[0].Value.(string)
+			if !ok {
+				return
+			}
+
+			if exp, err := regex2dfa.Regex2DFA(regex); err != nil {
+				t.Fatal(format, err)
+			} else if dfa, err := regex2dfa.Compile(regex); err != nil {
+				t.Fatal(format, err)
+			} else if exp != dfa {
+				t.Fatalf("%s: table mismatch: %q", format, regex)
+			}
+		}), doc)
+	}
+}
@@ -0,0 +1,41 @@
+package regex2dfa_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redjack/marionette/regex2dfa"
+)
+
+func TestCompile(t *testing.T) {
+	for i := 1; i <= 8; i++ {
+		name := fmt.Sprintf("test%d", i)
+		t.Run(name, func(t *testing.T) {
+			regex, err := ioutil.ReadFile(`testdata/` + name + `.regex`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			exp, err := ioutil.ReadFile(`testdata/` + name + `.dfa`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dfa, err := regex2dfa.Compile(string(regex))
+			if err != nil {
+				t.Fatal(err)
+			} else if diff := cmp.Diff(strings.TrimSpace(string(exp)), strings.TrimSpace(dfa)); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+
+	t.Run("ErrUnsupported", func(t *testing.T) {
+		if _, err := regex2dfa.Compile(`\bfoo`); err != regex2dfa.ErrUnsupported {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
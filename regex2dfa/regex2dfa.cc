@@ -1,3 +1,5 @@
+// +build !purego
+
 #include <fst/fstlib.h>
 #include <fst/script/fstscript.h>
 
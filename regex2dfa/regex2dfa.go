@@ -1,3 +1,5 @@
+// +build !purego
+
 package regex2dfa
 
 // #cgo CXXFLAGS: -std=c++11 -DMARIONETTE -I${SRCDIR}/../third_party/re2
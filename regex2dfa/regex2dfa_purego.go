@@ -0,0 +1,25 @@
+// +build purego
+
+package regex2dfa
+
+import "errors"
+
+// ErrInternal is returned any error occurs.
+var ErrInternal = errors.New("regex2dfa: internal error")
+
+// Regex2DFA converts regex into a DFA table.
+//
+// This implementation is used when built with the "purego" tag and is
+// equivalent to calling Compile().
+func Regex2DFA(regex string) (string, error) {
+	return Compile(regex)
+}
+
+// MustRegex2DFA converts regex into a DFA table. Panic on error.
+func MustRegex2DFA(regex string) string {
+	s, err := Regex2DFA(regex)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
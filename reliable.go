@@ -0,0 +1,463 @@
+package marionette
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Reliability defaults.
+const (
+	DefaultRetransmitTimeout = 1 * time.Second
+	DefaultMaxRetransmits    = 10
+	DefaultReorderTimeout    = 30 * time.Second
+)
+
+// maxRetransmitBackoff is the maximum multiple of the retransmit timeout
+// used when backing off repeated retransmissions.
+const maxRetransmitBackoff = 8
+
+// ackEntrySize is the size, in bytes, of each selective ack in an ACK cell.
+const ackEntrySize = 5
+
+var (
+	// ErrRetransmitLimit is returned from a stream when a cell could not be
+	// delivered within the maximum number of retransmissions.
+	ErrRetransmitLimit = errors.New("marionette: retransmit limit exceeded")
+
+	// ErrReorderTimeout is returned from a stream when a missing cell is not
+	// received within the reorder timeout.
+	ErrReorderTimeout = errors.New("marionette: reorder timeout")
+)
+
+// ReliableLayer provides acknowledgement & retransmission of stream cells
+// for transports which may drop or reorder messages, such as UDP.
+//
+// The layer sits between the FSM and a StreamSet. Cells dequeued from the
+// stream set are held until the peer acknowledges them and are resent if no
+// acknowledgement arrives within the retransmit timeout. Received cells are
+// acknowledged with ACK cells which carry the next expected sequence and a
+// selective list of cells received out of order. Reordering is handled by
+// the stream's read queue.
+//
+// Negotiation cells are not covered by the layer.
+type ReliableLayer struct {
+	mu        sync.Mutex
+	streamSet *StreamSet
+	sent      map[reliableKey]*reliableEntry
+	recv      map[int]*reliableRecvState
+
+	// Initial time to wait for an acknowledgement before resending a cell.
+	// The timeout doubles with each retransmission of the same cell.
+	RetransmitTimeout time.Duration
+
+	// Number of times a cell is resent before its stream is aborted.
+	MaxRetransmits int
+
+	// Time to wait for a missing cell before its stream is aborted.
+	ReorderTimeout time.Duration
+
+	// Clock used for retransmit & reorder timeouts. Defaults to DefaultClock.
+	Clock Clock
+}
+
+// NewReliableLayer returns a new instance of ReliableLayer for streamSet.
+func NewReliableLayer(streamSet *StreamSet) *ReliableLayer {
+	return &ReliableLayer{
+		streamSet: streamSet,
+		sent:      make(map[reliableKey]*reliableEntry),
+		recv:      make(map[int]*reliableRecvState),
+
+		RetransmitTimeout: DefaultRetransmitTimeout,
+		MaxRetransmits:    DefaultMaxRetransmits,
+		ReorderTimeout:    DefaultReorderTimeout,
+		Clock:             DefaultClock,
+	}
+}
+
+// StreamSet returns the underlying stream set.
+func (r *ReliableLayer) StreamSet() *StreamSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streamSet
+}
+
+// setStreamSet replaces the underlying stream set. Used when a server
+// connection joins a client session before any stream data is exchanged.
+func (r *ReliableLayer) setStreamSet(ss *StreamSet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streamSet = ss
+}
+
+// Unacked returns the number of sent cells awaiting acknowledgement.
+func (r *ReliableLayer) Unacked() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sent)
+}
+
+// undelivered returns the sent cells awaiting acknowledgement.
+func (r *ReliableLayer) undelivered() []*Cell {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cells := make([]*Cell, 0, len(r.sent))
+	for _, e := range r.sent {
+		cells = append(cells, e.cell)
+	}
+	return cells
+}
+
+// Dequeue returns the next cell to send that fits within n bytes. Pending
+// acknowledgements are sent first, then expired cells are retransmitted.
+// Otherwise the next cell is dequeued from the stream set.
+func (r *ReliableLayer) Dequeue(n int) *Cell {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.Clock.Now()
+	r.checkReorderTimeouts(now)
+
+	if cell := r.dequeueAck(n); cell != nil {
+		return cell
+	} else if cell := r.dequeueRetransmit(n, now); cell != nil {
+		return cell
+	}
+
+	cell := r.streamSet.Dequeue(n)
+	if cell == nil || cell.StreamID == 0 {
+		return cell
+	}
+
+	// Track the cell until it is acknowledged. Older window updates for the
+	// same stream are superseded since they carry absolute limits.
+	key := newReliableKey(cell)
+	if key.window {
+		for other := range r.sent {
+			if other.window && other.streamID == key.streamID {
+				delete(r.sent, other)
+			}
+		}
+	}
+	r.sent[key] = &reliableEntry{cell: cell, sentAt: now}
+	return cell
+}
+
+// dequeueAck returns an ACK cell for the first stream with received cells
+// that have not been acknowledged.
+func (r *ReliableLayer) dequeueAck(n int) *Cell {
+	for _, id := range r.recvIDs() {
+		state := r.recv[id]
+		if !state.pending {
+			continue
+		}
+
+		// Include as many selective acks as fit in the cell. Any remaining
+		// acks are sent in the next cell.
+		sz := n
+		if sz == 0 || sz > MaxCellLength {
+			sz = MaxCellLength
+		}
+		entries := state.entries()
+		if max := (sz - CellHeaderSize) / ackEntrySize; max < 0 {
+			return nil
+		} else if len(entries) > max {
+			entries = entries[:max]
+		} else {
+			state.pending = false
+		}
+
+		cell := NewCell(id, state.next, n, ACK)
+		if len(entries) > 0 {
+			cell.Payload = make([]byte, 0, len(entries)*ackEntrySize)
+			for _, e := range entries {
+				cell.Payload = append(cell.Payload, byte(e.typ), 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(cell.Payload[len(cell.Payload)-4:], uint32(e.seq))
+			}
+		}
+
+		// Window updates only need to be acknowledged once.
+		for _, e := range entries {
+			if e.typ == WINDOW_UPDATE {
+				delete(state.windows, e.seq)
+			}
+		}
+		return cell
+	}
+	return nil
+}
+
+// dequeueRetransmit returns a copy of the oldest cell whose retransmit
+// timeout has expired and which fits within n bytes. Streams whose cells
+// exceed the retransmit limit are aborted.
+func (r *ReliableLayer) dequeueRetransmit(n int, now time.Time) *Cell {
+	var key reliableKey
+	var entry *reliableEntry
+	for k, e := range r.sent {
+		if now.Before(e.sentAt.Add(r.timeout(e))) {
+			continue
+		} else if n > 0 && e.cell.Size()-e.cell.paddingN() > n {
+			continue
+		} else if entry == nil || e.sentAt.Before(entry.sentAt) || (e.sentAt.Equal(entry.sentAt) && k.less(key)) {
+			key, entry = k, e
+		}
+	}
+	if entry == nil {
+		return nil
+	}
+
+	// Give up on the stream if the cell has been sent too many times.
+	if entry.retransmits >= r.MaxRetransmits {
+		Logger.Debug("retransmit limit exceeded", zap.Int("stream_id", key.streamID), zap.Int("seq", key.seq))
+		r.abort(key.streamID, ErrRetransmitLimit)
+		return r.dequeueRetransmit(n, now)
+	}
+
+	entry.sentAt = now
+	entry.retransmits++
+
+	other := *entry.cell
+	other.Length = n
+	return &other
+}
+
+// timeout returns the retransmit timeout for the entry with backoff.
+func (r *ReliableLayer) timeout(e *reliableEntry) time.Duration {
+	backoff := 1 << uint(e.retransmits)
+	if backoff > maxRetransmitBackoff {
+		backoff = maxRetransmitBackoff
+	}
+	return r.RetransmitTimeout * time.Duration(backoff)
+}
+
+// checkReorderTimeouts aborts streams which have been waiting on a missing
+// cell for longer than the reorder timeout.
+func (r *ReliableLayer) checkReorderTimeouts(now time.Time) {
+	for _, id := range r.recvIDs() {
+		state := r.recv[id]
+		if len(state.sacks) == 0 || now.Sub(state.gapAt) < r.ReorderTimeout {
+			continue
+		}
+		Logger.Debug("reorder timeout", zap.Int("stream_id", id), zap.Int("seq", state.next))
+		r.abort(id, ErrReorderTimeout)
+	}
+
+	// Remove state for streams which have been closed.
+	for id, state := range r.recv {
+		if now.Sub(state.modTime) >= r.ReorderTimeout && r.streamSet.Stream(id) == nil {
+			delete(r.recv, id)
+		}
+	}
+}
+
+// abort aborts the stream and stops tracking its cells.
+func (r *ReliableLayer) abort(streamID int, err error) {
+	for key := range r.sent {
+		if key.streamID == streamID {
+			delete(r.sent, key)
+		}
+	}
+	if state := r.recv[streamID]; state != nil {
+		state.sacks, state.windows, state.aborted = nil, nil, true
+	}
+	if stream := r.streamSet.Stream(streamID); stream != nil {
+		stream.abort(err)
+	}
+}
+
+// Enqueue processes a cell received from the peer. ACK cells are consumed by
+// the layer. All other stream cells are acknowledged and passed to the stream
+// set unless they are duplicates.
+func (r *ReliableLayer) Enqueue(cell *Cell) error {
+	if cell.StreamID == 0 {
+		return r.streamSet.Enqueue(cell)
+	}
+
+	r.mu.Lock()
+	if cell.Type == ACK {
+		r.ack(cell)
+		r.mu.Unlock()
+		return nil
+	}
+	ok := r.received(cell)
+	r.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return r.streamSet.Enqueue(cell)
+}
+
+// ack removes acknowledged cells from the sent set. Unacknowledged cells
+// sent before a selectively acknowledged cell are retransmitted immediately.
+func (r *ReliableLayer) ack(cell *Cell) {
+	var lastAckedAt time.Time
+	remove := func(key reliableKey) {
+		if e := r.sent[key]; e != nil {
+			if e.sentAt.After(lastAckedAt) {
+				lastAckedAt = e.sentAt
+			}
+			delete(r.sent, key)
+		}
+	}
+
+	for key := range r.sent {
+		if key.streamID == cell.StreamID && !key.window && key.seq < cell.SequenceID {
+			remove(key)
+		}
+	}
+
+	var selective bool
+	for p := cell.Payload; len(p) >= ackEntrySize; p = p[ackEntrySize:] {
+		key := reliableKey{streamID: cell.StreamID, seq: int(binary.BigEndian.Uint32(p[1:])), window: p[0] == WINDOW_UPDATE}
+		if !key.window {
+			selective = true
+		}
+		remove(key)
+	}
+
+	// Cells before a selective ack are likely lost so resend them without
+	// waiting for the retransmit timeout.
+	if selective {
+		for key, e := range r.sent {
+			if key.streamID == cell.StreamID && !key.window && key.seq >= cell.SequenceID && e.sentAt.Before(lastAckedAt) {
+				e.sentAt = e.sentAt.Add(-r.timeout(e))
+			}
+		}
+	}
+}
+
+// received records a received cell so it can be acknowledged.
+// Returns false if the cell is a duplicate.
+func (r *ReliableLayer) received(cell *Cell) bool {
+	state := r.recv[cell.StreamID]
+	if state == nil {
+		state = &reliableRecvState{sacks: make(map[int]struct{}), windows: make(map[int]struct{})}
+		r.recv[cell.StreamID] = state
+	}
+	state.modTime = r.Clock.Now()
+
+	// Always acknowledge so that lost ACKs are eventually replaced.
+	state.pending = true
+
+	// Drop cells for streams which have been aborted.
+	if state.aborted {
+		return false
+	}
+
+	// Window updates are idempotent so duplicates are passed through.
+	if cell.Type == WINDOW_UPDATE {
+		if state.windows == nil {
+			state.windows = make(map[int]struct{})
+		}
+		state.windows[cell.SequenceID] = struct{}{}
+		return true
+	}
+
+	// Ignore cells which have already been received.
+	if cell.SequenceID < state.next {
+		return false
+	} else if _, ok := state.sacks[cell.SequenceID]; ok {
+		return false
+	}
+
+	if state.sacks == nil {
+		state.sacks = make(map[int]struct{})
+	}
+	if cell.SequenceID > state.next {
+		if len(state.sacks) == 0 {
+			state.gapAt = state.modTime
+		}
+		state.sacks[cell.SequenceID] = struct{}{}
+		return true
+	}
+
+	// Advance past all consecutive cells.
+	for state.next++; ; state.next++ {
+		if _, ok := state.sacks[state.next]; !ok {
+			break
+		}
+		delete(state.sacks, state.next)
+	}
+	if len(state.sacks) > 0 {
+		state.gapAt = state.modTime
+	}
+	return true
+}
+
+// recvIDs returns the stream ids of received state in sorted order.
+func (r *ReliableLayer) recvIDs() []int {
+	ids := make([]int, 0, len(r.recv))
+	for id := range r.recv {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// reliableKey identifies a sent cell. Window updates are numbered
+// separately from data cells.
+type reliableKey struct {
+	streamID int
+	seq      int
+	window   bool
+}
+
+func newReliableKey(cell *Cell) reliableKey {
+	return reliableKey{streamID: cell.StreamID, seq: cell.SequenceID, window: cell.Type == WINDOW_UPDATE}
+}
+
+func (k reliableKey) less(other reliableKey) bool {
+	if k.streamID != other.streamID {
+		return k.streamID < other.streamID
+	} else if k.window != other.window {
+		return !k.window
+	}
+	return k.seq < other.seq
+}
+
+// reliableEntry represents a sent cell awaiting acknowledgement.
+type reliableEntry struct {
+	cell        *Cell
+	sentAt      time.Time
+	retransmits int
+}
+
+// reliableRecvState tracks received cells for a single stream.
+type reliableRecvState struct {
+	next    int              // next expected data sequence
+	sacks   map[int]struct{} // data sequences received after a gap
+	windows map[int]struct{} // window update sequences to acknowledge
+	pending bool             // if true, an ACK needs to be sent
+	aborted bool             // if true, the stream has been aborted
+	gapAt   time.Time        // time the current gap was first seen
+	modTime time.Time        // time a cell was last received
+}
+
+type ackEntry struct {
+	typ int
+	seq int
+}
+
+// entries returns selective acks in sequence order. Window updates are first.
+func (s *reliableRecvState) entries() []ackEntry {
+	var a []ackEntry
+	for seq := range s.windows {
+		a = append(a, ackEntry{typ: WINDOW_UPDATE, seq: seq})
+	}
+	for seq := range s.sacks {
+		a = append(a, ackEntry{typ: NORMAL, seq: seq})
+	}
+	sort.Slice(a, func(i, j int) bool {
+		if a[i].typ != a[j].typ {
+			return a[i].typ == WINDOW_UPDATE
+		}
+		return a[i].seq < a[j].seq
+	})
+	return a
+}
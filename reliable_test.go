@@ -0,0 +1,364 @@
+package marionette_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/marionettetest"
+)
+
+func TestReliableLayer(t *testing.T) {
+	t.Run("Lossy", func(t *testing.T) {
+		clientConn, serverConn := NewLossyPacketPipe(0.2, 0.2, 1)
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		newStreams := make(chan *marionette.Stream, 1)
+		clientSS, serverSS := marionette.NewStreamSet(), marionette.NewStreamSet()
+		serverSS.OnNewStream = func(stream *marionette.Stream) { newStreams <- stream }
+		defer clientSS.Close()
+		defer serverSS.Close()
+
+		client, server := marionette.NewReliableLayer(clientSS), marionette.NewReliableLayer(serverSS)
+		client.RetransmitTimeout, server.RetransmitTimeout = 10*time.Millisecond, 10*time.Millisecond
+
+		closing := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(4)
+		go func() { defer wg.Done(); PumpReliableLayer(client, clientConn, serverConn.LocalAddr(), closing) }()
+		go func() { defer wg.Done(); PumpReliableLayer(server, serverConn, clientConn.LocalAddr(), closing) }()
+		go func() { defer wg.Done(); DrainReliableLayer(t, client, clientConn) }()
+		go func() { defer wg.Done(); DrainReliableLayer(t, server, serverConn) }()
+		defer wg.Wait()
+		defer close(closing)
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		// Write more than the initial window so window updates are exercised.
+		data := make([]byte, marionette.InitialStreamWindow*2)
+		rand.New(rand.NewSource(0)).Read(data)
+
+		stream := clientSS.Create()
+		errc := make(chan error, 1)
+		go func() {
+			for p := data; len(p) > 0; {
+				n := 1000
+				if n > len(p) {
+					n = len(p)
+				}
+				if _, err := stream.Write(p[:n]); err != nil {
+					errc <- err
+					return
+				}
+				p = p[n:]
+			}
+			errc <- stream.Close()
+		}()
+
+		// Read all data from the server side of the stream.
+		var other *marionette.Stream
+		select {
+		case other = <-newStreams:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for stream")
+		}
+		if buf, err := ioutil.ReadAll(other); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, data) {
+			t.Fatalf("data mismatch: len=%d", len(buf))
+		} else if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Retransmit", func(t *testing.T) {
+		clock := marionettetest.NewClock(time.Time{})
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		r := marionette.NewReliableLayer(ss)
+		r.Clock = clock
+
+		stream := ss.Create()
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Send cell and drop it.
+		cell := r.Dequeue(0)
+		if cell == nil || string(cell.Payload) != "foo" {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if n := r.Unacked(); n != 1 {
+			t.Fatalf("unexpected unacked: %d", n)
+		}
+
+		// Nothing should be sent until the timeout expires.
+		if other := r.Dequeue(0); other != nil {
+			t.Fatalf("unexpected cell: %#v", other)
+		}
+		clock.Add(r.RetransmitTimeout)
+		if other := r.Dequeue(0); other == nil || !other.Equal(cell) {
+			t.Fatalf("expected retransmit: %#v", other)
+		}
+
+		// Acknowledging the cell should stop retransmission.
+		if err := r.Enqueue(&marionette.Cell{Type: marionette.ACK, StreamID: stream.ID(), SequenceID: 1}); err != nil {
+			t.Fatal(err)
+		} else if n := r.Unacked(); n != 0 {
+			t.Fatalf("unexpected unacked: %d", n)
+		}
+		clock.Add(time.Hour)
+		if other := r.Dequeue(0); other != nil {
+			t.Fatalf("unexpected cell: %#v", other)
+		}
+	})
+
+	t.Run("SelectiveAck", func(t *testing.T) {
+		clock := marionettetest.NewClock(time.Time{})
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		r := marionette.NewReliableLayer(ss)
+		r.Clock = clock
+
+		// Send two cells at different times.
+		stream := ss.Create()
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if cell := r.Dequeue(0); cell == nil || cell.SequenceID != 0 {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+		clock.Add(time.Millisecond)
+		if _, err := stream.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if cell := r.Dequeue(0); cell == nil || cell.SequenceID != 1 {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+
+		// Acknowledging the second cell should resend the first immediately.
+		if err := r.Enqueue(&marionette.Cell{Type: marionette.ACK, StreamID: stream.ID(), SequenceID: 0, Payload: []byte{marionette.NORMAL, 0, 0, 0, 1}}); err != nil {
+			t.Fatal(err)
+		} else if cell := r.Dequeue(0); cell == nil || cell.SequenceID != 0 || string(cell.Payload) != "foo" {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if n := r.Unacked(); n != 1 {
+			t.Fatalf("unexpected unacked: %d", n)
+		}
+	})
+
+	t.Run("Ack", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		r := marionette.NewReliableLayer(ss)
+
+		// Receive cells out of order and a duplicate.
+		for _, seq := range []int{0, 2, 2, 3} {
+			if err := r.Enqueue(&marionette.Cell{Type: marionette.NORMAL, StreamID: 100, SequenceID: seq, Payload: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// ACK should include the next expected sequence & received cells after the gap.
+		if cell := r.Dequeue(0); cell == nil || cell.Type != marionette.ACK {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if cell.StreamID != 100 || cell.SequenceID != 1 {
+			t.Fatalf("unexpected ack: stream=%d seq=%d", cell.StreamID, cell.SequenceID)
+		} else if !bytes.Equal(cell.Payload, []byte{marionette.NORMAL, 0, 0, 0, 2, marionette.NORMAL, 0, 0, 0, 3}) {
+			t.Fatalf("unexpected payload: %x", cell.Payload)
+		} else if other := r.Dequeue(0); other != nil {
+			t.Fatalf("unexpected cell: %#v", other)
+		}
+
+		// Filling the gap should advance the acknowledged sequence.
+		if err := r.Enqueue(&marionette.Cell{Type: marionette.NORMAL, StreamID: 100, SequenceID: 1, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		} else if cell := r.Dequeue(0); cell == nil || cell.SequenceID != 4 || len(cell.Payload) != 0 {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+
+		buf := make([]byte, 10)
+		if n, err := ss.Stream(100).Read(buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != "xxxx" {
+			t.Fatalf("unexpected data: %q", buf[:n])
+		}
+	})
+
+	t.Run("ErrRetransmitLimit", func(t *testing.T) {
+		clock := marionettetest.NewClock(time.Time{})
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		r := marionette.NewReliableLayer(ss)
+		r.MaxRetransmits = 2
+		r.Clock = clock
+
+		stream := ss.Create()
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Drop all sent cells.
+		for i := 0; i < 10; i++ {
+			r.Dequeue(0)
+			clock.Add(time.Minute)
+		}
+
+		if _, err := stream.Write([]byte("bar")); err != marionette.ErrRetransmitLimit {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := stream.Read(make([]byte, 10)); err != marionette.ErrRetransmitLimit {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrReorderTimeout", func(t *testing.T) {
+		clock := marionettetest.NewClock(time.Time{})
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		r := marionette.NewReliableLayer(ss)
+		r.Clock = clock
+
+		// Receive a cell after a gap which is never filled.
+		if err := r.Enqueue(&marionette.Cell{Type: marionette.NORMAL, StreamID: 100, SequenceID: 1, Payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+		clock.Add(r.ReorderTimeout)
+		r.Dequeue(0)
+
+		if _, err := ss.Stream(100).Read(make([]byte, 10)); err != marionette.ErrReorderTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// PumpReliableLayer continually sends cells from r to addr until closing is closed.
+func PumpReliableLayer(r *marionette.ReliableLayer, conn net.PacketConn, addr net.Addr, closing chan struct{}) {
+	for {
+		select {
+		case <-closing:
+			return
+		default:
+		}
+
+		cell := r.Dequeue(1024)
+		if cell == nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		buf, err := cell.MarshalBinary()
+		if err != nil {
+			panic(err)
+		} else if _, err := conn.WriteTo(buf, addr); err != nil {
+			return
+		}
+	}
+}
+
+// DrainReliableLayer continually reads cells from conn into r until conn is closed.
+func DrainReliableLayer(tb testing.TB, r *marionette.ReliableLayer, conn net.PacketConn) {
+	buf := make([]byte, marionette.MaxCellLength)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var cell marionette.Cell
+		if err := cell.UnmarshalBinary(buf[:n]); err != nil {
+			tb.Error(err)
+			return
+		} else if err := r.Enqueue(&cell); err != nil {
+			tb.Error(err)
+			return
+		}
+	}
+}
+
+// LossyPacketConn is an in-memory net.PacketConn which randomly drops and
+// reorders datagrams written to its peer.
+type LossyPacketConn struct {
+	mu      sync.Mutex
+	addr    lossyAddr
+	peer    *LossyPacketConn
+	ch      chan []byte
+	held    []byte // datagram held back to be delivered out of order
+	rand    *rand.Rand
+	closing chan struct{}
+	once    sync.Once
+
+	DropRate    float64
+	ReorderRate float64
+}
+
+// NewLossyPacketPipe returns a pair of connected lossy packet conns.
+func NewLossyPacketPipe(dropRate, reorderRate float64, seed int64) (*LossyPacketConn, *LossyPacketConn) {
+	a := &LossyPacketConn{addr: "a", ch: make(chan []byte, 1024), rand: rand.New(rand.NewSource(seed)), closing: make(chan struct{}), DropRate: dropRate, ReorderRate: reorderRate}
+	b := &LossyPacketConn{addr: "b", ch: make(chan []byte, 1024), rand: rand.New(rand.NewSource(seed + 1)), closing: make(chan struct{}), DropRate: dropRate, ReorderRate: reorderRate}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *LossyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closing:
+		return 0, nil, io.EOF
+	case buf := <-c.ch:
+		return copy(p, buf), c.peer.addr, nil
+	}
+}
+
+func (c *LossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closing:
+		return 0, errors.New("closed")
+	default:
+	}
+
+	buf := append([]byte(nil), p...)
+	if c.rand.Float64() < c.DropRate {
+		return len(p), nil
+	}
+
+	// Hold back datagram to swap with the next one.
+	if c.held == nil && c.rand.Float64() < c.ReorderRate {
+		c.held = buf
+		return len(p), nil
+	}
+
+	c.deliver(buf)
+	if c.held != nil {
+		c.deliver(c.held)
+		c.held = nil
+	}
+	return len(p), nil
+}
+
+func (c *LossyPacketConn) deliver(buf []byte) {
+	select {
+	case c.peer.ch <- buf:
+	default: // queue full, drop
+	}
+}
+
+func (c *LossyPacketConn) Close() error {
+	c.once.Do(func() { close(c.closing) })
+	return nil
+}
+
+func (c *LossyPacketConn) LocalAddr() net.Addr                { return c.addr }
+func (c *LossyPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *LossyPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *LossyPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type lossyAddr string
+
+func (a lossyAddr) Network() string { return "lossy" }
+func (a lossyAddr) String() string  { return string(a) }
@@ -0,0 +1,224 @@
+package marionette
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/redjack/marionette/mar"
+)
+
+var (
+	// ErrInvalidTrace is returned when a trace does not begin with an open event.
+	ErrInvalidTrace = errors.New("marionette: invalid trace")
+
+	// ErrTraceUUIDMismatch is returned when replaying a trace with a different format.
+	ErrTraceUUIDMismatch = errors.New("marionette: trace uuid mismatch")
+
+	// ErrTraceNegotiated is returned when replaying a trace of a connection
+	// which negotiated a session key. Ephemeral keys cannot be reproduced.
+	ErrTraceNegotiated = errors.New("marionette: cannot replay negotiated connection")
+)
+
+// Replayer re-executes a recorded connection trace against the current code.
+//
+// Bytes read from the network are fed to the FSM at the same position
+// relative to the FSM's peeks as they were recorded, and cells sent by the
+// recorded connection are returned from the same dequeue calls. Writes are
+// discarded. The replay fails if the transitions diverge from the trace.
+type Replayer struct {
+	doc    *mar.Document
+	key    []byte
+	events []*TraceEvent
+
+	// Receives the events of the replayed connection, if set.
+	Output io.Writer
+}
+
+// NewReplayer returns a new Replayer for a trace recorded with doc & key.
+func NewReplayer(doc *mar.Document, key []byte, events []*TraceEvent) *Replayer {
+	return &Replayer{
+		doc:    doc,
+		key:    key,
+		events: events,
+	}
+}
+
+// Replay runs the FSM until all recorded transitions have been reproduced.
+// Returns the number of transitions replayed.
+func (r *Replayer) Replay(ctx context.Context) (int, error) {
+	if len(r.events) == 0 || r.events[0].Type != TraceEventOpen {
+		return 0, ErrInvalidTrace
+	}
+	hdr := r.events[0]
+	if hdr.UUID != r.doc.UUID {
+		return 0, ErrTraceUUIDMismatch
+	}
+
+	// Split recorded events by type.
+	var reads, dequeues, transitions []*TraceEvent
+	for _, e := range r.events[1:] {
+		switch e.Type {
+		case TraceEventRead:
+			reads = append(reads, e)
+		case TraceEventDequeue:
+			dequeues = append(dequeues, e)
+		case TraceEventTransition:
+			transitions = append(transitions, e)
+		}
+		if e.Cell != nil && e.Cell.Type == NEGOTIATE {
+			return 0, ErrTraceNegotiated
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Compare transitions as they occur & stop at the first divergence.
+	var mu sync.Mutex
+	var n int
+	var diverged error
+	tracer := NewTracer(r.Output)
+	tracer.fn = func(e *TraceEvent) {
+		if e.Type != TraceEventTransition {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if diverged != nil || n >= len(transitions) {
+			return
+		} else if exp := transitions[n]; exp.State != e.State || exp.Dest != e.Dest {
+			diverged = fmt.Errorf("replay diverged at transition %d: expected %s -> %s, got %s -> %s", n, exp.State, exp.Dest, e.State, e.Dest)
+			cancel()
+			return
+		}
+
+		// Stop once the last recorded transition is reproduced.
+		if n++; n == len(transitions) {
+			cancel()
+		}
+	}
+
+	var conn net.Conn = &replayConn{ctx: ctx, tracer: tracer, reads: reads, network: "tcp"}
+	if r.doc.Transport == "udp" {
+		conn = &replayPacketConn{replayConn: &replayConn{ctx: ctx, tracer: tracer, reads: reads, network: "udp"}}
+	}
+	fsm := newFSM(r.doc, hdr.Host, hdr.Party, conn, NewStreamSet(), r.key, hdr.InstanceID, tracer)
+	fsm.sessions = newSessionRegistry(NewStreamSet, DefaultSessionTimeout, DefaultClock)
+	defer fsm.sessions.close()
+	defer fsm.Close()
+	fsm.replay = &replayDequeuer{cells: dequeues}
+
+	err := r.execute(ctx, fsm)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diverged != nil {
+		return n, diverged
+	} else if n == len(transitions) {
+		return n, nil
+	} else if err != nil {
+		return n, err
+	}
+	exp := transitions[n]
+	return n, fmt.Errorf("replay diverged at transition %d: expected %s -> %s, input exhausted", n, exp.State, exp.Dest)
+}
+
+// execute runs the FSM until the input is exhausted, the context is
+// canceled or an error occurs.
+func (r *Replayer) execute(ctx context.Context, fsm *fsm) error {
+	for ctx.Err() == nil {
+		if err := fsm.Execute(ctx); err == io.EOF || err == ErrStreamClosed {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fsm.Reset()
+	}
+	return nil
+}
+
+// replayDequeuer returns recorded cells from the same dequeue calls as they
+// were returned during recording.
+type replayDequeuer struct {
+	cells []*TraceEvent
+}
+
+func (d *replayDequeuer) dequeue(i int) *Cell {
+	if len(d.cells) == 0 || d.cells[0].Seq != i {
+		return nil
+	}
+	other := *d.cells[0].Cell
+	d.cells = d.cells[1:]
+	return &other
+}
+
+// replayConn implements net.Conn by returning recorded reads once the peek
+// clock reaches the position they were recorded at. Writes are discarded.
+type replayConn struct {
+	ctx     context.Context
+	tracer  *Tracer
+	reads   []*TraceEvent
+	buf     []byte
+	network string
+}
+
+// Read returns the next recorded read. Returns io.EOF once all reads are consumed.
+func (c *replayConn) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		if len(c.reads) == 0 {
+			return 0, io.EOF
+		}
+
+		// Wait until the FSM reaches the position of the next read.
+		e := c.reads[0]
+		for c.tracer.peekClock() < e.Seq {
+			select {
+			case <-c.ctx.Done():
+				return 0, c.ctx.Err()
+			case <-c.tracer.clockNotify():
+			}
+		}
+		c.buf, c.reads = e.Data, c.reads[1:]
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *replayConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *replayConn) Close() error                { return nil }
+
+func (c *replayConn) LocalAddr() net.Addr  { return replayAddr(c.network) }
+func (c *replayConn) RemoteAddr() net.Addr { return replayAddr(c.network) }
+
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayPacketConn replays a packet-based connection. Each recorded read is
+// returned as a single datagram.
+type replayPacketConn struct {
+	*replayConn
+}
+
+func (c *replayPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *replayPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+// replayAddr is the address of both sides of a replayed connection.
+type replayAddr string
+
+func (a replayAddr) Network() string { return string(a) }
+func (a replayAddr) String() string  { return "replay" }
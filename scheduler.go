@@ -0,0 +1,143 @@
+package marionette
+
+// Scheduler chooses which stream in a StreamSet sends the next cell.
+//
+// Schedulers are called by the StreamSet while it holds its lock so they
+// are not called concurrently and must not call back into the StreamSet.
+type Scheduler interface {
+	// Next returns the stream to dequeue the next cell from. Only streams
+	// with data to send are passed in and they are in creation order.
+	Next(streams []*Stream) *Stream
+
+	// Sent is called after n bytes of payload are dequeued from stream.
+	Sent(stream *Stream, n int)
+}
+
+// Ensure types implement interface.
+var (
+	_ Scheduler = &RoundRobinScheduler{}
+	_ Scheduler = &WeightedFairScheduler{}
+	_ Scheduler = &PriorityScheduler{}
+)
+
+// RoundRobinScheduler sends one cell from each stream in turn.
+type RoundRobinScheduler struct {
+	tick   int
+	served map[int]int // tick last served, by stream id
+}
+
+// NewRoundRobinScheduler returns a new instance of RoundRobinScheduler.
+func NewRoundRobinScheduler() *RoundRobinScheduler {
+	return &RoundRobinScheduler{served: make(map[int]int)}
+}
+
+// Next returns the stream which has waited the longest since it was last served.
+// Streams which have not been served yet are returned first.
+func (s *RoundRobinScheduler) Next(streams []*Stream) *Stream {
+	// Forget streams which are no longer pending.
+	ids := streamIDSet(streams)
+	for id := range s.served {
+		if _, ok := ids[id]; !ok {
+			delete(s.served, id)
+		}
+	}
+
+	var next *Stream
+	for _, stream := range streams {
+		if next == nil || s.served[stream.ID()] < s.served[next.ID()] {
+			next = stream
+		}
+	}
+	if next != nil {
+		s.tick++
+		s.served[next.ID()] = s.tick
+	}
+	return next
+}
+
+// Sent is a no-op as round robin scheduling is independent of cell size.
+func (s *RoundRobinScheduler) Sent(stream *Stream, n int) {}
+
+// WeightedFairScheduler divides bandwidth between streams in proportion to
+// their weight. A stream with a weight of 2 sends twice as many bytes as a
+// stream with a weight of 1 when both have data pending.
+type WeightedFairScheduler struct {
+	vtime  float64         // virtual start time of the last sent cell
+	finish map[int]float64 // virtual finish time, by stream id
+}
+
+// NewWeightedFairScheduler returns a new instance of WeightedFairScheduler.
+func NewWeightedFairScheduler() *WeightedFairScheduler {
+	return &WeightedFairScheduler{finish: make(map[int]float64)}
+}
+
+// Next returns the stream with the earliest virtual finish time. Idle streams
+// do not accumulate credit and restart at the current virtual time.
+func (s *WeightedFairScheduler) Next(streams []*Stream) *Stream {
+	// Forget streams which are no longer pending.
+	ids := streamIDSet(streams)
+	for id := range s.finish {
+		if _, ok := ids[id]; !ok {
+			delete(s.finish, id)
+		}
+	}
+
+	var next *Stream
+	var min float64
+	for _, stream := range streams {
+		if f := s.start(stream); next == nil || f < min {
+			next, min = stream, f
+		}
+	}
+	return next
+}
+
+// Sent advances the virtual finish time of stream by n weighted bytes.
+func (s *WeightedFairScheduler) Sent(stream *Stream, n int) {
+	s.vtime = s.start(stream)
+	s.finish[stream.ID()] = s.vtime + float64(n)/float64(stream.Weight())
+}
+
+// start returns the virtual time at which the stream's next cell starts.
+func (s *WeightedFairScheduler) start(stream *Stream) float64 {
+	if f, ok := s.finish[stream.ID()]; ok && f > s.vtime {
+		return f
+	}
+	return s.vtime
+}
+
+// PriorityScheduler always sends from the streams with the highest priority.
+// Streams of equal priority are sent round robin.
+type PriorityScheduler struct {
+	rr *RoundRobinScheduler
+}
+
+// NewPriorityScheduler returns a new instance of PriorityScheduler.
+func NewPriorityScheduler() *PriorityScheduler {
+	return &PriorityScheduler{rr: NewRoundRobinScheduler()}
+}
+
+// Next returns the next stream among those with the highest priority.
+func (s *PriorityScheduler) Next(streams []*Stream) *Stream {
+	var a []*Stream
+	for _, stream := range streams {
+		if len(a) == 0 || stream.Priority() == a[0].Priority() {
+			a = append(a, stream)
+		} else if stream.Priority() > a[0].Priority() {
+			a = append(a[:0], stream)
+		}
+	}
+	return s.rr.Next(a)
+}
+
+// Sent is a no-op as priority scheduling is independent of cell size.
+func (s *PriorityScheduler) Sent(stream *Stream, n int) {}
+
+// streamIDSet returns the set of ids for streams.
+func streamIDSet(streams []*Stream) map[int]struct{} {
+	m := make(map[int]struct{}, len(streams))
+	for _, stream := range streams {
+		m[stream.ID()] = struct{}{}
+	}
+	return m
+}
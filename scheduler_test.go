@@ -0,0 +1,95 @@
+package marionette_test
+
+import (
+	"testing"
+
+	"github.com/redjack/marionette"
+)
+
+func TestRoundRobinScheduler_Next(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		s := marionette.NewRoundRobinScheduler()
+		streams := []*marionette.Stream{marionette.NewStream(1), marionette.NewStream(2), marionette.NewStream(3)}
+
+		var ids []int
+		for i := 0; i < 6; i++ {
+			ids = append(ids, s.Next(streams).ID())
+		}
+		if !intsEqual(ids, []int{1, 2, 3, 1, 2, 3}) {
+			t.Fatalf("unexpected order: %v", ids)
+		}
+	})
+
+	t.Run("NewStream", func(t *testing.T) {
+		s := marionette.NewRoundRobinScheduler()
+		stream1, stream2, stream3 := marionette.NewStream(1), marionette.NewStream(2), marionette.NewStream(3)
+
+		if id := s.Next([]*marionette.Stream{stream1, stream2}).ID(); id != 1 {
+			t.Fatalf("unexpected id: %d", id)
+		} else if id := s.Next([]*marionette.Stream{stream1, stream2, stream3}).ID(); id != 2 {
+			t.Fatalf("unexpected id: %d", id)
+		} else if id := s.Next([]*marionette.Stream{stream1, stream2, stream3}).ID(); id != 3 {
+			t.Fatalf("unexpected id: %d", id)
+		} else if id := s.Next([]*marionette.Stream{stream1, stream2, stream3}).ID(); id != 1 {
+			t.Fatalf("unexpected id: %d", id)
+		}
+	})
+
+	t.Run("NoStreams", func(t *testing.T) {
+		if stream := marionette.NewRoundRobinScheduler().Next(nil); stream != nil {
+			t.Fatal("expected nil stream")
+		}
+	})
+}
+
+func TestWeightedFairScheduler_Next(t *testing.T) {
+	s := marionette.NewWeightedFairScheduler()
+	stream1, stream2 := marionette.NewStream(1), marionette.NewStream(2)
+	stream1.SetWeight(3)
+	streams := []*marionette.Stream{stream1, stream2}
+
+	// Send equal sized cells and count bytes sent per stream.
+	m := make(map[int]int)
+	for i := 0; i < 400; i++ {
+		stream := s.Next(streams)
+		s.Sent(stream, 100)
+		m[stream.ID()] += 100
+	}
+	if m[1] != 30000 || m[2] != 10000 {
+		t.Fatalf("unexpected distribution: %v", m)
+	}
+}
+
+func TestPriorityScheduler_Next(t *testing.T) {
+	s := marionette.NewPriorityScheduler()
+	stream1, stream2, stream3 := marionette.NewStream(1), marionette.NewStream(2), marionette.NewStream(3)
+	stream2.SetPriority(10)
+	stream3.SetPriority(10)
+
+	// Higher priority streams should alternate.
+	streams := []*marionette.Stream{stream1, stream2, stream3}
+	var ids []int
+	for i := 0; i < 4; i++ {
+		ids = append(ids, s.Next(streams).ID())
+	}
+	if !intsEqual(ids, []int{2, 3, 2, 3}) {
+		t.Fatalf("unexpected order: %v", ids)
+	}
+
+	// Lower priority stream is sent once others are idle.
+	if id := s.Next([]*marionette.Stream{stream1}).ID(); id != 1 {
+		t.Fatalf("unexpected id: %d", id)
+	}
+}
+
+func intsEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,18 +1,31 @@
 package marionette
 
 import (
+	"context"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/armon/go-socks5"
 	"go.uber.org/zap"
 )
 
+// DefaultOpenTimeout is the default time limit for connecting to a stream's
+// requested destination.
+const DefaultOpenTimeout = 30 * time.Second
+
 // ServerProxy represents a proxy between a marionette listener and another server.
+//
+// Streams opened by the client with a destination are connected to that
+// destination directly. Other streams are proxied to Addr or handed off to
+// the socks5 server.
 type ServerProxy struct {
-	ln *Listener
-	wg sync.WaitGroup
+	ln    *Listener
+	conns connTracker // outgoing connections
+	wg    sync.WaitGroup
 
 	// Host and port to proxy requests to.
 	// Ignored if a socks5 server is enabled.
@@ -20,11 +33,29 @@ type ServerProxy struct {
 
 	// Server used for proxying requests.
 	Socks5Server *socks5.Server
+
+	// Addresses of named services which clients can open streams to.
+	Services map[string]string
+
+	// If true, clients can open streams to any "host:port" destination.
+	// Otherwise only named services are allowed.
+	AllowDestinations bool
+
+	// Time limit for connecting to a requested destination.
+	OpenTimeout time.Duration
+
+	// Restricts destinations & connections per client, if set. To apply the
+	// policy to socks5 requests it must be set as the socks5 server's rules
+	// and DialContext() must be set as its dialer.
+	Policy *EgressPolicy
 }
 
 // NewServerProxy returns a new instance of ServerProxy.
 func NewServerProxy(ln *Listener) *ServerProxy {
-	return &ServerProxy{ln: ln}
+	return &ServerProxy{
+		ln:          ln,
+		OpenTimeout: DefaultOpenTimeout,
+	}
 }
 
 func (p *ServerProxy) Open() error {
@@ -34,8 +65,13 @@ func (p *ServerProxy) Open() error {
 	return nil
 }
 
+// Close closes the listener, which drains its streams, and then closes
+// outgoing connections and waits for their handlers to finish.
 func (p *ServerProxy) Close() error {
-	return nil
+	err := p.ln.Close()
+	p.conns.closeAll()
+	p.wg.Wait()
+	return err
 }
 
 func (p *ServerProxy) run() {
@@ -60,6 +96,35 @@ func (p *ServerProxy) handleConn(conn net.Conn) {
 	Logger.Debug("server proxy: connection open")
 	defer Logger.Debug("server proxy: connection closed")
 
+	// Wait for the client to request a destination, if any.
+	var dst string
+	stream, ok := conn.(*Stream)
+	if ok {
+		var err error
+		if dst, err = stream.Destination(context.Background()); err != nil {
+			return
+		}
+	}
+
+	// Limit the number of connections for each client.
+	client := clientHost(conn)
+	ctx := withEgressClient(context.Background(), client)
+	if p.Policy != nil {
+		if err := p.Policy.acquire(ctx, client); err != nil {
+			if stream != nil {
+				stream.Reply(OpenErrNotAllowed)
+			}
+			return
+		}
+		defer p.Policy.release(client)
+	}
+
+	// If the client requested a destination then connect to it directly.
+	if dst != "" {
+		p.handleOpen(ctx, stream, dst)
+		return
+	}
+
 	// If the proxy address is "socks5" then hand off to socks5 server.
 	if p.Socks5Server != nil {
 		if err := p.Socks5Server.ServeConn(conn); err != nil {
@@ -69,14 +134,199 @@ func (p *ServerProxy) handleConn(conn net.Conn) {
 	}
 
 	// Connect to remote server.
-	proxyConn, err := net.Dial("tcp", p.Addr)
+	proxyConn, err := p.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		Logger.Debug("server proxy: cannot connect to remote server", zap.String("address", p.Addr), zap.Error(err))
+		return
+	}
+	defer proxyConn.Close()
+
+	proxy(conn, proxyConn)
+}
+
+// handleOpen connects a stream to the destination requested by the client
+// and replies with the result.
+func (p *ServerProxy) handleOpen(ctx context.Context, stream *Stream, dst string) {
+	logger := Logger.With(zap.Int("stream_id", stream.ID()), zap.String("destination", dst))
+
+	addr, code := p.resolve(dst)
+	if code != OpenOK {
+		logger.Debug("server proxy: destination rejected", zap.String("reason", OpenCodeText(code)))
+		stream.Reply(code)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.OpenTimeout)
+	proxyConn, err := p.DialContext(ctx, "tcp", addr)
+	cancel()
 	if err != nil {
-		Logger.Debug("server proxy: cannot connect to remote server", zap.String("address", p.Addr))
+		logger.Debug("server proxy: cannot connect to destination", zap.Error(err))
+		stream.Reply(dialErrorCode(err))
 		return
 	}
 	defer proxyConn.Close()
 
-	// Copy between connection and proxy until an error occurs.
+	if err := stream.Reply(OpenOK); err != nil {
+		return
+	}
+	proxy(stream, proxyConn)
+}
+
+// resolve returns the address of a requested destination. Named services are
+// checked first. Returns a reply code if the destination is rejected.
+func (p *ServerProxy) resolve(dst string) (addr string, code int) {
+	if addr, ok := p.Services[dst]; ok {
+		return addr, OpenOK
+	} else if _, _, err := net.SplitHostPort(dst); err != nil {
+		return "", OpenErrUnknownService
+	} else if !p.AllowDestinations {
+		return "", OpenErrNotAllowed
+	}
+	return dst, OpenOK
+}
+
+// DialContext connects to addr through the egress policy, if set. The
+// connection is closed when the proxy is closed.
+func (p *ServerProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if p.Policy != nil {
+		conn, err = p.Policy.DialContext(ctx, network, addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &trackedConn{Conn: conn, tracker: &p.conns}
+	p.conns.add(tc)
+	return tc, nil
+}
+
+// clientHost returns the host of a connection's remote address, if available.
+func clientHost(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	} else if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// dialErrorCode returns the reply code for a dial error.
+func dialErrorCode(err error) int {
+	if _, ok := err.(*EgressError); ok {
+		return OpenErrNotAllowed
+	} else if e, ok := err.(net.Error); ok && e.Timeout() {
+		return OpenErrTimeout
+	} else if err == context.DeadlineExceeded {
+		return OpenErrTimeout
+	}
+
+	// Unwrap to the underlying system error.
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			err = e.Err
+			continue
+		case *net.DNSError:
+			return OpenErrUnreachable
+		case syscall.Errno:
+			switch e {
+			case syscall.ECONNREFUSED:
+				return OpenErrRefused
+			case syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+				return OpenErrUnreachable
+			}
+		}
+		return OpenErrGeneral
+	}
+}
+
+// connTracker tracks open connections so they can be closed on shutdown.
+type connTracker struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// add tracks conn. The connection is closed immediately if the tracker has
+// already been closed.
+func (t *connTracker) add(conn net.Conn) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		forceClose(conn)
+		return
+	}
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	t.mu.Unlock()
+}
+
+// remove stops tracking conn.
+func (t *connTracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+}
+
+// closeAll closes all tracked connections & any which are added later.
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	t.closed = true
+	conns := t.conns
+	t.conns = nil
+	t.mu.Unlock()
+
+	for conn := range conns {
+		forceClose(conn)
+	}
+}
+
+// forceClose closes both sides of a connection. Streams only close their
+// write side on Close() so their read side is closed first.
+func forceClose(conn net.Conn) {
+	if rc, ok := conn.(interface {
+		CloseRead() error
+	}); ok {
+		rc.CloseRead()
+	}
+	conn.Close()
+}
+
+// trackedConn removes a connection from its tracker when closed.
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.remove(c)
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write side of the connection, if supported.
+// Otherwise the connection is closed.
+func (c *trackedConn) CloseWrite() error {
+	if wc, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return wc.CloseWrite()
+	}
+	return c.Close()
+}
+
+// proxy copies between conn and proxyConn until an error occurs.
+func proxy(conn, proxyConn net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
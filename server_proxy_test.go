@@ -0,0 +1,163 @@
+package marionette_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+)
+
+func TestServerProxy_Policy(t *testing.T) {
+	key := fte.NewKey([]byte("secret"))
+
+	echoLn := MustOpenEchoListener(t)
+	defer echoLn.Close()
+
+	serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	if err := ln.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	policy := marionette.NewEgressPolicy()
+	policy.MaxConnsPerClient = 1
+	policy.AllowNets = []*net.IPNet{MustParseCIDR(t, "127.0.0.1/32")}
+
+	proxy := marionette.NewServerProxy(ln)
+	proxy.Addr = "127.0.0.2:1"
+	proxy.Services = map[string]string{"echo": echoLn.Addr().String(), "other": "127.0.0.2:1"}
+	proxy.Policy = policy
+	if err := proxy.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+	if err := dialer.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+
+	t.Run("MaxConnsPerClient", func(t *testing.T) {
+		conn, err := dialer.DialDestination(context.Background(), "echo")
+		if err != nil {
+			t.Fatal(err)
+		} else if n := policy.ClientConns("127.0.0.1"); n != 1 {
+			t.Fatalf("unexpected client connections: %d", n)
+		}
+
+		// A second connection exceeds the limit.
+		_, err = dialer.DialDestination(context.Background(), "echo")
+		if e, ok := err.(*marionette.OpenError); !ok || e.Code != marionette.OpenErrNotAllowed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Closing the first connection releases it.
+		conn.Close()
+		MustWaitClientConns(t, policy, "127.0.0.1", 0)
+		if conn, err = dialer.DialDestination(context.Background(), "echo"); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		MustWaitClientConns(t, policy, "127.0.0.1", 0)
+	})
+
+	t.Run("ErrDenied", func(t *testing.T) {
+		_, err := dialer.DialDestination(context.Background(), "other")
+		if e, ok := err.(*marionette.OpenError); !ok || e.Code != marionette.OpenErrNotAllowed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Streams without a destination are closed if Addr is denied.
+	t.Run("ErrDeniedAddr", func(t *testing.T) {
+		conn, err := dialer.DialContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+		if _, err := conn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestServerProxy_Close(t *testing.T) {
+	key := fte.NewKey([]byte("secret"))
+
+	echoLn := MustOpenEchoListener(t)
+	defer echoLn.Close()
+
+	serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+	serverDoc.Port = "0"
+	ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+	if err := ln.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	proxy := marionette.NewServerProxy(ln)
+	proxy.Services = map[string]string{"echo": echoLn.Addr().String()}
+	if err := proxy.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+	clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+	dialer.DrainTimeout = 100 * time.Millisecond // server closes first
+	if err := dialer.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+
+	conn, err := dialer.DialDestination(context.Background(), "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	buf := make([]byte, 3)
+	if _, err := conn.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing waits for the idle connection's handler & ends its stream.
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// MustWaitClientConns waits until the client has n connections open.
+func MustWaitClientConns(tb testing.TB, policy *marionette.EgressPolicy, client string, n int) {
+	tb.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for policy.ClientConns(client) != n {
+		select {
+		case <-timeout:
+			tb.Fatalf("timeout waiting for %d connections, got %d", n, policy.ClientConns(client))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
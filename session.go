@@ -0,0 +1,158 @@
+package marionette
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionIDSize is the size of the session id carried by SESSION cells.
+	SessionIDSize = 8
+
+	// DefaultSessionTimeout is the time a session is kept after its last
+	// connection closes.
+	DefaultSessionTimeout = 5 * time.Minute
+)
+
+var (
+	// ErrUnexpectedSessionCell is returned when a SESSION cell is received
+	// by a client or conflicts with the connection's existing session.
+	ErrUnexpectedSessionCell = errors.New("marionette: unexpected session cell")
+)
+
+// newSessionID returns a random client session id.
+func newSessionID() (uint64, error) {
+	var buf [SessionIDSize]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// sessionRegistry shares stream sets between server connections which
+// belong to the same client session. A session's stream set is closed once
+// it has had no connections for the session timeout.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[uint64]*session
+	timeout  time.Duration
+	clock    Clock
+	closed   bool
+
+	newStreamSet func() *StreamSet
+}
+
+// session represents the shared state of a client session.
+type session struct {
+	streamSet *StreamSet
+	refs      int           // number of active connections
+	stop      chan struct{} // stops expiration, if no active connections
+}
+
+func newSessionRegistry(newStreamSet func() *StreamSet, timeout time.Duration, clock Clock) *sessionRegistry {
+	return &sessionRegistry{
+		sessions:     make(map[uint64]*session),
+		timeout:      timeout,
+		clock:        clock,
+		newStreamSet: newStreamSet,
+	}
+}
+
+// len returns the number of sessions in the registry.
+func (r *sessionRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// acquire returns the stream set for a session. The session is created if
+// it does not exist. Each call must be followed by a call to release().
+func (r *sessionRegistry) acquire(id uint64) *StreamSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.sessions[id]
+	if s == nil {
+		s = &session{streamSet: r.newStreamSet()}
+		r.sessions[id] = s
+	}
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.refs++
+	return s.streamSet
+}
+
+// release removes a connection from a session. The session expires after
+// the timeout if no other connection acquires it.
+func (r *sessionRegistry) release(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.sessions[id]
+	if s == nil {
+		return
+	} else if s.refs--; s.refs > 0 || r.closed {
+		return
+	}
+
+	stop, timeout := make(chan struct{}), r.clock.After(r.timeout)
+	s.stop = stop
+	go func() {
+		select {
+		case <-stop:
+		case <-timeout:
+			r.expire(id, s)
+		}
+	}()
+}
+
+// expire removes a session and closes its stream set if it is still unused.
+func (r *sessionRegistry) expire(id uint64, s *session) {
+	r.mu.Lock()
+	if r.sessions[id] != s || s.refs > 0 {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.sessions, id)
+	r.mu.Unlock()
+
+	s.streamSet.Close()
+}
+
+// activeStreamSets returns the stream sets of sessions with connections.
+func (r *sessionRegistry) activeStreamSets() []*StreamSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var a []*StreamSet
+	for _, s := range r.sessions {
+		if s.refs > 0 {
+			a = append(a, s.streamSet)
+		}
+	}
+	return a
+}
+
+// close removes all sessions and closes their stream sets.
+func (r *sessionRegistry) close() (err error) {
+	r.mu.Lock()
+	r.closed = true
+	sessions := r.sessions
+	r.sessions = make(map[uint64]*session)
+	r.mu.Unlock()
+
+	for _, s := range sessions {
+		if s.stop != nil {
+			close(s.stop)
+		}
+		if e := s.streamSet.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -1,6 +1,7 @@
 package marionette
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,9 +20,36 @@ var (
 	ErrStreamClosed = errors.New("marionette: stream closed")
 
 	// ErrWriteTooLarge is returned when a Write() is larger than the buffer.
+	//
+	// Deprecated: Write() now accepts writes of any size.
 	ErrWriteTooLarge = errors.New("marionette: write too large")
+
+	// ErrStreamWindowExceeded is returned when the remote side sends more
+	// stream data than the receive window allows.
+	ErrStreamWindowExceeded = errors.New("marionette: stream window exceeded")
+
+	// ErrTimeout is returned by Read() & Write() when the stream deadline passes.
+	// It implements net.Error and reports itself as a timeout.
+	ErrTimeout error = &timeoutError{}
 )
 
+// DefaultStreamBufferSize is the default size of a stream's read & write buffers.
+const DefaultStreamBufferSize = MaxCellLength
+
+// InitialStreamWindow is the number of bytes each side may send on a new
+// stream before receiving a WINDOW_UPDATE cell from the peer.
+const InitialStreamWindow = 8 * MaxCellLength
+
+// Ensure type implements interface.
+var _ net.Error = &timeoutError{}
+
+// timeoutError is the type of ErrTimeout.
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "marionette: i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
 // Ensure type implements interface.
 var _ net.Conn = &Stream{}
 
@@ -30,6 +58,7 @@ var _ net.Conn = &Stream{}
 // Implements the net.Conn interface.
 type Stream struct {
 	mu   sync.RWMutex
+	wmu  sync.Mutex // serializes writes so chunks are not interleaved
 	id   int
 	rseq int
 	wseq int
@@ -41,6 +70,9 @@ type Stream struct {
 	writeClosed  bool
 	writeClosing chan struct{}
 
+	// Set when the stream is aborted. Returned instead of io.EOF & ErrStreamClosed.
+	err error
+
 	// TODO: Find better names for these.
 	writeCloseNotified       bool
 	writeCloseNotifiedNotify chan struct{}
@@ -50,9 +82,43 @@ type Stream struct {
 
 	rbuf, wbuf []byte
 	rqueue     []*Cell
+	resend     []*Cell // undelivered cells to send again, sorted by sequence
 	rnotify    chan struct{}
 	wnotify    chan struct{}
 
+	rdeadline *deadline
+	wdeadline *deadline
+
+	// Flow control. Limits are absolute byte offsets so that resending a
+	// window update has no effect. The rgrown flag is set when the receive
+	// window is grown and must be advertised.
+	window int // receive window size
+	rlimit int // receive limit advertised to peer
+	rrecv  int // payload bytes received
+	rread  int // payload bytes read by caller
+	wlimit int // send limit advertised by peer
+	wsent  int // payload bytes sent
+	useq   int // sequence of next window update
+	rgrown bool
+
+	// Scheduling parameters.
+	priority int
+	weight   int
+
+	// Stream open control. The opening side sends its destination in
+	// STREAM_OPEN cells before any data and the peer answers with a
+	// STREAM_REPLY cell before any data of its own.
+	dst          string        // destination requested by the opener
+	opener       bool          // true if opened locally
+	wopen        []byte        // unsent portion of the open request
+	ropen        []byte        // partially received open request
+	reply        int           // reply code sent or received
+	replied      bool          // true once a reply is sent or received
+	replyPending bool          // STREAM_REPLY cell needs to be sent
+	ponce        sync.Once     // closes peerNotify
+	peerNotify   chan struct{} // closed once the first peer cell is read
+	replyNotify  chan struct{} // closed once a reply is received
+
 	modTime time.Time
 
 	onWrite func() // callback when a new write buffer changes
@@ -64,12 +130,20 @@ type Stream struct {
 func NewStream(id int) *Stream {
 	return &Stream{
 		id:           id,
-		rbuf:         make([]byte, 0, MaxCellLength),
-		wbuf:         make([]byte, 0, MaxCellLength),
+		rbuf:         make([]byte, 0, DefaultStreamBufferSize),
+		wbuf:         make([]byte, 0, DefaultStreamBufferSize),
 		readClosing:  make(chan struct{}),
 		writeClosing: make(chan struct{}),
 		rnotify:      make(chan struct{}),
 		wnotify:      make(chan struct{}),
+		peerNotify:   make(chan struct{}),
+		replyNotify:  make(chan struct{}),
+		rdeadline:    newDeadline(),
+		wdeadline:    newDeadline(),
+		window:       InitialStreamWindow,
+		rlimit:       InitialStreamWindow,
+		wlimit:       InitialStreamWindow,
+		weight:       1,
 		modTime:      time.Now(),
 
 		writeCloseNotifiedNotify: make(chan struct{}),
@@ -108,15 +182,25 @@ func (s *Stream) Read(b []byte) (n int, err error) {
 	}
 
 	for {
+		// Exit if the read deadline has passed.
+		expired := s.rdeadline.wait()
+		if isClosedChan(expired) {
+			return 0, ErrTimeout
+		}
+
 		// Attempt to read from the buffer. Exit if bytes read or error.
 		s.mu.Lock()
 		if n, err = s.read(b); n != 0 || err != nil {
+			s.consume(n)
 			s.mu.Unlock()
 			return n, err
 		} else if n == 0 && len(s.rqueue) == 0 && s.readClosed {
-			s.rbuf = nil
+			s.rbuf, err = nil, s.err
 			s.mu.Unlock()
-			return 0, io.EOF
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
 		}
 		notify := s.rnotify
 
@@ -127,6 +211,7 @@ func (s *Stream) Read(b []byte) (n int, err error) {
 		select {
 		case <-s.readClosing:
 		case <-notify:
+		case <-expired:
 		}
 	}
 }
@@ -150,6 +235,124 @@ func (s *Stream) read(b []byte) (n int, err error) {
 	return n, nil
 }
 
+// consume marks n bytes as read by the caller. A window update is scheduled
+// once half of the receive window has been consumed.
+func (s *Stream) consume(n int) {
+	s.rread += n
+	if s.windowUpdatePending() {
+		s.notifyWrite()
+	}
+}
+
+// WindowUpdatePending returns true if a WINDOW_UPDATE cell should be sent.
+func (s *Stream) WindowUpdatePending() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.windowUpdatePending()
+}
+
+func (s *Stream) windowUpdatePending() bool {
+	if s.readClosed {
+		return false
+	}
+	n := s.rread + s.window - s.rlimit
+	return n > 0 && (n >= s.window/2 || s.rgrown)
+}
+
+// SetReceiveWindow sets the number of unread bytes the peer may send. The
+// window can only be grown beyond InitialStreamWindow as the peer assumes
+// the initial size for new streams. The increase is advertised to the peer
+// in the next dequeued cell.
+func (s *Stream) SetReceiveWindow(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n <= s.window {
+		return
+	}
+
+	s.window, s.rgrown = n, true
+	s.notifyWrite()
+}
+
+// SendWindow returns the number of bytes that can be sent before the peer
+// must advertise a larger window.
+func (s *Stream) SendWindow() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.wlimit - s.wsent
+}
+
+// Priority returns the scheduling priority of the stream.
+func (s *Stream) Priority() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.priority
+}
+
+// SetPriority sets the scheduling priority used by PriorityScheduler.
+// Streams with higher priorities are sent first. Defaults to zero.
+func (s *Stream) SetPriority(priority int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.priority = priority
+}
+
+// Weight returns the scheduling weight of the stream.
+func (s *Stream) Weight() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.weight
+}
+
+// SetWeight sets the relative share of bandwidth used by WeightedFairScheduler.
+// Defaults to one.
+func (s *Stream) SetWeight(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.weight = weight
+}
+
+// SetReadBufferSize sets the capacity of the read buffer. Sizes smaller than
+// MaxCellLength are raised so that any cell payload fits. The buffer is never
+// shrunk below the number of unread bytes.
+func (s *Stream) SetReadBufferSize(n int) {
+	if n < MaxCellLength {
+		n = MaxCellLength
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rbuf = resizeBuffer(s.rbuf, n)
+	s.processReadQueue()
+}
+
+// SetWriteBufferSize sets the capacity of the write buffer. The buffer is
+// never shrunk below the number of unsent bytes.
+func (s *Stream) SetWriteBufferSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wbuf = resizeBuffer(s.wbuf, n)
+	s.notifyWrite()
+}
+
+// resizeBuffer returns a copy of buf with a capacity of n or len(buf),
+// whichever is larger.
+func resizeBuffer(buf []byte, n int) []byte {
+	if n < len(buf) {
+		n = len(buf)
+	}
+	other := make([]byte, len(buf), n)
+	copy(other, buf)
+	return other
+}
+
 // ReadBufferLen returns the number of bytes in the read buffer.
 func (s *Stream) ReadBufferLen() int {
 	s.mu.RLock()
@@ -157,22 +360,39 @@ func (s *Stream) ReadBufferLen() int {
 	return len(s.rbuf)
 }
 
-// Write appends b to the write buffer. This method will continue to try until
-// the entire byte slice is written atomically to the buffer.
+// Write appends b to the write buffer. Writes larger than the free space in
+// the buffer are copied in chunks as space becomes available. If the stream is
+// closed or the deadline passes then the number of bytes buffered is returned.
 func (s *Stream) Write(b []byte) (n int, err error) {
 	if s.TraceWriter != nil {
 		fmt.Fprintf(s.TraceWriter, "[Write] len=%d", len(b))
 	}
 
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
 	for {
+		// Exit if the write deadline has passed.
+		expired := s.wdeadline.wait()
+		if isClosedChan(expired) {
+			return n, ErrTimeout
+		}
+
 		s.mu.Lock()
 		if s.writeClosed {
+			err = s.err
 			s.mu.Unlock()
-			return 0, ErrStreamClosed
-		} else if n, err = s.write(b); n != 0 || err != nil {
+			if err == nil {
+				err = ErrStreamClosed
+			}
+			return n, err
+		} else if sz := s.write(b[n:]); sz != 0 {
+			n += sz
 			s.notifyWrite()
+		}
+		if n == len(b) {
 			s.mu.Unlock()
-			return n, err
+			return n, nil
 		}
 		notify := s.wnotify
 		s.mu.Unlock()
@@ -181,21 +401,22 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 		select {
 		case <-s.writeClosing:
 		case <-notify:
+		case <-expired:
 		}
 	}
 }
 
-func (s *Stream) write(b []byte) (n int, err error) {
-	if len(b) > cap(s.wbuf) {
-		return 0, ErrWriteTooLarge
-	} else if len(b) > cap(s.wbuf)-len(s.wbuf) {
-		return 0, nil // not enough space
+// write copies as much of b as fits into the write buffer.
+func (s *Stream) write(b []byte) int {
+	n := cap(s.wbuf) - len(s.wbuf)
+	if n > len(b) {
+		n = len(b)
 	}
 
 	// Copy bytes to the end of the write buffer.
-	s.wbuf = s.wbuf[:len(s.wbuf)+len(b)]
-	copy(s.wbuf[len(s.wbuf)-len(b):], b)
-	return len(b), nil
+	s.wbuf = s.wbuf[:len(s.wbuf)+n]
+	copy(s.wbuf[len(s.wbuf)-n:], b[:n])
+	return n
 }
 
 // WriteNotify returns a channel that receives a notification when a new write is available.
@@ -230,6 +451,18 @@ func (s *Stream) Enqueue(cell *Cell) error {
 		fmt.Fprintf(s.TraceWriter, "[Enqueue] seq=%d rseq=%d", cell.SequenceID, s.rseq)
 	}
 
+	// Window updates raise the send limit and are not sequenced.
+	if cell.Type == WINDOW_UPDATE {
+		if len(cell.Payload) < 8 {
+			return nil
+		}
+		if limit := int(binary.BigEndian.Uint64(cell.Payload)); limit > s.wlimit {
+			s.wlimit = limit
+			s.notifyWrite()
+		}
+		return nil
+	}
+
 	// If sequence is out of order then add to queue and exit.
 	if cell.SequenceID < s.rseq {
 		s.logger().Info("duplicate cell sequence",
@@ -237,6 +470,20 @@ func (s *Stream) Enqueue(cell *Cell) error {
 			zap.Int("remote", cell.SequenceID))
 		return nil // duplicate cell
 	}
+	for _, other := range s.rqueue {
+		if other.SequenceID == cell.SequenceID {
+			return nil // duplicate queued cell
+		}
+	}
+
+	// Ensure the peer has not sent more data than allowed. Control cells
+	// are not counted against the window.
+	if cell.Type != STREAM_OPEN && cell.Type != STREAM_REPLY {
+		if s.rrecv+len(cell.Payload) > s.rlimit {
+			return ErrStreamWindowExceeded
+		}
+		s.rrecv += len(cell.Payload)
+	}
 
 	// Add to queue & sort.
 	s.rqueue = append(s.rqueue, cell)
@@ -259,16 +506,29 @@ func (s *Stream) processReadQueue() {
 			break // not enough space on buffer
 		}
 
-		// Extend buffer and copy cell payload.
-		s.rbuf = s.rbuf[:len(s.rbuf)+len(cell.Payload)]
-		copy(s.rbuf[len(s.rbuf)-len(cell.Payload):], cell.Payload)
-		notify = true
+		opening := false
+		switch cell.Type {
+		case STREAM_OPEN:
+			opening = !s.receiveOpen(cell.Payload)
+		case STREAM_REPLY:
+			s.receiveReply(cell.Payload)
+		default:
+			// Extend buffer and copy cell payload.
+			s.rbuf = s.rbuf[:len(s.rbuf)+len(cell.Payload)]
+			copy(s.rbuf[len(s.rbuf)-len(cell.Payload):], cell.Payload)
+			notify = true
+		}
 
 		// Shift cell off queue and increment sequence.
 		s.rqueue[0] = nil
 		s.rqueue = s.rqueue[1:]
 		s.rseq++
 
+		// Notify of the first peer cell once any open request is complete.
+		if !opening {
+			s.ponce.Do(func() { close(s.peerNotify) })
+		}
+
 		// If this is the end of the stream then close out reads.
 		if cell.Type == END_OF_STREAM {
 			if s.TraceWriter != nil {
@@ -295,16 +555,37 @@ func (s *Stream) Dequeue(n int) *Cell {
 		fmt.Fprintf(s.TraceWriter, "[Dequeue] n=%d", n)
 	}
 
+	// Advertise consumed bytes before sending data.
+	if s.windowUpdatePending() {
+		return s.dequeueWindowUpdate(n)
+	}
+
+	// Resend undelivered cells before new data, if they fit.
+	if len(s.resend) > 0 {
+		if cell := s.resend[0]; n == 0 || CellHeaderSize+len(cell.Payload) <= n {
+			s.resend = s.resend[1:]
+			cell.Length = n
+			return cell
+		}
+	}
+
 	// Exit immediately if stream has already notified that its writes are closed.
 	if s.writeCloseNotified {
 		return nil
 	}
 
+	// Send stream open control cells before any data.
+	if len(s.wopen) > 0 || s.replyPending {
+		return s.dequeueControl(n)
+	}
+
 	// Determine the amount of data to read.
 	if n == 0 {
 		n = len(s.wbuf) + CellHeaderSize
 	} else if n > MaxCellLength {
 		n = MaxCellLength
+	} else if n < CellHeaderSize {
+		return nil
 	}
 
 	// Determine next sequence.
@@ -330,6 +611,10 @@ func (s *Stream) Dequeue(n int) *Cell {
 	if payloadN > len(s.wbuf) {
 		payloadN = len(s.wbuf)
 	}
+	if payloadN > s.wlimit-s.wsent {
+		payloadN = s.wlimit - s.wsent
+	}
+	s.wsent += payloadN
 
 	// Copy buffer to payload
 	if payloadN > 0 {
@@ -348,6 +633,79 @@ func (s *Stream) Dequeue(n int) *Cell {
 	return cell
 }
 
+// Requeue returns a cell previously dequeued from the stream so that it is
+// sent again. This is used when the connection a cell was sent on fails
+// before the cell was delivered. The peer discards any duplicates.
+func (s *Stream) Requeue(cell *Cell) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only sequenced cells are resent. Window updates are regenerated as needed.
+	switch cell.Type {
+	case NORMAL, END_OF_STREAM, STREAM_OPEN, STREAM_REPLY:
+	default:
+		return
+	}
+	if cell.SequenceID >= s.wseq {
+		return
+	}
+	for _, other := range s.resend {
+		if other.SequenceID == cell.SequenceID {
+			return
+		}
+	}
+
+	if s.TraceWriter != nil {
+		fmt.Fprintf(s.TraceWriter, "[requeue] seq=%d", cell.SequenceID)
+	}
+
+	s.resend = append(s.resend, cell)
+	sort.Sort(Cells(s.resend))
+	s.notifyWrite()
+}
+
+// dequeueWindowUpdate returns a WINDOW_UPDATE cell advertising the new
+// receive limit. Window updates are numbered separately from data cells.
+// Returns nil and leaves the update pending if the cell does not fit in n.
+func (s *Stream) dequeueWindowUpdate(n int) *Cell {
+	if n == 0 {
+		n = CellHeaderSize + 8
+	} else if n > MaxCellLength {
+		n = MaxCellLength
+	} else if n < CellHeaderSize+8 {
+		return nil
+	}
+
+	s.rlimit, s.rgrown = s.rread+s.window, false
+
+	if s.TraceWriter != nil {
+		fmt.Fprintf(s.TraceWriter, "[window:send] seq=%d limit=%d", s.useq, s.rlimit)
+	}
+
+	cell := NewCell(s.id, s.useq, n, WINDOW_UPDATE)
+	cell.Payload = make([]byte, 8)
+	binary.BigEndian.PutUint64(cell.Payload, uint64(s.rlimit))
+	s.useq++
+	return cell
+}
+
+// writeReady returns true if the stream has a cell to send.
+func (s *Stream) writeReady() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.windowUpdatePending() || len(s.resend) > 0 {
+		return true
+	} else if s.writeCloseNotified {
+		return false
+	} else if len(s.wopen) > 0 || s.replyPending {
+		return true
+	} else if len(s.wbuf) == 0 {
+		return s.writeClosed
+	}
+	return s.wsent < s.wlimit
+}
+
 // Close marks the stream as closed for writes. The server will close the read side.
 func (s *Stream) Close() error {
 	return s.CloseWrite()
@@ -378,6 +736,30 @@ func (s *Stream) CloseRead() error {
 func (s *Stream) closeRead() {
 	s.readClosed = true
 	s.ronce.Do(func() { close(s.readClosing) })
+	s.ponce.Do(func() { close(s.peerNotify) })
+}
+
+// abort closes both sides of the stream without notifying the peer. Buffered
+// data can still be read after which reads & writes return err.
+func (s *Stream) abort(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.TraceWriter != nil {
+		fmt.Fprintf(s.TraceWriter, "[abort] err=%s", err)
+	}
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.rqueue, s.wbuf = nil, s.wbuf[:0]
+	s.closeRead()
+	s.closeWrite()
+
+	if !s.writeCloseNotified {
+		s.writeCloseNotified = true
+		close(s.writeCloseNotifiedNotify)
+	}
 }
 
 // Closed returns true if the stream has been closed.
@@ -426,14 +808,90 @@ func (s *Stream) ReadWriteCloseNotified() bool {
 func (c *Stream) LocalAddr() net.Addr  { return c.localAddr }
 func (c *Stream) RemoteAddr() net.Addr { return c.remoteAddr }
 
-func (c *Stream) SetDeadline(t time.Time) error      { return nil }
-func (c *Stream) SetReadDeadline(t time.Time) error  { return nil }
-func (c *Stream) SetWriteDeadline(t time.Time) error { return nil }
+// SetDeadline sets the read & write deadlines for the stream.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.rdeadline.set(t)
+	s.wdeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for pending & future Read() calls.
+// Reads return ErrTimeout once the deadline passes. A zero value disables it.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.rdeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for pending & future Write() calls.
+// Writes return ErrTimeout once the deadline passes. A zero value disables it.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.wdeadline.set(t)
+	return nil
+}
 
 func (s *Stream) logger() *zap.Logger {
 	return Logger.With(zap.Int("stream_id", s.id))
 }
 
+// deadline represents a resettable deadline. The channel returned by wait()
+// is closed once the deadline passes and is replaced when the deadline is reset.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set updates the deadline. A zero value clears the deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Stop pending timer. If it has already fired then wait for it to finish
+	// closing the current channel before replacing it.
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	// Replace channel if the previous deadline has passed.
+	if isClosedChan(d.cancel) {
+		d.cancel = make(chan struct{})
+	}
+
+	// Ignore zero time. Close immediately if the deadline is in the past.
+	if t.IsZero() {
+		return
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.cancel)
+		return
+	}
+
+	cancel := d.cancel
+	d.timer = time.AfterFunc(dur, func() { close(cancel) })
+}
+
+// wait returns a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
 // streamExpVar is a wrapper for stream to generate expvar data.
 type streamExpVar Stream
 
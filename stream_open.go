@@ -0,0 +1,208 @@
+package marionette
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxDestinationLength is the maximum length of a stream open destination.
+// The destination is sent with a single byte length prefix and may be split
+// across several STREAM_OPEN cells.
+const MaxDestinationLength = 255
+
+// Stream open reply codes sent in STREAM_REPLY cells.
+const (
+	OpenOK                = 0x00
+	OpenErrGeneral        = 0x01
+	OpenErrNotAllowed     = 0x02
+	OpenErrUnknownService = 0x03
+	OpenErrUnreachable    = 0x04
+	OpenErrRefused        = 0x05
+	OpenErrTimeout        = 0x06
+)
+
+var (
+	// ErrInvalidDestination is returned when opening a stream with a blank
+	// destination or one longer than MaxDestinationLength.
+	ErrInvalidDestination = errors.New("marionette: invalid destination")
+
+	// ErrStreamAlreadyOpen is returned when opening a stream which has
+	// already been opened or has sent data.
+	ErrStreamAlreadyOpen = errors.New("marionette: stream already open")
+)
+
+// OpenError is returned when the peer rejects a stream open request.
+type OpenError struct {
+	Code int
+}
+
+// Error returns the error message for the reply code.
+func (e *OpenError) Error() string {
+	return "marionette: stream open rejected: " + OpenCodeText(e.Code)
+}
+
+// OpenCodeText returns a description of a stream open reply code.
+func OpenCodeText(code int) string {
+	switch code {
+	case OpenOK:
+		return "ok"
+	case OpenErrGeneral:
+		return "general failure"
+	case OpenErrNotAllowed:
+		return "destination not allowed"
+	case OpenErrUnknownService:
+		return "unknown service"
+	case OpenErrUnreachable:
+		return "destination unreachable"
+	case OpenErrRefused:
+		return "connection refused"
+	case OpenErrTimeout:
+		return "connection timed out"
+	default:
+		return fmt.Sprintf("unknown code %d", code)
+	}
+}
+
+// Open requests that the peer connects the stream to dst. The destination
+// is either a "host:port" address or the name of a service configured on the
+// server. Must be called before any data is written. Use WaitReply() to wait
+// for the peer to accept or reject the request.
+func (s *Stream) Open(dst string) error {
+	if dst == "" || len(dst) > MaxDestinationLength {
+		return ErrInvalidDestination
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dst != "" || s.wseq > 0 || len(s.wbuf) > 0 {
+		return ErrStreamAlreadyOpen
+	} else if s.writeClosed {
+		return ErrStreamClosed
+	}
+
+	s.dst, s.opener = dst, true
+	s.wopen = append([]byte{byte(len(dst))}, dst...)
+	s.notifyWrite()
+	return nil
+}
+
+// WaitReply waits for the peer to reply to Open(). Returns an *OpenError if
+// the request is rejected.
+func (s *Stream) WaitReply(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.replyNotify:
+	case <-s.readClosing:
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.replied {
+		if s.err != nil {
+			return s.err
+		}
+		return ErrStreamClosed
+	} else if s.reply != OpenOK {
+		return &OpenError{Code: s.reply}
+	}
+	return nil
+}
+
+// Destination waits for the first cell from the peer and returns the
+// destination requested by its STREAM_OPEN cell. Returns a blank string if
+// the peer sent data without opening the stream.
+func (s *Stream) Destination(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-s.peerNotify:
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.opener {
+		return "", nil
+	}
+	return s.dst, nil
+}
+
+// Reply accepts or rejects the peer's open request with a reply code. A
+// rejected stream is closed for writes after the reply. Does nothing if the
+// peer did not open the stream as it would read the reply as data.
+func (s *Stream) Reply(code int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dst == "" || s.opener || s.replied {
+		return nil
+	} else if s.writeClosed {
+		return ErrStreamClosed
+	}
+
+	s.reply, s.replied, s.replyPending = code, true, true
+	if code != OpenOK {
+		s.closeWrite()
+	} else {
+		s.notifyWrite()
+	}
+	return nil
+}
+
+// dequeueControl returns the pending STREAM_REPLY cell or the next
+// STREAM_OPEN cell. Open requests are split to fit in n bytes. Returns nil if
+// no part of the cell fits.
+func (s *Stream) dequeueControl(n int) *Cell {
+	if n == 0 && s.replyPending {
+		n = CellHeaderSize + 1
+	} else if n == 0 {
+		n = CellHeaderSize + len(s.wopen)
+	} else if n > MaxCellLength {
+		n = MaxCellLength
+	} else if n <= CellHeaderSize {
+		return nil
+	}
+
+	var cell *Cell
+	if s.replyPending {
+		cell = NewCell(s.id, s.wseq, n, STREAM_REPLY)
+		cell.Payload = []byte{byte(s.reply)}
+		s.replyPending = false
+	} else {
+		payloadN := n - CellHeaderSize
+		if payloadN > len(s.wopen) {
+			payloadN = len(s.wopen)
+		}
+		cell = NewCell(s.id, s.wseq, n, STREAM_OPEN)
+		cell.Payload, s.wopen = s.wopen[:payloadN], s.wopen[payloadN:]
+	}
+
+	s.wseq++
+	s.modTime = time.Now()
+	return cell
+}
+
+// receiveOpen appends a STREAM_OPEN payload to the open request. Returns true
+// once the request is complete and the destination is set.
+func (s *Stream) receiveOpen(payload []byte) bool {
+	s.ropen = append(s.ropen, payload...)
+	if len(s.ropen) == 0 || len(s.ropen) < int(s.ropen[0])+1 {
+		return false
+	}
+	s.dst = string(s.ropen[1 : int(s.ropen[0])+1])
+	s.ropen = nil
+	return true
+}
+
+// receiveReply records the reply code from a STREAM_REPLY cell.
+func (s *Stream) receiveReply(payload []byte) {
+	if s.replied {
+		return
+	}
+	s.reply, s.replied = OpenErrGeneral, true
+	if len(payload) > 0 {
+		s.reply = int(payload[0])
+	}
+	close(s.replyNotify)
+}
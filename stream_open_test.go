@@ -0,0 +1,173 @@
+package marionette_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+)
+
+func TestStream_Open(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		client, server := marionette.NewStream(100), marionette.NewStream(100)
+		if err := client.Open("example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Deliver the length-prefixed open request to the server.
+		cell := client.Dequeue(0)
+		if cell == nil || cell.Type != marionette.STREAM_OPEN || string(cell.Payload) != "\x0eexample.com:80" {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if err := server.Enqueue(cell); err != nil {
+			t.Fatal(err)
+		} else if dst, err := server.Destination(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if dst != "example.com:80" {
+			t.Fatalf("unexpected destination: %q", dst)
+		}
+
+		// Accept the request and send data after the reply.
+		if err := server.Reply(marionette.OpenOK); err != nil {
+			t.Fatal(err)
+		} else if _, err := server.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if cell := server.Dequeue(0); cell == nil || cell.Type != marionette.STREAM_REPLY {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if err := client.Enqueue(cell); err != nil {
+			t.Fatal(err)
+		} else if err := client.Enqueue(server.Dequeue(0)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.WaitReply(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "foo" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+	})
+
+	// Open requests are split across cells when they do not fit.
+	t.Run("Split", func(t *testing.T) {
+		client, server := marionette.NewStream(100), marionette.NewStream(100)
+		if err := client.Open("example.com:80"); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			cell := client.Dequeue(marionette.CellHeaderSize + 5)
+			if cell == nil || cell.Type != marionette.STREAM_OPEN || len(cell.Payload) != 5 {
+				t.Fatalf("unexpected cell: %#v", cell)
+			} else if err := server.Enqueue(cell); err != nil {
+				t.Fatal(err)
+			}
+			if i == 2 {
+				break
+			}
+
+			// The destination is not available until the request is complete.
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			_, err := server.Destination(ctx)
+			cancel()
+			if err != context.DeadlineExceeded {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		if dst, err := server.Destination(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if dst != "example.com:80" {
+			t.Fatalf("unexpected destination: %q", dst)
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		client, server := marionette.NewStream(100), marionette.NewStream(100)
+		if err := client.Open("db"); err != nil {
+			t.Fatal(err)
+		} else if err := server.Enqueue(client.Dequeue(0)); err != nil {
+			t.Fatal(err)
+		} else if err := server.Reply(marionette.OpenErrUnknownService); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Enqueue(server.Dequeue(0)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The stream is closed after a rejection.
+		if cell := server.Dequeue(0); cell == nil || cell.Type != marionette.END_OF_STREAM {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+
+		err := client.WaitReply(context.Background())
+		if e, ok := err.(*marionette.OpenError); !ok || e.Code != marionette.OpenErrUnknownService {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err.Error() != "marionette: stream open rejected: unknown service" {
+			t.Fatalf("unexpected error message: %s", err)
+		}
+	})
+
+	// Streams which send data without opening have no destination.
+	t.Run("Legacy", func(t *testing.T) {
+		client, server := marionette.NewStream(100), marionette.NewStream(100)
+		if _, err := client.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if err := server.Enqueue(client.Dequeue(0)); err != nil {
+			t.Fatal(err)
+		} else if dst, err := server.Destination(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if dst != "" {
+			t.Fatalf("unexpected destination: %q", dst)
+		}
+
+		// Replies are ignored so they are not read as data.
+		if err := server.Reply(marionette.OpenOK); err != nil {
+			t.Fatal(err)
+		} else if cell := server.Dequeue(0); cell.Type != marionette.NORMAL || len(cell.Payload) != 0 {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+	})
+
+	t.Run("ErrInvalidDestination", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		if err := stream.Open(""); err != marionette.ErrInvalidDestination {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := stream.Open(strings.Repeat("x", marionette.MaxDestinationLength+1)); err != marionette.ErrInvalidDestination {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrStreamAlreadyOpen", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		if err := stream.Open("db"); err != nil {
+			t.Fatal(err)
+		} else if err := stream.Open("db"); err != marionette.ErrStreamAlreadyOpen {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		other := marionette.NewStream(101)
+		if _, err := other.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if err := other.Open("db"); err != marionette.ErrStreamAlreadyOpen {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrStreamClosed", func(t *testing.T) {
+		client := marionette.NewStream(100)
+		if err := client.Open("db"); err != nil {
+			t.Fatal(err)
+		} else if err := client.CloseRead(); err != nil {
+			t.Fatal(err)
+		} else if err := client.WaitReply(context.Background()); err != marionette.ErrStreamClosed {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -1,22 +1,34 @@
 package marionette
 
 import (
+	"context"
 	"expvar"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
 const (
 	StreamSetMonitorInterval = 1 * time.Second
 	StreamCloseTimeout       = 5 * time.Second
+
+	// Time to ignore cells for a stream after it is removed. Cells can be
+	// resent by the peer after a stream closes if a connection fails before
+	// they are acknowledged.
+	StreamRemovedTimeout = 5 * time.Minute
+
+	// DefaultDrainTimeout is the time allowed for streams to flush buffered
+	// data when closing a dialer, listener or proxy.
+	DefaultDrainTimeout = 5 * time.Second
 )
 
 var (
@@ -29,29 +41,74 @@ type StreamSet struct {
 	streamIDs []int
 	wnotify   chan struct{}
 
+	// Recently removed stream ids in order of removal.
+	removed  map[int]struct{}
+	removedQ []removedStream
+
+	// Set once draining or closing starts. New streams received from the
+	// peer are immediately closed while draining and ignored once closed.
+	draining bool
+	closed   bool
+
 	closing chan struct{}
 	once    sync.Once
 	wg      sync.WaitGroup
 
+	// Tracks the number of open streams, if set.
+	gauge prometheus.Gauge
+
+	// Addresses of the connection which new streams are received on.
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
 	OnNewStream func(*Stream)
 
+	// Chooses the stream to send each cell from. Defaults to round robin.
+	Scheduler Scheduler
+
+	// Receive window for new streams. Must be at least InitialStreamWindow.
+	ReceiveWindow int
+
+	// Buffer sizes for new streams. Writes larger than the write buffer
+	// are split as the buffer drains. Defaults to DefaultStreamBufferSize.
+	ReadBufferSize  int
+	WriteBufferSize int
+
 	// Directory for storing stream traces.
 	TracePath string
+
+	// Clock used for stream close timeouts. Defaults to DefaultClock.
+	Clock Clock
 }
 
 // NewStreamSet returns a new instance of StreamSet.
 func NewStreamSet() *StreamSet {
 	ss := &StreamSet{
 		streams: make(map[int]*Stream),
+		removed: make(map[int]struct{}),
 		closing: make(chan struct{}),
 		wnotify: make(chan struct{}),
+
+		Scheduler:       NewRoundRobinScheduler(),
+		ReceiveWindow:   InitialStreamWindow,
+		ReadBufferSize:  DefaultStreamBufferSize,
+		WriteBufferSize: DefaultStreamBufferSize,
+		Clock:           DefaultClock,
 	}
 	return ss
 }
 
 // Close closes all streams in the set.
 func (ss *StreamSet) Close() (err error) {
+	ss.mu.Lock()
+	ss.closed = true
+	streams := make([]*Stream, 0, len(ss.streams))
 	for _, stream := range ss.streams {
+		streams = append(streams, stream)
+	}
+	ss.mu.Unlock()
+
+	for _, stream := range streams {
 		if e := stream.CloseWrite(); e != nil && err == nil {
 			err = e
 		} else if e := stream.CloseRead(); e != nil && err == nil {
@@ -63,6 +120,32 @@ func (ss *StreamSet) Close() (err error) {
 	return err
 }
 
+// Drain closes all streams for writing and waits until the peer has been sent
+// the end of each stream, or until ctx is done. Streams opened by the peer
+// while draining are closed immediately. Drain does not close the set.
+func (ss *StreamSet) Drain(ctx context.Context) error {
+	ss.mu.Lock()
+	ss.draining = true
+	streams := make([]*Stream, 0, len(ss.streams))
+	for _, stream := range ss.streams {
+		streams = append(streams, stream)
+	}
+	ss.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.CloseWrite()
+	}
+
+	for _, stream := range streams {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stream.WriteCloseNotifiedNotify():
+		}
+	}
+	return nil
+}
+
 // monitorStream checks a stream until its read & write channels are closed
 // and then removes the stream from the set.
 func (ss *StreamSet) monitorStream(stream *Stream) {
@@ -80,10 +163,10 @@ LOOP:
 			break LOOP
 		case <-readCloseNotify:
 			readCloseNotify = nil
-			timeout = time.After(StreamCloseTimeout)
+			timeout = ss.Clock.After(StreamCloseTimeout)
 		case <-writeCloseNotifiedNotify:
 			writeCloseNotifiedNotify = nil
-			timeout = time.After(StreamCloseTimeout)
+			timeout = ss.Clock.After(StreamCloseTimeout)
 		}
 
 		// If stream is completely closed then remove from the set.
@@ -123,16 +206,36 @@ func (ss *StreamSet) Streams() []*Stream {
 // Create returns a new stream with a random stream id.
 func (ss *StreamSet) Create() *Stream {
 	ss.mu.Lock()
-	defer ss.mu.Unlock()
-	return ss.create(0)
+	stream := ss.createStream(0)
+	ss.mu.Unlock()
+
+	ss.notify(stream)
+	return stream
+}
+
+// notify executes the OnNewStream callback, if exists. It must be called
+// without holding the lock as the callback may block.
+func (ss *StreamSet) notify(stream *Stream) {
+	if ss.OnNewStream != nil {
+		ss.OnNewStream(stream)
+	}
 }
 
-func (ss *StreamSet) create(id int) *Stream {
+// createStream adds a new stream to the set without executing OnNewStream.
+func (ss *StreamSet) createStream(id int) *Stream {
 	if id == 0 {
 		id = int(rand.Int31() + 1)
 	}
 
 	stream := NewStream(id)
+	stream.localAddr, stream.remoteAddr = ss.localAddr, ss.remoteAddr
+	stream.SetReceiveWindow(ss.ReceiveWindow)
+	if ss.ReadBufferSize != DefaultStreamBufferSize {
+		stream.SetReadBufferSize(ss.ReadBufferSize)
+	}
+	if ss.WriteBufferSize != DefaultStreamBufferSize {
+		stream.SetWriteBufferSize(ss.WriteBufferSize)
+	}
 	if ss.TracePath != "" {
 		path := filepath.Join(ss.TracePath, strconv.Itoa(id))
 		if err := os.MkdirAll(ss.TracePath, 0777); err != nil {
@@ -153,15 +256,13 @@ func (ss *StreamSet) create(id int) *Stream {
 	go func() { defer ss.wg.Done(); ss.monitorStream(stream) }()
 
 	evStreams.Add(1)
+	if ss.gauge != nil {
+		ss.gauge.Inc()
+	}
 
 	ss.wg.Add(1)
 	go func() { defer ss.wg.Done(); ss.handleStream(stream) }()
 
-	// Execute callback, if exists.
-	if ss.OnNewStream != nil {
-		ss.OnNewStream(stream)
-	}
-
 	return stream
 }
 
@@ -169,6 +270,9 @@ func (ss *StreamSet) remove(stream *Stream) {
 	streamID := stream.ID()
 
 	evStreams.Add(-1)
+	if ss.gauge != nil {
+		ss.gauge.Dec()
+	}
 
 	if stream.TraceWriter != nil {
 		stream.TraceWriter.Write([]byte("[remove]"))
@@ -178,6 +282,15 @@ func (ss *StreamSet) remove(stream *Stream) {
 	}
 	delete(ss.streams, streamID)
 
+	// Remember the id so that resent cells do not recreate the stream.
+	now := ss.Clock.Now()
+	for len(ss.removedQ) > 0 && now.Sub(ss.removedQ[0].removedAt) >= StreamRemovedTimeout {
+		delete(ss.removed, ss.removedQ[0].id)
+		ss.removedQ = ss.removedQ[1:]
+	}
+	ss.removed[streamID] = struct{}{}
+	ss.removedQ = append(ss.removedQ, removedStream{id: streamID, removedAt: now})
+
 	for i, id := range ss.streamIDs {
 		if id == streamID {
 			ss.streamIDs = append(ss.streamIDs[:i], ss.streamIDs[i+1:]...)
@@ -185,47 +298,107 @@ func (ss *StreamSet) remove(stream *Stream) {
 	}
 }
 
+// setAddrs sets the connection addresses of new streams, if not already set.
+func (ss *StreamSet) setAddrs(local, remote net.Addr) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.remoteAddr == nil {
+		ss.localAddr, ss.remoteAddr = local, remote
+	}
+}
+
 // Enqueue pushes a cell onto a stream's read queue.
 // If the stream doesn't exist then it is created.
 func (ss *StreamSet) Enqueue(cell *Cell) error {
+	stream, created, err := ss.enqueue(cell)
+
+	// New streams are passed on after the lock is released so that a slow
+	// callback does not block other connections sharing the set.
+	if created {
+		ss.notify(stream)
+	}
+	return err
+}
+
+// enqueue pushes a cell onto its stream. Returns the stream and true if it
+// was created and needs to be passed to the callback.
+func (ss *StreamSet) enqueue(cell *Cell) (stream *Stream, created bool, err error) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
 	// Ignore empty cells.
 	if cell.StreamID == 0 {
-		return nil
+		return nil, false, nil
 	}
 
-	// Create or find stream and enqueue cell.
-	stream := ss.streams[cell.StreamID]
-	if stream == nil {
-		stream = ss.create(cell.StreamID)
+	// Create or find stream and enqueue cell. Window updates & open replies
+	// for closed streams are ignored, as are cells resent to removed streams.
+	stream = ss.streams[cell.StreamID]
+	if stream == nil && (cell.Type == WINDOW_UPDATE || cell.Type == STREAM_REPLY || ss.closed) {
+		return nil, false, nil
+	} else if _, ok := ss.removed[cell.StreamID]; stream == nil && ok {
+		return nil, false, nil
+	} else if stream == nil && ss.draining {
+		// Ends the peer's stream without passing it to the callback.
+		stream = ss.createStream(cell.StreamID)
+		stream.CloseWrite()
+	} else if stream == nil {
+		stream, created = ss.createStream(cell.StreamID), true
 	}
-	return stream.Enqueue(cell)
+	return stream, created, stream.Enqueue(cell)
 }
 
-// Dequeue returns a cell containing data for a random stream's write buffer.
+// Dequeue returns a cell containing data from a stream's write buffer.
+// Pending window updates are sent first. Otherwise the stream is chosen by
+// the scheduler from the streams with data that the peer can accept.
 func (ss *StreamSet) Dequeue(n int) *Cell {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
-	// Choose a random stream with data.
-	var stream *Stream
-	for _, i := range rand.Perm(len(ss.streamIDs)) {
-		s := ss.streams[ss.streamIDs[i]]
-		if s.WriteBufferLen() > 0 || s.WriteClosed() {
-			stream = s
-			break
+	// Find streams with data to send.
+	var streams []*Stream
+	for _, id := range ss.streamIDs {
+		s := ss.streams[id]
+		if s.WindowUpdatePending() {
+			return s.Dequeue(n)
+		} else if s.writeReady() {
+			streams = append(streams, s)
 		}
 	}
 
 	// If there is no stream with data then send an empty
+	if len(streams) == 0 {
+		return nil
+	}
+
+	// Generate cell from the scheduled stream.
+	stream := ss.Scheduler.Next(streams)
 	if stream == nil {
 		return nil
 	}
+	cell := stream.Dequeue(n)
+	if cell != nil {
+		ss.Scheduler.Sent(stream, len(cell.Payload))
+	}
+	return cell
+}
 
-	// Generate cell from stream.
-	return stream.Dequeue(n)
+// Requeue returns undelivered cells to their streams so that they are sent
+// again. Cells for streams which no longer exist are dropped.
+func (ss *StreamSet) Requeue(cells []*Cell) {
+	if len(cells) == 0 {
+		return
+	}
+
+	ss.mu.Lock()
+	for _, cell := range cells {
+		if stream := ss.streams[cell.StreamID]; stream != nil {
+			stream.Requeue(cell)
+		}
+	}
+	ss.mu.Unlock()
+
+	ss.notifyWrite()
 }
 
 // WriteNotify returns a channel that receives a notification when a new write is available.
@@ -258,6 +431,12 @@ func (ss *StreamSet) handleStream(stream *Stream) {
 	}
 }
 
+// removedStream records when a stream was removed from a set.
+type removedStream struct {
+	id        int
+	removedAt time.Time
+}
+
 // timestampWriter wraps a writer and prepends a timestamp & appends a newline to every write.
 type timestampWriter struct {
 	Writer io.Writer
@@ -1,12 +1,15 @@
 package marionette_test
 
 import (
+	"context"
 	"io/ioutil"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/marionettetest"
 )
 
 func TestStreamSet_Create(t *testing.T) {
@@ -26,6 +29,179 @@ func TestStreamSet_Create(t *testing.T) {
 	}
 }
 
+// Ensure new streams use the stream set's buffer sizes.
+func TestStreamSet_BufferSize(t *testing.T) {
+	t.Run("Read", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		ss.ReadBufferSize = 2 * marionette.MaxCellLength
+		defer ss.Close()
+
+		// Both cells fit on the read buffer without reading.
+		payload := make([]byte, marionette.MaxCellLength)
+		for i := 0; i < 2; i++ {
+			if err := ss.Enqueue(&marionette.Cell{StreamID: 100, SequenceID: i, Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := ss.Stream(100).ReadBufferLen(); n != 2*marionette.MaxCellLength {
+			t.Fatalf("unexpected read buffer length: %d", n)
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		ss.WriteBufferSize = 10
+		defer ss.Close()
+
+		stream := ss.Create()
+		errs := make(chan error, 1)
+		go func() {
+			_, err := stream.Write([]byte("0123456789abcdefghijklmno"))
+			errs <- err
+		}()
+
+		var buf []byte
+		for len(buf) < 25 {
+			notify := stream.WriteNotify()
+			if n := stream.WriteBufferLen(); n > 10 {
+				t.Fatalf("unexpected write buffer length: %d", n)
+			} else if cell := ss.Dequeue(marionette.MaxCellLength); cell != nil && len(cell.Payload) > 0 {
+				buf = append(buf, cell.Payload...)
+				continue
+			}
+			<-notify
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "0123456789abcdefghijklmno" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+	})
+}
+
+// Ensure a half-closed stream is removed once the close timeout elapses.
+func TestStreamSet_CloseTimeout(t *testing.T) {
+	clock := marionettetest.NewClock(time.Unix(0, 0))
+	ss := marionette.NewStreamSet()
+	ss.Clock = clock
+	defer ss.Close()
+
+	stream := ss.Create()
+	if err := stream.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stream is kept until the peer is notified or the clock advances.
+	time.Sleep(10 * time.Millisecond)
+	if ss.Stream(stream.ID()) == nil {
+		t.Fatal("stream removed before timeout")
+	}
+
+	// Advance until the monitor's timer fires.
+	for i := 0; ss.Stream(stream.ID()) != nil; i++ {
+		if i == 100 {
+			t.Fatal("expected stream removal")
+		}
+		clock.Add(marionette.StreamCloseTimeout)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamSet_Close(t *testing.T) {
+	// Ensure streams can be removed while the set is closing.
+	t.Run("Concurrent", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		for i := 0; i < 100; i++ {
+			stream := ss.Create()
+			stream.CloseRead()
+			stream.CloseWrite()
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				ss.Dequeue(0)
+			}
+		}()
+
+		if err := ss.Close(); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	})
+}
+
+func TestStreamSet_Drain(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		stream := ss.Create()
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		errc := make(chan error, 1)
+		go func() { errc <- ss.Drain(context.Background()) }()
+
+		// Drain does not return until the end of stream has been sent.
+		var buf []byte
+		for i := 0; ; i++ {
+			if i == 1000 {
+				t.Fatal("expected end of stream")
+			}
+
+			cell := ss.Dequeue(0)
+			if cell == nil {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			buf = append(buf, cell.Payload...)
+			if cell.Type == marionette.END_OF_STREAM {
+				break
+			}
+		}
+
+		if string(buf) != "foo" {
+			t.Fatalf("unexpected data: %q", buf)
+		} else if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("DeadlineExceeded", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		ss.Create()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := ss.Drain(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure streams opened by the peer while draining are ended immediately.
+	t.Run("NewStream", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		ss.OnNewStream = func(s *marionette.Stream) {
+			t.Fatal("unexpected callback invocation")
+		}
+
+		if err := ss.Drain(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if err := ss.Enqueue(&marionette.Cell{StreamID: 100, Payload: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		}
+
+		if cell := ss.Dequeue(0); cell == nil || cell.StreamID != 100 || cell.Type != marionette.END_OF_STREAM {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+	})
+}
+
 func TestStreamSet_Enqueue(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
 		ss := marionette.NewStreamSet()
@@ -64,6 +240,55 @@ func TestStreamSet_Enqueue(t *testing.T) {
 		}
 	})
 
+	// Ensure cells resent after a stream is removed do not recreate it.
+	t.Run("RemovedStream", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		var n int
+		ss.OnNewStream = func(s *marionette.Stream) { n++ }
+
+		if err := ss.Enqueue(&marionette.Cell{Type: marionette.END_OF_STREAM, StreamID: 100}); err != nil {
+			t.Fatal(err)
+		}
+		stream := ss.Stream(100)
+		if _, err := ioutil.ReadAll(stream); err != nil {
+			t.Fatal(err)
+		} else if err := stream.CloseWrite(); err != nil {
+			t.Fatal(err)
+		} else if cell := ss.Dequeue(0); cell == nil || cell.Type != marionette.END_OF_STREAM {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+
+		// Wait for the closed stream to be removed.
+		for i := 0; ss.Stream(100) != nil; i++ {
+			if i == 100 {
+				t.Fatal("expected stream removal")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if err := ss.Enqueue(&marionette.Cell{Type: marionette.NORMAL, StreamID: 100, SequenceID: 0, Payload: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		} else if ss.Stream(100) != nil {
+			t.Fatal("unexpected stream")
+		} else if n != 1 {
+			t.Fatalf("unexpected callback invocations: %d", n)
+		}
+	})
+
+	t.Run("WindowUpdateUnknownStream", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+		ss.OnNewStream = func(s *marionette.Stream) {
+			t.Fatal("unexpected callback invocation")
+		}
+
+		if err := ss.Enqueue(&marionette.Cell{Type: marionette.WINDOW_UPDATE, StreamID: 100, Payload: []byte{0, 0, 0, 0, 0, 0, 0, 1}}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
 	t.Run("EmptyCell", func(t *testing.T) {
 		ss := marionette.NewStreamSet()
 		defer ss.Close()
@@ -75,6 +300,41 @@ func TestStreamSet_Enqueue(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+
+	// Ensure a blocked callback does not block other users of the set.
+	t.Run("SlowCallback", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		called, release := make(chan struct{}), make(chan struct{})
+		ss.OnNewStream = func(s *marionette.Stream) {
+			if s.ID() == 100 {
+				close(called)
+				<-release
+			}
+		}
+		if err := ss.Enqueue(&marionette.Cell{StreamID: 200, Payload: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make(chan error, 1)
+		go func() { errs <- ss.Enqueue(&marionette.Cell{StreamID: 100, Payload: []byte("bar")}) }()
+		<-called
+
+		// Existing streams can still receive & send while the callback blocks.
+		if err := ss.Enqueue(&marionette.Cell{StreamID: 200, SequenceID: 1, Payload: []byte("baz")}); err != nil {
+			t.Fatal(err)
+		} else if _, err := ss.Stream(200).Write([]byte("qux")); err != nil {
+			t.Fatal(err)
+		} else if cell := ss.Dequeue(0); cell == nil || cell.StreamID != 200 {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+
+		close(release)
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
 }
 
 func TestStreamSet_Dequeue(t *testing.T) {
@@ -126,4 +386,94 @@ func TestStreamSet_Dequeue(t *testing.T) {
 			t.Fatal("expected no cell")
 		}
 	})
+
+	t.Run("WindowUpdateFirst", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		stream0, stream1 := ss.Create(), ss.Create()
+		if _, err := stream0.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		stream1.SetReceiveWindow(marionette.InitialStreamWindow + 1000)
+
+		// The window update should be sent before stream data.
+		if diff := cmp.Diff(ss.Dequeue(0), &marionette.Cell{Type: marionette.WINDOW_UPDATE, StreamID: stream1.ID(), Payload: []byte{0, 0, 0, 0, 0, 4, 3, 232}, Length: 33}); diff != "" {
+			t.Fatal(diff)
+		} else if cell := ss.Dequeue(0); cell == nil || cell.StreamID != stream0.ID() {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+	})
+
+	t.Run("SendWindowExhausted", func(t *testing.T) {
+		ss := marionette.NewStreamSet()
+		defer ss.Close()
+
+		// Send a full window of data.
+		stream := ss.Create()
+		data := make([]byte, marionette.MaxCellLength-marionette.CellHeaderSize)
+		var n int
+		for n < marionette.InitialStreamWindow {
+			if _, err := stream.Write(data); err != nil {
+				t.Fatal(err)
+			} else if cell := ss.Dequeue(marionette.MaxCellLength); cell == nil {
+				t.Fatal("expected cell")
+			} else {
+				n += len(cell.Payload)
+			}
+		}
+
+		// Data should be held until the peer advertises a larger window.
+		if cell := ss.Dequeue(marionette.MaxCellLength); cell != nil {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if err := ss.Enqueue(&marionette.Cell{Type: marionette.WINDOW_UPDATE, StreamID: stream.ID(), Payload: []byte{0, 0, 0, 0, 0, 4, 0, 10}}); err != nil {
+			t.Fatal(err)
+		} else if cell := ss.Dequeue(marionette.MaxCellLength); cell == nil {
+			t.Fatal("expected cell")
+		} else if len(cell.Payload) != 10 {
+			t.Fatalf("unexpected payload length: %d", len(cell.Payload))
+		}
+	})
+}
+
+func TestStreamSet_Requeue(t *testing.T) {
+	ss := marionette.NewStreamSet()
+	defer ss.Close()
+
+	stream := ss.Create()
+	if _, err := stream.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	cell := ss.Dequeue(0)
+
+	// Requeued cells are resent while cells for unknown streams are dropped.
+	ss.Requeue([]*marionette.Cell{cell, {Type: marionette.NORMAL, StreamID: stream.ID() + 1, Payload: []byte("bar")}})
+	if other := ss.Dequeue(0); other == nil {
+		t.Fatal("expected cell")
+	} else if other.StreamID != stream.ID() || other.SequenceID != cell.SequenceID || string(other.Payload) != "foo" {
+		t.Fatalf("unexpected cell: %#v", other)
+	} else if other := ss.Dequeue(0); other != nil {
+		t.Fatalf("unexpected cell: %#v", other)
+	}
+}
+
+func TestStreamSet_Scheduler(t *testing.T) {
+	ss := marionette.NewStreamSet()
+	ss.Scheduler = marionette.NewPriorityScheduler()
+	defer ss.Close()
+
+	stream0, stream1 := ss.Create(), ss.Create()
+	stream1.SetPriority(1)
+	if _, err := stream0.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if _, err := stream1.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Higher priority stream should be sent first.
+	if cell := ss.Dequeue(0); cell.StreamID != stream1.ID() {
+		t.Fatalf("unexpected stream: %d", cell.StreamID)
+	} else if cell := ss.Dequeue(0); cell.StreamID != stream0.ID() {
+		t.Fatalf("unexpected stream: %d", cell.StreamID)
+	}
 }
@@ -2,13 +2,20 @@ package marionette_test
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+	"golang.org/x/net/nettest"
 )
 
 func TestStream_ID(t *testing.T) {
@@ -122,6 +129,40 @@ func TestStream_Enqueue(t *testing.T) {
 		}
 	})
 
+	t.Run("ErrStreamWindowExceeded", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		// Fill the receive window without reading.
+		data := make([]byte, marionette.InitialStreamWindow/4)
+		for i := 0; i < 4; i++ {
+			if err := stream.Enqueue(&marionette.Cell{StreamID: 100, SequenceID: i, Payload: data}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := stream.Enqueue(&marionette.Cell{StreamID: 100, SequenceID: 4, Payload: []byte("x")}); err != marionette.ErrStreamWindowExceeded {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("WindowUpdate", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		if err := stream.Enqueue(&marionette.Cell{Type: marionette.WINDOW_UPDATE, StreamID: 100, Payload: []byte{0, 0, 0, 0, 0, 4, 1, 0}}); err != nil {
+			t.Fatal(err)
+		} else if n := stream.SendWindow(); n != marionette.InitialStreamWindow+256 {
+			t.Fatalf("unexpected send window: %d", n)
+		}
+
+		// Resending an older limit should not change the window.
+		if err := stream.Enqueue(&marionette.Cell{Type: marionette.WINDOW_UPDATE, StreamID: 100, Payload: []byte{0, 0, 0, 0, 0, 4, 0, 0}}); err != nil {
+			t.Fatal(err)
+		} else if n := stream.SendWindow(); n != marionette.InitialStreamWindow+256 {
+			t.Fatalf("unexpected send window: %d", n)
+		}
+	})
+
 	t.Run("PendingRead", func(t *testing.T) {
 		stream := marionette.NewStream(100)
 		defer stream.Close()
@@ -164,6 +205,45 @@ func TestStream_Enqueue(t *testing.T) {
 	})
 }
 
+func TestStream_Read(t *testing.T) {
+	t.Run("WindowUpdate", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		// Read half of the receive window.
+		data := make([]byte, marionette.MaxCellLength)
+		buf := make([]byte, marionette.MaxCellLength)
+		for i := 0; i < marionette.InitialStreamWindow/2/len(data); i++ {
+			if stream.WindowUpdatePending() {
+				t.Fatal("unexpected window update")
+			} else if err := stream.Enqueue(&marionette.Cell{StreamID: 100, SequenceID: i, Payload: data}); err != nil {
+				t.Fatal(err)
+			} else if _, err := io.ReadFull(stream, buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The update should stay pending if it does not fit in the cell.
+		if cell := stream.Dequeue(marionette.CellHeaderSize + 7); cell != nil {
+			t.Fatalf("unexpected cell: %#v", cell)
+		}
+
+		// The new receive limit should be advertised to the peer.
+		if !stream.WindowUpdatePending() {
+			t.Fatal("expected window update")
+		} else if diff := cmp.Diff(stream.Dequeue(0), &marionette.Cell{
+			Type:     marionette.WINDOW_UPDATE,
+			Length:   marionette.CellHeaderSize + 8,
+			StreamID: 100,
+			Payload:  []byte{0, 0, 0, 0, 0, 6, 0, 0},
+		}); diff != "" {
+			t.Fatal(diff)
+		} else if stream.WindowUpdatePending() {
+			t.Fatal("unexpected window update")
+		}
+	})
+}
+
 func TestStream_Dequeue(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
 		stream := marionette.NewStream(100)
@@ -238,6 +318,30 @@ func TestStream_Dequeue(t *testing.T) {
 		}
 	})
 
+	// Ensure a cell smaller than the header does not affect the send window.
+	t.Run("TooSmall", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		if _, err := stream.Write([]byte("Lorem ipsum")); err != nil {
+			t.Fatal(err)
+		} else if cell := stream.Dequeue(marionette.CellHeaderSize - 1); cell != nil {
+			t.Fatalf("unexpected cell: %#v", cell)
+		} else if n := stream.SendWindow(); n != marionette.InitialStreamWindow {
+			t.Fatalf("unexpected send window: %d", n)
+		}
+
+		if diff := cmp.Diff(stream.Dequeue(0), &marionette.Cell{
+			Type:       marionette.NORMAL,
+			Length:     marionette.CellHeaderSize + 11,
+			StreamID:   100,
+			SequenceID: 0,
+			Payload:    []byte("Lorem ipsum"),
+		}); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
 	t.Run("PaddingTooLarge", func(t *testing.T) {
 		stream := marionette.NewStream(100)
 		defer stream.Close()
@@ -262,6 +366,75 @@ func TestStream_Dequeue(t *testing.T) {
 	})
 }
 
+func TestStream_Requeue(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		cell0 := stream.Dequeue(0)
+		if _, err := stream.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		cell1 := stream.Dequeue(0)
+
+		// Requeued cells should be resent in sequence order before new data.
+		stream.Requeue(cell1)
+		stream.Requeue(cell0)
+		stream.Requeue(cell0)
+		if _, err := stream.Write([]byte("baz")); err != nil {
+			t.Fatal(err)
+		} else if cell := stream.Dequeue(0); cell.SequenceID != 0 || string(cell.Payload) != "foo" {
+			t.Fatalf("unexpected cell: seq=%d payload=%q", cell.SequenceID, cell.Payload)
+		} else if cell := stream.Dequeue(0); cell.SequenceID != 1 || string(cell.Payload) != "bar" {
+			t.Fatalf("unexpected cell: seq=%d payload=%q", cell.SequenceID, cell.Payload)
+		} else if cell := stream.Dequeue(0); cell.SequenceID != 2 || string(cell.Payload) != "baz" {
+			t.Fatalf("unexpected cell: seq=%d payload=%q", cell.SequenceID, cell.Payload)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		if _, err := stream.Write([]byte("Lorem ipsum")); err != nil {
+			t.Fatal(err)
+		}
+		cell := stream.Dequeue(0)
+
+		// Cells are only resent when they fit within the requested size.
+		stream.Requeue(cell)
+		if other := stream.Dequeue(marionette.CellHeaderSize + 5); other.SequenceID != 1 {
+			t.Fatalf("unexpected sequence: %d", other.SequenceID)
+		} else if other := stream.Dequeue(marionette.CellHeaderSize + 20); other.SequenceID != 0 {
+			t.Fatalf("unexpected sequence: %d", other.SequenceID)
+		} else if other.Length != marionette.CellHeaderSize+20 {
+			t.Fatalf("unexpected length: %d", other.Length)
+		}
+	})
+
+	t.Run("EndOfStream", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		if err := stream.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cell := stream.Dequeue(0)
+		if cell.Type != marionette.END_OF_STREAM {
+			t.Fatalf("unexpected type: %d", cell.Type)
+		}
+
+		// End of stream should be resent after the stream has notified.
+		stream.Requeue(cell)
+		if other := stream.Dequeue(0); other == nil || other.Type != marionette.END_OF_STREAM {
+			t.Fatalf("unexpected cell: %#v", other)
+		} else if other := stream.Dequeue(0); other != nil {
+			t.Fatalf("unexpected cell: %#v", other)
+		}
+	})
+}
+
 func TestStream_Write(t *testing.T) {
 	t.Run("ErrStreamClosed", func(t *testing.T) {
 		stream := marionette.NewStream(100)
@@ -272,13 +445,54 @@ func TestStream_Write(t *testing.T) {
 		}
 	})
 
-	t.Run("ErrWriteTooLarge", func(t *testing.T) {
+	// Ensure writes larger than the buffer are split as the buffer drains.
+	t.Run("LargerThanBuffer", func(t *testing.T) {
 		stream := marionette.NewStream(100)
 		defer stream.Close()
 
-		data := bytes.Repeat([]byte("x"), marionette.MaxCellLength+1)
-		if _, err := stream.Write(data); err != marionette.ErrWriteTooLarge {
+		data := make([]byte, (3*marionette.MaxCellLength)+17)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			n, err := stream.Write(data)
+			if err == nil && n != len(data) {
+				err = fmt.Errorf("unexpected n: %d", n)
+			}
+			errs <- err
+		}()
+
+		var buf []byte
+		for len(buf) < len(data) {
+			notify := stream.WriteNotify()
+			if cell := stream.Dequeue(marionette.MaxCellLength); cell != nil && len(cell.Payload) > 0 {
+				buf = append(buf, cell.Payload...)
+				continue
+			}
+			<-notify
+		}
+		if err := <-errs; err != nil {
 			t.Fatal(err)
+		} else if !bytes.Equal(buf, data) {
+			t.Fatal("data mismatch")
+		}
+	})
+
+	// Ensure a partial write is reported if the stream closes mid-write.
+	t.Run("PartialErrStreamClosed", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+
+		data := bytes.Repeat([]byte("x"), marionette.MaxCellLength+100)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			stream.Close()
+		}()
+		if n, err := stream.Write(data); err != marionette.ErrStreamClosed {
+			t.Fatalf("unexpected error: %v", err)
+		} else if n != marionette.MaxCellLength {
+			t.Fatalf("unexpected n: %d", n)
 		}
 	})
 
@@ -440,25 +654,227 @@ func TestStream_RemoteAddr(t *testing.T) {
 }
 
 func TestStream_SetDeadline(t *testing.T) {
-	stream := marionette.NewStream(100)
-	defer stream.Close()
-	if err := stream.SetDeadline(time.Time{}); err != nil {
-		t.Fatal(err)
-	}
+	t.Run("PastTimeout", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+		if err := stream.SetDeadline(time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Repeated calls should continue to time out.
+		for i := 0; i < 3; i++ {
+			if _, err := stream.Read(make([]byte, 10)); !isTimeout(err) {
+				t.Fatalf("unexpected read error: %v", err)
+			} else if _, err := stream.Write([]byte("foo")); !isTimeout(err) {
+				t.Fatalf("unexpected write error: %v", err)
+			}
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+		if err := stream.SetDeadline(time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		} else if _, err := stream.Write([]byte("foo")); !isTimeout(err) {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+
+		// Clearing the deadline should allow reads & writes again.
+		if err := stream.SetDeadline(time.Time{}); err != nil {
+			t.Fatal(err)
+		} else if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		} else if err := stream.Enqueue(&marionette.Cell{StreamID: 100, SequenceID: 0, Payload: []byte("bar")}); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 10)
+		if n, err := stream.Read(buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != "bar" {
+			t.Fatalf("unexpected data: %s", buf[:n])
+		}
+	})
 }
 
 func TestStream_SetReadDeadline(t *testing.T) {
-	stream := marionette.NewStream(100)
-	defer stream.Close()
-	if err := stream.SetReadDeadline(time.Time{}); err != nil {
-		t.Fatal(err)
-	}
+	t.Run("FutureTimeout", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+		if err := stream.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		if _, err := stream.Read(make([]byte, 10)); !isTimeout(err) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if d := time.Since(start); d < 100*time.Millisecond {
+			t.Fatalf("read returned too early: %s", d)
+		}
+	})
+
+	t.Run("PendingRead", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		// Set deadline while a read is already blocked.
+		errc := make(chan error, 1)
+		go func() {
+			_, err := stream.Read(make([]byte, 10))
+			errc <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		if err := stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-errc:
+			if !isTimeout(err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("read did not time out")
+		}
+	})
+
+	t.Run("Extend", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+		if err := stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		} else if err := stream.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Data should arrive before the extended deadline.
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			stream.Enqueue(&marionette.Cell{StreamID: 100, SequenceID: 0, Payload: []byte("foo")})
+		}()
+
+		buf := make([]byte, 10)
+		if n, err := stream.Read(buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != "foo" {
+			t.Fatalf("unexpected data: %s", buf[:n])
+		}
+	})
+
+	t.Run("WriteUnaffected", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+		if err := stream.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		} else if _, err := stream.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+	})
 }
 
 func TestStream_SetWriteDeadline(t *testing.T) {
-	stream := marionette.NewStream(100)
-	defer stream.Close()
-	if err := stream.SetWriteDeadline(time.Time{}); err != nil {
-		t.Fatal(err)
+	t.Run("FutureTimeout", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+
+		// Fill the buffer so the next write blocks.
+		data := bytes.Repeat([]byte("x"), ((marionette.MaxCellLength * 2) / 3))
+		if _, err := stream.Write(data); err != nil {
+			t.Fatal(err)
+		} else if err := stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		// The free space is filled before the write times out.
+		start := time.Now()
+		if n, err := stream.Write(data); !isTimeout(err) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if n != marionette.MaxCellLength-len(data) {
+			t.Fatalf("unexpected n: %d", n)
+		} else if d := time.Since(start); d < 100*time.Millisecond {
+			t.Fatalf("write returned too early: %s", d)
+		} else if n := stream.WriteBufferLen(); n != marionette.MaxCellLength {
+			t.Fatalf("unexpected write buffer length: %d", n)
+		}
+	})
+
+	t.Run("ReadUnaffected", func(t *testing.T) {
+		stream := marionette.NewStream(100)
+		defer stream.Close()
+		if err := stream.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		} else if err := stream.Enqueue(&marionette.Cell{StreamID: 100, SequenceID: 0, Payload: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		} else if _, err := stream.Read(make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// isTimeout returns true if err is a net.Error which has timed out.
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// Ensure streams satisfy the net.Conn interface contract.
+func TestStream_Conn(t *testing.T) {
+	nettest.TestConn(t, MakeStreamPipe)
+}
+
+// MakeStreamPipe returns a connected pair of streams. Each stream belongs to
+// its own stream set and the sets are joined by a client & server FSM over
+// an in-memory connection.
+func MakeStreamPipe() (c1, c2 net.Conn, stop func(), err error) {
+	key := fte.NewKey([]byte("secret"))
+	clientConn, serverConn := net.Pipe()
+
+	newStreams := make(chan *marionette.Stream, 1)
+	clientStreamSet, serverStreamSet := marionette.NewStreamSet(), marionette.NewStreamSet()
+	serverStreamSet.OnNewStream = func(stream *marionette.Stream) { newStreams <- stream }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clientFSM := marionette.NewFSM(mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", "")), "127.0.0.1", marionette.PartyClient, clientConn, clientStreamSet, key)
+	serverFSM := marionette.NewFSM(mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", "")), "127.0.0.1", marionette.PartyServer, serverConn, serverStreamSet, key)
+
+	var wg sync.WaitGroup
+	for _, fsm := range []marionette.FSM{clientFSM, serverFSM} {
+		wg.Add(1)
+		go func(fsm marionette.FSM) {
+			defer wg.Done()
+			for fsm.Execute(ctx) == nil {
+				fsm.Reset()
+			}
+		}(fsm)
+	}
+
+	stop = func() {
+		cancel()
+		clientFSM.Close()
+		serverFSM.Close()
+		clientStreamSet.Close()
+		serverStreamSet.Close()
+		wg.Wait()
+	}
+
+	// The server only sees a stream once the client sends data on it.
+	c1 = clientStreamSet.Create()
+	if _, err := c1.Write([]byte{0}); err != nil {
+		stop()
+		return nil, nil, nil, err
+	}
+
+	select {
+	case stream := <-newStreams:
+		c2 = stream
+	case <-time.After(5 * time.Second):
+		stop()
+		return nil, nil, nil, fmt.Errorf("timeout waiting for stream")
+	}
+	if _, err := io.ReadFull(c2, make([]byte, 1)); err != nil {
+		stop()
+		return nil, nil, nil, err
 	}
+	return c1, c2, stop, nil
 }
@@ -0,0 +1,250 @@
+package marionette
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Trace event types.
+const (
+	TraceEventOpen       = "open"       // connection opened
+	TraceEventTransition = "transition" // FSM moved to a new state
+	TraceEventAction     = "action"     // plugin action invoked
+	TraceEventRead       = "read"       // bytes read from the network
+	TraceEventWrite      = "write"      // bytes written to the network
+	TraceEventPeek       = "peek"       // buffered bytes returned to a plugin
+	TraceEventEnqueue    = "enqueue"    // cell received from the peer
+	TraceEventDequeue    = "dequeue"    // cell sent to the peer
+	TraceEventError      = "error"      // FSM execution failed
+)
+
+// TraceEvent represents a single line of a connection trace.
+type TraceEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// Logical position used to replay input in the recorded order. For read
+	// events, this is the peek clock, which advances at the start & end of
+	// each peek. For dequeue events, it is the number of prior dequeues.
+	Seq int `json:"seq,omitempty"`
+
+	// Set on open events.
+	Party      string `json:"party,omitempty"`
+	Host       string `json:"host,omitempty"`
+	UUID       int    `json:"uuid,omitempty"`
+	InstanceID int    `json:"instance_id,omitempty"`
+
+	// Set on transition & action events.
+	State  string        `json:"state,omitempty"`
+	Dest   string        `json:"dest,omitempty"`
+	Action string        `json:"action,omitempty"`
+	Args   []interface{} `json:"args,omitempty"`
+
+	// Set on read, write & peek events.
+	Data []byte `json:"data,omitempty"`
+	N    int    `json:"n,omitempty"`
+
+	// Set on enqueue & dequeue events.
+	Cell *Cell `json:"cell,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// ReadTrace reads all events from a JSONL trace.
+func ReadTrace(r io.Reader) ([]*TraceEvent, error) {
+	var events []*TraceEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for i := 1; scanner.Scan(); i++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("trace line %d: %s", i, err)
+		}
+		events = append(events, &e)
+	}
+	return events, scanner.Err()
+}
+
+// Tracer records the events of a single connection as JSONL.
+// All methods are no-ops on a nil tracer.
+type Tracer struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer // closed with the tracer, if set
+	closed bool
+
+	clock    int           // advanced at the start & end of each peek
+	dequeueN int           // number of dequeues
+	notify   chan struct{} // closed when the clock advances
+
+	fn func(*TraceEvent) // called for each event, if set
+}
+
+// NewTracer returns a new Tracer that writes to w.
+func NewTracer(w io.Writer) *Tracer {
+	t := &Tracer{notify: make(chan struct{})}
+	if w != nil {
+		t.enc = json.NewEncoder(w)
+	}
+	return t
+}
+
+// createTracer returns a tracer writing to a new file in dir.
+// Returns nil if dir is blank or the file cannot be created.
+func createTracer(dir, party string) *Tracer {
+	if dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		Logger.Warn("cannot create trace directory", zap.Error(err))
+		return nil
+	}
+	f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s-%d.jsonl", party, time.Now().UnixNano())))
+	if err != nil {
+		Logger.Warn("cannot create trace file", zap.Error(err))
+		return nil
+	}
+	t := NewTracer(f)
+	t.closer = f
+	return t
+}
+
+// Close stops recording. Trace files created by listeners & dialers are closed.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	if t.closer != nil {
+		return t.closer.Close()
+	}
+	return nil
+}
+
+func (t *Tracer) write(e *TraceEvent) {
+	if t == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	if t.fn != nil {
+		t.fn(e)
+	}
+	if t.enc != nil {
+		if err := t.enc.Encode(e); err != nil {
+			Logger.Warn("cannot write trace event", zap.Error(err))
+		}
+	}
+}
+
+func (t *Tracer) open(fsm *fsm) {
+	t.write(&TraceEvent{
+		Type:       TraceEventOpen,
+		Party:      fsm.party,
+		Host:       fsm.host,
+		UUID:       fsm.doc.UUID,
+		InstanceID: fsm.instanceID,
+	})
+}
+
+func (t *Tracer) transition(state, dest string) {
+	t.write(&TraceEvent{Type: TraceEventTransition, State: state, Dest: dest})
+}
+
+func (t *Tracer) action(state, name string, args []interface{}) {
+	t.write(&TraceEvent{Type: TraceEventAction, State: state, Action: name, Args: args})
+}
+
+func (t *Tracer) error(err error) {
+	t.write(&TraceEvent{Type: TraceEventError, Error: err.Error()})
+}
+
+// read records bytes read from the network at the current peek clock.
+func (t *Tracer) read(b []byte) {
+	if t == nil {
+		return
+	}
+	t.write(&TraceEvent{Type: TraceEventRead, Seq: t.peekClock(), Data: append([]byte(nil), b...)})
+}
+
+func (t *Tracer) writeData(b []byte) {
+	if t == nil {
+		return
+	}
+	t.write(&TraceEvent{Type: TraceEventWrite, Data: append([]byte(nil), b...)})
+}
+
+func (t *Tracer) peek(n int) {
+	t.write(&TraceEvent{Type: TraceEventPeek, N: n})
+}
+
+func (t *Tracer) enqueue(cell *Cell) {
+	t.write(&TraceEvent{Type: TraceEventEnqueue, Cell: cell})
+}
+
+// nextDequeue returns the index of the current dequeue & advances the count.
+func (t *Tracer) nextDequeue() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := t.dequeueN
+	t.dequeueN++
+	return i
+}
+
+func (t *Tracer) dequeue(i int, cell *Cell) {
+	t.write(&TraceEvent{Type: TraceEventDequeue, Seq: i, Cell: cell})
+}
+
+// tick advances the peek clock.
+func (t *Tracer) tick() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clock++
+	close(t.notify)
+	t.notify = make(chan struct{})
+}
+
+// peekClock returns the current peek clock.
+func (t *Tracer) peekClock() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.clock
+}
+
+// clockNotify returns a channel that is closed when the peek clock advances.
+func (t *Tracer) clockNotify() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.notify
+}
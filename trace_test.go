@@ -0,0 +1,150 @@
+package marionette_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+)
+
+func TestReplayer_Replay(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		path, err := ioutil.TempDir("", "marionette-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(path)
+
+		// Record a round trip between a client & server.
+		key := fte.NewKey([]byte("secret"))
+		serverDoc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+		serverDoc.Port = "0"
+		ln := marionette.NewListener(serverDoc, "127.0.0.1", key)
+		ln.TracePath = filepath.Join(path, "server")
+		if err := ln.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("http_simple_blocking", ""))
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+		dialer.TracePath = filepath.Join(path, "client")
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+
+		clientConn, err := dialer.Dial()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := clientConn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		serverConn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(serverConn, buf); err != nil {
+			t.Fatal(err)
+		} else if _, err := serverConn.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(clientConn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "bar" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+
+		if err := dialer.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := ln.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Replay both sides of the connection.
+		for _, party := range []string{marionette.PartyClient, marionette.PartyServer} {
+			events := MustReadTraceDir(t, filepath.Join(path, party))
+			if events[0].Party != party {
+				t.Fatalf("unexpected party: %s", events[0].Party)
+			}
+
+			var out bytes.Buffer
+			doc := mar.MustParse(party, mar.Format("http_simple_blocking", ""))
+			r := marionette.NewReplayer(doc, key, events)
+			r.Output = &out
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if n, err := r.Replay(ctx); err != nil {
+				t.Fatalf("%s: %s", party, err)
+			} else if n == 0 {
+				t.Fatalf("%s: expected transitions", party)
+			} else if other, err := marionette.ReadTrace(&out); err != nil {
+				t.Fatal(err)
+			} else if other[0].Type != marionette.TraceEventOpen || other[0].Party != party {
+				t.Fatalf("%s: unexpected replayed trace header: %#v", party, other[0])
+			}
+		}
+	})
+
+	t.Run("ErrInvalidTrace", func(t *testing.T) {
+		doc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+		events := []*marionette.TraceEvent{{Type: marionette.TraceEventRead}}
+		if _, err := marionette.NewReplayer(doc, nil, events).Replay(context.Background()); err != marionette.ErrInvalidTrace {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrTraceUUIDMismatch", func(t *testing.T) {
+		doc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+		events := []*marionette.TraceEvent{{Type: marionette.TraceEventOpen, Party: marionette.PartyServer, UUID: doc.UUID + 1}}
+		if _, err := marionette.NewReplayer(doc, nil, events).Replay(context.Background()); err != marionette.ErrTraceUUIDMismatch {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Diverged", func(t *testing.T) {
+		doc := mar.MustParse(marionette.PartyServer, mar.Format("http_simple_blocking", ""))
+		events := []*marionette.TraceEvent{
+			{Type: marionette.TraceEventOpen, Party: marionette.PartyServer, UUID: doc.UUID},
+			{Type: marionette.TraceEventTransition, State: "start", Dest: "no_such_state"},
+		}
+		if _, err := marionette.NewReplayer(doc, nil, events).Replay(context.Background()); err == nil || err.Error() != `replay diverged at transition 0: expected start -> no_such_state, got start -> upstream` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustReadTraceDir reads the only connection trace in a directory.
+func MustReadTraceDir(tb testing.TB, path string) []*marionette.TraceEvent {
+	tb.Helper()
+	matches, err := filepath.Glob(filepath.Join(path, "*.jsonl"))
+	if err != nil {
+		tb.Fatal(err)
+	} else if len(matches) != 1 {
+		tb.Fatalf("expected one trace, got %d", len(matches))
+	}
+
+	f, err := os.Open(matches[0])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	events, err := marionette.ReadTrace(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return events
+}
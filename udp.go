@@ -0,0 +1,295 @@
+package marionette
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// PacketQueueSize is the number of datagrams buffered for each remote peer of
+	// a packet listener. Datagrams received while the queue is full are dropped.
+	PacketQueueSize = 64
+
+	// PacketAcceptQueueSize is the number of new peers of a packet listener
+	// waiting to be accepted. Peers arriving while the queue is full are dropped.
+	PacketAcceptQueueSize = 64
+
+	// MaxPacketConns is the maximum number of remote peers tracked by a packet
+	// listener. Datagrams from new peers are dropped once the limit is reached.
+	MaxPacketConns = 1024
+
+	// PacketConnIdleTimeout is the time after which a packet connection that
+	// has not received a datagram is closed.
+	PacketConnIdleTimeout = 2 * time.Minute
+)
+
+var (
+	// ErrPacketConnClosed is returned when reading from a closed packet connection.
+	ErrPacketConnClosed = errors.New("marionette: packet connection closed")
+)
+
+// listen opens a listener on addr. Packet-based transports, such as UDP, are
+// demultiplexed so that each remote address is accepted as a separate connection.
+func listen(transport, addr string) (net.Listener, error) {
+	switch transport {
+	case "udp", "udp4", "udp6":
+		pc, err := net.ListenPacket(transport, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newPacketListener(pc), nil
+	default:
+		return net.Listen(transport, addr)
+	}
+}
+
+// packetListener implements net.Listener over a net.PacketConn.
+type packetListener struct {
+	mu    sync.Mutex
+	pc    net.PacketConn
+	conns map[string]*packetConn
+	err   error
+
+	accept  chan *packetConn
+	closing chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+
+	// Limits on tracked peers.
+	maxConns    int
+	idleTimeout time.Duration
+}
+
+func newPacketListener(pc net.PacketConn) *packetListener {
+	l := &packetListener{
+		pc:          pc,
+		conns:       make(map[string]*packetConn),
+		accept:      make(chan *packetConn, PacketAcceptQueueSize),
+		closing:     make(chan struct{}),
+		maxConns:    MaxPacketConns,
+		idleTimeout: PacketConnIdleTimeout,
+	}
+
+	l.wg.Add(2)
+	go func() { defer l.wg.Done(); l.monitor() }()
+	go func() { defer l.wg.Done(); l.expire() }()
+
+	return l
+}
+
+// Accept waits for a datagram from a new remote address.
+func (l *packetListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closing:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, ErrListenerClosed
+	case conn := <-l.accept:
+		return conn, nil
+	}
+}
+
+// Close closes the underlying packet connection and all accepted connections.
+func (l *packetListener) Close() error {
+	err := l.pc.Close()
+	l.once.Do(func() { close(l.closing) })
+	l.wg.Wait()
+
+	l.mu.Lock()
+	conns := make([]*packetConn, 0, len(l.conns))
+	for _, conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Addr returns the local address of the underlying packet connection.
+func (l *packetListener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+// monitor reads datagrams and routes them to the connection for their remote
+// address. A new connection is queued for accept for each unknown address.
+// Datagrams from new addresses are dropped if the accept queue is full or
+// too many peers are tracked so the read loop never blocks.
+func (l *packetListener) monitor() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil && !isTemporaryError(err) {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			l.once.Do(func() { close(l.closing) })
+			return
+		} else if n == 0 {
+			continue
+		}
+
+		conn := l.conn(addr)
+		if conn == nil {
+			continue
+		}
+		conn.push(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// conn returns the connection for addr. Creates & queues a new connection
+// if one does not exist. Returns nil if a new connection cannot be queued.
+func (l *packetListener) conn(addr net.Addr) *packetConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if conn := l.conns[addr.String()]; conn != nil {
+		conn.lastRead = now
+		return conn
+	} else if len(l.conns) >= l.maxConns {
+		return nil
+	}
+
+	conn := newPacketConn(l, addr)
+	conn.lastRead = now
+	select {
+	case l.accept <- conn:
+	default:
+		return nil
+	}
+	l.conns[addr.String()] = conn
+	return conn
+}
+
+// expire periodically closes connections which have been idle for longer
+// than the idle timeout.
+func (l *packetListener) expire() {
+	ticker := time.NewTicker(l.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closing:
+			return
+		case <-ticker.C:
+		}
+
+		var idle []*packetConn
+		l.mu.Lock()
+		for _, conn := range l.conns {
+			if time.Since(conn.lastRead) >= l.idleTimeout {
+				idle = append(idle, conn)
+			}
+		}
+		l.mu.Unlock()
+
+		for _, conn := range idle {
+			conn.Close()
+		}
+	}
+}
+
+func (l *packetListener) remove(conn *packetConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[conn.raddr.String()] == conn {
+		delete(l.conns, conn.raddr.String())
+	}
+}
+
+// packetConn represents datagrams exchanged with a single remote address
+// through a packetListener. Each Read() returns a single datagram.
+type packetConn struct {
+	ln    *packetListener
+	raddr net.Addr
+	ch    chan []byte
+
+	lastRead time.Time // time of last datagram, protected by ln.mu
+
+	rdeadline *deadline
+	closing   chan struct{}
+	once      sync.Once
+}
+
+func newPacketConn(ln *packetListener, raddr net.Addr) *packetConn {
+	return &packetConn{
+		ln:        ln,
+		raddr:     raddr,
+		ch:        make(chan []byte, PacketQueueSize),
+		rdeadline: newDeadline(),
+		closing:   make(chan struct{}),
+	}
+}
+
+// push adds a datagram to the read queue. Drops the datagram if the queue is full.
+func (c *packetConn) push(b []byte) {
+	select {
+	case c.ch <- b:
+	default:
+	}
+}
+
+// Read reads the next datagram into b. If b is smaller than the datagram
+// then the excess bytes are discarded.
+func (c *packetConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.closing:
+		return 0, ErrPacketConnClosed
+	case <-c.rdeadline.wait():
+		return 0, ErrTimeout
+	case buf := <-c.ch:
+		return copy(b, buf), nil
+	}
+}
+
+// ReadFrom reads the next datagram into b and returns the remote address.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.raddr, err
+}
+
+// Write sends b as a single datagram to the remote address.
+func (c *packetConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closing:
+		return 0, ErrPacketConnClosed
+	default:
+	}
+	return c.ln.pc.WriteTo(b, c.raddr)
+}
+
+// WriteTo sends b as a single datagram to addr.
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.ln.pc.WriteTo(b, addr)
+}
+
+// Close removes the connection from the listener. Later datagrams from the
+// remote address are accepted as a new connection.
+func (c *packetConn) Close() error {
+	c.once.Do(func() {
+		close(c.closing)
+		c.ln.remove(c)
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr  { return c.ln.pc.LocalAddr() }
+func (c *packetConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.rdeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op as datagram writes do not block.
+func (c *packetConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,151 @@
+package marionette_test
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redjack/marionette"
+	"github.com/redjack/marionette/fte"
+	"github.com/redjack/marionette/mar"
+	"github.com/redjack/marionette/plugins/tg"
+)
+
+func TestListener_UDP(t *testing.T) {
+	key := fte.NewKey([]byte("secret"))
+
+	t.Run("udp_test_format", func(t *testing.T) {
+		ln := MustOpenListener(t, "udp_test_format", key)
+		defer ln.Close()
+
+		// The dialer closes first so the server's stream cannot drain.
+		ln.DrainTimeout = 10 * time.Millisecond
+
+		clientDoc := mar.MustParse(marionette.PartyClient, mar.Format("udp_test_format", ""))
+		clientDoc.Port = strconv.Itoa(ln.Addr().(*net.UDPAddr).Port)
+		dialer := marionette.NewDialer(clientDoc, "127.0.0.1", marionette.NewStreamSet(), key)
+		if err := dialer.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dialer.Close()
+
+		// Write from client and read from server.
+		clientConn, err := dialer.Dial()
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := clientConn.Write([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+
+		serverConn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(serverConn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "foo" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+
+		// Write back from server to client.
+		if _, err := serverConn.Write([]byte("bar")); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(clientConn, buf); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != "bar" {
+			t.Fatalf("unexpected data: %q", buf)
+		}
+	})
+
+	// The DNS format carries no data so verify the server responds to each
+	// request datagram with a single matching response datagram.
+	t.Run("dns_request", func(t *testing.T) {
+		ln := MustOpenListener(t, "dns_request", key)
+		defer ln.Close()
+
+		conn, err := net.Dial("udp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		for _, id := range []string{"AB", "CD"} {
+			if _, err := conn.Write([]byte(id + "\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03foo\x03com\x00\x00\x01\x00\x01")); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 1024)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := tg.Parse("dns_response", string(buf[:n]))
+			if m == nil {
+				t.Fatalf("cannot parse response: %q", buf[:n])
+			} else if m["DNS_TRANSACTION_ID"] != id {
+				t.Fatalf("unexpected transaction id: %q", m["DNS_TRANSACTION_ID"])
+			} else if m["DNS_DOMAIN"] != "\x03foo\x03com\x00" {
+				t.Fatalf("unexpected domain: %q", m["DNS_DOMAIN"])
+			}
+		}
+	})
+
+	// Verify that a flood of new peers does not stall an existing peer.
+	t.Run("ManyPeers", func(t *testing.T) {
+		ln := MustOpenListener(t, "dns_request", key)
+		defer ln.Close()
+
+		conn, err := net.Dial("udp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		MustExchangeDNS(t, conn, "AB")
+
+		for i := 0; i < 2*marionette.PacketAcceptQueueSize; i++ {
+			peer, err := net.Dial("udp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer peer.Close()
+
+			if _, err := peer.Write([]byte(dnsRequest("XY"))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		MustExchangeDNS(t, conn, "CD")
+	})
+}
+
+// dnsRequest returns a DNS request datagram for foo.com with the given transaction id.
+func dnsRequest(id string) string {
+	return id + "\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03foo\x03com\x00\x00\x01\x00\x01"
+}
+
+// MustExchangeDNS sends a DNS request over conn and verifies the response.
+func MustExchangeDNS(tb testing.TB, conn net.Conn, id string) {
+	tb.Helper()
+	if _, err := conn.Write([]byte(dnsRequest(id))); err != nil {
+		tb.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	m := tg.Parse("dns_response", string(buf[:n]))
+	if m == nil {
+		tb.Fatalf("cannot parse response: %q", buf[:n])
+	} else if m["DNS_TRANSACTION_ID"] != id {
+		tb.Fatalf("unexpected transaction id: %q", m["DNS_TRANSACTION_ID"])
+	}
+}